@@ -0,0 +1,601 @@
+// Command aof-tool inspects and repairs cache AOF files without starting a
+// server. It reads every format the server writes: text, binary and hybrid
+// files, segmented AOFs (given the AOF path, its .d directory or its
+// manifest), and sealed records, given the keys.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+const usage = `Usage: aof-tool <command> [flags] <aof>
+
+Commands:
+  check     validate every record and report the corrupt ones
+  dump      print every record as a JSON line
+  stats     count keys and how many SETs are live, expired or overwritten
+  rewrite   compact into a new file: aof-tool rewrite [flags] <aof> <out>
+  truncate  cut each file at its first bad record
+
+Run "aof-tool <command> -h" for a command's flags.
+`
+
+// errBadRecords makes check exit with status 1 once it has printed its report.
+var errBadRecords = errors.New("bad records found")
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "check":
+		err = runCheck(args, os.Stdout)
+	case "dump":
+		err = runDump(args, os.Stdout)
+	case "stats":
+		err = runStats(args, os.Stdout)
+	case "rewrite":
+		err = runRewrite(args, os.Stdout)
+	case "truncate":
+		err = runTruncate(args, os.Stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "aof-tool: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	case errors.Is(err, errBadRecords):
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "aof-tool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// command holds the flags every command shares.
+type command struct {
+	fs      *flag.FlagSet
+	keyFile *string
+}
+
+func newCommand(name, args string) *command {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	c := &command{
+		fs:      fs,
+		keyFile: fs.String("key-file", "", "File of hex AES keys for sealed records, one per line (falls back to $"+aof.KeyEnv+")"),
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: aof-tool %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return c
+}
+
+// parse parses the flags and returns exactly n positional arguments.
+func (c *command) parse(args []string, n int) ([]string, error) {
+	if err := c.fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if c.fs.NArg() != n {
+		c.fs.Usage()
+		return nil, flag.ErrHelp
+	}
+	return c.fs.Args(), nil
+}
+
+// sealer builds a Sealer from the keys given, or returns nil if there are
+// none and compression is CompressNone.
+func (c *command) sealer(compression aof.Compression) (*aof.Sealer, error) {
+	return aof.LoadSealer(compression, *c.keyFile)
+}
+
+// inputFiles resolves path to the files to read, in replay order. path may be
+// a single AOF file, a segmented AOF's manifest or directory, or the AOF path
+// a segmented AOF was created for.
+func inputFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, dirErr := os.Stat(path + ".d"); dirErr == nil {
+			return inputFiles(path + ".d")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := path
+	switch {
+	case info.IsDir():
+		manifest = filepath.Join(path, aof.ManifestName(strings.TrimSuffix(filepath.Base(path), ".d")))
+	case !strings.HasSuffix(path, ".manifest"):
+		return []string{path}, nil
+	}
+
+	m, err := aof.ReadManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, seg := range m.Segments {
+		files = append(files, filepath.Join(filepath.Dir(manifest), seg.Name))
+	}
+	return files, nil
+}
+
+// position locates a record within the files being read.
+type position struct {
+	File   string
+	Index  int   // counted from 1, which is also the line number in a text file
+	Offset int64 // where the record starts
+	Format aof.Format
+}
+
+func (p position) String() string {
+	if p.Format == aof.FormatText {
+		return fmt.Sprintf("%s: line %d", p.File, p.Index)
+	}
+	return fmt.Sprintf("%s: record %d at offset %d", p.File, p.Index, p.Offset)
+}
+
+// scan calls fn for every record in files, in order. A bad record is passed
+// with recErr set; after a torn one, the rest of its file is skipped.
+func scan(files []string, sealer *aof.Sealer, fn func(pos position, rec aof.Record, recErr *aof.RecordError) error) error {
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = scanFile(f, path, sealer, fn)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanFile(f io.Reader, path string, sealer *aof.Sealer, fn func(pos position, rec aof.Record, recErr *aof.RecordError) error) error {
+	r := aof.NewReader(f)
+	r.SetSealer(sealer)
+
+	for i := 1; ; i++ {
+		pos := position{File: path, Index: i, Offset: r.Offset(), Format: r.Format()}
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		var recErr *aof.RecordError
+		if err != nil && !errors.As(err, &recErr) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if recErr != nil {
+			pos.Offset = recErr.Offset
+		}
+		if err := fn(pos, rec, recErr); err != nil {
+			return err
+		}
+		if recErr != nil && errors.Is(recErr, aof.ErrTorn) {
+			return nil
+		}
+	}
+}
+
+func runCheck(args []string, out io.Writer) error {
+	c := newCommand("check", "<aof>")
+	paths, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	files, err := inputFiles(paths[0])
+	if err != nil {
+		return err
+	}
+	sealer, err := c.sealer(aof.CompressNone)
+	if err != nil {
+		return err
+	}
+
+	var records, bad int
+	err = scan(files, sealer, func(pos position, rec aof.Record, recErr *aof.RecordError) error {
+		records++
+		if recErr != nil {
+			bad++
+			fmt.Fprintf(out, "%v: %v\n", pos, recErr.Err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%d records in %d files, %d bad\n", records, len(files), bad)
+	if bad > 0 {
+		return errBadRecords
+	}
+	return nil
+}
+
+// dumpLine is one record as printed by dump. Keys and values that aren't
+// valid UTF-8 are printed in base64 instead.
+type dumpLine struct {
+	File        string `json:"file"`
+	Offset      int64  `json:"offset"`
+	Op          string `json:"op,omitempty"`
+	Key         string `json:"key,omitempty"`
+	KeyBase64   string `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ValueLen    int    `json:"value_len,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	Expired     bool   `json:"expired,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func runDump(args []string, out io.Writer) error {
+	c := newCommand("dump", "<aof>")
+	previewLen := c.fs.Int("preview", 64, "Bytes of each value to print (0 = all of it)")
+	paths, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	files, err := inputFiles(paths[0])
+	if err != nil {
+		return err
+	}
+	sealer, err := c.sealer(aof.CompressNone)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	now := time.Now()
+
+	return scan(files, sealer, func(pos position, rec aof.Record, recErr *aof.RecordError) error {
+		line := dumpLine{File: pos.File, Offset: pos.Offset}
+		if recErr != nil {
+			line.Error = recErr.Err.Error()
+			return enc.Encode(line)
+		}
+
+		line.Op = rec.Op.String()
+		line.Key, line.KeyBase64 = printable(rec.Key)
+		if rec.Op == aof.OpSet {
+			value := rec.Value
+			if *previewLen > 0 && len(value) > *previewLen {
+				value = value[:*previewLen]
+			}
+			line.Value, line.ValueBase64 = printable(value)
+			line.ValueLen = len(rec.Value)
+			if rec.ExpiresAt != 0 {
+				expiresAt := time.UnixMilli(rec.ExpiresAt)
+				line.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+				line.Expired = !expiresAt.After(now)
+			}
+		}
+		return enc.Encode(line)
+	})
+}
+
+// printable returns b as a string if it is valid UTF-8, otherwise in base64 as
+// the second result.
+func printable(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(b)
+}
+
+// canonicalKey returns a record's key in one form whatever the format of the
+// file it came from. Text files JSON-encode every key while the others store
+// string keys raw, and a segmented AOF can hold both, so a quoted text key is
+// decoded to compare equal to the same key written in binary.
+func canonicalKey(format aof.Format, key []byte) string {
+	if format == aof.FormatText && len(key) > 0 && key[0] == '"' {
+		var s string
+		if json.Unmarshal(key, &s) == nil {
+			return s
+		}
+	}
+	return string(key)
+}
+
+// tally follows every key through the log, as replay would.
+type tally struct {
+	sets, dels, bad int
+	overwritten     int              // SETs superseded by a later record for the same key
+	last            map[string]int64 // each key's last record: its expiry, or -1 for a DEL
+}
+
+func (t *tally) add(format aof.Format, rec aof.Record) {
+	key := canonicalKey(format, rec.Key)
+	if exp, ok := t.last[key]; ok && exp != -1 {
+		t.overwritten++
+	}
+	if rec.Op == aof.OpDel {
+		t.dels++
+		t.last[key] = -1
+		return
+	}
+	t.sets++
+	t.last[key] = rec.ExpiresAt
+}
+
+func runStats(args []string, out io.Writer) error {
+	c := newCommand("stats", "<aof>")
+	paths, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	files, err := inputFiles(paths[0])
+	if err != nil {
+		return err
+	}
+	sealer, err := c.sealer(aof.CompressNone)
+	if err != nil {
+		return err
+	}
+
+	t := &tally{last: make(map[string]int64)}
+	err = scan(files, sealer, func(pos position, rec aof.Record, recErr *aof.RecordError) error {
+		if recErr != nil {
+			t.bad++
+			return nil
+		}
+		t.add(pos.Format, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every SET ends up overwritten, or as its key's value, live or expired
+	var live, expired, deleted int
+	now := time.Now().UnixMilli()
+	for _, exp := range t.last {
+		switch {
+		case exp == -1:
+			deleted++
+		case exp != 0 && exp <= now:
+			expired++
+		default:
+			live++
+		}
+	}
+	percent := func(n int) string {
+		if t.sets == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", float64(n)*100/float64(t.sets))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "files\t%d\n", len(files))
+	fmt.Fprintf(w, "records\t%d\t(%d SET, %d DEL, %d bad)\n", t.sets+t.dels+t.bad, t.sets, t.dels, t.bad)
+	fmt.Fprintf(w, "keys\t%d\t(%d live, %d expired, %d deleted)\n", len(t.last), live, expired, deleted)
+	fmt.Fprintf(w, "live SETs\t%d\t%s\n", live, percent(live))
+	fmt.Fprintf(w, "expired SETs\t%d\t%s\n", expired, percent(expired))
+	fmt.Fprintf(w, "overwritten SETs\t%d\t%s\n", t.overwritten, percent(t.overwritten))
+	return w.Flush()
+}
+
+func runRewrite(args []string, out io.Writer) error {
+	c := newCommand("rewrite", "<aof> <out>")
+	formatName := c.fs.String("format", "", "Format to write: binary, hybrid or text (default: the input's)")
+	compress := c.fs.String("compress", aof.CompressNone.String(), "Compress the records written: none, zstd, snappy or deflate")
+	paths, err := c.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	files, err := inputFiles(paths[0])
+	if err != nil {
+		return err
+	}
+	compression, err := aof.ParseCompression(*compress)
+	if err != nil {
+		return err
+	}
+	sealer, err := c.sealer(compression)
+	if err != nil {
+		return err
+	}
+
+	// Keep each key's latest SET, in the order they were last written, which
+	// is the order replay needs to rebuild the same recency
+	type entry struct {
+		rec        aof.Record
+		text       bool
+		superseded bool
+	}
+	var (
+		entries []*entry
+		latest  = make(map[string]*entry)
+		input   []aof.Format // the first file's, unless -format says otherwise
+		bad     int
+	)
+	err = scan(files, sealer, func(pos position, rec aof.Record, recErr *aof.RecordError) error {
+		if recErr != nil {
+			if errors.Is(recErr, aof.ErrKey) {
+				return fmt.Errorf("%v: %w", pos, recErr.Err)
+			}
+			bad++
+			return nil
+		}
+		if input == nil {
+			input = []aof.Format{pos.Format}
+		}
+		key := canonicalKey(pos.Format, rec.Key)
+		if e := latest[key]; e != nil {
+			e.superseded = true
+		}
+		delete(latest, key)
+		if rec.Op == aof.OpSet {
+			e := &entry{rec: rec, text: pos.Format == aof.FormatText}
+			entries = append(entries, e)
+			latest[key] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	format := aof.FormatBinary
+	if input != nil {
+		format = input[0]
+	}
+	if *formatName != "" {
+		if format, err = aof.ParseFormat(*formatName); err != nil {
+			return err
+		}
+	}
+	if format == aof.FormatText && sealer != nil {
+		return errors.New("compression and encryption need the binary or hybrid format")
+	}
+
+	tempPath := paths[1] + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+	w := bufio.NewWriter(f)
+
+	var snapshot *aof.SnapshotWriter
+	switch format {
+	case aof.FormatHybrid:
+		snapshot = aof.NewSnapshotWriter(w)
+		snapshot.SetSealer(sealer)
+	case aof.FormatBinary:
+		w.Write(aof.Header)
+	}
+
+	now := time.Now().UnixMilli()
+	written := 0
+	for _, e := range entries {
+		if e.superseded || (e.rec.ExpiresAt != 0 && e.rec.ExpiresAt <= now) {
+			continue
+		}
+		// Text files JSON-encode every key and value while the others store
+		// strings and bytes raw; only the server knows the types to convert
+		if e.text != (format == aof.FormatText) {
+			f.Close()
+			return fmt.Errorf("can't convert between the text and %v formats offline; compact from the server instead", format)
+		}
+		if snapshot != nil {
+			err = snapshot.Add(e.rec.Key, e.rec.Value, e.rec.ExpiresAt)
+		} else {
+			var rec []byte
+			rec, err = sealer.AppendRecord(nil, format, e.rec)
+			w.Write(rec)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		written++
+	}
+	if snapshot != nil {
+		snapshot.Close()
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, paths[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "wrote %d entries to %s (%v)", written, paths[1], format)
+	if bad > 0 {
+		fmt.Fprintf(out, ", leaving out %d bad records", bad)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+func runTruncate(args []string, out io.Writer) error {
+	c := newCommand("truncate", "<aof>")
+	dryRun := c.fs.Bool("dry-run", false, "Report what would be cut without changing anything")
+	paths, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	files, err := inputFiles(paths[0])
+	if err != nil {
+		return err
+	}
+	sealer, err := c.sealer(aof.CompressNone)
+	if err != nil {
+		return err
+	}
+
+	// Like the server's truncate recovery, only the last segment is cut: the
+	// ones after an earlier cut would replay over the gap
+	for i, path := range files {
+		var first *position
+		err := scan([]string{path}, sealer, func(pos position, rec aof.Record, recErr *aof.RecordError) error {
+			if recErr == nil || first != nil {
+				return nil
+			}
+			if errors.Is(recErr, aof.ErrKey) {
+				// Not damage; cutting here would throw away good records
+				return fmt.Errorf("%v: %w", pos, recErr.Err)
+			}
+			first = &pos
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			fmt.Fprintf(out, "%s: ok\n", path)
+			continue
+		}
+		if i < len(files)-1 {
+			return fmt.Errorf("%v: damaged before the last segment; name the segment file to cut it anyway", *first)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !*dryRun {
+			if err := os.Truncate(path, first.Offset); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "%v: cut %d bytes\n", *first, info.Size()-first.Offset)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/shard"
+)
+
+// writeAOF writes an AOF the way the server does: a, b and c set, a set again
+// and b deleted.
+func writeAOF(t *testing.T, format aof.Format, opts ...shard.Option) string {
+	t.Helper()
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, err := shard.NewCacheManager[string, []byte](4, 100, 3, aofPath, 0, append(opts, shard.WithAOFFormat(format))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.Set("a", []byte("1"), time.Hour)
+	mgr.Set("b", []byte("2"), time.Hour)
+	mgr.Set("c", []byte{0xff, 0x00}, lru.NoExpiration)
+	mgr.Set("a", []byte("one"), time.Hour)
+	mgr.Delete("b")
+	mgr.Stop()
+	return aofPath
+}
+
+func appendTo(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(b)
+	f.Close()
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("clean", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := runCheck([]string{writeAOF(t, aof.FormatBinary)}, &out); err != nil {
+			t.Fatalf("check: %v\n%s", err, out.String())
+		}
+		if !strings.Contains(out.String(), "5 records in 1 files, 0 bad") {
+			t.Errorf("Unexpected report %q", out.String())
+		}
+	})
+
+	t.Run("text line numbers", func(t *testing.T) {
+		path := writeAOF(t, aof.FormatText)
+		appendTo(t, path, []byte("SET|ImQi|IjQi|0|00000000\nSET|half"))
+
+		var out bytes.Buffer
+		if err := runCheck([]string{path}, &out); !errors.Is(err, errBadRecords) {
+			t.Fatalf("Expected errBadRecords, got %v", err)
+		}
+		for _, want := range []string{"line 6: aof: checksum mismatch", "line 7: aof: torn record", "7 records in 1 files, 2 bad"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Expected %q in %q", want, out.String())
+			}
+		}
+	})
+}
+
+func TestDump(t *testing.T) {
+	var out bytes.Buffer
+	if err := runDump([]string{writeAOF(t, aof.FormatHybrid)}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []dumpLine
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line dumpLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 lines, got %d", len(lines))
+	}
+	if l := lines[0]; l.Op != "SET" || l.Key != "a" || l.Value != "1" || l.ExpiresAt == "" || l.Expired {
+		t.Errorf("Unexpected first line %+v", l)
+	}
+	if l := lines[2]; l.ValueBase64 != "/wA=" || l.ValueLen != 2 || l.ExpiresAt != "" {
+		t.Errorf("Expected a binary value in base64, got %+v", l)
+	}
+	if l := lines[4]; l.Op != "DEL" || l.Key != "b" {
+		t.Errorf("Unexpected last line %+v", l)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var out bytes.Buffer
+	if err := runStats([]string{writeAOF(t, aof.FormatBinary)}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"(4 SET, 1 DEL, 0 bad)",
+		"(2 live, 0 expired, 1 deleted)",
+		"overwritten SETs  2 ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	in := writeAOF(t, aof.FormatBinary)
+	appendTo(t, in, []byte{byte(aof.OpSet), 0x7f}) // a torn tail
+	out := filepath.Join(t.TempDir(), "compact.aof")
+
+	var report bytes.Buffer
+	if err := runRewrite([]string{"-format", "hybrid", "-compress", "zstd", in, out}, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "wrote 2 entries") || !strings.Contains(report.String(), "leaving out 1 bad records") {
+		t.Errorf("Unexpected report %q", report.String())
+	}
+
+	sealer, _ := aof.NewSealer(aof.CompressZstd)
+	mgr, _ := shard.NewCacheManager[string, []byte](4, 100, 3, out, 0, shard.WithSealer(sealer))
+	defer mgr.Stop()
+	loaded, err := mgr.LoadAOF()
+	if err != nil || loaded.Applied != 2 {
+		t.Fatalf("LoadAOF = %+v, %v", loaded, err)
+	}
+	if got, _ := mgr.Get("a"); string(got) != "one" || mgr.Exists("b") {
+		t.Error("Expected the rewrite to hold the latest value of every live key")
+	}
+
+	if err := runRewrite([]string{"-format", "text", in, out}, &report); err == nil {
+		t.Error("Expected converting binary to text to be refused")
+	}
+}
+
+func TestMixedFormats(t *testing.T) {
+	// A segmented AOF begun in text and carried on in binary holds the same
+	// key JSON-encoded in one segment and raw in the next
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	for _, format := range []aof.Format{aof.FormatText, aof.FormatBinary} {
+		mgr, _ := shard.NewCacheManager[string, []byte](4, 100, 3, path, 0, shard.WithSegmentSize(32), shard.WithAOFFormat(format))
+		mgr.LoadAOF()
+		mgr.Set("a", []byte(format.String()), time.Hour)
+		mgr.Stop()
+	}
+
+	var out bytes.Buffer
+	if err := runStats([]string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"(1 live, 0 expired, 0 deleted)", "overwritten SETs  1 "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in\n%s", want, out.String())
+		}
+	}
+
+	compact := filepath.Join(t.TempDir(), "compact.aof")
+	if err := runRewrite([]string{"-format", "binary", path, compact}, &out); err != nil {
+		t.Fatal(err)
+	}
+	mgr, _ := shard.NewCacheManager[string, []byte](4, 100, 3, compact, 0)
+	defer mgr.Stop()
+	if loaded, err := mgr.LoadAOF(); err != nil || loaded.Applied != 1 {
+		t.Fatalf("LoadAOF = %+v, %v", loaded, err)
+	}
+	if got, _ := mgr.Get("a"); string(got) != "binary" {
+		t.Errorf("Expected the binary SET to win, got %q", got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	path := writeAOF(t, aof.FormatBinary)
+	before, _ := os.Stat(path)
+	appendTo(t, path, []byte("garbage"))
+
+	var out bytes.Buffer
+	if err := runTruncate([]string{"-dry-run", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() == before.Size() {
+		t.Fatal("Expected -dry-run to leave the file alone")
+	}
+
+	if err := runTruncate([]string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() != before.Size() {
+		t.Errorf("Size after truncate = %d, want %d", info.Size(), before.Size())
+	}
+	if err := runCheck([]string{path}, &out); err != nil {
+		t.Errorf("Expected a clean file after truncate, got %v", err)
+	}
+}
+
+func TestTruncate_OnlyTheLastSegment(t *testing.T) {
+	path := writeAOF(t, aof.FormatBinary, shard.WithSegmentSize(32))
+	files, err := inputFiles(path)
+	if err != nil || len(files) < 2 {
+		t.Fatalf("inputFiles = %v, %v, want several segments", files, err)
+	}
+	appendTo(t, files[0], []byte("garbage"))
+	before, _ := os.Stat(files[0])
+
+	var out bytes.Buffer
+	if err := runTruncate([]string{path}, &out); err == nil {
+		t.Error("Expected an error for damage before the last segment")
+	}
+	if info, _ := os.Stat(files[0]); info.Size() != before.Size() {
+		t.Error("Expected the damaged segment to be left alone")
+	}
+	// Named on its own, the segment is cut
+	if err := runTruncate([]string{files[0]}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(files[0]); info.Size() == before.Size() {
+		t.Error("Expected the named segment to be cut")
+	}
+}
+
+func TestSegmentedAndSealed(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	keys, _ := aof.ParseKeys(strings.Repeat("ab", 32))
+	sealer, _ := aof.NewSealer(aof.CompressNone, keys...)
+
+	path := writeAOF(t, aof.FormatBinary, shard.WithSegmentSize(32), shard.WithSealer(sealer))
+
+	var out bytes.Buffer
+	if err := runCheck([]string{path}, &out); err == nil {
+		t.Error("Expected sealed records to be unreadable without the key")
+	}
+	out.Reset()
+	if err := runCheck([]string{"-key-file", keyFile, path + ".d"}, &out); err != nil {
+		t.Fatalf("check: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "5 records in ") || strings.Contains(out.String(), " 1 files") {
+		t.Errorf("Expected every segment to be read, got %q", out.String())
+	}
+}
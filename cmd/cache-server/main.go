@@ -1,22 +1,104 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/memcache"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/raft"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/resp"
 	"github.com/Hiroki111/sharded-lru-cache/pkg/shard"
 )
 
-const aofPath = "data/cache.aof"
-
 type Server struct {
-	cache *shard.CacheManager[string, any]
+	cache *shard.CacheManager[string, []byte]
+	// replicaOf is the primary's base URL when this server is a read-only replica
+	replicaOf string
+	// raft orders writes across the cluster when this server is one of its nodes
+	raft *raft.Node
+}
+
+// raftWriteTimeout bounds how long a write waits for a quorum.
+const raftWriteTimeout = 5 * time.Second
+
+// set stores key locally or, on a Raft node, on a quorum of the cluster.
+func (s *Server) set(r *http.Request, key string, value []byte, ttl time.Duration) error {
+	if s.raft == nil {
+		s.cache.Set(key, value, ttl)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), raftWriteTimeout)
+	defer cancel()
+	return s.cache.ProposeSet(ctx, s.raft, key, value, ttl)
+}
+
+// delete removes key locally or, on a Raft node, on a quorum of the cluster.
+func (s *Server) delete(r *http.Request, key string) (bool, error) {
+	if s.raft == nil {
+		return s.cache.Delete(key), nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), raftWriteTimeout)
+	defer cancel()
+	return s.cache.ProposeDelete(ctx, s.raft, key)
+}
+
+// setMany stores every item locally or, on a Raft node, proposes them one at a
+// time, stopping at the first that fails.
+func (s *Server) setMany(r *http.Request, items map[string][]byte, ttl time.Duration) error {
+	if s.raft == nil {
+		s.cache.SetMany(items, ttl)
+		return nil
+	}
+	for key, value := range items {
+		if err := s.set(r, key, value, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMany removes every key locally or, on a Raft node, proposes the
+// deletes one at a time, stopping at the first that fails.
+func (s *Server) deleteMany(r *http.Request, keys []string) ([]bool, error) {
+	if s.raft == nil {
+		return s.cache.DeleteMany(keys), nil
+	}
+	deleted := make([]bool, len(keys))
+	for i, key := range keys {
+		var err error
+		if deleted[i], err = s.delete(r, key); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// writeFailed answers a write that couldn't go through the Raft log. Writes
+// to a follower are redirected to the leader with 307, which keeps the method
+// and body.
+func (s *Server) writeFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) && notLeader.Leader != "" {
+		http.Redirect(w, r, notLeader.Leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Write not committed: "+err.Error(), http.StatusServiceUnavailable)
 }
 
 type setPayload struct {
@@ -42,7 +124,10 @@ func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
 		ttl = 10 * time.Minute
 	}
 
-	s.cache.Set(payload.Key, payload.Value, ttl)
+	if err := s.set(r, payload.Key, payload.Value, ttl); err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -63,6 +148,188 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]any{"value": value})
 }
 
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+
+	deleted, err := s.delete(r, key)
+	if err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Value not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// maxBatchKeys is the most keys /mget, /mset and /mdel take in one request.
+const maxBatchKeys = 1000
+
+// batchKeys returns the key parameters of a /mget or /mdel request, or
+// answers 400 and returns nil if there are none or too many.
+func batchKeys(w http.ResponseWriter, r *http.Request) []string {
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 || len(keys) > maxBatchKeys {
+		http.Error(w, fmt.Sprintf("Want 1 to %d key parameters", maxBatchKeys), http.StatusBadRequest)
+		return nil
+	}
+	return keys
+}
+
+type msetPayload struct {
+	Items map[string][]byte `json:"items"`
+	TTL   int               `json:"ttl"`
+}
+
+// handleMGet looks up every ?key= at once, answering with the values found
+// and the keys that are missing, in the order they were asked for.
+func (s *Server) handleMGet(w http.ResponseWriter, r *http.Request) {
+	keys := batchKeys(w, r)
+	if keys == nil {
+		return
+	}
+
+	values := s.cache.GetMany(keys)
+	missing := []string{}
+	for _, key := range keys {
+		if _, found := values[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"values": values, "missing": missing})
+}
+
+// handleMSet stores every item with the same TTL.
+func (s *Server) handleMSet(w http.ResponseWriter, r *http.Request) {
+	var payload msetPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Items) == 0 || len(payload.Items) > maxBatchKeys {
+		http.Error(w, fmt.Sprintf("Want 1 to %d items", maxBatchKeys), http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(payload.TTL) * time.Second
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+
+	if err := s.setMany(r, payload.Items, ttl); err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"status": "stored", "stored": len(payload.Items)})
+}
+
+// handleMDelete removes every ?key= at once, answering with the keys that
+// were deleted and the ones that were missing.
+func (s *Server) handleMDelete(w http.ResponseWriter, r *http.Request) {
+	keys := batchKeys(w, r)
+	if keys == nil {
+		return
+	}
+
+	deleted, err := s.deleteMany(r, keys)
+	if err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
+	response := map[string][]string{"deleted": {}, "missing": {}}
+	for i, key := range keys {
+		if deleted[i] {
+			response["deleted"] = append(response["deleted"], key)
+		} else {
+			response["missing"] = append(response["missing"], key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ttlHeader carries TTLs in seconds for the raw /keys API, which has no JSON body
+// to put them in. The ttl query parameter works too.
+const ttlHeader = "X-Cache-TTL"
+
+func (s *Server) handlePutKey(w http.ResponseWriter, r *http.Request) {
+	ttlParam := r.Header.Get(ttlHeader)
+	if ttlParam == "" {
+		ttlParam = r.URL.Query().Get("ttl")
+	}
+
+	var ttl time.Duration
+	if ttlParam != "" {
+		seconds, err := strconv.Atoi(ttlParam)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid TTL", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.set(r, r.PathValue("key"), value, ttl); err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	value, found := s.cache.Get(key)
+	if !found {
+		http.Error(w, "Value not found", http.StatusNotFound)
+		return
+	}
+
+	if ttl, found := s.cache.TTL(key); found && ttl != lru.NoExpiration {
+		w.Header().Set(ttlHeader, strconv.Itoa(int((ttl+time.Second-1)/time.Second)))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+}
+
+func (s *Server) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
+	deleted, err := s.delete(r, r.PathValue("key"))
+	if err != nil {
+		s.writeFailed(w, r, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Value not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	stats := s.cache.GetStats()
 
@@ -72,21 +339,139 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		hitRate = (float64(stats.Hits) / float64(totalRequests)) * 100
 	}
 
+	shardStats := s.cache.GetShardStats()
+	shardBytes := make([]int64, len(shardStats))
+	for i, stats := range shardStats {
+		shardBytes[i] = stats.Bytes
+	}
+
+	repl := s.cache.ReplicationStatus()
+	replication := map[string]interface{}{
+		"role":     repl.Role,
+		"offset":   repl.Offset,
+		"replicas": repl.Replicas,
+	}
+	if repl.Role == "replica" {
+		replication["primary"] = s.replicaOf
+		replication["primary_offset"] = repl.PrimaryOffset
+		replication["lag"] = repl.Lag
+		replication["last_heard_ms"] = repl.LastHeard.Milliseconds()
+		replication["connected"] = repl.Connected
+		replication["synced"] = repl.Synced
+	}
+
+	response := map[string]interface{}{
+		"hits":        stats.Hits,
+		"misses":      stats.Misses,
+		"evictions":   stats.Evictions,
+		"hit_rate":    fmt.Sprintf("%.2f%%", hitRate),
+		"items":       stats.Items,
+		"bytes":       stats.Bytes,
+		"shard_bytes": shardBytes,
+		"replication": replication,
+	}
+	if s.raft != nil {
+		status := s.raft.Status()
+		response["raft"] = map[string]interface{}{
+			"id":             status.ID,
+			"state":          status.State.String(),
+			"term":           status.Term,
+			"leader":         status.Leader,
+			"last_index":     status.LastIndex,
+			"commit_index":   status.CommitIndex,
+			"applied_index":  status.AppliedIndex,
+			"snapshot_index": status.SnapshotIndex,
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"hits":      stats.Hits,
-		"misses":    stats.Misses,
-		"evictions": stats.Evictions,
-		"hit_rate":  fmt.Sprintf("%.2f%%", hitRate),
-	})
+	json.NewEncoder(w).Encode(response)
+}
+
+// distributionSample is how many sample keys /admin/distribution places by
+// default, and maxDistributionSample the most it will, which bounds the time
+// one request spends hashing.
+const (
+	distributionSample    = 100000
+	maxDistributionSample = 1000000
+)
+
+// handleDistribution reports how evenly keys are spread over the shards: the
+// entries each holds, each one's share of the hash space, and where sample
+// keys land. With ?replicas=N it also shows a ring with N points per shard,
+// to compare before changing the replica count.
+func (s *Server) handleDistribution(w http.ResponseWriter, r *http.Request) {
+	sample := distributionSample
+	if param := r.URL.Query().Get("sample"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxDistributionSample {
+			http.Error(w, fmt.Sprintf("Invalid sample, want 1 to %d", maxDistributionSample), http.StatusBadRequest)
+			return
+		}
+		sample = n
+	}
+
+	response := distributionJSON(s.cache.Distribution(sample))
+	if param := r.URL.Query().Get("replicas"); param != "" {
+		replicas, err := strconv.Atoi(param)
+		if err != nil || replicas < 1 || replicas > 1000 {
+			http.Error(w, "Invalid replicas, want 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		response["what_if"] = distributionJSON(s.cache.SimulateReplicas(replicas, sample))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func distributionJSON(d shard.ShardDistribution) map[string]interface{} {
+	summary := func(d placement.Distribution) map[string]interface{} {
+		return map[string]interface{}{
+			"counts":     d.Counts,
+			"total":      d.Total,
+			"mean":       d.Mean,
+			"stddev":     d.StdDev,
+			"rel_stddev": d.RelStdDev,
+			"min":        d.Min,
+			"max":        d.Max,
+		}
+	}
+	response := map[string]interface{}{
+		"strategy":      d.Strategy,
+		"shards":        len(d.Ownership),
+		"ownership_pct": d.Ownership,
+		"simulated":     summary(d.Simulated),
+	}
+	if d.Replicas > 0 {
+		response["replicas"] = d.Replicas
+	}
+	if d.Items.Counts != nil {
+		response["items"] = summary(d.Items)
+	}
+	return response
 }
 
 // You don't want to compact on every Set (that would be $O(N)$ and slow). You usually trigger it based on:
 // Time: Once every hour.
 // Size: When the AOF file exceeds 1GB.
 // Manual: An admin endpoint /compact.
+// On a Raft node it snapshots the cache and drops the log up to the snapshot.
 func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		if err := s.raft.Snapshot(); err != nil {
+			http.Error(w, "Snapshot failed", 500)
+			return
+		}
+		w.Write([]byte("Compaction successful"))
+		return
+	}
+
 	err := s.cache.Compact()
+	if errors.Is(err, shard.ErrRewriteInProgress) {
+		http.Error(w, "Compaction already in progress", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Compaction failed", 500)
 		return
@@ -94,56 +479,296 @@ func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Compaction successful"))
 }
 
+// handleReplicate streams the cache, and then every write to it, to a replica
+// for as long as the replica stays connected.
+func (s *Server) handleReplicate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	log.Printf("Replica connected from %s", r.RemoteAddr)
+	err := s.cache.ServeReplica(r.Context(), w)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Replica %s dropped: %v", r.RemoteAddr, err)
+		return
+	}
+	log.Printf("Replica %s disconnected", r.RemoteAddr)
+}
+
+// followPrimary keeps replicating from the primary until ctx is done,
+// reconnecting, and resyncing from a fresh snapshot, whenever the stream breaks.
+func (s *Server) followPrimary(ctx context.Context) {
+	for {
+		if err := s.replicateOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Replication from %s interrupted: %v", s.replicaOf, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) replicateOnce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.replicaOf+"/replicate", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned status: %d", resp.StatusCode)
+	}
+	log.Printf("Replicating from %s", s.replicaOf)
+	if err := s.cache.Replicate(resp.Body); err != nil {
+		return err
+	}
+	return errors.New("primary closed the stream")
+}
+
+// readOnly refuses writes on a replica, which only takes them from its primary.
+func (s *Server) readOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.replicaOf != "" {
+			http.Error(w, "Read-only replica, write to the primary at "+s.replicaOf, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireReady answers 503 until the cache has recovered from the AOF, or on a
+// replica until the first snapshot has arrived from the primary, so the port
+// can be opened, and health-checked, before a long replay finishes.
+func (s *Server) requireReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.cache.Ready():
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Loading the dataset from the AOF", http.StatusServiceUnavailable)
+			return
+		}
+		if s.replicaOf != "" && !s.cache.ReplicationStatus().Synced {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Syncing with the primary", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ready"))
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux() // Using a local mux is cleaner than global http.HandleFunc
+	mux.HandleFunc("/get", s.handleGet)
+	mux.HandleFunc("/set", s.readOnly(s.handleSet))
+	mux.HandleFunc("/delete", s.readOnly(s.handleDelete))
+	mux.HandleFunc("GET /mget", s.handleMGet)
+	mux.HandleFunc("POST /mset", s.readOnly(s.handleMSet))
+	mux.HandleFunc("DELETE /mdel", s.readOnly(s.handleMDelete))
+	mux.HandleFunc("PUT /keys/{key...}", s.readOnly(s.handlePutKey))
+	mux.HandleFunc("GET /keys/{key...}", s.handleGetKey)
+	mux.HandleFunc("DELETE /keys/{key...}", s.readOnly(s.handleDeleteKey))
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/compact", s.handleCompact)
+	mux.HandleFunc("GET /admin/distribution", s.handleDistribution)
+	mux.HandleFunc("GET /replicate", s.handleReplicate)
+	if s.raft != nil {
+		mux.Handle("/raft/", s.raft.Handler())
+	}
+	mux.HandleFunc("/ready", s.handleReady)
+	return s.requireReady(mux)
+}
+
 func main() {
 	// 1. Configuration
 	var maxAofSize int64 = 50 * 1024 * 1024 // 50 MB
+	addr := flag.String("addr", ":8080", "Address for the HTTP API")
+	aofPath := flag.String("aof-path", "data/cache.aof", "Append-only file the cache is persisted to")
+	replicaOf := flag.String("replica-of", "", "Base URL of a primary to replicate from, e.g. http://localhost:8080; the HTTP API then refuses writes")
+	raftID := flag.String("raft-id", "", "This node's base URL in a Raft cluster, e.g. http://localhost:9001; writes then need a quorum (disabled if empty)")
+	raftPeers := flag.String("raft-peers", "", "Comma-separated base URLs of the other Raft nodes")
+	raftDir := flag.String("raft-dir", "data/raft", "Directory for the Raft log and snapshots, which replace the AOF")
+	evictionPolicy := flag.String("eviction-policy", string(lru.PolicyLRU), "Eviction policy: lru, lfu, w-tinylfu, sieve or arc")
+	placementStrategy := flag.String("placement", string(placement.StrategyRing), "How keys are placed on shards: ring, jump, rendezvous or maglev")
+	maxBytes := flag.Int64("max-bytes", 0, "Upper bound for the total size of keys and values in bytes (0 = bounded by item count only)")
+	respAddr := flag.String("resp-addr", "", "Address for the Redis protocol (RESP) listener, e.g. :6379 (disabled if empty)")
+	memcacheAddr := flag.String("memcache-addr", "", "Address for the memcached protocol listener, e.g. :11211 (disabled if empty)")
+	aofFormat := flag.String("aof-format", aof.FormatBinary.String(), "Record format for new and compacted AOF files: binary, hybrid (snapshot preamble + binary records) or text")
+	snapshotPath := flag.String("snapshot-path", "data/cache.snap", "File that scheduled snapshots are written to")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "How often to write a snapshot to -snapshot-path, e.g. 24h (disabled if 0)")
+	aofRecovery := flag.String("aof-recovery", string(shard.RecoveryTruncate), "What to do with a torn or corrupt AOF record: truncate, skip or fail")
+	aofSegmentSize := flag.Int64("aof-segment-size", 0, "Split the AOF into segments of about this many bytes, tracked by a manifest in <aof>.d (disabled if 0)")
+	aofCompress := flag.String("aof-compress", aof.CompressNone.String(), "Compress AOF and snapshot records: none, zstd, snappy or deflate")
+	aofKeyFile := flag.String("aof-key-file", "", "File of hex AES keys to encrypt the AOF and snapshots with, the current key first (falls back to $"+aof.KeyEnv+")")
+	appendFsync := flag.String("appendfsync", string(shard.FsyncEverySec), "AOF fsync policy: always, everysec or no")
+	flag.Parse()
+
+	fsyncPolicy, err := shard.ParseFsyncPolicy(*appendFsync)
+	if err != nil {
+		log.Fatalf("Critical Error: %v", err)
+	}
+	format, err := aof.ParseFormat(*aofFormat)
+	if err != nil {
+		log.Fatalf("Critical Error: %v", err)
+	}
+
+	compression, err := aof.ParseCompression(*aofCompress)
+	if err != nil {
+		log.Fatalf("Critical Error: %v", err)
+	}
+	sealer, err := aof.LoadSealer(compression, *aofKeyFile)
+	if err != nil {
+		log.Fatalf("Critical Error: %v", err)
+	}
+
+	// A replica only takes writes from its primary, and the other protocols
+	// would write straight into it
+	if *replicaOf != "" && (*respAddr != "" || *memcacheAddr != "") {
+		log.Fatalf("Critical Error: -replica-of can't be combined with -resp-addr or -memcache-addr")
+	}
+
+	var peers []string
+	if *raftID != "" {
+		// The Raft log and its snapshots are what make writes durable, and the
+		// other protocols would write around it
+		if *replicaOf != "" || *respAddr != "" || *memcacheAddr != "" {
+			log.Fatalf("Critical Error: -raft-id can't be combined with -replica-of, -resp-addr or -memcache-addr")
+		}
+		for _, peer := range strings.Split(*raftPeers, ",") {
+			if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		*aofPath = ""
+	}
 
 	// 2. Initialization
-	mgr, err := shard.NewCacheManager[string, any](32, 1024, 3, aofPath, maxAofSize)
+	mgr, err := shard.NewCacheManager[string, []byte](32, 1024, 3, *aofPath, maxAofSize,
+		shard.WithEvictionPolicy(lru.PolicyType(*evictionPolicy)),
+		shard.WithPlacement(placement.Strategy(*placementStrategy)),
+		shard.WithMaxBytes(*maxBytes),
+		shard.WithFsyncPolicy(fsyncPolicy),
+		shard.WithAOFFormat(format),
+		shard.WithRecoveryMode(shard.RecoveryMode(*aofRecovery)),
+		shard.WithSegmentSize(*aofSegmentSize),
+		shard.WithSealer(sealer),
+	)
 	if err != nil {
 		// Use log.Fatalf for critical startup errors
 		log.Fatalf("Critical Error: Failed to initialize cache manager: %v", err)
 	}
 
-	// 3. Recovery
-	if err := mgr.LoadAOF(); err != nil {
+	srv := &Server{cache: mgr, replicaOf: strings.TrimSuffix(*replicaOf, "/")}
+	if *raftID != "" {
+		srv.raft, err = raft.NewNode(raft.Config{
+			ID:        strings.TrimSuffix(*raftID, "/"),
+			Peers:     peers,
+			Dir:       *raftDir,
+			Transport: raft.NewHTTPTransport(),
+			FSM:       mgr,
+		})
+		if err != nil {
+			log.Fatalf("Critical Error: Failed to open the Raft log: %v", err)
+		}
+		log.Printf("Raft node %s with peers %v, state in %s", *raftID, peers, *raftDir)
+	}
+
+	// 3. Routing. The port opens now and answers 503 until recovery is done.
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: srv.routes(),
+	}
+	go func() {
+		log.Printf("Server starting on %s...", *addr)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	// 4. Recovery
+	report, err := mgr.LoadAOF()
+	switch {
+	case err != nil && (shard.RecoveryMode(*aofRecovery) == shard.RecoveryFail || errors.Is(err, aof.ErrKey)):
+		log.Fatalf("Critical Error: AOF recovery failed: %v", err)
+	case err != nil:
 		// A warning is appropriate here as the server can still function
 		log.Printf("Warning: Recovery from AOF incomplete: %v", err)
 	}
+	log.Printf("AOF recovery: %d records applied, %d skipped, %d bytes truncated", report.Applied, report.Skipped, report.Truncated)
+	if report.Stale > 0 {
+		// Plaintext or an old key on disk: rewrite it under the current key
+		log.Printf("AOF has %d records not encrypted with the current key. Compacting...", report.Stale)
+		if err := mgr.Compact(); err != nil {
+			log.Printf("Warning: Re-encrypting the AOF failed: %v", err)
+		}
+	}
+
+	// A replica starts from the primary's snapshot, which replaces what was recovered
+	ctx, cancel := context.WithCancel(context.Background())
+	if srv.replicaOf != "" {
+		go srv.followPrimary(ctx)
+	}
+	if srv.raft != nil {
+		srv.raft.Start()
+	}
 
-	// 4. Background Workers
+	// 5. Background Workers
 	mgr.StartJanitor(10 * time.Second)
 	mgr.StartAofSyncer()
 	mgr.StartAofMonitor(30 * time.Second)
+	if *snapshotInterval > 0 {
+		mgr.StartSnapshotter(*snapshotPath, *snapshotInterval)
+	}
 
-	srv := &Server{cache: mgr}
-
-	// 5. Routing
-	mux := http.NewServeMux() // Using a local mux is cleaner than global http.HandleFunc
-	mux.HandleFunc("/get", srv.handleGet)
-	mux.HandleFunc("/set", srv.handleSet)
-	mux.HandleFunc("/stats", srv.handleStats)
-	mux.HandleFunc("/compact", srv.handleCompact)
+	// 6. Optional protocol listeners
+	var respServer *resp.Server
+	if *respAddr != "" {
+		respServer = resp.NewServer(mgr)
+		go func() {
+			log.Printf("RESP listener starting on %s...", *respAddr)
+			if err := respServer.ListenAndServe(*respAddr); err != resp.ErrServerClosed {
+				log.Fatalf("RESP listener failed: %v", err)
+			}
+		}()
+	}
 
-	httpServer := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	var memcacheServer *memcache.Server
+	if *memcacheAddr != "" {
+		memcacheServer = memcache.NewServer(mgr)
+		go func() {
+			log.Printf("Memcached listener starting on %s...", *memcacheAddr)
+			if err := memcacheServer.ListenAndServe(*memcacheAddr); err != memcache.ErrServerClosed {
+				log.Fatalf("Memcached listener failed: %v", err)
+			}
+		}()
 	}
 
-	// 6. Graceful Shutdown Logic
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-		<-sigChan
-
-		log.Println("Shutting down gracefully...")
-		mgr.Stop()
-		log.Println("AOF flushed. Goodbye!")
-		os.Exit(0)
-	}()
+	// 7. Graceful Shutdown Logic
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
 
-	log.Println("Server starting on :8080...")
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("HTTP server failed: %v", err)
+	log.Println("Shutting down gracefully...")
+	cancel()
+	httpServer.Close()
+	if srv.raft != nil {
+		srv.raft.Stop()
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
+	if memcacheServer != nil {
+		memcacheServer.Close()
 	}
+	mgr.Stop()
+	log.Println("AOF flushed. Goodbye!")
 }
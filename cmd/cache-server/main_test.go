@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/client"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/raft"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/shard"
+)
+
+func newTestServer(t *testing.T, aofPath string) (*shard.CacheManager[string, []byte], *httptest.Server) {
+	t.Helper()
+
+	mgr, err := shard.NewCacheManager[string, []byte](4, 100, 3, aofPath, 0)
+	if err != nil {
+		t.Fatalf("NewCacheManager: %v", err)
+	}
+	if _, err := mgr.LoadAOF(); err != nil {
+		t.Fatalf("LoadAOF: %v", err)
+	}
+
+	ts := httptest.NewServer((&Server{cache: mgr}).routes())
+	t.Cleanup(ts.Close)
+	return mgr, ts
+}
+
+func fetch(t *testing.T, url string) []byte {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return body
+}
+
+// Values must come back from the AOF as the exact bytes that were written, and
+// every read API must answer identically before a crash and after recovery.
+func TestRecovery_ResponsesAreByteIdentical(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+	mgr, ts := newTestServer(t, aofPath)
+
+	values := map[string][]byte{
+		"text":   []byte("Batman"),
+		"json":   []byte(`{"id":1,"gpa":3.8000000000000003,"name":"Bruce"}`),
+		"binary": {0x00, 0xff, 0x10, '|', '\n', 0x80, 0x00},
+		"number": []byte("12345678901234567890"),
+		"empty":  {},
+	}
+
+	for key, value := range values {
+		payload, _ := json.Marshal(setPayload{Key: key, Value: value, TTL: 3600})
+		resp, err := http.Post(ts.URL+"/set", "application/json", bytes.NewReader(payload))
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /set %s: %v %v", key, err, resp.StatusCode)
+		}
+		resp.Body.Close()
+
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/keys/raw-"+key, bytes.NewReader(value))
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("PUT /keys/raw-%s: %v %v", key, err, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+
+	before := make(map[string][]byte)
+	for key := range values {
+		before["/get?key="+key] = fetch(t, ts.URL+"/get?key="+key)
+		before["/keys/raw-"+key] = fetch(t, ts.URL+"/keys/raw-"+key)
+	}
+
+	// Live entries hold exactly the bytes that were sent
+	for key, value := range values {
+		if got, _ := mgr.Get(key); !bytes.Equal(got, value) {
+			t.Errorf("Live value of %s is %q, want %q", key, got, value)
+		}
+	}
+
+	// Flush the AOF and "restart"
+	mgr.Stop()
+	ts.Close()
+	recovered, ts := newTestServer(t, aofPath)
+	defer recovered.Stop()
+
+	for key, value := range values {
+		got, found := recovered.Get(key)
+		if !found {
+			t.Fatalf("%s was not recovered", key)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Recovered value of %s is %#v, want %#v", key, got, value)
+		}
+	}
+
+	for path, want := range before {
+		if got := fetch(t, ts.URL+path); !bytes.Equal(got, want) {
+			t.Errorf("GET %s after recovery returned %q, before the crash %q", path, got, want)
+		}
+	}
+}
+
+func TestServer_UnavailableUntilRecovered(t *testing.T) {
+	mgr, err := shard.NewCacheManager[string, []byte](4, 100, 3, filepath.Join(t.TempDir(), "cache.aof"), 0)
+	if err != nil {
+		t.Fatalf("NewCacheManager: %v", err)
+	}
+	defer mgr.Stop()
+	ts := httptest.NewServer((&Server{cache: mgr}).routes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("GET /ready before recovery: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if _, err := mgr.LoadAOF(); err != nil {
+		t.Fatalf("LoadAOF: %v", err)
+	}
+	fetch(t, ts.URL+"/ready")
+}
+
+func TestServer_Replica(t *testing.T) {
+	primary, primaryTS := newTestServer(t, "")
+	primary.Set("before", []byte("1"), time.Hour)
+
+	replica, err := shard.NewCacheManager[string, []byte](4, 100, 3, "", 0)
+	if err != nil {
+		t.Fatalf("NewCacheManager: %v", err)
+	}
+	replica.LoadAOF()
+	defer replica.Stop()
+	srv := &Server{cache: replica, replicaOf: primaryTS.URL}
+	replicaTS := httptest.NewServer(srv.routes())
+	defer replicaTS.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.followPrimary(ctx)
+
+	req, _ := http.NewRequest(http.MethodPut, primaryTS.URL+"/keys/after", bytes.NewReader([]byte("2")))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(replicaTS.URL + "/keys/after")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the replica to catch up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fetch(t, replicaTS.URL+"/keys/before"); string(got) != "1" {
+		t.Errorf("GET /keys/before on the replica = %q, want the snapshot's value", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, replicaTS.URL+"/keys/x", bytes.NewReader([]byte("3")))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT on the replica: status %d, want 403", resp.StatusCode)
+	}
+
+	var stats struct {
+		Replication struct {
+			Role          string `json:"role"`
+			Offset        uint64 `json:"offset"`
+			PrimaryOffset uint64 `json:"primary_offset"`
+			Connected     bool   `json:"connected"`
+		} `json:"replication"`
+	}
+	json.Unmarshal(fetch(t, replicaTS.URL+"/stats"), &stats)
+	if r := stats.Replication; r.Role != "replica" || r.Offset != 2 || r.PrimaryOffset != 2 || !r.Connected {
+		t.Errorf("Unexpected replication stats %+v", r)
+	}
+}
+
+func TestServer_RaftCluster(t *testing.T) {
+	// Listeners first, since every node needs the others' addresses
+	servers := make([]*httptest.Server, 3)
+	ids := make([]string, 3)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		ids[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	nodes := make([]*raft.Node, 3)
+	caches := make([]*shard.CacheManager[string, []byte], 3)
+	for i := range servers {
+		var peers []string
+		for j, id := range ids {
+			if j != i {
+				peers = append(peers, id)
+			}
+		}
+		caches[i], _ = shard.NewCacheManager[string, []byte](4, 100, 3, "", 0)
+		node, err := raft.NewNode(raft.Config{
+			ID:                ids[i],
+			Peers:             peers,
+			Dir:               t.TempDir(),
+			Transport:         raft.NewHTTPTransport(),
+			FSM:               caches[i],
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+		servers[i].Config.Handler = (&Server{cache: caches[i], raft: node}).routes()
+		servers[i].Start()
+		node.Start()
+		defer servers[i].Close()
+		defer node.Stop()
+	}
+
+	// Every node takes writes, followers by redirecting to the leader
+	for i, ts := range servers {
+		var resp *http.Response
+		var err error
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/keys/k%d", ts.URL, i), bytes.NewReader([]byte("v")))
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil && resp.StatusCode != http.StatusServiceUnavailable || time.Now().After(deadline) {
+				break
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			time.Sleep(20 * time.Millisecond) // no leader elected yet
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("PUT via node %d: status %d", i, resp.StatusCode)
+		}
+	}
+
+	// A write is acknowledged once a quorum has it, so the rest may lag a little
+	deadline := time.Now().Add(5 * time.Second)
+	for i, cache := range caches {
+		for !cache.Exists("k0") || !cache.Exists("k1") || !cache.Exists("k2") {
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %d is missing writes: %+v", i, nodes[i].Status())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var stats struct {
+		Raft struct {
+			State  string `json:"state"`
+			Leader string `json:"leader"`
+		} `json:"raft"`
+	}
+	json.Unmarshal(fetch(t, servers[0].URL+"/stats"), &stats)
+	if stats.Raft.Leader == "" || stats.Raft.State == "" {
+		t.Errorf("Unexpected raft stats %+v", stats.Raft)
+	}
+	resp, err := http.Get(servers[0].URL + "/compact")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /compact: %v %v", err, resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestServer_Distribution(t *testing.T) {
+	mgr, ts := newTestServer(t, "")
+	defer mgr.Stop()
+	for i := 0; i < 100; i++ {
+		mgr.Set(fmt.Sprintf("key-%d", i), []byte("v"), 0)
+	}
+
+	var report struct {
+		Strategy  string    `json:"strategy"`
+		Shards    int       `json:"shards"`
+		Replicas  int       `json:"replicas"`
+		Ownership []float64 `json:"ownership_pct"`
+		Items     struct {
+			Counts []int `json:"counts"`
+			Total  int   `json:"total"`
+		} `json:"items"`
+		Simulated struct {
+			Total     int     `json:"total"`
+			RelStdDev float64 `json:"rel_stddev"`
+		} `json:"simulated"`
+		WhatIf *struct {
+			Replicas  int `json:"replicas"`
+			Simulated struct {
+				RelStdDev float64 `json:"rel_stddev"`
+			} `json:"simulated"`
+		} `json:"what_if"`
+	}
+	if err := json.Unmarshal(fetch(t, ts.URL+"/admin/distribution?sample=20000&replicas=100"), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Strategy != "ring" || report.Shards != 4 || report.Replicas != 3 || len(report.Ownership) != 4 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if report.Items.Total != 100 || len(report.Items.Counts) != 4 || report.Simulated.Total != 20000 {
+		t.Errorf("Unexpected counts %+v, %+v", report.Items, report.Simulated)
+	}
+	if report.WhatIf == nil || report.WhatIf.Replicas != 100 || report.WhatIf.Simulated.RelStdDev >= report.Simulated.RelStdDev {
+		t.Errorf("Expected a better spread from 100 replicas, got %+v", report.WhatIf)
+	}
+
+	for _, sample := range []int{0, maxDistributionSample + 1} {
+		resp, err := http.Get(fmt.Sprintf("%s/admin/distribution?sample=%d", ts.URL, sample))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected a sample of %d to be refused, got %d", sample, resp.StatusCode)
+		}
+	}
+}
+
+func TestServer_Batches(t *testing.T) {
+	mgr, ts := newTestServer(t, "")
+	defer mgr.Stop()
+	c := client.NewClient(ts.URL)
+
+	type user struct{ ID int }
+	items := make(map[string]any)
+	var keys []string
+	for i := 0; i < 80; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		items[key] = user{ID: i}
+		keys = append(keys, key)
+	}
+	if err := c.SetMany(items, time.Hour); err != nil {
+		t.Fatalf("SetMany: %v", err)
+	}
+	if ttl, found := mgr.TTL("user:7"); !found || ttl <= 59*time.Minute {
+		t.Errorf("Expected user:7 to live for an hour, got %v, %v", ttl, found)
+	}
+
+	users, missing, err := client.GetManyAs[user](c, append([]string{"user:absent"}, keys...))
+	if err != nil {
+		t.Fatalf("GetManyAs: %v", err)
+	}
+	if len(users) != len(keys) || users["user:79"].ID != 79 {
+		t.Errorf("GetManyAs found %d users, user:79 = %+v", len(users), users["user:79"])
+	}
+	if len(missing) != 1 || missing[0] != "user:absent" {
+		t.Errorf("Expected only user:absent missing, got %v", missing)
+	}
+
+	deleted, missing, err := c.DeleteMany([]string{"user:1", "user:absent", "user:1"})
+	if err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "user:1" || len(missing) != 2 {
+		t.Errorf("DeleteMany = %v deleted, %v missing", deleted, missing)
+	}
+	if mgr.Exists("user:1") || mgr.Len() != len(keys)-1 {
+		t.Errorf("Expected only user:1 to be deleted, %d entries left", mgr.Len())
+	}
+
+	resp, err := http.Get(ts.URL + "/mget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected /mget without keys to be refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+// Command placement-report compares the placement strategies on simulated
+// keys: how evenly each spreads them over the nodes, and how many move when a
+// node is added at the end or the last one removed.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "placement-report: %v\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// strategy is a row of the report.
+type strategy struct {
+	name string
+	new  func(nodes []placement.Node) placement.Placement
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("placement-report", flag.ContinueOnError)
+	nodeCount := fs.Int("nodes", 32, "Number of nodes or shards")
+	keyCount := fs.Int("keys", 1000000, "Number of simulated keys")
+	replicas := fs.Int("replicas", 3, "Points per node for the extra ring row, e.g. the server's shardReplica")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *nodeCount < 2 || *keyCount < 1 || *replicas < 1 {
+		return errors.New("need at least 2 nodes, 1 key and 1 replica")
+	}
+
+	nodes := make([]placement.Node, *nodeCount+1) // the last one is the node added
+	for i := range nodes {
+		nodes[i] = placement.Node{Name: "shard-" + strconv.Itoa(i)}
+	}
+	hashes := make([]uint64, *keyCount)
+	for i := range hashes {
+		hashes[i] = placement.Hash("key-" + strconv.Itoa(i))
+	}
+
+	rows := []strategy{{name: fmt.Sprintf("ring/%d", *replicas), new: func(nodes []placement.Node) placement.Placement {
+		return placement.NewRing(nodes, *replicas)
+	}}}
+	for _, s := range []placement.Strategy{placement.StrategyRing, placement.StrategyJump, placement.StrategyRendezvous, placement.StrategyMaglev} {
+		name := string(s)
+		if s == placement.StrategyRing {
+			name += "/" + strconv.Itoa(placement.DefaultReplicas)
+		}
+		rows = append(rows, strategy{name: name, new: func(nodes []placement.Node) placement.Placement {
+			p, _ := placement.New(s, nodes)
+			return p
+		}})
+	}
+
+	n := *nodeCount
+	fmt.Fprintf(out, "%d keys over %d nodes; ideal remap is %.2f%% when adding a node, %.2f%% when removing one\n\n",
+		*keyCount, n, 100/float64(n+1), 100/float64(n))
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "strategy\tstddev\tmin/mean\tmax/mean\tadd remap\tremove remap\t")
+	for _, row := range rows {
+		base, grown, shrunk := row.new(nodes[:n]), row.new(nodes), row.new(nodes[:n-1])
+		d := placement.Summarize(placement.Spread(base, n, hashes))
+		fmt.Fprintf(tw, "%s\t%.2f%%\t%.2f\t%.2f\t%.2f%%\t%.2f%%\t\n", row.name,
+			100*d.RelStdDev, float64(d.Min)/d.Mean, float64(d.Max)/d.Mean,
+			100*placement.Remapped(base, nodes[:n], grown, nodes, hashes),
+			100*placement.Remapped(base, nodes[:n], shrunk, nodes[:n-1], hashes))
+	}
+	return tw.Flush()
+}
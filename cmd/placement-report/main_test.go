@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun_ReportsEveryStrategy(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"-nodes", "8", "-keys", "20000", "-replicas", "3"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []string{"ring/3", "ring/160", "jump", "rendezvous", "maglev"} {
+		if !strings.Contains(out.String(), row+"  ") {
+			t.Errorf("Expected a row for %s in\n%s", row, out.String())
+		}
+	}
+}
+
+func TestRun_RejectsTooFewNodes(t *testing.T) {
+	if err := run([]string{"-nodes", "1"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected a single node to be refused")
+	}
+}
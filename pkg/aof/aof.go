@@ -0,0 +1,479 @@
+// Package aof encodes and decodes the records of the cache's append-only file.
+//
+// Files come in two formats. A binary file starts with Header and holds
+// length-prefixed records:
+//
+//	op (1 byte) | uvarint len | key | [uvarint len | value | varint unixExpiry] | crc
+//
+// where the value and expiry are only present for SET and crc is the CRC32C of
+// everything before it, little endian.
+//
+// A hybrid file starts with a snapshot (see SnapshotWriter) and carries on
+// with binary records after it, like Redis' RDB preamble.
+//
+// A text file has no header and one record per line:
+//
+//	SET|base64(key)|base64(value)|unixExpiry|crc
+//	DEL|base64(key)|crc
+//
+// where crc is the CRC32C of everything before the last '|', as 8 hex digits.
+// Lines written before checksums were introduced have no crc field and are
+// still accepted, unverified. Text is the original format and is kept so old
+// files stay readable.
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// Format identifies how the records of a file are encoded.
+type Format uint8
+
+const (
+	FormatText Format = iota
+	FormatBinary
+	// FormatHybrid is a snapshot preamble followed by binary records. Records
+	// appended to a hybrid file are encoded exactly as for FormatBinary.
+	FormatHybrid
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatText:
+		return "text"
+	case FormatBinary:
+		return "binary"
+	case FormatHybrid:
+		return "hybrid"
+	default:
+		return fmt.Sprintf("Format(%d)", uint8(f))
+	}
+}
+
+// ParseFormat converts "text", "binary" or "hybrid" into a Format.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return FormatText, nil
+	case "binary":
+		return FormatBinary, nil
+	case "hybrid":
+		return FormatHybrid, nil
+	default:
+		return 0, fmt.Errorf("unknown AOF format %q", name)
+	}
+}
+
+// Version is the binary format version written into Header.
+const Version = 1
+
+const magic = "LRUCAOF"
+
+// Header starts every binary file: a magic string followed by the format version.
+var Header = []byte(magic + string(rune(Version)))
+
+// MaxRecordSize bounds the key and value lengths a binary record may declare,
+// so a damaged length can't make the reader allocate without limit.
+const MaxRecordSize = 1 << 30
+
+// Detect reports the format of a file that starts with prefix, which should be
+// at least len(Header) bytes unless the file is shorter.
+func Detect(prefix []byte) Format {
+	switch {
+	case bytes.HasPrefix(prefix, []byte(magic)):
+		return FormatBinary
+	case bytes.HasPrefix(prefix, []byte(snapshotMagic)):
+		return FormatHybrid
+	default:
+		return FormatText
+	}
+}
+
+// Op is the kind of change a record describes.
+type Op byte
+
+const (
+	OpSet Op = iota + 1
+	OpDel
+)
+
+// opSetMillis is the opcode binary records are written with for OpSet. Their
+// expiry is in Unix milliseconds; records with OpSet's own opcode come from
+// earlier builds, hold Unix seconds, and are scaled up as they are read. Text
+// records mark the new unit with an "ms" suffix on the expiry instead.
+const opSetMillis = 3
+
+// legacyExpiry converts an expiry in Unix seconds, as earlier builds wrote
+// them, to milliseconds.
+func legacyExpiry(seconds int64) int64 {
+	return seconds * 1000
+}
+
+func (op Op) String() string {
+	switch op {
+	case OpSet:
+		return "SET"
+	case OpDel:
+		return "DEL"
+	default:
+		return fmt.Sprintf("Op(%d)", byte(op))
+	}
+}
+
+// Record is a single AOF entry. Key and Value hold the encoded key and value
+// exactly as the cache serialised them; the aof package doesn't interpret them.
+type Record struct {
+	Op        Op
+	Key       []byte
+	Value     []byte
+	ExpiresAt int64 // Unix milliseconds, 0 for entries that never expire
+}
+
+var (
+	// ErrTorn means nothing from this point on can be read as records: the file
+	// ends part way through a record, typically because the process died
+	// mid-write, or a binary record's framing is damaged so the next one can't
+	// be found.
+	ErrTorn = errors.New("aof: torn record at end of file")
+	// ErrChecksum means a record's contents don't match its checksum.
+	ErrChecksum = errors.New("aof: checksum mismatch")
+	// ErrMalformed means a record couldn't be parsed at all.
+	ErrMalformed = errors.New("aof: malformed record")
+)
+
+// RecordError reports a bad record and where it starts in the file.
+type RecordError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32C of b, the checksum used for every record.
+func Checksum(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+// AppendRecord appends rec, encoded in the given format, to dst and returns the
+// result.
+func AppendRecord(dst []byte, format Format, rec Record) []byte {
+	if format == FormatText {
+		return appendText(dst, rec)
+	}
+	return appendBinary(dst, rec)
+}
+
+// DecodeRecord decodes b, which must hold exactly one binary record as
+// AppendRecord writes it, checksum included. It is for records framed by
+// something other than an AOF file, such as a replication stream.
+func DecodeRecord(b []byte) (Record, error) {
+	if len(b) < 4 {
+		return Record{}, ErrMalformed
+	}
+	body, sum := b[:len(b)-4], b[len(b)-4:]
+	if Checksum(body) != binary.LittleEndian.Uint32(sum) {
+		return Record{}, ErrChecksum
+	}
+	return parseBinary(body)
+}
+
+func appendBinary(dst []byte, rec Record) []byte {
+	start := len(dst)
+	op := byte(rec.Op)
+	if rec.Op == OpSet {
+		op = opSetMillis
+	}
+	dst = append(dst, op)
+	dst = binary.AppendUvarint(dst, uint64(len(rec.Key)))
+	dst = append(dst, rec.Key...)
+	if rec.Op == OpSet {
+		dst = binary.AppendUvarint(dst, uint64(len(rec.Value)))
+		dst = append(dst, rec.Value...)
+		dst = binary.AppendVarint(dst, rec.ExpiresAt)
+	}
+	return binary.LittleEndian.AppendUint32(dst, Checksum(dst[start:]))
+}
+
+func appendText(dst []byte, rec Record) []byte {
+	start := len(dst)
+	dst = append(dst, rec.Op.String()...)
+	dst = append(dst, '|')
+	dst = base64.StdEncoding.AppendEncode(dst, rec.Key)
+	if rec.Op == OpSet {
+		dst = append(dst, '|')
+		dst = base64.StdEncoding.AppendEncode(dst, rec.Value)
+		dst = append(dst, '|')
+		dst = strconv.AppendInt(dst, rec.ExpiresAt, 10)
+		dst = append(dst, "ms"...)
+	}
+	dst = fmt.Appendf(dst, "|%08x\n", Checksum(dst[start:]))
+	return dst
+}
+
+// Reader reads records one at a time from an AOF.
+type Reader struct {
+	r      *bufio.Reader
+	off    int64
+	format Format
+	err    error // sticky error from the header or a torn record
+
+	preamble     bool   // still inside a hybrid file's snapshot
+	snapshotOnly bool   // report io.EOF at the end of the snapshot
+	count        uint64 // records read from the snapshot so far
+
+	sealer *Sealer // opens sealed records
+	stale  uint64  // records not encrypted with the sealer's current key
+}
+
+// NewReader returns a Reader that decodes records from r, working out the
+// format from the start of the file.
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReader(r)
+	reader := &Reader{r: br}
+
+	prefix, _ := br.Peek(len(Header))
+	if reader.format = Detect(prefix); reader.format == FormatText {
+		return reader
+	}
+	if len(prefix) < len(Header) {
+		reader.err = &RecordError{Offset: 0, Err: ErrTorn}
+		return reader
+	}
+	if v := prefix[len(Header)-1]; v != Version {
+		reader.err = fmt.Errorf("aof: unsupported %v format version %d", reader.format, v)
+		return reader
+	}
+	br.Discard(len(Header))
+	reader.off = int64(len(Header))
+	reader.preamble = reader.format == FormatHybrid
+	return reader
+}
+
+// SetSealer gives the Reader the keys to open encrypted records. Compressed
+// records that aren't encrypted can be read without one.
+func (r *Reader) SetSealer(s *Sealer) {
+	r.sealer = s
+}
+
+// Stale returns how many of the records read so far were not encrypted with
+// the Sealer's current key: encrypted with an older one, or not at all. It is
+// always 0 when the Sealer doesn't encrypt. A rewrite brings them up to date.
+func (r *Reader) Stale() uint64 {
+	return r.stale
+}
+
+// Format returns the format the file was detected as.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Offset returns the number of bytes consumed so far, which is where the next
+// record starts.
+func (r *Reader) Offset() int64 {
+	return r.off
+}
+
+// Next returns the next record, or io.EOF once the file has been read cleanly
+// to the end. A bad record is reported as a *RecordError wrapping ErrTorn,
+// ErrChecksum or ErrMalformed. After ErrChecksum or ErrMalformed the Reader has
+// moved past the record, so the caller may carry on with the next one; ErrTorn
+// is always the last thing returned.
+func (r *Reader) Next() (Record, error) {
+	if r.err != nil {
+		return Record{}, r.err
+	}
+	if r.format == FormatText {
+		return r.nextText()
+	}
+
+	for {
+		rec, err := r.nextBinary()
+		if errors.Is(err, ErrTorn) {
+			r.err = err
+		}
+		if err == errSnapshotEnd {
+			if r.snapshotOnly {
+				r.err = io.EOF
+				return Record{}, io.EOF
+			}
+			continue
+		}
+		return rec, err
+	}
+}
+
+func (r *Reader) nextBinary() (Record, error) {
+	start := r.off
+	torn := &RecordError{Offset: start, Err: ErrTorn}
+
+	op, err := r.r.ReadByte()
+	if err == io.EOF {
+		if r.preamble {
+			// The snapshot never finished
+			return Record{}, torn
+		}
+		return Record{}, io.EOF
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	if r.preamble && op == opSnapshotEnd {
+		return Record{}, r.endSnapshot(start)
+	}
+	if op == opSealed {
+		rec, err := r.nextSealed(start)
+		if err == nil && r.preamble {
+			r.count++
+		}
+		return rec, err
+	}
+	rec := Record{Op: Op(op)}
+	if op == opSetMillis {
+		rec.Op = OpSet
+	}
+	if rec.Op != OpSet && (rec.Op != OpDel || r.preamble) {
+		return Record{}, torn
+	}
+	body := []byte{op}
+
+	if body, rec.Key, err = r.readBytes(body); err != nil {
+		return Record{}, torn
+	}
+	if rec.Op == OpSet {
+		if body, rec.Value, err = r.readBytes(body); err != nil {
+			return Record{}, torn
+		}
+		if rec.ExpiresAt, err = binary.ReadVarint(r.r); err != nil {
+			return Record{}, torn
+		}
+		body = binary.AppendVarint(body, rec.ExpiresAt)
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r.r, sum[:]); err != nil {
+		return Record{}, torn
+	}
+	r.off += int64(len(body) + len(sum))
+
+	if Checksum(body) != binary.LittleEndian.Uint32(sum[:]) {
+		return Record{}, &RecordError{Offset: start, Err: ErrChecksum}
+	}
+	if op == byte(OpSet) {
+		rec.ExpiresAt = legacyExpiry(rec.ExpiresAt)
+	}
+	if r.preamble {
+		r.count++
+	}
+	if r.sealer.Encrypts() {
+		r.stale++
+	}
+	return rec, nil
+}
+
+// readBytes reads a length-prefixed field, appending its encoding to body. The
+// returned field is a fresh slice the caller may keep.
+func (r *Reader) readBytes(body []byte) ([]byte, []byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return body, nil, err
+	}
+	if n > MaxRecordSize {
+		return body, nil, ErrMalformed
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r.r, field); err != nil {
+		return body, nil, err
+	}
+	body = binary.AppendUvarint(body, n)
+	return append(body, field...), field, nil
+}
+
+func (r *Reader) nextText() (Record, error) {
+	start := r.off
+	line, err := r.r.ReadBytes('\n')
+	r.off += int64(len(line))
+	if err == io.EOF {
+		if len(line) == 0 {
+			return Record{}, io.EOF
+		}
+		return Record{}, &RecordError{Offset: start, Err: ErrTorn}
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec, err := parseLine(line[:len(line)-1])
+	if err != nil {
+		return Record{}, &RecordError{Offset: start, Err: err}
+	}
+	if r.sealer.Encrypts() {
+		r.stale++
+	}
+	return rec, nil
+}
+
+func parseLine(line []byte) (Record, error) {
+	parts := bytes.Split(line, []byte("|"))
+
+	var op Op
+	var fields int
+	switch string(parts[0]) {
+	case "SET":
+		op, fields = OpSet, 4
+	case "DEL":
+		op, fields = OpDel, 2
+	default:
+		return Record{}, ErrMalformed
+	}
+
+	switch len(parts) {
+	case fields + 1:
+		want, err := strconv.ParseUint(string(parts[fields]), 16, 32)
+		if err != nil || len(parts[fields]) != 8 {
+			return Record{}, ErrMalformed
+		}
+		body := line[:len(line)-len(parts[fields])-1]
+		if Checksum(body) != uint32(want) {
+			return Record{}, ErrChecksum
+		}
+	case fields:
+		// A record from before checksums; nothing to verify it against
+	default:
+		return Record{}, ErrMalformed
+	}
+
+	rec := Record{Op: op}
+	var err error
+	if rec.Key, err = base64.StdEncoding.DecodeString(string(parts[1])); err != nil {
+		return Record{}, ErrMalformed
+	}
+	if op == OpSet {
+		if rec.Value, err = base64.StdEncoding.DecodeString(string(parts[2])); err != nil {
+			return Record{}, ErrMalformed
+		}
+		expiry, millis := bytes.CutSuffix(parts[3], []byte("ms"))
+		if rec.ExpiresAt, err = strconv.ParseInt(string(expiry), 10, 64); err != nil {
+			return Record{}, ErrMalformed
+		}
+		if !millis {
+			rec.ExpiresAt = legacyExpiry(rec.ExpiresAt)
+		}
+	}
+	return rec, nil
+}
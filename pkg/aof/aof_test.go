@@ -0,0 +1,191 @@
+package aof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+var formats = []Format{FormatText, FormatBinary}
+
+// encode builds a whole file, header included, from records.
+func encode(format Format, records ...Record) []byte {
+	var buf []byte
+	if format == FormatBinary {
+		buf = append(buf, Header...)
+	}
+	for _, rec := range records {
+		buf = AppendRecord(buf, format, rec)
+	}
+	return buf
+}
+
+func TestRecord_RoundTrip(t *testing.T) {
+	records := []Record{
+		{Op: OpSet, Key: []byte(`"user:1"`), Value: []byte(`{"name":"a|b\nc"}`), ExpiresAt: 1700000000123},
+		{Op: OpSet, Key: []byte("raw"), Value: []byte{0, 0xff, '\n', '|'}},
+		{Op: OpSet, Key: []byte{}, Value: []byte{}, ExpiresAt: -1},
+		{Op: OpDel, Key: []byte(`"user:1"`)},
+	}
+
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			buf := encode(format, records...)
+
+			r := NewReader(bytes.NewReader(buf))
+			if r.Format() != format {
+				t.Fatalf("Detected %v, want %v", r.Format(), format)
+			}
+			for i, want := range records {
+				got, err := r.Next()
+				if err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+				if got.Op != want.Op || !bytes.Equal(got.Key, want.Key) || !bytes.Equal(got.Value, want.Value) || got.ExpiresAt != want.ExpiresAt {
+					t.Errorf("record %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF after the last record, got %v", err)
+			}
+			if r.Offset() != int64(len(buf)) {
+				t.Errorf("Offset = %d, want %d", r.Offset(), len(buf))
+			}
+		})
+	}
+}
+
+func TestRecord_BinaryIsSmaller(t *testing.T) {
+	rec := Record{Op: OpSet, Key: []byte("session:12345"), Value: bytes.Repeat([]byte("x"), 256), ExpiresAt: 1700000000}
+
+	text := len(AppendRecord(nil, FormatText, rec))
+	bin := len(AppendRecord(nil, FormatBinary, rec))
+	if bin >= text*3/4 {
+		t.Errorf("Expected the binary record (%d bytes) to be well under the text one (%d bytes)", bin, text)
+	}
+}
+
+func TestReader_AcceptsRecordsWithoutChecksum(t *testing.T) {
+	// "k" and "v" as written before checksums were added
+	r := NewReader(bytes.NewReader([]byte("SET|Imsi|InYi|0\nDEL|Imsi\n")))
+
+	set, err := r.Next()
+	if err != nil || set.Op != OpSet || string(set.Key) != `"k"` || string(set.Value) != `"v"` {
+		t.Fatalf("Next() = %+v, %v", set, err)
+	}
+	del, err := r.Next()
+	if err != nil || del.Op != OpDel || string(del.Key) != `"k"` {
+		t.Fatalf("Next() = %+v, %v", del, err)
+	}
+}
+
+func TestReader_DetectsBadRecords(t *testing.T) {
+	rec := Record{Op: OpSet, Key: []byte(`"a"`), Value: []byte(`1`)}
+
+	for _, format := range formats {
+		good := encode(format, rec)
+		encoded := AppendRecord(nil, format, rec)
+
+		flipped := bytes.Clone(encoded)
+		flipped[len(flipped)-6] ^= 0x01
+
+		type badRecord struct {
+			name string
+			data []byte
+			want error
+		}
+		// Damaged binary framing can't be stepped over, so it ends the file
+		garbage := badRecord{"malformed", []byte("BOGUS|record\n"), ErrMalformed}
+		if format == FormatBinary {
+			garbage = badRecord{"bad opcode", []byte{0x7f, 1, 'a'}, ErrTorn}
+		}
+
+		tests := []badRecord{
+			{"checksum", flipped, ErrChecksum},
+			{"torn", encoded[:len(encoded)-3], ErrTorn},
+			garbage,
+		}
+
+		for _, tt := range tests {
+			t.Run(format.String()+"/"+tt.name, func(t *testing.T) {
+				r := NewReader(bytes.NewReader(append(bytes.Clone(good), tt.data...)))
+				if _, err := r.Next(); err != nil {
+					t.Fatalf("first record: %v", err)
+				}
+
+				_, err := r.Next()
+				var recErr *RecordError
+				if !errors.As(err, &recErr) || !errors.Is(err, tt.want) {
+					t.Fatalf("Expected a RecordError wrapping %v, got %v", tt.want, err)
+				}
+				if recErr.Offset != int64(len(good)) {
+					t.Errorf("Offset = %d, want %d", recErr.Offset, len(good))
+				}
+			})
+		}
+	}
+}
+
+func TestReader_SkipsPastChecksumMismatch(t *testing.T) {
+	a := Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")}
+	b := Record{Op: OpDel, Key: []byte("b")}
+
+	buf := encode(FormatBinary, a, b)
+	buf[len(Header)+4] ^= 0xff // a's value byte
+
+	r := NewReader(bytes.NewReader(buf))
+	if _, err := r.Next(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Expected ErrChecksum, got %v", err)
+	}
+	if got, err := r.Next(); err != nil || got.Op != OpDel || string(got.Key) != "b" {
+		t.Errorf("Next() after a checksum mismatch = %+v, %v", got, err)
+	}
+}
+
+func TestReader_UnsupportedVersion(t *testing.T) {
+	header := bytes.Clone(Header)
+	header[len(header)-1] = Version + 1
+
+	if _, err := NewReader(bytes.NewReader(header)).Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected an error for an unknown version, got %v", err)
+	}
+}
+
+func TestReader_ScalesExpiryInSeconds(t *testing.T) {
+	// SETs as written when expiries were stored in Unix seconds
+	legacy := []byte{byte(OpSet), 1, 'k', 1, 'v'}
+	legacy = binary.AppendVarint(legacy, 1700000000)
+	legacy = binary.LittleEndian.AppendUint32(legacy, Checksum(legacy))
+	line := []byte("SET|Imsi|InYi|1700000000")
+	line = fmt.Appendf(line, "|%08x\n", Checksum(line))
+
+	for name, file := range map[string][]byte{"binary": append(bytes.Clone(Header), legacy...), "text": line} {
+		rec, err := NewReader(bytes.NewReader(file)).Next()
+		if err != nil || rec.Op != OpSet || rec.ExpiresAt != 1700000000000 {
+			t.Errorf("%s: Next() = %+v, %v, want the expiry in milliseconds", name, rec, err)
+		}
+	}
+	if rec, err := DecodeRecord(legacy); err != nil || rec.ExpiresAt != 1700000000000 {
+		t.Errorf("DecodeRecord = %+v, %v, want the expiry in milliseconds", rec, err)
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	want := Record{Op: OpSet, Key: []byte("k"), Value: []byte("v"), ExpiresAt: 42}
+	buf := AppendRecord(nil, FormatBinary, want)
+
+	got, err := DecodeRecord(buf)
+	if err != nil || string(got.Key) != "k" || string(got.Value) != "v" || got.ExpiresAt != 42 {
+		t.Fatalf("DecodeRecord = %+v, %v", got, err)
+	}
+	buf[2] ^= 0xff
+	if _, err := DecodeRecord(buf); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected ErrChecksum, got %v", err)
+	}
+	if _, err := DecodeRecord(append(AppendRecord(nil, FormatBinary, want), 0)); err == nil {
+		t.Error("Expected an error for trailing bytes")
+	}
+}
@@ -0,0 +1,141 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A segmented AOF is a directory of files listed in a manifest, like Redis 7's
+// multi-part AOF: at most one base segment holding a rewrite of the whole
+// cache, then increment segments holding the records appended since, in
+// sequence order. Each segment is a complete file in one of the formats above,
+// so a damaged segment can be recovered without touching the others.
+//
+// The manifest has one line per segment:
+//
+//	file cache.aof.2.base type b seq 2
+//	file cache.aof.7.incr type i seq 7
+
+// SegmentType tells base segments from increments.
+type SegmentType byte
+
+const (
+	SegmentBase SegmentType = 'b'
+	SegmentIncr SegmentType = 'i'
+)
+
+// Segment is one file of a segmented AOF.
+type Segment struct {
+	Name string
+	Type SegmentType
+	Seq  int
+}
+
+// Manifest lists the segments of an AOF in replay order.
+type Manifest struct {
+	Segments []Segment
+}
+
+// SegmentName returns the file name for a segment of the AOF called prefix.
+func SegmentName(prefix string, t SegmentType, seq int) string {
+	if t == SegmentBase {
+		return fmt.Sprintf("%s.%d.base", prefix, seq)
+	}
+	return fmt.Sprintf("%s.%d.incr", prefix, seq)
+}
+
+// ManifestName returns the manifest's file name for the AOF called prefix.
+func ManifestName(prefix string) string {
+	return prefix + ".manifest"
+}
+
+// Base returns the base segment, if there is one.
+func (m *Manifest) Base() (Segment, bool) {
+	for _, s := range m.Segments {
+		if s.Type == SegmentBase {
+			return s, true
+		}
+	}
+	return Segment{}, false
+}
+
+// LastIncr returns the newest increment, the one records are appended to.
+func (m *Manifest) LastIncr() (Segment, bool) {
+	for i := len(m.Segments) - 1; i >= 0; i-- {
+		if m.Segments[i].Type == SegmentIncr {
+			return m.Segments[i], true
+		}
+	}
+	return Segment{}, false
+}
+
+// ReadManifest parses the manifest at path.
+func ReadManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &Manifest{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 || fields[0] != "file" || fields[2] != "type" || fields[4] != "seq" || len(fields[3]) != 1 {
+			return nil, fmt.Errorf("aof: manifest %s line %d: malformed", path, line)
+		}
+		seq, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("aof: manifest %s line %d: bad seq: %w", path, line, err)
+		}
+		t := SegmentType(fields[3][0])
+		if t != SegmentBase && t != SegmentIncr {
+			return nil, fmt.Errorf("aof: manifest %s line %d: unknown segment type %q", path, line, fields[3])
+		}
+		m.Segments = append(m.Segments, Segment{Name: fields[1], Type: t, Seq: seq})
+	}
+	return m, scanner.Err()
+}
+
+// WriteManifest replaces the manifest at path atomically, so a crash leaves
+// either the old list of segments or the new one.
+func WriteManifest(path string, m *Manifest) error {
+	var b strings.Builder
+	for _, s := range m.Segments {
+		fmt.Fprintf(&b, "file %s type %c seq %d\n", s.Name, s.Type, s.Seq)
+	}
+
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(b.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
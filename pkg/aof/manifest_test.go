@@ -0,0 +1,49 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ManifestName("cache.aof"))
+	want := &Manifest{Segments: []Segment{
+		{Name: SegmentName("cache.aof", SegmentBase, 2), Type: SegmentBase, Seq: 2},
+		{Name: SegmentName("cache.aof", SegmentIncr, 6), Type: SegmentIncr, Seq: 6},
+		{Name: SegmentName("cache.aof", SegmentIncr, 7), Type: SegmentIncr, Seq: 7},
+	}}
+
+	if err := WriteManifest(path, want); err != nil {
+		t.Fatalf("WriteManifest failed: %v", err)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadManifest = %+v, want %+v", got, want)
+	}
+
+	if base, ok := got.Base(); !ok || base.Seq != 2 {
+		t.Errorf("Base() = %+v, %v", base, ok)
+	}
+	if incr, ok := got.LastIncr(); !ok || incr.Name != "cache.aof.7.incr" {
+		t.Errorf("LastIncr() = %+v, %v", incr, ok)
+	}
+}
+
+func TestManifest_RejectsMalformedLines(t *testing.T) {
+	for _, line := range []string{
+		"file cache.aof.1.incr type i\n",
+		"file cache.aof.1.incr type x seq 1\n",
+		"file cache.aof.1.incr type i seq one\n",
+	} {
+		path := filepath.Join(t.TempDir(), "cache.aof.manifest")
+		os.WriteFile(path, []byte(line), 0644)
+		if _, err := ReadManifest(path); err == nil {
+			t.Errorf("Expected an error for %q", line)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package aof
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A sealed record wraps an ordinary binary record that has been compressed,
+// encrypted, or both:
+//
+//	0xfd | uvarint n | flags | [keyID (4 bytes) | nonce (12 bytes)] | data | crc32c
+//
+// n counts the bytes from flags up to the checksum. data is the inner record
+// (op | klen | key | [vlen | value | exp], without its own checksum),
+// compressed if flags has one of the codec bits, then AES-GCM encrypted if it
+// has sealEncrypted. The flags and key ID are authenticated along with the
+// data. The key ID is the start of the key's SHA-256, so a reader holding
+// several keys knows which one to use.
+//
+// Sealed and plain records can be mixed freely in a binary or hybrid file, and
+// so can records compressed with different codecs.
+
+const opSealed = 0xfd
+
+const (
+	sealDeflate = 1 << iota
+	sealEncrypted
+	sealZstd
+	sealSnappy
+
+	sealCodecs = sealDeflate | sealZstd | sealSnappy
+)
+
+const (
+	keyIDSize = 4
+	nonceSize = 12
+	// compressMin is the smallest inner record worth trying to compress
+	compressMin = 128
+)
+
+// ErrKey means a record was encrypted with a key the Reader hasn't been given.
+// Unlike a damaged record, it says nothing about the data itself, so it should
+// never be recovered from by dropping the record.
+var ErrKey = errors.New("aof: record encrypted with an unknown key")
+
+type sealKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// Compression is the codec a Sealer compresses records with.
+type Compression uint8
+
+const (
+	CompressNone Compression = iota
+	// CompressZstd is the best trade-off of ratio and speed, and the one to
+	// pick unless there is a reason not to.
+	CompressZstd
+	// CompressSnappy is the fastest, for when the disk keeps up but the CPU
+	// doesn't, at a worse ratio.
+	CompressSnappy
+	// CompressDeflate is what the first sealed files were written with. It
+	// is slower than zstd for a similar ratio.
+	CompressDeflate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressZstd:
+		return "zstd"
+	case CompressSnappy:
+		return "snappy"
+	case CompressDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+// ParseCompression converts "none", "zstd", "snappy" or "deflate" into a
+// Compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none":
+		return CompressNone, nil
+	case "zstd":
+		return CompressZstd, nil
+	case "snappy":
+		return CompressSnappy, nil
+	case "deflate":
+		return CompressDeflate, nil
+	default:
+		return 0, fmt.Errorf("unknown AOF compression %q", name)
+	}
+}
+
+// Sealer compresses and encrypts records for a binary or hybrid AOF, and opens
+// them again. A nil *Sealer writes plain records.
+type Sealer struct {
+	compression Compression
+	keys        []sealKey // keys[0] seals; any of them opens
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, so one of each serves every Sealer.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxRecordSize))
+		return d
+	})
+)
+
+// NewSealer returns a Sealer that compresses records with compression and
+// encrypts them with AES-GCM if any keys are given. Keys must be 16, 24 or 32
+// bytes long. New records are encrypted with the first key; the others are
+// kept to read records written before a key rotation, until Compact has
+// rewritten them. Any Sealer opens records compressed with any codec.
+func NewSealer(compression Compression, keys ...[]byte) (*Sealer, error) {
+	if compression > CompressDeflate {
+		return nil, fmt.Errorf("aof: unknown compression %v", compression)
+	}
+	s := &Sealer{compression: compression}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("aof: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("aof: %w", err)
+		}
+		sum := sha256.Sum256(key)
+		var k sealKey
+		copy(k.id[:], sum[:])
+		k.aead = aead
+		s.keys = append(s.keys, k)
+	}
+	return s, nil
+}
+
+// ParseKeys reads hex-encoded keys, separated by newlines or commas, as found
+// in a key file or environment variable. Blank lines and lines starting with
+// '#' are ignored. The first key is the current one.
+func ParseKeys(text string) ([][]byte, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("aof: key %d is not hex: %w", len(keys)+1, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// KeyEnv is the environment variable that holds the keys, in the form
+// ParseKeys reads, when no key file is given.
+const KeyEnv = "CACHE_AOF_KEY"
+
+// LoadSealer builds a Sealer from the keys in keyFile, or in $KeyEnv if
+// keyFile is empty. It returns nil if there are no keys and no compression,
+// as records are then stored plain.
+func LoadSealer(compression Compression, keyFile string) (*Sealer, error) {
+	text := os.Getenv(KeyEnv)
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("aof: reading key file: %w", err)
+		}
+		text = string(data)
+	}
+	keys, err := ParseKeys(text)
+	if err != nil {
+		return nil, err
+	}
+	if compression == CompressNone && len(keys) == 0 {
+		return nil, nil
+	}
+	return NewSealer(compression, keys...)
+}
+
+// Encrypts reports whether the Sealer encrypts records.
+func (s *Sealer) Encrypts() bool {
+	return s != nil && len(s.keys) > 0
+}
+
+// AppendRecord appends rec to dst like the package-level AppendRecord, sealed
+// unless s is nil or the format is text, which can't hold sealed records. It
+// fails only if no random nonce can be read for encryption.
+func (s *Sealer) AppendRecord(dst []byte, format Format, rec Record) ([]byte, error) {
+	if s == nil || format == FormatText || (s.compression == CompressNone && len(s.keys) == 0) {
+		return AppendRecord(dst, format, rec), nil
+	}
+	return s.appendSealed(dst, rec)
+}
+
+func (s *Sealer) appendSealed(dst []byte, rec Record) ([]byte, error) {
+	inner := appendBinary(nil, rec)
+	inner = inner[:len(inner)-4] // the envelope carries the checksum
+
+	var flags byte
+	if s.compression != CompressNone && len(inner) >= compressMin {
+		if packed, flag := compress(s.compression, inner); len(packed) < len(inner) {
+			inner = packed
+			flags |= flag
+		}
+	}
+
+	payload := []byte{0}
+	if len(s.keys) > 0 {
+		flags |= sealEncrypted
+		key := s.keys[0]
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return dst, fmt.Errorf("aof: reading a nonce: %w", err)
+		}
+		// The flags and key ID are authenticated from a slice of their own,
+		// since Seal's additional data may not overlap its output
+		ad := append([]byte{flags}, key.id[:]...)
+		payload = make([]byte, 0, len(ad)+nonceSize+len(inner)+key.aead.Overhead())
+		payload = append(append(payload, ad...), nonce...)
+		payload = key.aead.Seal(payload, nonce, inner, ad)
+	} else {
+		payload[0] = flags
+		payload = append(payload, inner...)
+	}
+
+	start := len(dst)
+	dst = append(dst, opSealed)
+	dst = binary.AppendUvarint(dst, uint64(len(payload)))
+	dst = append(dst, payload...)
+	return binary.LittleEndian.AppendUint32(dst, Checksum(dst[start:])), nil
+}
+
+// compress returns b compressed with c, and the flag that says so.
+func compress(c Compression, b []byte) ([]byte, byte) {
+	switch c {
+	case CompressZstd:
+		return zstdEncoder().EncodeAll(b, nil), sealZstd
+	case CompressSnappy:
+		return snappy.Encode(nil, b), sealSnappy
+	default:
+		var buf bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		w.Write(b)
+		w.Close()
+		flateWriters.Put(w)
+		return buf.Bytes(), sealDeflate
+	}
+}
+
+// decompress undoes compress for the codec in flags, refusing anything that
+// would grow past MaxRecordSize.
+func decompress(flags byte, b []byte) ([]byte, error) {
+	switch flags & sealCodecs {
+	case sealZstd:
+		return zstdDecoder().DecodeAll(b, nil)
+	case sealSnappy:
+		if n, err := snappy.DecodedLen(b); err != nil || n > MaxRecordSize {
+			return nil, ErrMalformed
+		}
+		return snappy.Decode(nil, b)
+	case sealDeflate:
+		return io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(b)), MaxRecordSize))
+	default:
+		return nil, ErrMalformed
+	}
+}
+
+// open returns the inner record of a sealed payload, and whether it was
+// encrypted with the current key.
+func (s *Sealer) open(payload []byte) ([]byte, bool, error) {
+	if len(payload) < 1 {
+		return nil, false, ErrMalformed
+	}
+	flags := payload[0]
+	codec := flags & sealCodecs
+	if flags&^(sealCodecs|sealEncrypted) != 0 || codec&(codec-1) != 0 {
+		// Unknown flags, or more than one codec
+		return nil, false, ErrMalformed
+	}
+
+	inner := payload[1:]
+	current := false
+	if flags&sealEncrypted != 0 {
+		if len(inner) < keyIDSize+nonceSize {
+			return nil, false, ErrMalformed
+		}
+		id, nonce, data := inner[:keyIDSize], inner[keyIDSize:keyIDSize+nonceSize], inner[keyIDSize+nonceSize:]
+		i := s.keyIndex(id)
+		if i < 0 {
+			return nil, false, ErrKey
+		}
+		var err error
+		ad := bytes.Clone(payload[:1+keyIDSize]) // kept apart from the output, as in appendSealed
+		if inner, err = s.keys[i].aead.Open(nil, nonce, data, ad); err != nil {
+			// The checksum matched, so this is the wrong key or tampering
+			return nil, false, ErrChecksum
+		}
+		current = i == 0
+	}
+
+	if codec != 0 {
+		var err error
+		if inner, err = decompress(flags, inner); err != nil {
+			return nil, false, ErrMalformed
+		}
+	}
+	return inner, current, nil
+}
+
+func (s *Sealer) keyIndex(id []byte) int {
+	if s == nil {
+		return -1
+	}
+	for i, k := range s.keys {
+		if bytes.Equal(k.id[:], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSealed reads the rest of a sealed record, whose opcode has already been
+// consumed.
+func (r *Reader) nextSealed(start int64) (Record, error) {
+	torn := &RecordError{Offset: start, Err: ErrTorn}
+
+	body := []byte{opSealed}
+	body, payload, err := r.readBytes(body)
+	if err != nil {
+		return Record{}, torn
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r.r, sum[:]); err != nil {
+		return Record{}, torn
+	}
+	r.off += int64(len(body) + len(sum))
+
+	if Checksum(body) != binary.LittleEndian.Uint32(sum[:]) {
+		return Record{}, &RecordError{Offset: start, Err: ErrChecksum}
+	}
+	inner, current, err := r.sealer.open(payload)
+	if err != nil {
+		return Record{}, &RecordError{Offset: start, Err: err}
+	}
+	rec, err := parseBinary(inner)
+	if err != nil || (r.preamble && rec.Op != OpSet) {
+		return Record{}, &RecordError{Offset: start, Err: ErrMalformed}
+	}
+	if r.sealer.Encrypts() && !current {
+		r.stale++
+	}
+	return rec, nil
+}
+
+// parseBinary decodes an inner record, which must fill b exactly.
+func parseBinary(b []byte) (Record, error) {
+	br := bytes.NewReader(b)
+	field := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n > uint64(br.Len()) {
+			return nil, ErrMalformed
+		}
+		f := make([]byte, n)
+		br.Read(f)
+		return f, nil
+	}
+
+	op, err := br.ReadByte()
+	if err != nil {
+		return Record{}, ErrMalformed
+	}
+	rec := Record{Op: Op(op)}
+	if op == opSetMillis {
+		rec.Op = OpSet
+	}
+	if rec.Op != OpSet && rec.Op != OpDel {
+		return Record{}, ErrMalformed
+	}
+	if rec.Key, err = field(); err != nil {
+		return Record{}, err
+	}
+	if rec.Op == OpSet {
+		if rec.Value, err = field(); err != nil {
+			return Record{}, err
+		}
+		if rec.ExpiresAt, err = binary.ReadVarint(br); err != nil {
+			return Record{}, ErrMalformed
+		}
+		if op == byte(OpSet) {
+			rec.ExpiresAt = legacyExpiry(rec.ExpiresAt)
+		}
+	}
+	if br.Len() != 0 {
+		return Record{}, ErrMalformed
+	}
+	return rec, nil
+}
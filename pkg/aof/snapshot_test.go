@@ -0,0 +1,93 @@
+package aof
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func writeSnapshot(t *testing.T, entries ...Record) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	s := NewSnapshotWriter(&buf)
+	for _, e := range entries {
+		if err := s.Add(e.Key, e.Value, e.ExpiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	entries := []Record{
+		{Op: OpSet, Key: []byte("a"), Value: []byte("1"), ExpiresAt: 1700000000},
+		{Op: OpSet, Key: []byte("b"), Value: []byte{0, '\n'}},
+	}
+	data := writeSnapshot(t, entries...)
+
+	var got []Record
+	if err := ReadSnapshot(bytes.NewReader(data), func(rec Record) error {
+		got = append(got, rec)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadSnapshot failed: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("Read %d entries, want %d", len(got), len(entries))
+	}
+	for i := range entries {
+		if !bytes.Equal(got[i].Key, entries[i].Key) || !bytes.Equal(got[i].Value, entries[i].Value) || got[i].ExpiresAt != entries[i].ExpiresAt {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], entries[i])
+		}
+	}
+}
+
+func TestSnapshot_DetectsTruncation(t *testing.T) {
+	data := writeSnapshot(t, Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+
+	// Cut inside the end record, and cut the end record off entirely
+	for _, n := range []int{len(data) - 2, len(data) - 6} {
+		err := ReadSnapshot(bytes.NewReader(data[:n]), func(Record) error { return nil })
+		if !errors.Is(err, ErrTorn) {
+			t.Errorf("ReadSnapshot of %d/%d bytes: expected ErrTorn, got %v", n, len(data), err)
+		}
+	}
+}
+
+func TestSnapshot_RejectsOtherFiles(t *testing.T) {
+	for _, data := range [][]byte{encode(FormatBinary), encode(FormatText, Record{Op: OpDel, Key: []byte("a")})} {
+		if err := ReadSnapshot(bytes.NewReader(data), func(Record) error { return nil }); err != ErrNotSnapshot {
+			t.Errorf("Expected ErrNotSnapshot, got %v", err)
+		}
+	}
+}
+
+func TestReader_Hybrid(t *testing.T) {
+	data := writeSnapshot(t, Record{Op: OpSet, Key: []byte("a"), Value: []byte("1")})
+	data = AppendRecord(data, FormatHybrid, Record{Op: OpDel, Key: []byte("a")})
+	data = AppendRecord(data, FormatHybrid, Record{Op: OpSet, Key: []byte("b"), Value: []byte("2")})
+
+	r := NewReader(bytes.NewReader(data))
+	if r.Format() != FormatHybrid {
+		t.Fatalf("Detected %v, want hybrid", r.Format())
+	}
+	var ops []Op
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		ops = append(ops, rec.Op)
+	}
+	if len(ops) != 3 || ops[0] != OpSet || ops[1] != OpDel || ops[2] != OpSet {
+		t.Errorf("Read ops %v, want [SET DEL SET]", ops)
+	}
+}
@@ -3,14 +3,35 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
+// ErrNotFound is returned when the key does not exist or has expired.
+var ErrNotFound = errors.New("key not found")
+
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError struct {
+	Op         string // what failed, such as "get key"
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to %s, status: %d", e.Op, e.StatusCode)
+}
+
 type Client struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// ReadReplicas are base URLs of replicas of BaseURL that reads fall back
+	// to, in order, when it can't be reached or answers with a server error.
+	// Writes always go to BaseURL.
+	ReadReplicas []string
 }
 
 // NewClient creates a new instance of the cache client
@@ -33,11 +54,42 @@ type getResponse struct {
 	Value []byte `json:"value"`
 }
 
+type mgetResponse struct {
+	Values  map[string][]byte `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+type msetRequest struct {
+	Items map[string][]byte `json:"items"`
+	TTL   int               `json:"ttl"`
+}
+
+type mdelResponse struct {
+	Deleted []string `json:"deleted"`
+	Missing []string `json:"missing"`
+}
+
 type statsResponse struct {
-	Hits      uint64 `json:"hits"`
-	Misses    uint64 `json:"misses"`
-	Evictions uint64 `json:"evictions"`
-	HitRate   string `json:"hit_rate"`
+	Hits        uint64           `json:"hits"`
+	Misses      uint64           `json:"misses"`
+	Evictions   uint64           `json:"evictions"`
+	HitRate     string           `json:"hit_rate"`
+	Items       int              `json:"items"`
+	Bytes       int64            `json:"bytes"`
+	ShardBytes  []int64          `json:"shard_bytes"`
+	Replication replicationStats `json:"replication"`
+}
+
+type replicationStats struct {
+	Role          string `json:"role"`
+	Offset        uint64 `json:"offset"`
+	Replicas      int    `json:"replicas"`
+	Primary       string `json:"primary,omitempty"`
+	PrimaryOffset uint64 `json:"primary_offset,omitempty"`
+	Lag           uint64 `json:"lag,omitempty"`
+	LastHeardMs   int64  `json:"last_heard_ms,omitempty"`
+	Connected     bool   `json:"connected,omitempty"`
+	Synced        bool   `json:"synced,omitempty"`
 }
 
 func (c *Client) Set(key string, value any, ttl time.Duration) error {
@@ -66,61 +118,285 @@ func (c *Client) Set(key string, value any, ttl time.Duration) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to set key, status: %d", resp.StatusCode)
+		return &StatusError{Op: "set key", StatusCode: resp.StatusCode}
 	}
 	return nil
 }
 
 func (c *Client) Get(key string) (any, error) {
-	url := fmt.Sprintf("%s/get?key=%s", c.BaseURL, key)
-
-	resp, err := c.HTTPClient.Get(url)
+	value, err := c.getValue(key)
 	if err != nil {
 		return "", err
 	}
+
+	var parsedValue any
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsedValue); err != nil {
+		return nil, err
+	}
+
+	return parsedValue, nil
+}
+
+// getValue returns the JSON stored under key by Set.
+func (c *Client) getValue(key string) ([]byte, error) {
+	resp, err := c.read("/get?" + url.Values{"key": {key}}.Encode())
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return "", fmt.Errorf("key not found")
+		return nil, ErrNotFound
 	}
-
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get key, status: %d", resp.StatusCode)
+		return nil, &StatusError{Op: "get key", StatusCode: resp.StatusCode}
 	}
 
 	var res getResponse
 	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
 		return nil, err
 	}
+	return res.Value, nil
+}
 
-	var parsedValue any
-	decoder := json.NewDecoder(bytes.NewReader(res.Value))
-	decoder.UseNumber()
-	if err := decoder.Decode(&parsedValue); err != nil {
-		return nil, err
+// Delete removes the key. Deleting a key that does not exist is not an error.
+func (c *Client) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.BaseURL+"/delete?"+url.Values{"key": {key}}.Encode(), nil)
+	if err != nil {
+		return err
 	}
 
-	return parsedValue, nil
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return &StatusError{Op: "delete key", StatusCode: resp.StatusCode}
+	}
+	return nil
 }
 
-func GetAs[T any](c *Client, key string) (T, error) {
-	var result T
-	url := fmt.Sprintf("%s/get?key=%s", c.BaseURL, key)
+// SetMany stores every item with the same TTL in one round trip, encoding the
+// values as Set does. The server takes up to 1000 items per call.
+func (c *Client) SetMany(items map[string]any, ttl time.Duration) error {
+	values := make(map[string][]byte, len(items))
+	for key, value := range items {
+		valueInBytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[key] = valueInBytes
+	}
+	return c.SetManyBytes(values, ttl)
+}
 
-	resp, err := c.HTTPClient.Get(url)
+// SetManyBytes stores every value as-is, like SetBytes, in one round trip.
+func (c *Client) SetManyBytes(items map[string][]byte, ttl time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+	jsonData, err := json.Marshal(msetRequest{Items: items, TTL: int(ttl.Seconds())})
 	if err != nil {
-		var zero T
-		return zero, err
+		return err
+	}
+
+	resp, err := c.HTTPClient.Post(c.BaseURL+"/mset", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
-	var res getResponse
-	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusCreated {
+		return &StatusError{Op: "set keys", StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// GetMany looks up every key in one round trip and returns the values found,
+// decoded as Get does, and the keys that are missing or expired, in order.
+// The server takes up to 1000 keys per call.
+func (c *Client) GetMany(keys []string) (map[string]any, []string, error) {
+	values, missing, err := c.getValues(keys)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	err = json.Unmarshal(res.Value, &result)
+	parsed := make(map[string]any, len(values))
+	for key, value := range values {
+		var parsedValue any
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&parsedValue); err != nil {
+			return nil, nil, err
+		}
+		parsed[key] = parsedValue
+	}
+	return parsed, missing, nil
+}
+
+// GetManyBytes is GetMany for raw values, like GetBytes.
+func (c *Client) GetManyBytes(keys []string) (map[string][]byte, []string, error) {
+	return c.getValues(keys)
+}
+
+func (c *Client) getValues(keys []string) (map[string][]byte, []string, error) {
+	if len(keys) == 0 {
+		return map[string][]byte{}, nil, nil
+	}
+	resp, err := c.read("/mget?" + url.Values{"key": keys}.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &StatusError{Op: "get keys", StatusCode: resp.StatusCode}
+	}
+
+	var res mgetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, nil, err
+	}
+	if res.Values == nil {
+		res.Values = map[string][]byte{}
+	}
+	return res.Values, res.Missing, nil
+}
+
+// DeleteMany removes every key in one round trip and returns the keys that
+// were deleted and the ones that did not exist, in order.
+func (c *Client) DeleteMany(keys []string) (deleted, missing []string, err error) {
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	req, err := http.NewRequest(http.MethodDelete, c.BaseURL+"/mdel?"+url.Values{"key": keys}.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &StatusError{Op: "delete keys", StatusCode: resp.StatusCode}
+	}
+
+	var res mdelResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, nil, err
+	}
+	return res.Deleted, res.Missing, nil
+}
+
+// SetBytes stores value as-is through the raw /keys API, skipping the JSON and
+// Base64 wrapping that Set applies.
+func (c *Client) SetBytes(key string, value []byte, ttl time.Duration) error {
+	req, err := http.NewRequest(http.MethodPut, c.keyURL(key), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Cache-TTL", strconv.Itoa(int(ttl.Seconds())))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return &StatusError{Op: "set key", StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// GetBytes returns the raw bytes stored under key, or ErrNotFound.
+func (c *Client) GetBytes(key string) ([]byte, error) {
+	resp, err := c.read(keyPath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Op: "get key", StatusCode: resp.StatusCode}
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.BaseURL + keyPath(key)
+}
+
+func keyPath(key string) string {
+	return "/keys/" + url.PathEscape(key)
+}
+
+// read GETs path from BaseURL, or from the first of ReadReplicas that can be
+// reached and doesn't answer with a server error. The last server's error or
+// response is returned if none of them can.
+func (c *Client) read(path string) (*http.Response, error) {
+	resp, err := c.HTTPClient.Get(c.BaseURL + path)
+	for _, replica := range c.ReadReplicas {
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		resp, err = c.HTTPClient.Get(replica + path)
+	}
+	return resp, err
+}
+
+// valueGetter is what GetAs and GetManyAs read from: a *Client or a
+// *ClusterClient.
+type valueGetter interface {
+	getValue(key string) ([]byte, error)
+	getValues(keys []string) (map[string][]byte, []string, error)
+}
+
+func GetAs[T any](c valueGetter, key string) (T, error) {
+	var result T
+	value, err := c.getValue(key)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(value, &result)
 	return result, err
 }
 
+// GetManyAs looks up every key in one round trip, like GetMany, decoding the
+// values found into T.
+func GetManyAs[T any](c valueGetter, keys []string) (map[string]T, []string, error) {
+	values, missing, err := c.getValues(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make(map[string]T, len(values))
+	for key, value := range values {
+		var result T
+		if err := json.Unmarshal(value, &result); err != nil {
+			return nil, nil, err
+		}
+		results[key] = result
+	}
+	return results, missing, nil
+}
+
 func (c *Client) Stats() (statsResponse, error) {
 	url := fmt.Sprintf("%s/stats", c.BaseURL)
 
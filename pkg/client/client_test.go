@@ -0,0 +1,78 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient_ReadsFailOverToReplicas(t *testing.T) {
+	down := httptest.NewServer(nil)
+	down.Close() // a primary that is restarting
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Loading the dataset from the AOF", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/get":
+			w.Write([]byte(`{"value":"eyJuYW1lIjoiQnJ1Y2UifQ=="}`)) // {"name":"Bruce"}
+		case "/mget":
+			w.Write([]byte(`{"values":{"u":"eyJuYW1lIjoiQnJ1Y2UifQ=="},"missing":["v"]}`))
+		case "/keys/k":
+			w.Write([]byte("raw"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer replica.Close()
+
+	c := NewClient(down.URL)
+	c.ReadReplicas = []string{failing.URL, replica.URL}
+
+	if got, err := c.GetBytes("k"); err != nil || string(got) != "raw" {
+		t.Errorf("GetBytes = %q, %v", got, err)
+	}
+	type user struct{ Name string }
+	if got, err := GetAs[user](c, "u"); err != nil || got.Name != "Bruce" {
+		t.Errorf("GetAs = %+v, %v", got, err)
+	}
+	if got, missing, err := GetManyAs[user](c, []string{"u", "v"}); err != nil || got["u"].Name != "Bruce" || len(missing) != 1 {
+		t.Errorf("GetManyAs = %+v, %v, %v", got, missing, err)
+	}
+	if _, err := c.GetBytes("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound from the replica, got %v", err)
+	}
+
+	// Writes never go to a replica
+	if err := c.SetBytes("k", []byte("v"), 0); err == nil {
+		t.Error("Expected a write to fail with the primary down")
+	}
+	if _, _, err := c.DeleteMany([]string{"k"}); err == nil {
+		t.Error("Expected a batch write to fail with the primary down")
+	}
+
+	c.ReadReplicas = []string{failing.URL}
+	if _, err := c.GetBytes("k"); err == nil {
+		t.Error("Expected the last server's error when none can answer")
+	}
+}
+
+func TestClient_EscapesKeys(t *testing.T) {
+	const key = "a&key=b #c+d"
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.Query().Get("key"))
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	c.Get(key)
+	c.Delete(key)
+	if len(got) != 2 || got[0] != key || got[1] != key {
+		t.Errorf("Server saw keys %q, want %q twice", got, key)
+	}
+}
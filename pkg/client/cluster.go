@@ -0,0 +1,466 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// ClusterClient spreads keys across several cache-server nodes, each holding
+// its own share. Every key belongs to one node, picked by a placement
+// strategy: a consistent hash ring by default, so adding or removing a node
+// only moves the keys on its share of the ring. SetPlacement picks another.
+//
+// A node that fails with a network error or a 5xx answer is marked down for
+// RetryInterval. Reads of its keys go to the other nodes in the meantime, by
+// rendezvous hashing, where they miss. Writes and deletes never move: one
+// whose node is down fails. A write kept on another node would outlive a
+// later delete, and hide behind the key's own, stale copy once it is back.
+type ClusterClient struct {
+	// HTTPClient makes every request to the nodes.
+	HTTPClient *http.Client
+	// RetryInterval is how long a failed node is skipped for.
+	RetryInterval time.Duration
+
+	mu       sync.RWMutex
+	nodes    map[string]*clusterNode
+	order    []placement.Node // in the order they were added, as placed
+	strategy placement.Strategy
+	place    placement.Placement
+	fallback *placement.Rendezvous // ranks the other nodes while one is down
+}
+
+type clusterNode struct {
+	addr      string
+	downUntil time.Time // guarded by ClusterClient.mu
+}
+
+// NewClusterClient creates a client for the nodes at the given base URLs.
+func NewClusterClient(addrs ...string) *ClusterClient {
+	c := &ClusterClient{
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+		RetryInterval: 5 * time.Second,
+		nodes:         make(map[string]*clusterNode),
+		strategy:      placement.StrategyRing,
+	}
+	for _, addr := range addrs {
+		c.AddNode(addr)
+	}
+	return c
+}
+
+// SetPlacement switches to another placement strategy, which moves most keys
+// to a different node, so it is best done before any are written.
+func (c *ClusterClient) SetPlacement(strategy placement.Strategy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := placement.New(strategy, nil); err != nil {
+		return err
+	}
+	c.strategy = strategy
+	c.replace()
+	return nil
+}
+
+// AddNode adds a node with a weight of 1. It takes over its share of the keys
+// from the nodes that held them, which then miss until they are set again.
+func (c *ClusterClient) AddNode(addr string) {
+	c.AddWeightedNode(addr, 1)
+}
+
+// AddWeightedNode adds a node that gets a share of the keys in proportion to
+// weight, under placement.StrategyRendezvous. The other strategies give every
+// node the same share. With placement.StrategyJump, adding and removing nodes
+// only moves few keys when it is the last node added that is removed.
+func (c *ClusterClient) AddWeightedNode(addr string, weight float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[addr]; ok {
+		return
+	}
+	c.nodes[addr] = &clusterNode{addr: addr}
+	c.order = append(c.order, placement.Node{Name: addr, Weight: weight})
+	c.replace()
+}
+
+// RemoveNode removes a node. Only its keys move, except under
+// placement.StrategyMaglev, which shuffles a few others, and
+// placement.StrategyJump, unless it was the last node added.
+func (c *ClusterClient) RemoveNode(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.nodes, addr)
+	c.order = slices.DeleteFunc(c.order, func(n placement.Node) bool { return n.Name == addr })
+	c.replace()
+}
+
+// replace rebuilds the placement over the current nodes, under mu.
+func (c *ClusterClient) replace() {
+	c.place, _ = placement.New(c.strategy, c.order) // the strategy was checked when it was set
+	c.fallback = placement.NewRendezvous(c.order)
+}
+
+// Nodes returns the nodes' base URLs.
+func (c *ClusterClient) Nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	addrs := make([]string, 0, len(c.nodes))
+	for addr := range c.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// NodeFor returns the node key is routed to, skipping nodes that are down,
+// or "" if there are no nodes.
+func (c *ClusterClient) NodeFor(key string) string {
+	candidates := c.candidates(key)
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].addr
+}
+
+// candidates lists the nodes in the order key should try them: its own node,
+// then the others by rendezvous rank, nodes that are up first. Down nodes
+// stay on the list, last, in case every node is down.
+func (c *ClusterClient) candidates(key string) []*clusterNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.order) == 0 {
+		return nil
+	}
+
+	hash := placement.Hash(key)
+	owner := c.place.Locate(hash)
+	now := time.Now()
+	var up, down []*clusterNode
+	for i, next := range append([]int{owner}, c.fallback.Rank(hash)...) {
+		if i > 0 && next == owner {
+			continue
+		}
+		if node := c.nodes[c.order[next].Name]; now.Before(node.downUntil) {
+			down = append(down, node)
+		} else {
+			up = append(up, node)
+		}
+	}
+	return append(up, down...)
+}
+
+func (c *ClusterClient) markDown(node *clusterNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node.downUntil = time.Now().Add(c.RetryInterval)
+}
+
+func (c *ClusterClient) markUp(node *clusterNode) {
+	c.mu.RLock()
+	down := !node.downUntil.IsZero()
+	c.mu.RUnlock()
+	if down {
+		c.mu.Lock()
+		node.downUntil = time.Time{}
+		c.mu.Unlock()
+	}
+}
+
+// client returns a Client for node that uses HTTPClient as it is now.
+func (c *ClusterClient) client(node *clusterNode) *Client {
+	return &Client{BaseURL: node.addr, HTTPClient: c.HTTPClient}
+}
+
+// owner returns the node key is placed on, whether it is up or not, or nil
+// if there are no nodes.
+func (c *ClusterClient) owner(key string) *clusterNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.order) == 0 {
+		return nil
+	}
+	return c.nodes[c.order[c.place.Locate(placement.Hash(key))].Name]
+}
+
+// doOwner runs fn against the node key is placed on and never another, for
+// writes and deletes, which must not land anywhere else.
+func (c *ClusterClient) doOwner(key string, fn func(*Client) error) error {
+	node := c.owner(key)
+	if node == nil {
+		return errors.New("cluster has no nodes")
+	}
+	err := fn(c.client(node))
+	if nodeFailed(err) {
+		c.markDown(node)
+	} else {
+		c.markUp(node)
+	}
+	return err
+}
+
+// do runs fn against key's node, moving on to the next one while nodes fail.
+// It is for reads only.
+func (c *ClusterClient) do(key string, fn func(*Client) error) error {
+	candidates := c.candidates(key)
+	if len(candidates) == 0 {
+		return errors.New("cluster has no nodes")
+	}
+	var err error
+	for _, node := range candidates {
+		if err = fn(c.client(node)); !nodeFailed(err) {
+			c.markUp(node)
+			return err
+		}
+		c.markDown(node)
+	}
+	return err
+}
+
+// nodeFailed reports whether err means the node, rather than the request, is
+// at fault.
+func nodeFailed(err error) bool {
+	var urlErr *url.Error
+	var statusErr *StatusError
+	return errors.As(err, &urlErr) || errors.As(err, &statusErr) && statusErr.StatusCode >= http.StatusInternalServerError
+}
+
+// Set stores value on the key's node. It fails if the node is down.
+func (c *ClusterClient) Set(key string, value any, ttl time.Duration) error {
+	return c.doOwner(key, func(node *Client) error { return node.Set(key, value, ttl) })
+}
+
+func (c *ClusterClient) Get(key string) (any, error) {
+	var value any
+	err := c.do(key, func(node *Client) (err error) {
+		value, err = node.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Delete removes the key from its node. Deleting a key that does not exist is
+// not an error, but one whose node is down is.
+func (c *ClusterClient) Delete(key string) error {
+	return c.doOwner(key, func(node *Client) error { return node.Delete(key) })
+}
+
+// SetBytes stores value as-is, like Client.SetBytes.
+func (c *ClusterClient) SetBytes(key string, value []byte, ttl time.Duration) error {
+	return c.doOwner(key, func(node *Client) error { return node.SetBytes(key, value, ttl) })
+}
+
+// GetBytes returns the raw bytes stored under key, or ErrNotFound.
+func (c *ClusterClient) GetBytes(key string) ([]byte, error) {
+	var value []byte
+	err := c.do(key, func(node *Client) (err error) {
+		value, err = node.GetBytes(key)
+		return err
+	})
+	return value, err
+}
+
+func (c *ClusterClient) getValue(key string) ([]byte, error) {
+	var value []byte
+	err := c.do(key, func(node *Client) (err error) {
+		value, err = node.getValue(key)
+		return err
+	})
+	return value, err
+}
+
+// doMany splits keys by the node each is routed to and runs fn once per node,
+// in parallel, with the keys routed there. With failover, for reads, keys
+// whose node fails move on to their next node, as in do; without, they only
+// ever go to the node they are placed on, as in doOwner. fn must be safe to
+// call concurrently.
+func (c *ClusterClient) doMany(keys []string, failover bool, fn func(node *Client, keys []string) error) error {
+	type pending struct {
+		key        string
+		candidates []*clusterNode
+		next       int
+	}
+	var remaining []*pending
+	for _, key := range keys {
+		var candidates []*clusterNode
+		if failover {
+			candidates = c.candidates(key)
+		} else if owner := c.owner(key); owner != nil {
+			candidates = []*clusterNode{owner}
+		}
+		if len(candidates) == 0 {
+			return errors.New("cluster has no nodes")
+		}
+		remaining = append(remaining, &pending{key: key, candidates: candidates})
+	}
+
+	var mu sync.Mutex
+	var firstErr, nodeErr error
+	for len(remaining) > 0 {
+		groups := make(map[*clusterNode][]*pending)
+		for _, p := range remaining {
+			node := p.candidates[p.next]
+			groups[node] = append(groups[node], p)
+		}
+		remaining = nil
+
+		var wg sync.WaitGroup
+		for node, group := range groups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				groupKeys := make([]string, len(group))
+				for i, p := range group {
+					groupKeys[i] = p.key
+				}
+				err := fn(c.client(node), groupKeys)
+
+				if !nodeFailed(err) {
+					c.markUp(node)
+				} else {
+					c.markDown(node)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if !nodeFailed(err) {
+					if err != nil && firstErr == nil {
+						firstErr = err
+					}
+					return
+				}
+				for _, p := range group {
+					if p.next++; p.next < len(p.candidates) {
+						remaining = append(remaining, p)
+					} else {
+						nodeErr = err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return nodeErr
+}
+
+// SetMany stores every item with the same TTL, with one round trip per node.
+// Like Set, it fails if a key's node is down, though the items of the nodes
+// that are up are still stored.
+func (c *ClusterClient) SetMany(items map[string]any, ttl time.Duration) error {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	return c.doMany(keys, false, func(node *Client, keys []string) error {
+		batch := make(map[string]any, len(keys))
+		for _, key := range keys {
+			batch[key] = items[key]
+		}
+		return node.SetMany(batch, ttl)
+	})
+}
+
+// SetManyBytes stores every value as-is, with one round trip per node.
+func (c *ClusterClient) SetManyBytes(items map[string][]byte, ttl time.Duration) error {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	return c.doMany(keys, false, func(node *Client, keys []string) error {
+		batch := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			batch[key] = items[key]
+		}
+		return node.SetManyBytes(batch, ttl)
+	})
+}
+
+// GetMany looks up every key, with one round trip per node, and returns the
+// values found and the keys that are missing, in order.
+func (c *ClusterClient) GetMany(keys []string) (map[string]any, []string, error) {
+	var mu sync.Mutex
+	values := make(map[string]any, len(keys))
+	err := c.doMany(keys, true, func(node *Client, keys []string) error {
+		found, _, err := node.GetMany(keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for key, value := range found {
+			values[key] = value
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, missingKeys(keys, values), nil
+}
+
+// GetManyBytes is GetMany for raw values.
+func (c *ClusterClient) GetManyBytes(keys []string) (map[string][]byte, []string, error) {
+	return c.getValues(keys)
+}
+
+func (c *ClusterClient) getValues(keys []string) (map[string][]byte, []string, error) {
+	var mu sync.Mutex
+	values := make(map[string][]byte, len(keys))
+	err := c.doMany(keys, true, func(node *Client, keys []string) error {
+		found, _, err := node.getValues(keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for key, value := range found {
+			values[key] = value
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, missingKeys(keys, values), nil
+}
+
+// DeleteMany removes every key, with one round trip per node, and returns the
+// keys that were deleted and the ones that did not exist, in order. Like
+// Delete, it fails if a key's node is down.
+func (c *ClusterClient) DeleteMany(keys []string) (deleted, missing []string, err error) {
+	var mu sync.Mutex
+	removed := make(map[string]bool, len(keys))
+	err = c.doMany(keys, false, func(node *Client, keys []string) error {
+		gone, _, err := node.DeleteMany(keys)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range gone {
+			removed[key] = true
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range keys {
+		if removed[key] {
+			deleted = append(deleted, key)
+			delete(removed, key) // a key listed twice was only deleted once
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	return deleted, missing, nil
+}
+
+// missingKeys returns the keys that values has no entry for, in order.
+func missingKeys[V any](keys []string, values map[string]V) []string {
+	var missing []string
+	for _, key := range keys {
+		if _, found := values[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
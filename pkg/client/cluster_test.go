@@ -0,0 +1,385 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// fakeNode is a minimal cache-server: the JSON, batch and raw key APIs over a
+// map. While down is set it answers every request with a 503.
+type fakeNode struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	down bool
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, *httptest.Server) {
+	n := &fakeNode{data: make(map[string][]byte)}
+	ts := httptest.NewServer(n)
+	t.Cleanup(ts.Close)
+	return n, ts
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case n.down:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.URL.Path == "/delete":
+		delete(n.data, r.URL.Query().Get("key"))
+	case r.URL.Path == "/set":
+		var req setRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		n.data[req.Key] = req.Value
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/get":
+		value, ok := n.data[r.URL.Query().Get("key")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(getResponse{Value: value})
+	case r.URL.Path == "/mset":
+		var req msetRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		for key, value := range req.Items {
+			n.data[key] = value
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/mget":
+		res := mgetResponse{Values: make(map[string][]byte), Missing: []string{}}
+		for _, key := range r.URL.Query()["key"] {
+			if value, ok := n.data[key]; ok {
+				res.Values[key] = value
+			} else {
+				res.Missing = append(res.Missing, key)
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	case r.URL.Path == "/mdel":
+		res := mdelResponse{Deleted: []string{}, Missing: []string{}}
+		for _, key := range r.URL.Query()["key"] {
+			if _, ok := n.data[key]; ok {
+				delete(n.data, key)
+				res.Deleted = append(res.Deleted, key)
+			} else {
+				res.Missing = append(res.Missing, key)
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	case strings.HasPrefix(r.URL.Path, "/keys/") && r.Method == http.MethodPut:
+		n.data[strings.TrimPrefix(r.URL.Path, "/keys/")], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/keys/"):
+		value, ok := n.data[strings.TrimPrefix(r.URL.Path, "/keys/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(value)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (n *fakeNode) len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.data)
+}
+
+func TestClusterClient_SpreadsKeys(t *testing.T) {
+	var nodes []*fakeNode
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		n, ts := newFakeNode(t)
+		nodes, addrs = append(nodes, n), append(addrs, ts.URL)
+	}
+	c := NewClusterClient(addrs...)
+
+	for i := 0; i < 300; i++ {
+		if err := c.Set(fmt.Sprintf("user:%d", i), map[string]int{"id": i}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, n := range nodes {
+		if n.len() < 50 {
+			t.Errorf("node %d holds %d of 300 keys", i, n.len())
+		}
+	}
+
+	type user struct{ ID int }
+	if got, err := GetAs[user](c, "user:42"); err != nil || got.ID != 42 {
+		t.Errorf("GetAs = %+v, %v", got, err)
+	}
+	if _, err := c.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClusterClient_AddAndRemoveMoveFewKeys(t *testing.T) {
+	c := NewClusterClient("http://a", "http://b", "http://c", "http://d")
+	owners := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = c.NodeFor(key)
+	}
+
+	c.AddNode("http://e")
+	moved := 0
+	for key, owner := range owners {
+		if now := c.NodeFor(key); now != owner {
+			if now != "http://e" {
+				t.Fatalf("%s moved from %s to %s rather than to the new node", key, owner, now)
+			}
+			moved++
+		}
+	}
+	// The new node should take about a fifth
+	if moved < 1000 || moved > 3000 {
+		t.Errorf("Adding a fifth node moved %d of 10000 keys", moved)
+	}
+
+	c.RemoveNode("http://e")
+	for key, owner := range owners {
+		if c.NodeFor(key) != owner {
+			t.Fatalf("Removing the node again should restore every owner, %s differs", key)
+		}
+	}
+}
+
+func TestClusterClient_ReroutesAroundDownNodes(t *testing.T) {
+	upNode, up := newFakeNode(t)
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	c := NewClusterClient(up.URL, down.URL)
+	var key string
+	for i := 0; ; i++ {
+		if key = fmt.Sprintf("k%d", i); c.NodeFor(key) == down.URL {
+			break
+		}
+	}
+
+	// Writes stay on the key's node, so one that is down fails them
+	if err := c.SetBytes(key, []byte("v"), time.Minute); err == nil || upNode.len() != 0 {
+		t.Fatalf("Expected the write to fail without landing elsewhere, got %v", err)
+	}
+	if c.NodeFor(key) != up.URL {
+		t.Error("Expected the failed node to be marked down")
+	}
+	if _, err := c.GetBytes(key); err != ErrNotFound {
+		t.Errorf("Expected reads to go to the next node and miss, got %v", err)
+	}
+	if err := c.Delete(key); err == nil {
+		t.Error("Expected a delete to fail while the key's node is down")
+	}
+
+	c.RetryInterval = 0
+	c.markDown(c.nodes[down.URL])
+	if c.NodeFor(key) != down.URL {
+		t.Error("Expected the node to be tried again once RetryInterval has passed")
+	}
+}
+
+func TestClusterClient_DeleteAfterOutage(t *testing.T) {
+	owner, ownerTS := newFakeNode(t)
+	other, otherTS := newFakeNode(t)
+	c := NewClusterClient(ownerTS.URL, otherTS.URL)
+	var key string
+	for i := 0; ; i++ {
+		if key = fmt.Sprintf("session:%d", i); c.NodeFor(key) == ownerTS.URL {
+			break
+		}
+	}
+	setDown := func(down bool) {
+		owner.mu.Lock()
+		owner.down = down
+		owner.mu.Unlock()
+	}
+
+	if err := c.SetBytes(key, []byte("v1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	setDown(true)
+	if err := c.SetBytes(key, []byte("v2"), time.Minute); err == nil {
+		t.Error("Expected a write to fail while the key's node is down")
+	}
+	if other.len() != 0 {
+		t.Fatal("Expected nothing to be written to the other node")
+	}
+
+	setDown(false)
+	c.markUp(c.nodes[ownerTS.URL])
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted session must not come back, not even in the next outage
+	setDown(true)
+	if _, err := c.GetBytes(key); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to stay gone, got %v", err)
+	}
+}
+
+func TestClusterClient_Batches(t *testing.T) {
+	var nodes []*fakeNode
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		n, ts := newFakeNode(t)
+		nodes, addrs = append(nodes, n), append(addrs, ts.URL)
+	}
+	down := httptest.NewServer(nil)
+	down.Close()
+	c := NewClusterClient(append(addrs, down.URL)...)
+
+	// Writes and deletes only go to each key's own node, so these must be on
+	// nodes that are up
+	items := make(map[string]any)
+	var keys []string
+	var onDown string
+	for i := 0; len(keys) < 100; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		if c.owner(key).addr == down.URL {
+			onDown = key
+			continue
+		}
+		items[key] = map[string]int{"id": i}
+		keys = append(keys, key)
+	}
+	if err := c.SetMany(items, time.Minute); err != nil {
+		t.Fatalf("SetMany: %v", err)
+	}
+	if err := c.SetMany(map[string]any{onDown: 1}, time.Minute); err == nil {
+		t.Errorf("Expected writing %s to fail while its node is down", onDown)
+	}
+	for i, n := range nodes {
+		if n.len() == 0 {
+			t.Errorf("Node %d got none of the batch", i)
+		}
+	}
+
+	type user struct{ ID int }
+	users, missing, err := GetManyAs[user](c, append(keys, "user:absent"))
+	if err != nil {
+		t.Fatalf("GetManyAs: %v", err)
+	}
+	if len(users) != len(keys) {
+		t.Errorf("GetManyAs found %d users, want %d", len(users), len(keys))
+	}
+	for _, key := range keys {
+		if want := items[key].(map[string]int)["id"]; users[key].ID != want {
+			t.Errorf("%s = %+v, want ID %d", key, users[key], want)
+		}
+	}
+	if len(missing) != 1 || missing[0] != "user:absent" {
+		t.Errorf("Expected only user:absent missing, got %v", missing)
+	}
+
+	up := keys
+	absent := "absent"
+	for i := 0; c.owner(absent).addr == down.URL; i++ {
+		absent = fmt.Sprintf("absent:%d", i)
+	}
+	first, second := up[0], up[1]
+
+	deleted, missing, err := c.DeleteMany([]string{first, absent, second, first})
+	if err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	if strings.Join(deleted, ",") != first+","+second || strings.Join(missing, ",") != absent+","+first {
+		t.Errorf("DeleteMany = %v deleted, %v missing", deleted, missing)
+	}
+	if _, err := c.GetBytes(first); err != ErrNotFound {
+		t.Errorf("Expected %s to be gone, got %v", first, err)
+	}
+
+	// and a key of the down node can't be deleted anywhere else
+	if _, _, err := c.DeleteMany([]string{up[2], onDown}); err == nil {
+		t.Errorf("Expected deleting %s to fail while its node is down", onDown)
+	}
+}
+
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClusterClient_HTTPClientAppliesToEveryNode(t *testing.T) {
+	_, ts := newFakeNode(t)
+	c := NewClusterClient(ts.URL)
+	transport := &countingTransport{}
+	c.HTTPClient = &http.Client{Transport: transport}
+
+	if err := c.SetBytes("k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBytes("k"); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests != 2 {
+		t.Errorf("Expected both requests to use the HTTPClient set after construction, it made %d", transport.requests)
+	}
+}
+
+func TestClusterClient_Placements(t *testing.T) {
+	for _, s := range []placement.Strategy{placement.StrategyJump, placement.StrategyRendezvous, placement.StrategyMaglev} {
+		c := NewClusterClient("http://a", "http://b", "http://c", "http://d")
+		if err := c.SetPlacement(s); err != nil {
+			t.Fatal(err)
+		}
+		owners := make(map[string]string)
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			owners[key] = c.NodeFor(key)
+		}
+
+		c.AddNode("http://e")
+		moved := 0
+		for key, owner := range owners {
+			if now := c.NodeFor(key); now != owner {
+				if now != "http://e" && s != placement.StrategyMaglev {
+					t.Fatalf("%s: %s moved from %s to %s rather than to the new node", s, key, owner, now)
+				}
+				moved++
+			}
+		}
+		if moved < 1500 || moved > 2500 {
+			t.Errorf("%s: adding a fifth node moved %d of 10000 keys", s, moved)
+		}
+	}
+
+	c := NewClusterClient()
+	if err := c.SetPlacement("modulo"); err == nil {
+		t.Error("Expected an unknown strategy to fail")
+	}
+	c.SetPlacement(placement.StrategyRendezvous)
+	c.AddNode("http://small")
+	c.AddWeightedNode("http://big", 3)
+	big := 0
+	for i := 0; i < 10000; i++ {
+		if c.NodeFor(fmt.Sprintf("key-%d", i)) == "http://big" {
+			big++
+		}
+	}
+	if big < 7000 || big > 8000 {
+		t.Errorf("A node of weight 3 next to one of 1 got %d of 10000 keys", big)
+	}
+}
@@ -0,0 +1,229 @@
+package lru
+
+import "time"
+
+const (
+	arcT1 uint8 = iota // resident, seen once recently
+	arcT2              // resident, seen at least twice
+	arcB1              // ghost of an entry evicted from T1
+	arcB2              // ghost of an entry evicted from T2
+)
+
+// ARC is the Adaptive Replacement Cache of Megiddo and Modha.
+// It splits the capacity between a recency list (T1) and a frequency list (T2)
+// and remembers the keys it recently evicted from each (B1, B2). A Set for a
+// ghost key shifts the target size p towards the list that would have kept it.
+type ARC[K comparable, V any] struct {
+	limits[K, V]
+	p              int
+	nodesMap       map[K]*Node[K, V] // resident and ghost entries
+	t1, t2, b1, b2 list[K, V]
+	stats          Stats
+}
+
+func NewARCCache[K comparable, V any](capacity int) *ARC[K, V] {
+	return &ARC[K, V]{
+		limits:   newLimits[K, V](capacity),
+		nodesMap: make(map[K]*Node[K, V]),
+	}
+}
+
+func (c *ARC[K, V]) Get(key K) (V, bool) {
+	var emptyValue V
+	node, found := c.nodesMap[key]
+	if !found || node.segment >= arcB1 || node.expired(time.Now()) {
+		c.stats.Misses++
+		return emptyValue, false
+	}
+
+	c.move(node, arcT2)
+
+	c.stats.Hits++
+	return node.Value, true
+}
+
+func (c *ARC[K, V]) Peek(key K) (Entry[V], bool) {
+	node, found := c.nodesMap[key]
+	return peekNode(node, found && node.segment <= arcT2)
+}
+
+func (c *ARC[K, V]) Set(key K, value V, ttl time.Duration) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		c.Delete(key)
+		return
+	}
+
+	expiresAt := expiryFor(ttl)
+	node, found := c.nodesMap[key]
+
+	switch {
+	case found && node.segment <= arcT2:
+		c.used -= node.cost
+
+	case found && node.segment == arcB1:
+		c.p = min(c.capacity, c.p+max(c.b2.len/c.b1.len, 1))
+		c.replace(false)
+
+	case found && node.segment == arcB2:
+		c.p = max(0, c.p-max(c.b1.len/c.b2.len, 1))
+		c.replace(true)
+	}
+
+	if found {
+		node.Value = value
+		node.ExpiresAt = expiresAt
+		node.Version = nextVersion()
+		node.cost = cost
+		c.move(node, arcT2)
+		c.used += cost
+
+		for c.overBudget() && c.evictForCost(node) {
+		}
+		return
+	}
+
+	// A brand new key
+	if c.t1.len+c.b1.len >= c.capacity {
+		if c.t1.len < c.capacity {
+			c.drop(c.b1.tail)
+			c.replace(false)
+		} else {
+			c.drop(c.t1.tail)
+			c.stats.Evictions++
+		}
+	} else if total := c.t1.len + c.t2.len + c.b1.len + c.b2.len; total >= c.capacity {
+		if total >= 2*c.capacity {
+			c.drop(c.b2.tail)
+		}
+		c.replace(false)
+	}
+
+	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: expiresAt, Version: nextVersion(), segment: arcT1, cost: cost}
+	c.nodesMap[key] = newNode
+	c.t1.pushFront(newNode)
+	c.used += cost
+
+	for c.overBudget() && c.evictForCost(newNode) {
+	}
+}
+
+func (c *ARC[K, V]) Delete(key K) bool {
+	node, found := c.nodesMap[key]
+	if !found {
+		return false
+	}
+
+	c.drop(node)
+	return node.segment <= arcT2
+}
+
+func (c *ARC[K, V]) DeleteExpired() {
+	now := time.Now()
+	for _, node := range c.nodesMap {
+		if node.segment <= arcT2 && node.expired(now) {
+			c.drop(node)
+		}
+	}
+}
+
+func (c *ARC[K, V]) Stats() Stats {
+	stats := c.stats
+	stats.Items = c.t1.len + c.t2.len
+	stats.Bytes = c.used
+	return stats
+}
+
+// Ordered lists the recency side (T1) before the frequency side (T2).
+func (c *ARC[K, V]) Ordered() []Item[K, V] {
+	res := make([]Item[K, V], 0, c.t1.len+c.t2.len)
+	res = appendOrdered(res, &c.t1)
+	return appendOrdered(res, &c.t2)
+}
+
+func (c *ARC[K, V]) Items() map[K]Entry[V] {
+	res := make(map[K]Entry[V])
+	collectItems(res, &c.t1)
+	collectItems(res, &c.t2)
+	return res
+}
+
+// replace demotes the LRU entry of T1 or T2 to its ghost list, following the
+// paper's REPLACE routine. inB2 is true when the incoming key was a B2 ghost.
+// Deletes and expiry can leave free slots, in which case nothing is demoted.
+func (c *ARC[K, V]) replace(inB2 bool) {
+	if c.t1.len+c.t2.len < c.capacity {
+		return
+	}
+
+	if c.t1.len > 0 && (c.t1.len > c.p || (inB2 && c.t1.len == c.p)) {
+		c.demote(c.t1.tail, arcB1)
+	} else if c.t2.len > 0 {
+		c.demote(c.t2.tail, arcB2)
+	} else if c.t1.len > 0 {
+		c.demote(c.t1.tail, arcB1)
+	}
+}
+
+// evictForCost demotes resident entries other than keep while the byte budget is
+// exceeded, preferring whichever list is above its target size.
+func (c *ARC[K, V]) evictForCost(keep *Node[K, V]) bool {
+	t1Victim, t2Victim := c.t1.tail, c.t2.tail
+	if t1Victim == keep {
+		t1Victim = t1Victim.Prev
+	}
+	if t2Victim == keep {
+		t2Victim = t2Victim.Prev
+	}
+
+	switch {
+	case t1Victim != nil && (c.t1.len > c.p || t2Victim == nil):
+		c.demote(t1Victim, arcB1)
+	case t2Victim != nil:
+		c.demote(t2Victim, arcB2)
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *ARC[K, V]) demote(node *Node[K, V], ghost uint8) {
+	var emptyValue V
+	node.Value = emptyValue // ghosts only remember the key
+	c.used -= node.cost
+	node.cost = 0
+	c.move(node, ghost)
+	c.stats.Evictions++
+}
+
+func (c *ARC[K, V]) move(node *Node[K, V], segment uint8) {
+	c.segmentList(node.segment).remove(node)
+	node.segment = segment
+	c.segmentList(segment).pushFront(node)
+}
+
+func (c *ARC[K, V]) drop(node *Node[K, V]) {
+	if node == nil {
+		return
+	}
+	c.segmentList(node.segment).remove(node)
+	delete(c.nodesMap, node.Key)
+	c.used -= node.cost
+}
+
+func (c *ARC[K, V]) segmentList(segment uint8) *list[K, V] {
+	switch segment {
+	case arcT1:
+		return &c.t1
+	case arcT2:
+		return &c.t2
+	case arcB1:
+		return &c.b1
+	default:
+		return &c.b2
+	}
+}
@@ -0,0 +1,62 @@
+package lru
+
+import "unsafe"
+
+// CostFunc reports how much of a policy's cost budget an entry uses.
+type CostFunc[K comparable, V any] func(key K, value V) int64
+
+// ByteCost is the default CostFunc. It charges the length of string and []byte
+// keys and values, Size() for values that report their own size, and the
+// shallow in-memory size for everything else.
+func ByteCost[K comparable, V any](key K, value V) int64 {
+	return sizeOf(key) + sizeOf(value)
+}
+
+func sizeOf[T any](v T) int64 {
+	switch x := any(v).(type) {
+	case []byte:
+		return int64(len(x))
+	case string:
+		return int64(len(x))
+	case interface{ Size() int }:
+		return int64(x.Size())
+	default:
+		return int64(unsafe.Sizeof(v))
+	}
+}
+
+// limits bounds a policy by entry count, total cost, or both.
+// A capacity or maxCost <= 0 disables that bound.
+type limits[K comparable, V any] struct {
+	capacity int
+	maxCost  int64
+	costFn   CostFunc[K, V]
+	used     int64
+}
+
+func newLimits[K comparable, V any](capacity int) limits[K, V] {
+	return limits[K, V]{capacity: capacity, costFn: ByteCost[K, V]}
+}
+
+func (l *limits[K, V]) limitsRef() *limits[K, V] {
+	return l
+}
+
+func (l *limits[K, V]) costOf(key K, value V) int64 {
+	return l.costFn(key, value)
+}
+
+// tooBig reports whether an entry can never fit, however much is evicted.
+func (l *limits[K, V]) tooBig(cost int64) bool {
+	return l.maxCost > 0 && cost > l.maxCost
+}
+
+// needsRoom reports whether something has to go before a new entry of the given
+// cost can join the existing items.
+func (l *limits[K, V]) needsRoom(items int, cost int64) bool {
+	return (l.capacity > 0 && items >= l.capacity) || (l.maxCost > 0 && l.used+cost > l.maxCost)
+}
+
+func (l *limits[K, V]) overBudget() bool {
+	return l.maxCost > 0 && l.used > l.maxCost
+}
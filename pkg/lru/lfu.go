@@ -0,0 +1,194 @@
+package lru
+
+import (
+	"slices"
+	"time"
+)
+
+// LFU evicts the least frequently used entry, breaking ties by recency.
+// Every operation is O(1): nodes live in one list per access count.
+type LFU[K comparable, V any] struct {
+	limits[K, V]
+	nodesMap map[K]*Node[K, V]
+	freqs    map[int]*list[K, V]
+	minFreq  int
+	stats    Stats
+}
+
+func NewLFUCache[K comparable, V any](capacity int) *LFU[K, V] {
+	return &LFU[K, V]{
+		limits:   newLimits[K, V](capacity),
+		nodesMap: make(map[K]*Node[K, V]),
+		freqs:    make(map[int]*list[K, V]),
+	}
+}
+
+func (c *LFU[K, V]) Get(key K) (V, bool) {
+	var emptyValue V
+	node, found := c.nodesMap[key]
+	if !found || node.expired(time.Now()) {
+		c.stats.Misses++
+		return emptyValue, false
+	}
+
+	c.touch(node)
+
+	c.stats.Hits++
+	return node.Value, true
+}
+
+func (c *LFU[K, V]) Peek(key K) (Entry[V], bool) {
+	node, found := c.nodesMap[key]
+	return peekNode(node, found)
+}
+
+func (c *LFU[K, V]) Set(key K, value V, ttl time.Duration) {
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		c.Delete(key)
+		return
+	}
+
+	if node, found := c.nodesMap[key]; found {
+		c.used += cost - node.cost
+		node.cost = cost
+		node.Value = value
+		node.ExpiresAt = expiryFor(ttl)
+		node.Version = nextVersion()
+		c.touch(node)
+
+		for c.overBudget() && c.evict(node) {
+		}
+		return
+	}
+
+	for c.needsRoom(len(c.nodesMap), cost) && c.evict(nil) {
+	}
+
+	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: expiryFor(ttl), Version: nextVersion(), freq: 1, cost: cost}
+	c.nodesMap[key] = newNode
+	c.bucket(1).pushFront(newNode)
+	c.minFreq = 1
+	c.used += cost
+}
+
+func (c *LFU[K, V]) Delete(key K) bool {
+	node, found := c.nodesMap[key]
+	if !found {
+		return false
+	}
+
+	c.unlink(node)
+	delete(c.nodesMap, key)
+	c.used -= node.cost
+	return true
+}
+
+func (c *LFU[K, V]) DeleteExpired() {
+	now := time.Now()
+	for key, node := range c.nodesMap {
+		if node.expired(now) {
+			c.unlink(node)
+			delete(c.nodesMap, key)
+			c.used -= node.cost
+		}
+	}
+}
+
+func (c *LFU[K, V]) Stats() Stats {
+	stats := c.stats
+	stats.Items = len(c.nodesMap)
+	stats.Bytes = c.used
+	return stats
+}
+
+func (c *LFU[K, V]) Items() map[K]Entry[V] {
+	res := make(map[K]Entry[V])
+	for _, l := range c.freqs {
+		collectItems(res, l)
+	}
+	return res
+}
+
+// Ordered lists the lowest frequencies first, least recent first within each.
+func (c *LFU[K, V]) Ordered() []Item[K, V] {
+	freqs := make([]int, 0, len(c.freqs))
+	for freq := range c.freqs {
+		freqs = append(freqs, freq)
+	}
+	slices.Sort(freqs)
+
+	res := make([]Item[K, V], 0, len(c.nodesMap))
+	for _, freq := range freqs {
+		res = appendOrdered(res, c.freqs[freq])
+	}
+	return res
+}
+
+func (c *LFU[K, V]) touch(node *Node[K, V]) {
+	oldFreq := node.freq
+	c.unlink(node)
+	if oldFreq == c.minFreq && c.freqs[oldFreq] == nil {
+		c.minFreq++
+	}
+
+	node.freq++
+	c.bucket(node.freq).pushFront(node)
+}
+
+func (c *LFU[K, V]) bucket(freq int) *list[K, V] {
+	l, found := c.freqs[freq]
+	if !found {
+		l = &list[K, V]{}
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// unlink removes the node from its frequency list, dropping the list once empty
+// so that minFreq can be recomputed from the remaining keys.
+func (c *LFU[K, V]) unlink(node *Node[K, V]) {
+	l := c.freqs[node.freq]
+	l.remove(node)
+	if l.len == 0 {
+		delete(c.freqs, node.freq)
+	}
+}
+
+// evict drops the least frequently used entry other than keep and reports
+// whether there was one.
+func (c *LFU[K, V]) evict(keep *Node[K, V]) bool {
+	victim := c.victim(c.freqs[c.minFreq], keep)
+	if victim == nil {
+		// Deletes can leave minFreq pointing at a list that no longer exists,
+		// and keep may be the only entry at the lowest frequency
+		bestFreq := 0
+		for freq, l := range c.freqs {
+			if candidate := c.victim(l, keep); candidate != nil && (victim == nil || freq < bestFreq) {
+				victim, bestFreq = candidate, freq
+			}
+		}
+		if victim == nil {
+			return false
+		}
+		if keep == nil {
+			c.minFreq = bestFreq
+		}
+	}
+
+	c.unlink(victim)
+	delete(c.nodesMap, victim.Key)
+	c.used -= victim.cost
+	c.stats.Evictions++
+	return true
+}
+
+func (c *LFU[K, V]) victim(l *list[K, V], keep *Node[K, V]) *Node[K, V] {
+	if l == nil {
+		return nil
+	}
+	if l.tail != keep {
+		return l.tail
+	}
+	return l.tail.Prev
+}
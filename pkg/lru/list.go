@@ -0,0 +1,105 @@
+package lru
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// list is a doubly linked list of nodes with the most recently inserted node at the head.
+// The policies other than LRU share it so they only have to express their own bookkeeping.
+type list[K comparable, V any] struct {
+	head *Node[K, V]
+	tail *Node[K, V]
+	len  int
+}
+
+func (l *list[K, V]) pushFront(node *Node[K, V]) {
+	node.Next = l.head
+	node.Prev = nil
+
+	if l.head != nil {
+		l.head.Prev = node
+	}
+	l.head = node
+
+	if l.tail == nil {
+		l.tail = node
+	}
+	l.len++
+}
+
+func (l *list[K, V]) remove(node *Node[K, V]) {
+	if node.Prev != nil {
+		node.Prev.Next = node.Next
+	} else {
+		l.head = node.Next
+	}
+
+	if node.Next != nil {
+		node.Next.Prev = node.Prev
+	} else {
+		l.tail = node.Prev
+	}
+
+	node.Next = nil
+	node.Prev = nil
+	l.len--
+}
+
+func (l *list[K, V]) moveToFront(node *Node[K, V]) {
+	if l.head == node {
+		return
+	}
+	l.remove(node)
+	l.pushFront(node)
+}
+
+func (n *Node[K, V]) expired(now time.Time) bool {
+	return !n.ExpiresAt.IsZero() && now.After(n.ExpiresAt)
+}
+
+// expiryFor turns a TTL into an absolute deadline; NoExpiration maps to the zero time.
+func expiryFor(ttl time.Duration) time.Time {
+	if ttl == NoExpiration {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func peekNode[K comparable, V any](node *Node[K, V], found bool) (Entry[V], bool) {
+	if !found || node.expired(time.Now()) {
+		return Entry[V]{}, false
+	}
+	return entryOf(node), true
+}
+
+func entryOf[K comparable, V any](node *Node[K, V]) Entry[V] {
+	return Entry[V]{Value: node.Value, ExpiryAt: node.ExpiresAt, Version: node.Version}
+}
+
+// versions numbers every Set across the process, so no two writes share a
+// Version even when Resize moves a key to another shard.
+var versions atomic.Uint64
+
+func nextVersion() uint64 {
+	return versions.Add(1)
+}
+
+func itemOf[K comparable, V any](node *Node[K, V]) Item[K, V] {
+	return Item[K, V]{Key: node.Key, Entry: entryOf(node)}
+}
+
+// appendOrdered appends the list's entries from the tail (least recently
+// inserted) to the head.
+func appendOrdered[K comparable, V any](res []Item[K, V], l *list[K, V]) []Item[K, V] {
+	for node := l.tail; node != nil; node = node.Prev {
+		res = append(res, itemOf(node))
+	}
+	return res
+}
+
+func collectItems[K comparable, V any](res map[K]Entry[V], l *list[K, V]) {
+	for node := l.head; node != nil; node = node.Next {
+		res[node.Key] = entryOf(node)
+	}
+}
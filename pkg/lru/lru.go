@@ -8,16 +8,26 @@ type Node[K comparable, V any] struct {
 	Prev      *Node[K, V]
 	Next      *Node[K, V]
 	ExpiresAt time.Time
+	Version   uint64
+
+	cost int64
+
+	// Bookkeeping used by the non-LRU policies
+	freq    int
+	segment uint8
+	visited bool
 }
 
 type Stats struct {
 	Hits      uint64
 	Misses    uint64
 	Evictions uint64
+	Items     int
+	Bytes     int64 // Total cost of the live entries, in bytes unless a custom CostFunc is used
 }
 
 type LRU[K comparable, V any] struct {
-	capacity int
+	limits[K, V]
 	nodesMap map[K]*Node[K, V]
 	head     *Node[K, V]
 	tail     *Node[K, V]
@@ -26,12 +36,26 @@ type LRU[K comparable, V any] struct {
 
 type Entry[V any] struct {
 	Value    V
-	ExpiryAt time.Time
+	ExpiryAt time.Time // Zero for entries that never expire
+	// Version is new on every Set of the key, so it identifies one write, for
+	// compare-and-swap.
+	Version uint64
+}
+
+// Item is an entry together with its key.
+type Item[K comparable, V any] struct {
+	Key K
+	Entry[V]
+}
+
+// Expired reports whether the entry's TTL has run out by now.
+func (e Entry[V]) Expired(now time.Time) bool {
+	return !e.ExpiryAt.IsZero() && now.After(e.ExpiryAt)
 }
 
 func NewLRUCache[K comparable, V any](capacity int) *LRU[K, V] {
 	return &LRU[K, V]{
-		capacity: capacity,
+		limits:   newLimits[K, V](capacity),
 		nodesMap: make(map[K]*Node[K, V]),
 	}
 }
@@ -44,7 +68,7 @@ func (c *LRU[K, V]) Get(key K) (V, bool) {
 		return emptyValue, false
 	}
 
-	if time.Now().After(node.ExpiresAt) {
+	if node.expired(time.Now()) {
 		c.stats.Misses++
 		return emptyValue, false
 	}
@@ -56,45 +80,86 @@ func (c *LRU[K, V]) Get(key K) (V, bool) {
 	return node.Value, true
 }
 
+func (c *LRU[K, V]) Peek(key K) (Entry[V], bool) {
+	node, found := c.nodesMap[key]
+	return peekNode(node, found)
+}
+
 func (c *LRU[K, V]) Set(key K, value V, ttl time.Duration) {
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		c.Delete(key)
+		return
+	}
+
 	if node, found := c.nodesMap[key]; found {
+		c.used += cost - node.cost
+		node.cost = cost
 		node.Value = value
-		node.ExpiresAt = time.Now().Add(ttl)
+		node.ExpiresAt = expiryFor(ttl)
+		node.Version = nextVersion()
 		c.extract(node)
 		c.pushFront(node)
+
+		// A bigger value may push the shard over its byte budget
+		for c.overBudget() && c.tail != node {
+			c.evict()
+		}
 		return
 	}
 
-	if len(c.nodesMap) >= c.capacity {
+	for c.needsRoom(len(c.nodesMap), cost) && c.tail != nil {
 		c.evict()
 	}
 
-	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: time.Now().Add(ttl)}
+	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: expiryFor(ttl), Version: nextVersion(), cost: cost}
 	c.nodesMap[key] = newNode
 	c.pushFront(newNode)
+	c.used += cost
+}
+
+func (c *LRU[K, V]) Delete(key K) bool {
+	node, found := c.nodesMap[key]
+	if !found {
+		return false
+	}
+
+	c.extract(node)
+	delete(c.nodesMap, key)
+	c.used -= node.cost
+	return true
 }
 
 func (c *LRU[K, V]) DeleteExpired() {
 	now := time.Now()
 	for key, node := range c.nodesMap {
-		if now.After(node.ExpiresAt) {
+		if node.expired(now) {
 			c.extract(node)
 			delete(c.nodesMap, key)
+			c.used -= node.cost
 		}
 	}
 }
 
 func (c *LRU[K, V]) Stats() Stats {
-	return c.stats
+	stats := c.stats
+	stats.Items = len(c.nodesMap)
+	stats.Bytes = c.used
+	return stats
 }
 
 func (c *LRU[K, V]) Items() map[K]Entry[V] {
 	res := make(map[K]Entry[V])
 	for k, node := range c.nodesMap {
-		res[k] = Entry[V]{
-			Value:    node.Value,
-			ExpiryAt: node.ExpiresAt,
-		}
+		res[k] = entryOf(node)
+	}
+	return res
+}
+
+func (c *LRU[K, V]) Ordered() []Item[K, V] {
+	res := make([]Item[K, V], 0, len(c.nodesMap))
+	for node := c.tail; node != nil; node = node.Prev {
+		res = append(res, itemOf(node))
 	}
 	return res
 }
@@ -136,6 +201,7 @@ func (c *LRU[K, V]) evict() {
 	}
 
 	delete(c.nodesMap, c.tail.Key)
+	c.used -= c.tail.cost
 	c.stats.Evictions++
 
 	if c.head == c.tail {
@@ -32,6 +32,32 @@ func TestLRU_SetAndGet(t *testing.T) {
 	}
 }
 
+func TestLRU_Delete(t *testing.T) {
+	cache := NewLRUCache[string, int](2)
+
+	cache.Set("a", 1, ttl)
+	cache.Set("b", 2, ttl)
+
+	if !cache.Delete("a") {
+		t.Fatal("Expected 'a' to be deleted")
+	}
+	if cache.Delete("a") {
+		t.Error("Expected second delete of 'a' to report false")
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected 'a' to be gone")
+	}
+
+	// The freed slot must be reusable without evicting "b"
+	cache.Set("c", 3, ttl)
+	if val, ok := cache.Get("b"); !ok || val != 2 {
+		t.Errorf("Expected 2, got %v", val)
+	}
+	if stats := cache.Stats(); stats.Evictions != 0 {
+		t.Errorf("Expected no evictions, got %d", stats.Evictions)
+	}
+}
+
 func BenchmarkLRU_Set(b *testing.B) {
 	cache := NewLRUCache[int, int](1000)
 	b.ResetTimer() // Don't count the setup time
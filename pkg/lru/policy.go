@@ -0,0 +1,92 @@
+package lru
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Policy is an eviction strategy a shard can be built on.
+// Implementations are not safe for concurrent use; the shard lock guards them.
+type Policy[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	// Peek looks up a live entry without counting a hit or miss or refreshing it.
+	Peek(key K) (Entry[V], bool)
+	Set(key K, value V, ttl time.Duration)
+	Delete(key K) bool
+	DeleteExpired()
+	Stats() Stats
+	Items() map[K]Entry[V]
+	// Ordered returns the entries coldest first, the order the policy would evict
+	// them in. Setting them into an empty policy in that order rebuilds the same
+	// recency, though not any frequency counts.
+	Ordered() []Item[K, V]
+}
+
+// NoExpiration as a TTL keeps an entry until it is evicted or deleted. Any
+// other TTL sets a deadline, so one of 0 or less expires the entry at once.
+const NoExpiration time.Duration = math.MinInt64
+
+type PolicyType string
+
+const (
+	PolicyLRU     PolicyType = "lru"
+	PolicyLFU     PolicyType = "lfu"
+	PolicyTinyLFU PolicyType = "w-tinylfu"
+	PolicySIEVE   PolicyType = "sieve"
+	PolicyARC     PolicyType = "arc"
+)
+
+var (
+	_ Policy[string, int] = (*LRU[string, int])(nil)
+	_ Policy[string, int] = (*LFU[string, int])(nil)
+	_ Policy[string, int] = (*TinyLFU[string, int])(nil)
+	_ Policy[string, int] = (*SIEVE[string, int])(nil)
+	_ Policy[string, int] = (*ARC[string, int])(nil)
+)
+
+// NewPolicy builds the policy named by t, holding at most capacity entries.
+func NewPolicy[K comparable, V any](t PolicyType, capacity int) (Policy[K, V], error) {
+	return NewWeightedPolicy[K, V](t, capacity, 0, nil)
+}
+
+// NewWeightedPolicy builds the policy named by t, bounded by capacity entries and
+// by maxCost as measured by cost (ByteCost when nil). Either bound can be disabled
+// with a value <= 0, except that ARC and W-TinyLFU size their internal lists from
+// the entry capacity and therefore always need one.
+// Entries are evicted until a new one fits; an entry costing more than maxCost on
+// its own is not stored at all.
+func NewWeightedPolicy[K comparable, V any](t PolicyType, capacity int, maxCost int64, cost CostFunc[K, V]) (Policy[K, V], error) {
+	if capacity <= 0 && (t == PolicyARC || t == PolicyTinyLFU) {
+		return nil, fmt.Errorf("eviction policy %q needs an item capacity", t)
+	}
+
+	policy, err := newPolicy[K, V](t, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	l := policy.(interface{ limitsRef() *limits[K, V] }).limitsRef()
+	l.maxCost = maxCost
+	if cost != nil {
+		l.costFn = cost
+	}
+	return policy, nil
+}
+
+func newPolicy[K comparable, V any](t PolicyType, capacity int) (Policy[K, V], error) {
+	switch t {
+	case PolicyLRU, "":
+		return NewLRUCache[K, V](capacity), nil
+	case PolicyLFU:
+		return NewLFUCache[K, V](capacity), nil
+	case PolicyTinyLFU:
+		return NewTinyLFUCache[K, V](capacity), nil
+	case PolicySIEVE:
+		return NewSIEVECache[K, V](capacity), nil
+	case PolicyARC:
+		return NewARCCache[K, V](capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", t)
+	}
+}
@@ -0,0 +1,287 @@
+package lru
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var allPolicies = []PolicyType{PolicyLRU, PolicyLFU, PolicyTinyLFU, PolicySIEVE, PolicyARC}
+
+func newTestPolicy(t testing.TB, policyType PolicyType, capacity int) Policy[string, int] {
+	t.Helper()
+	cache, err := NewPolicy[string, int](policyType, capacity)
+	if err != nil {
+		t.Fatalf("NewPolicy(%q): %v", policyType, err)
+	}
+	return cache
+}
+
+func TestPolicy_Basics(t *testing.T) {
+	for _, policyType := range allPolicies {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache := newTestPolicy(t, policyType, 100)
+
+			cache.Set("a", 1, ttl)
+			cache.Set("b", 2, ttl)
+			cache.Set("a", 10, ttl)
+
+			if val, ok := cache.Get("a"); !ok || val != 10 {
+				t.Errorf("Expected 10, got %v", val)
+			}
+			if _, ok := cache.Get("missing"); ok {
+				t.Error("Expected miss for unknown key")
+			}
+
+			if !cache.Delete("b") {
+				t.Error("Expected 'b' to be deleted")
+			}
+			if _, ok := cache.Get("b"); ok {
+				t.Error("Expected 'b' to be gone")
+			}
+
+			cache.Set("short", 3, -time.Second)
+			if _, ok := cache.Get("short"); ok {
+				t.Error("Expected expired entry to miss")
+			}
+			cache.DeleteExpired()
+			if _, found := cache.Items()["short"]; found {
+				t.Error("Expected DeleteExpired to drop the expired entry")
+			}
+
+			stats := cache.Stats()
+			if stats.Hits != 1 || stats.Misses != 3 {
+				t.Errorf("Expected 1 hit and 3 misses, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestPolicy_ZeroTTLExpires(t *testing.T) {
+	for _, policyType := range allPolicies {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache := newTestPolicy(t, policyType, 100)
+
+			cache.Set("zero", 1, 0)
+			cache.Set("forever", 2, NoExpiration)
+			time.Sleep(time.Millisecond)
+
+			if _, ok := cache.Get("zero"); ok {
+				t.Error("Expected a TTL of 0 to expire the entry at once")
+			}
+			if entry, ok := cache.Peek("forever"); !ok || !entry.ExpiryAt.IsZero() {
+				t.Errorf("Expected NoExpiration to keep the entry without a deadline, got %+v, %v", entry, ok)
+			}
+		})
+	}
+}
+
+func TestPolicy_RespectsCapacity(t *testing.T) {
+	const capacity = 50
+	for _, policyType := range allPolicies {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache := newTestPolicy(t, policyType, capacity)
+
+			for i := 0; i < 10*capacity; i++ {
+				key := fmt.Sprintf("key-%d", i%(3*capacity))
+				cache.Set(key, i, ttl)
+				cache.Get(fmt.Sprintf("key-%d", i%7))
+
+				if n := len(cache.Items()); n > capacity {
+					t.Fatalf("Cache holds %d items, capacity is %d", n, capacity)
+				}
+			}
+
+			if cache.Stats().Evictions == 0 {
+				t.Error("Expected evictions once the cache overflowed")
+			}
+		})
+	}
+}
+
+// A hot working set that is read repeatedly must survive a one-off scan over many
+// cold keys. Plain LRU fails this, which is why the other policies exist.
+func TestPolicy_ScanResistance(t *testing.T) {
+	const capacity = 100
+	for _, policyType := range []PolicyType{PolicyLFU, PolicyTinyLFU, PolicySIEVE, PolicyARC} {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache := newTestPolicy(t, policyType, capacity)
+
+			for round := 0; round < 5; round++ {
+				for i := 0; i < capacity/2; i++ {
+					key := fmt.Sprintf("hot-%d", i)
+					if _, ok := cache.Get(key); !ok {
+						cache.Set(key, i, ttl)
+					}
+				}
+			}
+
+			for i := 0; i < 10*capacity; i++ {
+				cache.Set(fmt.Sprintf("scan-%d", i), i, ttl)
+			}
+
+			survivors := 0
+			for i := 0; i < capacity/2; i++ {
+				if _, ok := cache.Get(fmt.Sprintf("hot-%d", i)); ok {
+					survivors++
+				}
+			}
+			if survivors < capacity/4 {
+				t.Errorf("Only %d of %d hot keys survived the scan", survivors, capacity/2)
+			}
+		})
+	}
+}
+
+func TestPolicy_MaxCost(t *testing.T) {
+	const maxCost = 1000
+	for _, policyType := range allPolicies {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache, err := NewWeightedPolicy[string, []byte](policyType, 1000, maxCost, nil)
+			if err != nil {
+				t.Fatalf("NewWeightedPolicy: %v", err)
+			}
+
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("k%03d", i%120)
+				cache.Set(key, make([]byte, 10+(i*37)%300), ttl)
+				cache.Get(fmt.Sprintf("k%03d", i%5))
+
+				stats := cache.Stats()
+				if stats.Bytes > maxCost {
+					t.Fatalf("Cache uses %d bytes, budget is %d", stats.Bytes, maxCost)
+				}
+
+				var want int64
+				for k, entry := range cache.Items() {
+					want += int64(len(k) + len(entry.Value))
+				}
+				if stats.Bytes != want {
+					t.Fatalf("Stats report %d bytes, items add up to %d", stats.Bytes, want)
+				}
+				if stats.Items != len(cache.Items()) {
+					t.Fatalf("Stats report %d items, cache holds %d", stats.Items, len(cache.Items()))
+				}
+			}
+
+			// An entry bigger than the whole budget is rejected and replaces nothing
+			cache.Set("k001", make([]byte, maxCost+1), ttl)
+			if _, ok := cache.Get("k001"); ok {
+				t.Error("Expected oversized entry to be rejected")
+			}
+
+			// A large entry evicts as many others as needed to fit
+			cache.Set("big", make([]byte, maxCost-10), ttl)
+			if _, ok := cache.Get("big"); !ok {
+				t.Error("Expected large entry to be stored")
+			}
+			if stats := cache.Stats(); stats.Bytes > maxCost {
+				t.Errorf("Cache uses %d bytes, budget is %d", stats.Bytes, maxCost)
+			}
+		})
+	}
+}
+
+func TestPolicy_CustomCost(t *testing.T) {
+	cost := func(key string, value int) int64 { return int64(value) }
+	cache, _ := NewWeightedPolicy[string, int](PolicyLRU, 0, 10, cost)
+
+	cache.Set("a", 4, ttl)
+	cache.Set("b", 4, ttl)
+	cache.Set("c", 4, ttl) // 12 > 10, so the coldest entry "a" has to go
+
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected 'a' to be evicted")
+	}
+	if stats := cache.Stats(); stats.Bytes != 8 || stats.Items != 2 {
+		t.Errorf("Expected 8 bytes in 2 items, got %+v", stats)
+	}
+}
+
+func TestPolicy_Ordered(t *testing.T) {
+	for _, policyType := range allPolicies {
+		t.Run(string(policyType), func(t *testing.T) {
+			cache := newTestPolicy(t, policyType, 10)
+			for i := 0; i < 10; i++ {
+				cache.Set(fmt.Sprintf("k%d", i), i, ttl)
+			}
+			// Every key but k3 is touched again, so k3 is the coldest
+			for i := 0; i < 10; i++ {
+				if i != 3 {
+					cache.Get(fmt.Sprintf("k%d", i))
+				}
+			}
+
+			ordered := cache.Ordered()
+			seen := make(map[string]bool)
+			for _, item := range ordered {
+				if seen[item.Key] {
+					t.Fatalf("%s listed twice", item.Key)
+				}
+				seen[item.Key] = true
+				if want := "k" + fmt.Sprint(item.Value); item.Key != want {
+					t.Errorf("Item %s has value %d", item.Key, item.Value)
+				}
+			}
+			if len(ordered) != 10 {
+				t.Fatalf("Ordered returned %d items, want 10", len(ordered))
+			}
+			if ordered[0].Key != "k3" {
+				t.Errorf("Expected the untouched k3 to be coldest, got %s", ordered[0].Key)
+			}
+		})
+	}
+}
+
+func TestLRU_OrderedReplayEvictsTheSame(t *testing.T) {
+	original := newTestPolicy(t, PolicyLRU, 5)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		original.Set(k, 0, ttl)
+	}
+	original.Get("a")
+	original.Get("c")
+
+	replayed := newTestPolicy(t, PolicyLRU, 5)
+	for _, item := range original.Ordered() {
+		replayed.Set(item.Key, item.Value, ttl)
+	}
+
+	for _, cache := range []Policy[string, int]{original, replayed} {
+		cache.Set("f", 0, ttl)
+		cache.Set("g", 0, ttl)
+	}
+	for _, k := range []string{"b", "d"} {
+		if _, ok := replayed.Peek(k); ok {
+			t.Errorf("Expected %s to be evicted first after the replay", k)
+		}
+	}
+	if fmt.Sprint(keysOf(original.Ordered())) != fmt.Sprint(keysOf(replayed.Ordered())) {
+		t.Errorf("Replayed order %v differs from original %v", keysOf(replayed.Ordered()), keysOf(original.Ordered()))
+	}
+}
+
+func keysOf(items []Item[string, int]) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+func TestNewPolicy_Unknown(t *testing.T) {
+	if _, err := NewPolicy[string, int]("random", 10); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func BenchmarkPolicy_Set(b *testing.B) {
+	for _, policyType := range allPolicies {
+		b.Run(string(policyType), func(b *testing.B) {
+			cache, _ := NewPolicy[int, int](policyType, 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Set(i, i, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package lru
+
+import "time"
+
+// SIEVE keeps entries in insertion order and marks them as visited on a hit.
+// Eviction sweeps a hand from the oldest entry towards the newest, clearing marks
+// until it finds an unvisited entry. Hits never move nodes, which makes the policy
+// cheap and keeps one-off scans from displacing the working set.
+type SIEVE[K comparable, V any] struct {
+	limits[K, V]
+	nodesMap map[K]*Node[K, V]
+	queue    list[K, V]
+	hand     *Node[K, V]
+	stats    Stats
+}
+
+func NewSIEVECache[K comparable, V any](capacity int) *SIEVE[K, V] {
+	return &SIEVE[K, V]{
+		limits:   newLimits[K, V](capacity),
+		nodesMap: make(map[K]*Node[K, V]),
+	}
+}
+
+func (c *SIEVE[K, V]) Get(key K) (V, bool) {
+	var emptyValue V
+	node, found := c.nodesMap[key]
+	if !found || node.expired(time.Now()) {
+		c.stats.Misses++
+		return emptyValue, false
+	}
+
+	node.visited = true
+
+	c.stats.Hits++
+	return node.Value, true
+}
+
+func (c *SIEVE[K, V]) Peek(key K) (Entry[V], bool) {
+	node, found := c.nodesMap[key]
+	return peekNode(node, found)
+}
+
+func (c *SIEVE[K, V]) Set(key K, value V, ttl time.Duration) {
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		c.Delete(key)
+		return
+	}
+
+	if node, found := c.nodesMap[key]; found {
+		c.used += cost - node.cost
+		node.cost = cost
+		node.Value = value
+		node.ExpiresAt = expiryFor(ttl)
+		node.Version = nextVersion()
+		node.visited = true
+
+		for c.overBudget() && c.evict(node) {
+		}
+		return
+	}
+
+	for c.needsRoom(len(c.nodesMap), cost) && c.evict(nil) {
+	}
+
+	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: expiryFor(ttl), Version: nextVersion(), cost: cost}
+	c.nodesMap[key] = newNode
+	c.queue.pushFront(newNode)
+	c.used += cost
+}
+
+func (c *SIEVE[K, V]) Delete(key K) bool {
+	node, found := c.nodesMap[key]
+	if !found {
+		return false
+	}
+
+	c.unlink(node)
+	delete(c.nodesMap, key)
+	c.used -= node.cost
+	return true
+}
+
+func (c *SIEVE[K, V]) DeleteExpired() {
+	now := time.Now()
+	for key, node := range c.nodesMap {
+		if node.expired(now) {
+			c.unlink(node)
+			delete(c.nodesMap, key)
+			c.used -= node.cost
+		}
+	}
+}
+
+func (c *SIEVE[K, V]) Stats() Stats {
+	stats := c.stats
+	stats.Items = len(c.nodesMap)
+	stats.Bytes = c.used
+	return stats
+}
+
+// Ordered follows the hand's sweep from its current position: the unvisited
+// entries it would evict on the first pass, then the visited ones it would
+// come back to once their marks were cleared.
+func (c *SIEVE[K, V]) Ordered() []Item[K, V] {
+	res := make([]Item[K, V], 0, c.queue.len)
+	start := c.hand
+	if start == nil {
+		start = c.queue.tail
+	}
+	for _, visited := range []bool{false, true} {
+		node := start
+		for range c.queue.len {
+			if node.visited == visited {
+				res = append(res, itemOf(node))
+			}
+			if node = node.Prev; node == nil {
+				node = c.queue.tail
+			}
+		}
+	}
+	return res
+}
+
+func (c *SIEVE[K, V]) Items() map[K]Entry[V] {
+	res := make(map[K]Entry[V])
+	collectItems(res, &c.queue)
+	return res
+}
+
+// unlink removes the node from the queue, stepping the hand past it first.
+func (c *SIEVE[K, V]) unlink(node *Node[K, V]) {
+	if c.hand == node {
+		c.hand = node.Prev
+	}
+	c.queue.remove(node)
+}
+
+// evict sweeps the hand to the first unvisited entry other than keep, drops it
+// and reports whether there was one.
+func (c *SIEVE[K, V]) evict(keep *Node[K, V]) bool {
+	if c.queue.len == 0 || (c.queue.len == 1 && c.queue.head == keep) {
+		return false
+	}
+
+	node := c.hand
+	if node == nil {
+		node = c.queue.tail
+	}
+
+	for node.visited || node == keep {
+		if node != keep {
+			node.visited = false
+		}
+		node = node.Prev
+		if node == nil {
+			node = c.queue.tail
+		}
+	}
+
+	c.hand = node.Prev
+	c.queue.remove(node)
+	delete(c.nodesMap, node.Key)
+	c.used -= node.cost
+	c.stats.Evictions++
+	return true
+}
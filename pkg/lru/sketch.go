@@ -0,0 +1,73 @@
+package lru
+
+import "hash/maphash"
+
+const sketchDepth = 4
+
+// countMinSketch estimates how often keys were seen using 4 rows of saturating
+// 4-bit counters. Every resetAt increments all counters are halved so that the
+// estimates follow recent popularity rather than all-time totals.
+type countMinSketch[K comparable] struct {
+	seed      maphash.Seed
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch[K comparable](capacity int) *countMinSketch[K] {
+	width := 16
+	for width < capacity {
+		width <<= 1
+	}
+
+	s := &countMinSketch[K]{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		resetAt: 10 * max(capacity, 1),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch[K]) increment(key K) {
+	h := maphash.Comparable(s.seed, key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch[K]) estimate(key K) uint8 {
+	h := maphash.Comparable(s.seed, key)
+	est := uint8(15)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(h, i)])
+	}
+	return est
+}
+
+func (s *countMinSketch[K]) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+// index derives the column for row i from the two halves of one 64-bit hash
+// (Kirsch-Mitzenmacher double hashing).
+func (s *countMinSketch[K]) index(h uint64, i int) uint64 {
+	h1, h2 := h&0xffffffff, h>>32
+	return (h1 + uint64(i)*h2) & s.mask
+}
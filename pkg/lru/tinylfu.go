@@ -0,0 +1,223 @@
+package lru
+
+import "time"
+
+const (
+	tinyWindow uint8 = iota
+	tinyProbation
+	tinyProtected
+)
+
+// TinyLFU implements W-TinyLFU: new entries land in a small LRU window (1% of the
+// capacity), and an entry leaving the window only enters the main segmented LRU
+// if a count-min sketch says it is used more often than the entry it would evict.
+// One-off scans therefore churn through the window without flushing the hot set.
+type TinyLFU[K comparable, V any] struct {
+	limits[K, V]
+	windowCap    int
+	protectedCap int
+	mainCap      int
+	nodesMap     map[K]*Node[K, V]
+	window       list[K, V]
+	probation    list[K, V]
+	protected    list[K, V]
+	sketch       *countMinSketch[K]
+	stats        Stats
+}
+
+func NewTinyLFUCache[K comparable, V any](capacity int) *TinyLFU[K, V] {
+	windowCap := max(1, capacity/100)
+	mainCap := max(0, capacity-windowCap)
+	return &TinyLFU[K, V]{
+		limits:       newLimits[K, V](capacity),
+		windowCap:    windowCap,
+		mainCap:      mainCap,
+		protectedCap: mainCap * 8 / 10,
+		nodesMap:     make(map[K]*Node[K, V]),
+		sketch:       newCountMinSketch[K](capacity),
+	}
+}
+
+func (c *TinyLFU[K, V]) Get(key K) (V, bool) {
+	var emptyValue V
+	c.sketch.increment(key)
+
+	node, found := c.nodesMap[key]
+	if !found || node.expired(time.Now()) {
+		c.stats.Misses++
+		return emptyValue, false
+	}
+
+	c.touch(node)
+
+	c.stats.Hits++
+	return node.Value, true
+}
+
+func (c *TinyLFU[K, V]) Peek(key K) (Entry[V], bool) {
+	node, found := c.nodesMap[key]
+	return peekNode(node, found)
+}
+
+func (c *TinyLFU[K, V]) Set(key K, value V, ttl time.Duration) {
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		c.Delete(key)
+		return
+	}
+
+	if node, found := c.nodesMap[key]; found {
+		c.used += cost - node.cost
+		node.cost = cost
+		node.Value = value
+		node.ExpiresAt = expiryFor(ttl)
+		node.Version = nextVersion()
+		c.touch(node)
+
+		for c.overBudget() && c.evictForCost(node) {
+		}
+		return
+	}
+
+	c.sketch.increment(key)
+
+	newNode := &Node[K, V]{Key: key, Value: value, ExpiresAt: expiryFor(ttl), Version: nextVersion(), segment: tinyWindow, cost: cost}
+	c.nodesMap[key] = newNode
+	c.window.pushFront(newNode)
+	c.used += cost
+
+	if c.window.len > c.windowCap {
+		c.admit(c.window.tail)
+	}
+	for c.overBudget() && c.evictForCost(newNode) {
+	}
+}
+
+func (c *TinyLFU[K, V]) Delete(key K) bool {
+	node, found := c.nodesMap[key]
+	if !found {
+		return false
+	}
+
+	c.remove(node)
+	return true
+}
+
+func (c *TinyLFU[K, V]) DeleteExpired() {
+	now := time.Now()
+	for _, node := range c.nodesMap {
+		if node.expired(now) {
+			c.remove(node)
+		}
+	}
+}
+
+func (c *TinyLFU[K, V]) Stats() Stats {
+	stats := c.stats
+	stats.Items = len(c.nodesMap)
+	stats.Bytes = c.used
+	return stats
+}
+
+// Ordered follows the segment order evictForCost uses: probation, then the
+// window, then protected.
+func (c *TinyLFU[K, V]) Ordered() []Item[K, V] {
+	res := make([]Item[K, V], 0, len(c.nodesMap))
+	for _, l := range []*list[K, V]{&c.probation, &c.window, &c.protected} {
+		res = appendOrdered(res, l)
+	}
+	return res
+}
+
+func (c *TinyLFU[K, V]) Items() map[K]Entry[V] {
+	res := make(map[K]Entry[V])
+	collectItems(res, &c.window)
+	collectItems(res, &c.probation)
+	collectItems(res, &c.protected)
+	return res
+}
+
+func (c *TinyLFU[K, V]) touch(node *Node[K, V]) {
+	switch node.segment {
+	case tinyWindow:
+		c.window.moveToFront(node)
+	case tinyProtected:
+		c.protected.moveToFront(node)
+	case tinyProbation:
+		// A second hit while on probation earns a place in the protected segment
+		c.probation.remove(node)
+		node.segment = tinyProtected
+		c.protected.pushFront(node)
+
+		if c.protected.len > c.protectedCap {
+			demoted := c.protected.tail
+			c.protected.remove(demoted)
+			demoted.segment = tinyProbation
+			c.probation.pushFront(demoted)
+		}
+	}
+}
+
+// admit moves the window's LRU entry into the main segment, or evicts it if the
+// main segment is full of entries the sketch considers more popular.
+func (c *TinyLFU[K, V]) admit(candidate *Node[K, V]) {
+	c.window.remove(candidate)
+
+	if c.probation.len+c.protected.len < c.mainCap {
+		candidate.segment = tinyProbation
+		c.probation.pushFront(candidate)
+		return
+	}
+
+	victim := c.probation.tail
+	if victim == nil {
+		victim = c.protected.tail
+	}
+
+	if victim == nil || c.sketch.estimate(candidate.Key) <= c.sketch.estimate(victim.Key) {
+		delete(c.nodesMap, candidate.Key)
+		c.used -= candidate.cost
+		c.stats.Evictions++
+		return
+	}
+
+	c.remove(victim)
+	c.stats.Evictions++
+
+	candidate.segment = tinyProbation
+	c.probation.pushFront(candidate)
+}
+
+// evictForCost drops entries while the byte budget is exceeded, coldest segment
+// first, and reports whether it found something other than keep to drop.
+func (c *TinyLFU[K, V]) evictForCost(keep *Node[K, V]) bool {
+	for _, l := range []*list[K, V]{&c.probation, &c.window, &c.protected} {
+		victim := l.tail
+		if victim == keep {
+			victim = victim.Prev
+		}
+		if victim != nil {
+			c.remove(victim)
+			c.stats.Evictions++
+			return true
+		}
+	}
+	return false
+}
+
+func (c *TinyLFU[K, V]) remove(node *Node[K, V]) {
+	c.segmentList(node.segment).remove(node)
+	delete(c.nodesMap, node.Key)
+	c.used -= node.cost
+}
+
+func (c *TinyLFU[K, V]) segmentList(segment uint8) *list[K, V] {
+	switch segment {
+	case tinyWindow:
+		return &c.window
+	case tinyProbation:
+		return &c.probation
+	default:
+		return &c.protected
+	}
+}
@@ -0,0 +1,77 @@
+package memcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// Memcached clients attach 32-bit flags to every item, which PHP clients use to
+// remember how a value was serialized. The cache only stores bytes, so non-zero
+// flags travel in a small header in front of the data. Items with flags 0, which
+// is what most clients send for plain strings, are stored untouched and read the
+// same through the HTTP and RESP APIs.
+var flagsMagic = []byte{0x00, 'm', 'c', 'f'}
+
+const flagsHeaderLen = 8 // magic + uint32 flags
+
+// maxRelativeExptime is the largest exptime memcached treats as relative seconds;
+// anything above it is an absolute Unix timestamp.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+func encodeItem(flags uint32, data []byte) []byte {
+	if flags == 0 {
+		return data
+	}
+
+	buf := make([]byte, flagsHeaderLen+len(data))
+	copy(buf, flagsMagic)
+	binary.BigEndian.PutUint32(buf[len(flagsMagic):], flags)
+	copy(buf[flagsHeaderLen:], data)
+	return buf
+}
+
+func decodeItem(stored []byte) (flags uint32, data []byte) {
+	if len(stored) >= flagsHeaderLen && bytes.HasPrefix(stored, flagsMagic) {
+		return binary.BigEndian.Uint32(stored[len(flagsMagic):]), stored[flagsHeaderLen:]
+	}
+	return 0, stored
+}
+
+// ttlOf returns the TTL an entry has left, to carry over when it is rewritten.
+func ttlOf(entry lru.Entry[[]byte]) time.Duration {
+	if entry.ExpiryAt.IsZero() {
+		return lru.NoExpiration
+	}
+	return max(time.Until(entry.ExpiryAt), time.Nanosecond)
+}
+
+// ttlFromExptime converts a memcached exptime into a TTL. expired is true when
+// the item should disappear straight away (negative or past absolute times).
+func ttlFromExptime(exptime int64) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return lru.NoExpiration, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= maxRelativeExptime:
+		return time.Duration(exptime) * time.Second, false
+	default:
+		ttl = time.Until(time.Unix(exptime, 0))
+		return ttl, ttl <= 0
+	}
+}
+
+func validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,323 @@
+package memcache
+
+import (
+	"bufio"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// metaRequest holds the parsed key and flags of an mg, ms or md command.
+// Each flag is a single letter, optionally followed by a token (e.g. T30, Oabc).
+type metaRequest struct {
+	key     string
+	rawKey  string
+	flags   []metaFlag
+	noreply bool
+	opaque  string
+}
+
+type metaFlag struct {
+	name  byte
+	token string
+}
+
+func parseMeta(args [][]byte, allowed string) (*metaRequest, string) {
+	if len(args) == 0 {
+		return nil, "CLIENT_ERROR bad command line format"
+	}
+
+	req := &metaRequest{rawKey: string(args[0])}
+	base64Key := false
+	for _, arg := range args[1:] {
+		f := metaFlag{name: arg[0], token: string(arg[1:])}
+		if !containsByte(allowed, f.name) {
+			return nil, "CLIENT_ERROR invalid flag"
+		}
+		switch f.name {
+		case 'b':
+			base64Key = true
+		case 'q':
+			req.noreply = true
+		case 'O':
+			req.opaque = f.token
+		}
+		req.flags = append(req.flags, f)
+	}
+
+	if base64Key {
+		key, err := base64.StdEncoding.DecodeString(req.rawKey)
+		if err != nil || len(key) == 0 || len(key) > 250 {
+			return nil, "CLIENT_ERROR bad key"
+		}
+		req.key = string(key)
+	} else {
+		if !validKey(args[0]) {
+			return nil, "CLIENT_ERROR bad key"
+		}
+		req.key = req.rawKey
+	}
+	return req, ""
+}
+
+func (req *metaRequest) token(name byte) (string, bool) {
+	for _, f := range req.flags {
+		if f.name == name {
+			return f.token, true
+		}
+	}
+	return "", false
+}
+
+// writeReturnFlags appends the flags every meta command echoes back (k and O),
+// plus those the caller rendered for the flags it handles.
+func (req *metaRequest) writeReturnFlags(w *bufio.Writer, render func(f metaFlag) string) {
+	for _, f := range req.flags {
+		var out string
+		switch f.name {
+		case 'k':
+			out = "k" + req.rawKey
+		case 'O':
+			out = "O" + req.opaque
+		case 'b':
+			// Keys returned with k stay base64 encoded, and the b flag says so
+			if _, ok := req.token('k'); ok {
+				out = "b"
+			}
+		default:
+			if render != nil {
+				out = render(f)
+			}
+		}
+		if out != "" {
+			w.WriteByte(' ')
+			w.WriteString(out)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// metaGet implements mg <key> <flags>*.
+func (s *Server) metaGet(w *bufio.Writer, args [][]byte) {
+	req, errMsg := parseMeta(args, "bcfkOqstvT")
+	if req == nil {
+		w.WriteString(errMsg + "\r\n")
+		return
+	}
+
+	if token, ok := req.token('T'); ok {
+		exptime, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return
+		}
+		if ttl, expired := ttlFromExptime(exptime); expired {
+			s.store.Delete(req.key)
+		} else {
+			s.store.Expire(req.key, ttl)
+		}
+	}
+
+	entry, found := s.store.GetEntry(req.key)
+	if !found {
+		if !req.noreply {
+			w.WriteString("EN\r\n")
+		}
+		return
+	}
+
+	flags, data := decodeItem(entry.Value)
+	render := func(f metaFlag) string {
+		switch f.name {
+		case 'c':
+			return "c" + strconv.FormatUint(entry.Version, 10)
+		case 'f':
+			return "f" + strconv.FormatUint(uint64(flags), 10)
+		case 's':
+			return "s" + strconv.Itoa(len(data))
+		case 't':
+			ttl, found := s.store.TTL(req.key)
+			if !found || ttl == lru.NoExpiration {
+				return "t-1"
+			}
+			return "t" + strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10)
+		}
+		return ""
+	}
+
+	if _, withValue := req.token('v'); withValue {
+		w.WriteString("VA " + strconv.Itoa(len(data)))
+		req.writeReturnFlags(w, render)
+		w.Write(data)
+		w.WriteString("\r\n")
+		return
+	}
+	w.WriteString("HD")
+	req.writeReturnFlags(w, render)
+}
+
+// metaSet implements ms <key> <datalen> <flags>*\r\n<data>\r\n.
+func (s *Server) metaSet(r *bufio.Reader, w *bufio.Writer, args [][]byte) error {
+	if len(args) < 2 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	size, err := strconv.Atoi(string(args[1]))
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return errCloseConn
+	}
+	req, errMsg := parseMeta(append([][]byte{args[0]}, args[2:]...), "bcCFIkOqTM")
+	if size > s.MaxItemSize {
+		// q only hides successes, so the error is always sent
+		return refuseData(r, w, size, false)
+	}
+
+	// The data block has to be consumed even if the command line is rejected
+	data, err := readData(r, size)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return errCloseConn
+	}
+	if req == nil {
+		w.WriteString(errMsg + "\r\n")
+		return nil
+	}
+
+	var clientFlags uint32
+	ttl, expired := lru.NoExpiration, false
+	var compareCAS uint64
+	mode := "S"
+	for _, f := range req.flags {
+		var err error
+		switch f.name {
+		case 'F':
+			var n uint64
+			n, err = strconv.ParseUint(f.token, 10, 32)
+			clientFlags = uint32(n)
+		case 'T':
+			var exptime int64
+			exptime, err = strconv.ParseInt(f.token, 10, 64)
+			ttl, expired = ttlFromExptime(exptime)
+		case 'C':
+			compareCAS, err = strconv.ParseUint(f.token, 10, 64)
+		case 'M':
+			mode = strings.ToUpper(f.token)
+			if len(mode) != 1 || !containsByte("EAPRS", mode[0]) {
+				err = strconv.ErrSyntax
+			}
+		}
+		if err != nil {
+			w.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return nil
+		}
+	}
+
+	var code string
+	stored, _ := s.store.ComputeEntry(req.key, func(current lru.Entry[[]byte], found bool) ([]byte, time.Duration, bool) {
+		if compareCAS != 0 {
+			if !found {
+				code = "NF"
+				return nil, 0, false
+			}
+			if current.Version != compareCAS {
+				code = "EX"
+				return nil, 0, false
+			}
+		}
+
+		item := encodeItem(clientFlags, data)
+		switch mode {
+		case "E":
+			if found {
+				code = "NS"
+				return nil, 0, false
+			}
+		case "R":
+			if !found {
+				code = "NS"
+				return nil, 0, false
+			}
+		case "A", "P":
+			if !found {
+				code = "NS"
+				return nil, 0, false
+			}
+			// Appending keeps the existing flags and TTL, as in memcached
+			oldFlags, oldData := decodeItem(current.Value)
+			joined := make([]byte, 0, len(oldData)+len(data))
+			if mode == "A" {
+				joined = append(append(joined, oldData...), data...)
+			} else {
+				joined = append(append(joined, data...), oldData...)
+			}
+			code = "HD"
+			return encodeItem(oldFlags, joined), ttlOf(current), true
+		}
+
+		code = "HD"
+		return item, ttl, !expired
+	})
+
+	if code == "HD" && expired {
+		s.store.Delete(req.key)
+	}
+
+	if code == "HD" && req.noreply {
+		return nil
+	}
+	w.WriteString(code)
+	req.writeReturnFlags(w, func(f metaFlag) string {
+		if f.name == 'c' && code == "HD" && !expired {
+			return "c" + strconv.FormatUint(stored.Version, 10)
+		}
+		return ""
+	})
+	return nil
+}
+
+// metaDelete implements md <key> <flags>*.
+func (s *Server) metaDelete(w *bufio.Writer, args [][]byte) {
+	req, errMsg := parseMeta(args, "bCkOqIT")
+	if req == nil {
+		w.WriteString(errMsg + "\r\n")
+		return
+	}
+
+	code := "NF"
+	if token, ok := req.token('C'); ok {
+		compareCAS, err := strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return
+		}
+
+		switch deleted, found := s.store.CompareAndDelete(req.key, compareCAS); {
+		case deleted:
+			code = "HD"
+		case found:
+			code = "EX"
+		}
+	} else if s.store.Delete(req.key) {
+		code = "HD"
+	}
+
+	if code == "HD" && req.noreply {
+		return
+	}
+	w.WriteString(code)
+	req.writeReturnFlags(w, nil)
+}
+
+func containsByte(s string, c byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/tcpserver"
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = tcpserver.ErrServerClosed
+
+// Store is the part of shard.CacheManager[string, []byte] the memcached server needs.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	// An item's CAS unique is its entry's Version, which is new on every write
+	// through any API, even one that puts back the bytes it had, and never 0.
+	GetEntry(key string) (lru.Entry[[]byte], bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string) bool
+	CompareAndDelete(key string, version uint64) (deleted, found bool)
+	TTL(key string) (time.Duration, bool)
+	Expire(key string, ttl time.Duration) bool
+	Compute(key string, fn func(value []byte, ttl time.Duration, found bool) ([]byte, time.Duration, bool)) ([]byte, bool)
+	ComputeEntry(key string, fn func(entry lru.Entry[[]byte], found bool) ([]byte, time.Duration, bool)) (lru.Entry[[]byte], bool)
+	Len() int
+	GetStats() lru.Stats
+}
+
+const version = "1.6.21"
+
+// DefaultMaxItemSize is the largest data block NewServer accepts, like
+// memcached's default -I of 1MB.
+const DefaultMaxItemSize = 1024 * 1024
+
+// Server speaks the memcached ASCII protocol, including the meta commands, on
+// top of a Store, so that services with only a memcached client can use the cache.
+type Server struct {
+	// MaxItemSize is the largest data block a storage command may send. Bigger
+	// ones are refused with SERVER_ERROR and skipped.
+	MaxItemSize int
+
+	store   Store
+	started time.Time
+
+	listener tcpserver.Listener
+}
+
+func NewServer(store Store) *Server {
+	return &Server{
+		MaxItemSize: DefaultMaxItemSize,
+		store:       store,
+		started:     time.Now(),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	return s.listener.Serve(l, s.serveConn)
+}
+
+// Close stops the listener and drops every open connection.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// errCloseConn tells serveConn to hang up after flushing, either because the
+// client sent "quit" or because the stream can no longer be parsed.
+var errCloseConn = errors.New("close connection")
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, 64*1024)
+	w := bufio.NewWriterSize(conn, 64*1024)
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				w.WriteString("CLIENT_ERROR line too long\r\n")
+				w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("memcache: connection %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		fields := splitFields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if err := s.dispatch(r, w, fields); err != nil {
+			w.Flush()
+			return
+		}
+
+		// Only flush once the client has no more pipelined commands waiting
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) dispatch(r *bufio.Reader, w *bufio.Writer, fields [][]byte) error {
+	cmd, args := string(fields[0]), fields[1:]
+
+	switch cmd {
+	case "get", "gets":
+		s.get(w, args, cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return s.storage(r, w, cmd, args)
+	case "delete":
+		s.delete(w, args)
+	case "incr", "decr":
+		s.incr(w, args, cmd == "incr")
+	case "touch":
+		s.touch(w, args)
+	case "mg":
+		s.metaGet(w, args)
+	case "ms":
+		return s.metaSet(r, w, args)
+	case "md":
+		s.metaDelete(w, args)
+	case "mn":
+		w.WriteString("MN\r\n")
+	case "version":
+		w.WriteString("VERSION " + version + "\r\n")
+	case "stats":
+		s.stats(w)
+	case "verbosity":
+		w.WriteString("OK\r\n")
+	case "quit":
+		return errCloseConn
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+func (s *Server) get(w *bufio.Writer, keys [][]byte, withCAS bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	for _, key := range keys {
+		entry, found := s.store.GetEntry(string(key))
+		if !found {
+			continue
+		}
+
+		flags, data := decodeItem(entry.Value)
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, flags, len(data), entry.Version)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(data))
+		}
+		w.Write(data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// storage implements set, add, replace and cas:
+//
+//	<cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n<data>\r\n
+func (s *Server) storage(r *bufio.Reader, w *bufio.Writer, cmd string, args [][]byte) error {
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want && !(len(args) == want+1 && string(args[want]) == "noreply") {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	noreply := len(args) == want+1
+
+	flags, errFlags := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, errExp := strconv.ParseInt(string(args[2]), 10, 64)
+	size, errSize := strconv.Atoi(string(args[3]))
+	var casUnique uint64
+	var errCAS error
+	if cmd == "cas" {
+		casUnique, errCAS = strconv.ParseUint(string(args[4]), 10, 64)
+	}
+	if errFlags != nil || errExp != nil || errSize != nil || errCAS != nil || size < 0 || !validKey(args[0]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		// Without a trustworthy length the data block cannot be skipped
+		return errCloseConn
+	}
+
+	// Copy the key out of the reader's buffer before reading the data block
+	key := string(args[0])
+	if size > s.MaxItemSize {
+		return refuseData(r, w, size, noreply)
+	}
+	data, err := readData(r, size)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return errCloseConn
+	}
+
+	ttl, expired := ttlFromExptime(exptime)
+	item := encodeItem(uint32(flags), data)
+
+	var result string
+	s.store.ComputeEntry(key, func(current lru.Entry[[]byte], found bool) ([]byte, time.Duration, bool) {
+		switch {
+		case cmd == "add" && found:
+			result = "NOT_STORED"
+		case cmd == "replace" && !found:
+			result = "NOT_STORED"
+		case cmd == "cas" && !found:
+			result = "NOT_FOUND"
+		case cmd == "cas" && current.Version != casUnique:
+			result = "EXISTS"
+		default:
+			result = "STORED"
+			return item, ttl, !expired
+		}
+		return nil, 0, false
+	})
+
+	// An already expired item is accepted but never visible
+	if result == "STORED" && expired {
+		s.store.Delete(key)
+	}
+
+	if !noreply {
+		w.WriteString(result + "\r\n")
+	}
+	return nil
+}
+
+func (s *Server) delete(w *bufio.Writer, args [][]byte) {
+	noreply := len(args) == 2 && string(args[1]) == "noreply"
+	if len(args) != 1 && !noreply {
+		w.WriteString("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]\r\n")
+		return
+	}
+
+	result := "NOT_FOUND"
+	if s.store.Delete(string(args[0])) {
+		result = "DELETED"
+	}
+	if !noreply {
+		w.WriteString(result + "\r\n")
+	}
+}
+
+// incr implements incr and decr. Like memcached, incr wraps around at 2^64 and
+// decr stops at 0.
+func (s *Server) incr(w *bufio.Writer, args [][]byte, up bool) {
+	noreply := len(args) == 3 && string(args[2]) == "noreply"
+	if len(args) != 2 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	var result string
+	s.store.Compute(string(args[0]), func(current []byte, ttl time.Duration, found bool) ([]byte, time.Duration, bool) {
+		if !found {
+			result = "NOT_FOUND"
+			return nil, 0, false
+		}
+
+		flags, data := decodeItem(current)
+		n, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			result = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+			return nil, 0, false
+		}
+
+		switch {
+		case up:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.FormatUint(n, 10)
+		return encodeItem(flags, []byte(result)), ttl, true
+	})
+
+	if !noreply {
+		w.WriteString(result + "\r\n")
+	}
+}
+
+func (s *Server) touch(w *bufio.Writer, args [][]byte) {
+	noreply := len(args) == 3 && string(args[2]) == "noreply"
+	if len(args) != 2 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+		return
+	}
+
+	key := string(args[0])
+	ttl, expired := ttlFromExptime(exptime)
+
+	var touched bool
+	if expired {
+		touched = s.store.Delete(key)
+	} else {
+		touched = s.store.Expire(key, ttl)
+	}
+
+	if noreply {
+		return
+	}
+	if touched {
+		w.WriteString("TOUCHED\r\n")
+	} else {
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+func (s *Server) stats(w *bufio.Writer) {
+	stats := s.store.GetStats()
+	now := time.Now()
+
+	for _, stat := range []struct {
+		name  string
+		value any
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(s.started).Seconds())},
+		{"time", now.Unix()},
+		{"version", version},
+		{"curr_connections", s.listener.ClientCount()},
+		{"curr_items", s.store.Len()},
+		{"bytes", stats.Bytes},
+		{"get_hits", stats.Hits},
+		{"get_misses", stats.Misses},
+		{"evictions", stats.Evictions},
+	} {
+		fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	w.WriteString("END\r\n")
+}
+
+// refuseData answers a storage command whose data block is larger than
+// MaxItemSize and skips the block, so the connection stays usable.
+func refuseData(r *bufio.Reader, w *bufio.Writer, size int, noreply bool) error {
+	// Skip the CRLF separately, size+2 could overflow
+	if _, err := r.Discard(size); err != nil {
+		return errCloseConn
+	}
+	if _, err := r.Discard(2); err != nil {
+		return errCloseConn
+	}
+	if !noreply {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+	}
+	return nil
+}
+
+func readData(r *bufio.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return nil, errors.New("data block is not terminated by CRLF")
+	}
+	return buf[:size], nil
+}
+
+// splitFields splits a command line on spaces. The slices alias the reader's
+// buffer, so they must be copied before the next read.
+func splitFields(line []byte) [][]byte {
+	var fields [][]byte
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
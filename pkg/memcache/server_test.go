@@ -0,0 +1,229 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/shard"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	mgr  *shard.CacheManager[string, []byte]
+	addr string
+}
+
+func startServer(t *testing.T) *testClient {
+	t.Helper()
+
+	mgr, err := shard.NewCacheManager[string, []byte](4, 1000, 3, "", 0)
+	if err != nil {
+		t.Fatalf("NewCacheManager: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := NewServer(mgr)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return dial(t, mgr, l.Addr().String())
+}
+
+func dial(t *testing.T, mgr *shard.CacheManager[string, []byte], addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn), mgr: mgr, addr: addr}
+}
+
+// do sends raw protocol text and returns the reply lines up to and including
+// the first line that starts with one of the terminators.
+func (c *testClient) do(request string, terminators ...string) string {
+	c.t.Helper()
+	fmt.Fprint(c.conn, request)
+
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read reply to %q: %v (so far %q)", request, err, lines)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		for _, term := range terminators {
+			if strings.HasPrefix(line, term) {
+				return strings.Join(lines, "|")
+			}
+		}
+	}
+}
+
+// line sends a command and returns its single line reply.
+func (c *testClient) line(request string) string {
+	c.t.Helper()
+	return c.do(request, "")
+}
+
+func expect(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestServer_StorageCommands(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.line("set hero 0 0 6\r\nBatman\r\n"), "STORED")
+	expect(t, c.do("get hero\r\n", "END"), "VALUE hero 0 6|Batman|END")
+	expect(t, c.do("get nobody\r\n", "END"), "END")
+
+	expect(t, c.line("add hero 0 0 5\r\nRobin\r\n"), "NOT_STORED")
+	expect(t, c.line("add sidekick 0 0 5\r\nRobin\r\n"), "STORED")
+	expect(t, c.line("replace nobody 0 0 1\r\nx\r\n"), "NOT_STORED")
+	expect(t, c.line("replace hero 0 0 5\r\nBruce\r\n"), "STORED")
+	expect(t, c.do("get hero sidekick nobody\r\n", "END"), "VALUE hero 0 5|Bruce|VALUE sidekick 0 5|Robin|END")
+
+	expect(t, c.line("delete hero\r\n"), "DELETED")
+	expect(t, c.line("delete hero\r\n"), "NOT_FOUND")
+
+	// noreply commands answer nothing, so the next reply belongs to "get"
+	expect(t, c.do("set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", "END"), "VALUE quiet 0 1|q|END")
+}
+
+func TestServer_ItemTooLarge(t *testing.T) {
+	c := startServer(t)
+
+	big := strings.Repeat("x", DefaultMaxItemSize+1)
+	expect(t, c.line(fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(big), big)), "SERVER_ERROR object too large for cache")
+	expect(t, c.line(fmt.Sprintf("ms big %d\r\n%s\r\n", len(big), big)), "SERVER_ERROR object too large for cache")
+	// The data blocks were skipped, so the connection is still in step
+	expect(t, c.line("set small 0 0 1\r\nx\r\n"), "STORED")
+	if c.mgr.Exists("big") {
+		t.Error("Expected the oversized item not to be stored")
+	}
+
+	// A length that can't be allocated must not take the server down
+	fmt.Fprint(c.conn, "set huge 0 0 9223372036854775807\r\n")
+	c.conn.Close()
+	other := dial(t, c.mgr, c.addr)
+	expect(t, other.do("get small\r\n", "END"), "VALUE small 0 1|x|END")
+}
+
+func TestServer_FlagsAreKept(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.line("set obj 4 0 8\r\na:1:{i;}\r\n"), "STORED")
+	expect(t, c.do("get obj\r\n", "END"), "VALUE obj 4 8|a:1:{i;}|END")
+
+	// Flag-less items are stored as-is so the other APIs see the same bytes
+	expect(t, c.line("set plain 0 0 5\r\nhello\r\n"), "STORED")
+	if v, _ := c.mgr.Get("plain"); string(v) != "hello" {
+		t.Errorf("Expected raw bytes in the cache, got %q", v)
+	}
+}
+
+func TestServer_GetsAndCas(t *testing.T) {
+	c := startServer(t)
+
+	c.line("set k 0 0 2\r\nv1\r\n")
+	reply := c.do("gets k\r\n", "END")
+	var cas uint64
+	if _, err := fmt.Sscanf(reply, "VALUE k 0 2 %d|", &cas); err != nil || cas == 0 {
+		t.Fatalf("Unexpected gets reply %q", reply)
+	}
+
+	expect(t, c.line(fmt.Sprintf("cas k 0 0 2 %d\r\nv2\r\n", cas)), "STORED")
+	// The item changed, so the old CAS unique is stale
+	expect(t, c.line(fmt.Sprintf("cas k 0 0 2 %d\r\nv3\r\n", cas)), "EXISTS")
+	expect(t, c.line("cas nobody 0 0 1 1\r\nx\r\n"), "NOT_FOUND")
+	expect(t, c.do("get k\r\n", "END"), "VALUE k 0 2|v2|END")
+
+	// A value changed and changed back (A -> B -> A) still has a new CAS unique
+	reply = c.do("gets k\r\n", "END")
+	fmt.Sscanf(reply, "VALUE k 0 2 %d|", &cas)
+	c.line("set k 0 0 2\r\nv3\r\n")
+	c.line("set k 0 0 2\r\nv2\r\n")
+	expect(t, c.line(fmt.Sprintf("cas k 0 0 2 %d\r\nv4\r\n", cas)), "EXISTS")
+	expect(t, c.line(fmt.Sprintf("md k C%d\r\n", cas)), "EX")
+	expect(t, c.do("get k\r\n", "END"), "VALUE k 0 2|v2|END")
+}
+
+func TestServer_IncrDecrTouch(t *testing.T) {
+	c := startServer(t)
+
+	c.line("set n 0 0 2\r\n10\r\n")
+	expect(t, c.line("incr n 5\r\n"), "15")
+	expect(t, c.line("decr n 20\r\n"), "0")
+	expect(t, c.line("incr nobody 1\r\n"), "NOT_FOUND")
+	c.line("set s 0 0 3\r\nabc\r\n")
+	expect(t, c.line("incr s 1\r\n"), "CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+	expect(t, c.line("touch n 100\r\n"), "TOUCHED")
+	if ttl, _ := c.mgr.TTL("n"); ttl < 99*time.Second || ttl > 100*time.Second {
+		t.Errorf("Expected a TTL of ~100s after touch, got %v", ttl)
+	}
+	expect(t, c.line("touch nobody 100\r\n"), "NOT_FOUND")
+	expect(t, c.line("touch n -1\r\n"), "TOUCHED")
+	expect(t, c.do("get n\r\n", "END"), "END")
+}
+
+func TestServer_MetaCommands(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.line("ms hero 6 T100 F3\r\nBatman\r\n"), "HD")
+	expect(t, c.do("mg hero v f t k Oxyz\r\n", "VA", "EN"), "VA 6 f3 t100 khero Oxyz")
+	expect(t, c.line(""), "Batman")
+	expect(t, c.line("mg hero s\r\n"), "HD s6")
+	expect(t, c.line("mg nobody v\r\n"), "EN")
+
+	// Quiet misses are silent; mn marks the end of the batch
+	expect(t, c.line("mg nobody v q\r\nmn\r\n"), "MN")
+
+	expect(t, c.line("ms hero 5 ME\r\nRobin\r\n"), "NS")
+	expect(t, c.line("ms nobody 1 MR\r\nx\r\n"), "NS")
+	expect(t, c.line("ms hero 1 MA\r\n!\r\n"), "HD")
+	c.do("mg hero v\r\n", "VA")
+	expect(t, c.line(""), "Batman!")
+
+	reply := c.line("mg hero c\r\n")
+	var cas uint64
+	fmt.Sscanf(reply, "HD c%d", &cas)
+	expect(t, c.line(fmt.Sprintf("ms hero 1 C%d\r\nx\r\n", cas+2)), "EX")
+	expect(t, c.line(fmt.Sprintf("md hero C%d\r\n", cas+2)), "EX")
+	expect(t, c.line(fmt.Sprintf("md hero C%d q\r\nmn\r\n", cas)), "MN")
+	expect(t, c.line("md hero\r\n"), "NF")
+
+	// Base64 keys can hold bytes a plain key cannot
+	expect(t, c.line("ms aGkgdGhlcmU= 2 b\r\nok\r\n"), "HD")
+	if v, _ := c.mgr.Get("hi there"); string(v) != "ok" {
+		t.Errorf("Expected base64 key to be decoded, got %q", v)
+	}
+}
+
+func TestServer_MiscCommands(t *testing.T) {
+	c := startServer(t)
+
+	if v := c.line("version\r\n"); !strings.HasPrefix(v, "VERSION ") {
+		t.Errorf("Unexpected version reply %q", v)
+	}
+	c.line("set a 0 0 1\r\n1\r\n")
+	if stats := c.do("stats\r\n", "END"); !strings.Contains(stats, "STAT curr_items 1") {
+		t.Errorf("Unexpected stats reply %q", stats)
+	}
+	expect(t, c.line("bogus\r\n"), "ERROR")
+	expect(t, c.line("set bad 0 0 nope\r\n"), "CLIENT_ERROR bad command line format")
+}
@@ -0,0 +1,169 @@
+package placement
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+// Hasher turns keys into the 64-bit hashes a Placement locates. Both methods
+// must be safe for concurrent use and must not allocate, since one of them
+// runs on every operation.
+type Hasher interface {
+	HashString(s string) uint64
+	// HashUint64 hashes an integer key, or 8 bytes of a longer fixed-size one.
+	HashUint64(v uint64) uint64
+}
+
+// XXHash64 is xxHash64 with the given seed, the default hasher. It is fast
+// and spreads similar keys well, but anyone who can choose keys can also find
+// ones that land on the same node.
+type XXHash64 struct {
+	Seed uint64
+}
+
+// MapHash hashes with hash/maphash under a random seed, so keys can't be
+// crafted to pile up on one node. Placement differs from process to process.
+type MapHash struct {
+	seed maphash.Seed
+}
+
+// NewMapHash returns a MapHash with a new random seed.
+func NewMapHash() MapHash {
+	return MapHash{seed: maphash.MakeSeed()}
+}
+
+// FNV1a is 64-bit FNV-1a. It is the simplest of the three, but keys that
+// differ only in their last bytes, like "user:1" and "user:2", land close
+// together, so it needs more replicas than the others for an even spread.
+type FNV1a struct{}
+
+func (h XXHash64) HashString(s string) uint64 {
+	return xxh64(s, h.Seed)
+}
+
+func (h XXHash64) HashUint64(v uint64) uint64 {
+	// xxHash64 of v's 8 little-endian bytes
+	acc := h.Seed + xxPrime5 + 8
+	acc ^= xxRound(0, v)
+	acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	return xxAvalanche(acc)
+}
+
+func (h MapHash) HashString(s string) uint64 {
+	return maphash.String(h.seed, s)
+}
+
+func (h MapHash) HashUint64(v uint64) uint64 {
+	return maphash.Comparable(h.seed, v)
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func (FNV1a) HashString(s string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func (FNV1a) HashUint64(v uint64) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= fnvPrime64
+		v >>= 8
+	}
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 is xxHash64 of s, reading it in place.
+func xxh64(s string, seed uint64) uint64 {
+	n := len(s)
+	i := 0
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for ; i+32 <= n; i += 32 {
+			v1 = xxRound(v1, le64(s[i:]))
+			v2 = xxRound(v2, le64(s[i+8:]))
+			v3 = xxRound(v3, le64(s[i+16:]))
+			v4 = xxRound(v4, le64(s[i+24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+
+	for ; i+8 <= n; i += 8 {
+		h ^= xxRound(0, le64(s[i:]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if i+4 <= n {
+		h ^= uint64(le32(s[i:])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		i += 4
+	}
+	for ; i < n; i++ {
+		h ^= uint64(s[i]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	return xxAvalanche(h)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func xxAvalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func le64(s string) uint64 {
+	_ = s[7]
+	return uint64(s[0]) | uint64(s[1])<<8 | uint64(s[2])<<16 | uint64(s[3])<<24 |
+		uint64(s[4])<<32 | uint64(s[5])<<40 | uint64(s[6])<<48 | uint64(s[7])<<56
+}
+
+func le32(s string) uint32 {
+	_ = s[3]
+	return uint32(s[0]) | uint32(s[1])<<8 | uint32(s[2])<<16 | uint32(s[3])<<24
+}
+
+// Hash is XXHash64 with seed 0, the hash a ClusterClient places keys with and
+// the strategies here name nodes with. A CacheManager's default ring hashes
+// keys the same way.
+func Hash(s string) uint64 {
+	return xxh64(s, 0)
+}
@@ -0,0 +1,40 @@
+package placement
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestXXHash64_KnownValues(t *testing.T) {
+	cases := []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, c := range cases {
+		if got := (XXHash64{}).HashString(c.in); got != c.want {
+			t.Errorf("xxHash64(%q) = %#x, want %#x", c.in, got, c.want)
+		}
+	}
+	if (XXHash64{}).HashUint64(0x0807060504030201) != (XXHash64{}).HashString("\x01\x02\x03\x04\x05\x06\x07\x08") {
+		t.Error("Expected HashUint64 to match hashing the little-endian bytes")
+	}
+}
+
+func TestHash_SpreadsSimilarKeys(t *testing.T) {
+	// Keys that differ only in their last byte must not bunch on the ring
+	ring := NewRing([]Node{{Name: "a"}, {Name: "b"}, {Name: "c"}}, DefaultReplicas)
+	counts := make([]int, 3)
+	for i := 0; i < 3000; i++ {
+		counts[ring.Locate(Hash(fmt.Sprintf("user:%d", i)))]++
+	}
+	for i, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("node %d got %d of 3000 keys, want about 1000", i, n)
+		}
+	}
+}
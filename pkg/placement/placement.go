@@ -0,0 +1,65 @@
+// Package placement decides which of a set of nodes owns a key, given the
+// key's 64-bit hash. The same strategies place keys on the shards of a
+// CacheManager and on the nodes behind a ClusterClient.
+package placement
+
+import "fmt"
+
+// Placement maps a key hash to the index of the node that owns it. A
+// Placement is immutable once built, so it is safe for concurrent use, and
+// one without nodes returns 0.
+type Placement interface {
+	Locate(hash uint64) int
+	// Ownership returns each node's share of the hash space, in percent: the
+	// share of uniformly spread keys it can expect.
+	Ownership() []float64
+}
+
+type Strategy string
+
+const (
+	// StrategyRing is consistent hashing with DefaultReplicas points per node.
+	StrategyRing Strategy = "ring"
+	// StrategyJump is jump consistent hashing: an even spread with no memory,
+	// but nodes can only be added or removed at the end of the list.
+	StrategyJump Strategy = "jump"
+	// StrategyRendezvous is highest random weight hashing, the only strategy
+	// that honours Node.Weight. A lookup scores every node.
+	StrategyRendezvous Strategy = "rendezvous"
+	// StrategyMaglev is Maglev hashing: a lookup is one table read, at the cost
+	// of moving a few more keys than strictly needed when the nodes change.
+	StrategyMaglev Strategy = "maglev"
+)
+
+// Node is one of the targets keys are placed on, identified by its name.
+type Node struct {
+	Name string
+	// Weight is the node's share of the keys relative to the others, used by
+	// StrategyRendezvous. 0 counts as 1.
+	Weight float64
+}
+
+// New builds the placement named by s over nodes, which keep their order as
+// the indexes Locate returns.
+func New(s Strategy, nodes []Node) (Placement, error) {
+	switch s {
+	case StrategyRing:
+		return NewRing(nodes, DefaultReplicas), nil
+	case StrategyJump:
+		return Jump(len(nodes)), nil
+	case StrategyRendezvous:
+		return NewRendezvous(nodes), nil
+	case StrategyMaglev:
+		return NewMaglev(nodes), nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q", s)
+	}
+}
+
+// mix64 is the SplitMix64 finalizer, which spreads every input bit over the
+// whole output.
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
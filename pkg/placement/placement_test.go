@@ -0,0 +1,121 @@
+package placement
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var strategies = []Strategy{StrategyRing, StrategyJump, StrategyRendezvous, StrategyMaglev}
+
+func nodes(n int) []Node {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{Name: fmt.Sprintf("node-%d", i)}
+	}
+	return nodes
+}
+
+func keyHashes(n int) []uint64 {
+	hashes := make([]uint64, n)
+	for i := range hashes {
+		hashes[i] = Hash(fmt.Sprintf("key-%d", i))
+	}
+	return hashes
+}
+
+func TestStrategies_SpreadEvenly(t *testing.T) {
+	hashes := keyHashes(200000)
+	limits := map[Strategy]float64{StrategyRing: 0.12, StrategyJump: 0.03, StrategyRendezvous: 0.03, StrategyMaglev: 0.03}
+	for _, s := range strategies {
+		p, err := New(s, nodes(16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev := RelStdDev(Spread(p, 16, hashes)); dev > limits[s] {
+			t.Errorf("%s: relative standard deviation %.3f, want at most %.3f", s, dev, limits[s])
+		}
+	}
+}
+
+func TestStrategies_AddingANodeMovesFewKeys(t *testing.T) {
+	hashes := keyHashes(100000)
+	before, after := nodes(16), nodes(17)
+	for _, s := range strategies {
+		a, _ := New(s, before)
+		b, _ := New(s, after)
+		// Ideally the new node takes a 17th of the keys, and only those move
+		if moved := Remapped(a, before, b, after, hashes); moved > 1.0/17+0.03 {
+			t.Errorf("%s: adding a 17th node moved %.1f%% of keys", s, 100*moved)
+		}
+		if s == StrategyMaglev {
+			continue // may also shuffle a few keys between the old nodes
+		}
+		for _, h := range hashes {
+			if i, j := a.Locate(h), b.Locate(h); i != j && j != 16 {
+				t.Fatalf("%s: a key moved from node %d to %d rather than to the new node", s, i, j)
+			}
+		}
+	}
+}
+
+func TestStrategies_OwnershipMatchesSpread(t *testing.T) {
+	hashes := keyHashes(200000)
+	for _, s := range strategies {
+		p, _ := New(s, nodes(8))
+		counts := Spread(p, 8, hashes)
+		var total float64
+		for i, pct := range p.Ownership() {
+			total += pct
+			if share := 100 * float64(counts[i]) / 200000; math.Abs(share-pct) > 1 {
+				t.Errorf("%s: node %d owns %.2f%% but got %.2f%% of keys", s, i, pct, share)
+			}
+		}
+		if math.Abs(total-100) > 1e-6 {
+			t.Errorf("%s: Ownership adds up to %v%%", s, total)
+		}
+	}
+
+	d := Summarize([]int{1, 3})
+	if d.Total != 4 || d.Mean != 2 || d.StdDev != 1 || d.RelStdDev != 0.5 || d.Min != 1 || d.Max != 3 {
+		t.Errorf("Summarize = %+v", d)
+	}
+}
+
+func TestRendezvous_Weights(t *testing.T) {
+	nodes := []Node{{Name: "a"}, {Name: "b", Weight: 1}, {Name: "c", Weight: 2}}
+	counts := Spread(NewRendezvous(nodes), 3, keyHashes(100000))
+	if share := float64(counts[2]) / 100000; share < 0.47 || share > 0.53 {
+		t.Errorf("A node of weight 2 among 1 and 1 got %.1f%% of keys, want 50%%", 100*share)
+	}
+
+	r := NewRendezvous(nodes)
+	for _, h := range keyHashes(100) {
+		if rank := r.Rank(h); len(rank) != 3 || rank[0] != r.Locate(h) {
+			t.Fatalf("Rank(%d) = %v, want it to start with Locate's %d", h, rank, r.Locate(h))
+		}
+	}
+}
+
+func TestNew_Unknown(t *testing.T) {
+	if _, err := New("modulo", nodes(2)); err == nil {
+		t.Error("Expected an unknown strategy to fail")
+	}
+	for _, s := range strategies {
+		if p, _ := New(s, nil); p.Locate(42) != 0 {
+			t.Errorf("%s: Expected a placement without nodes to return 0", s)
+		}
+	}
+}
+
+func BenchmarkLocate(b *testing.B) {
+	hashes := keyHashes(1024)
+	for _, s := range strategies {
+		p, _ := New(s, nodes(32))
+		b.Run(string(s), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.Locate(hashes[i&1023])
+			}
+		})
+	}
+}
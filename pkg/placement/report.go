@@ -0,0 +1,78 @@
+package placement
+
+import "math"
+
+// Spread counts how many of hashes each of n nodes gets under p.
+func Spread(p Placement, n int, hashes []uint64) []int {
+	counts := make([]int, n)
+	for _, h := range hashes {
+		counts[p.Locate(h)]++
+	}
+	return counts
+}
+
+// Distribution summarises how many keys each node holds.
+type Distribution struct {
+	Counts []int
+	Total  int
+	Mean   float64
+	StdDev float64
+	// RelStdDev is StdDev as a fraction of Mean.
+	RelStdDev float64
+	Min       int
+	Max       int
+}
+
+// Summarize describes the spread of counts, one per node.
+func Summarize(counts []int) Distribution {
+	d := Distribution{Counts: counts}
+	if len(counts) == 0 {
+		return d
+	}
+	d.Min, d.Max = counts[0], counts[0]
+	for _, c := range counts {
+		d.Total += c
+		d.Min, d.Max = min(d.Min, c), max(d.Max, c)
+	}
+	d.Mean = float64(d.Total) / float64(len(counts))
+	d.RelStdDev = RelStdDev(counts)
+	d.StdDev = d.RelStdDev * d.Mean
+	return d
+}
+
+// RelStdDev is the standard deviation of counts as a fraction of their mean:
+// 0 for a perfect spread.
+func RelStdDev(counts []int) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, c := range counts {
+		sum += float64(c)
+	}
+	mean := sum / float64(len(counts))
+	if mean == 0 {
+		return 0
+	}
+	var sq float64
+	for _, c := range counts {
+		sq += (float64(c) - mean) * (float64(c) - mean)
+	}
+	return math.Sqrt(sq/float64(len(counts))) / mean
+}
+
+// Remapped is the fraction of hashes that change node between placement a
+// over aNodes and placement b over bNodes. Nodes are matched by name, since a
+// node's index can differ between the two.
+func Remapped(a Placement, aNodes []Node, b Placement, bNodes []Node, hashes []uint64) float64 {
+	if len(hashes) == 0 {
+		return 0
+	}
+	moved := 0
+	for _, h := range hashes {
+		if aNodes[a.Locate(h)].Name != bNodes[b.Locate(h)].Name {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(hashes))
+}
@@ -0,0 +1,260 @@
+package placement
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is how many points New gives each node on a ring. More
+// points spread keys more evenly.
+const DefaultReplicas = 160
+
+// Ring is consistent hashing: every node has replicas points on a circle of
+// hashes, and a key belongs to the node of the first point at or after it.
+// Adding a node only takes keys from its neighbours, and removing one only
+// hands its keys on.
+type Ring struct {
+	points []ringPoint // sorted by hash
+	nodes  int
+}
+
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// NewRing builds a ring with replicas points per node, hashed from the node's
+// name, so a node keeps its points whatever else is on the ring.
+func NewRing(nodes []Node, replicas int) *Ring {
+	return NewRingFunc(len(nodes), replicas, func(node, replica int) uint64 {
+		return Hash(nodes[node].Name + "#" + strconv.Itoa(replica))
+	})
+}
+
+// NewRingFunc builds a ring over nodes nodes with replicas points each, placed
+// at point(node, replica), for callers that name and hash points their own way.
+func NewRingFunc(nodes, replicas int, point func(node, replica int) uint64) *Ring {
+	r := &Ring{points: make([]ringPoint, 0, nodes*replicas), nodes: nodes}
+	for i := 0; i < nodes; i++ {
+		for v := 0; v < replicas; v++ {
+			r.points = append(r.points, ringPoint{hash: point(i, v), node: i})
+		}
+	}
+	// Ties, which are rare with 64 bits, go to the lower node whatever the count
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		return a.node - b.node
+	})
+	return r
+}
+
+// Nodes returns the number of nodes on the ring.
+func (r *Ring) Nodes() int {
+	return r.nodes
+}
+
+func (r *Ring) Locate(hash uint64) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Ownership sums the arcs of the ring each node's points end.
+func (r *Ring) Ownership() []float64 {
+	owned := make([]float64, r.nodes)
+	for i, p := range r.points {
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		// The first point's arc wraps around zero, which uint64 arithmetic does
+		owned[p.node] += arcPercent(p.hash - prev)
+	}
+	if len(r.points) == 1 {
+		owned[r.points[0].node] = 100
+	}
+	return owned
+}
+
+// arcPercent is an arc of the ring as a percentage of the whole.
+func arcPercent(arc uint64) float64 {
+	return float64(arc) / (1 << 64) * 100
+}
+
+// Jump is jump consistent hashing (Lamping and Veach) over that many nodes.
+// It needs no memory and spreads keys evenly, and growing from n to n+1 nodes
+// moves only the keys the new node takes. Nodes are numbered rather than
+// named, though, so only the last one can be removed without reshuffling.
+type Jump int
+
+func (j Jump) Locate(hash uint64) int {
+	var b, next int64 = -1, 0
+	for next < int64(j) {
+		b = next
+		hash = hash*2862933555777941757 + 1
+		next = int64(float64(b+1) * (float64(int64(1)<<31) / float64((hash>>33)+1)))
+	}
+	return int(max(b, 0))
+}
+
+// Ownership is an even share for every node.
+func (j Jump) Ownership() []float64 {
+	owned := make([]float64, j)
+	for i := range owned {
+		owned[i] = 100 / float64(j)
+	}
+	return owned
+}
+
+// Rendezvous is highest random weight hashing: a key belongs to the node with
+// the highest score for it, so adding a node only takes the keys it now wins
+// and removing one hands each of its keys to its runner-up. Scores follow the
+// logarithmic method, which gives each node a share of the keys in proportion
+// to its weight.
+type Rendezvous struct {
+	seeds   []uint64
+	weights []float64
+}
+
+func NewRendezvous(nodes []Node) *Rendezvous {
+	r := &Rendezvous{seeds: make([]uint64, len(nodes)), weights: make([]float64, len(nodes))}
+	for i, node := range nodes {
+		r.seeds[i] = Hash(node.Name)
+		r.weights[i] = node.Weight
+		if r.weights[i] <= 0 {
+			r.weights[i] = 1
+		}
+	}
+	return r
+}
+
+func (r *Rendezvous) score(hash uint64, node int) float64 {
+	// A uniform draw in (0, 1) from the top 53 bits, never exactly 0 or 1
+	u := (float64(mix64(hash^r.seeds[node])>>11) + 0.5) / (1 << 53)
+	return -r.weights[node] / math.Log(u)
+}
+
+func (r *Rendezvous) Locate(hash uint64) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i := range r.seeds {
+		if s := r.score(hash, i); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// Ownership is each node's weight as a share of the total.
+func (r *Rendezvous) Ownership() []float64 {
+	var total float64
+	for _, w := range r.weights {
+		total += w
+	}
+	owned := make([]float64, len(r.weights))
+	for i, w := range r.weights {
+		owned[i] = w / total * 100
+	}
+	return owned
+}
+
+// Rank returns every node's index, best first for hash. The first is the one
+// Locate returns; the rest are where its keys go if it is taken away.
+func (r *Rendezvous) Rank(hash uint64) []int {
+	order := make([]int, len(r.seeds))
+	scores := make([]float64, len(r.seeds))
+	for i := range order {
+		order[i], scores[i] = i, r.score(hash, i)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	return order
+}
+
+// maglevMinTableSize is the smallest lookup table Maglev builds, a prime.
+// The table needs about 100 slots per node to keep nodes within 1% of each
+// other.
+const maglevMinTableSize = 65537
+
+// Maglev is Maglev hashing (Eisenbud et al.): each node walks its own
+// permutation of a lookup table, and the nodes take turns claiming the next
+// free slot on theirs until the table is full. A lookup is one read, every
+// node gets the same number of slots, and a change to the nodes moves few
+// keys besides the ones that have to move.
+type Maglev struct {
+	table []int32
+	nodes int
+}
+
+func NewMaglev(nodes []Node) *Maglev {
+	if len(nodes) == 0 {
+		return &Maglev{}
+	}
+	size := uint64(maglevMinTableSize)
+	for size < uint64(100*len(nodes)) || !isPrime(size) {
+		size++
+	}
+
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		h := Hash(node.Name)
+		offsets[i] = h % size
+		skips[i] = mix64(h)%(size-1) + 1
+	}
+
+	table := make([]int32, size)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := uint64(0); ; {
+		for i := range nodes {
+			slot := (offsets[i] + next[i]*skips[i]) % size
+			for table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % size
+			}
+			table[slot] = int32(i)
+			next[i]++
+			if filled++; filled == size {
+				return &Maglev{table: table, nodes: len(nodes)}
+			}
+		}
+	}
+}
+
+func (m *Maglev) Locate(hash uint64) int {
+	if len(m.table) == 0 {
+		return 0
+	}
+	return int(m.table[hash%uint64(len(m.table))])
+}
+
+// Ownership counts each node's slots in the table.
+func (m *Maglev) Ownership() []float64 {
+	owned := make([]float64, m.nodes)
+	for _, node := range m.table {
+		owned[node] += 100 / float64(len(m.table))
+	}
+	return owned
+}
+
+func isPrime(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+	for d := uint64(2); d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
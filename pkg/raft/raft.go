@@ -0,0 +1,801 @@
+// Package raft replicates a log of commands across a fixed set of nodes with
+// the Raft consensus algorithm (https://raft.github.io/raft.pdf): leader
+// election, log replication and snapshots. A command is applied to each
+// node's FSM once a majority of nodes have it on disk, so it survives the
+// loss of any minority. Adding and removing nodes at runtime is not supported.
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// FSM is the state machine a log is applied to. Apply, Snapshot and Restore
+// are never called concurrently.
+type FSM interface {
+	// Apply applies a committed command. What it returns is handed to the
+	// Propose call that proposed the command, on the node it was proposed on.
+	Apply(cmd []byte) any
+	// Snapshot writes the whole state to w.
+	Snapshot(w io.Writer) error
+	// Restore replaces the whole state with a snapshot written by Snapshot.
+	Restore(r io.Reader) error
+}
+
+// State is a node's role in the cluster.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+var (
+	// ErrNotLeader is wrapped by the *NotLeaderError that Propose returns on
+	// any node but the leader.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLeadershipLost means the node stopped being leader before a proposed
+	// command was committed, and a new leader has overwritten it.
+	ErrLeadershipLost = errors.New("raft: leadership lost before the command was committed")
+	// ErrStopped is returned by calls on a stopped node.
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// NotLeaderError is returned by Propose on a follower or candidate. Leader is
+// the leader's ID, if the node knows it.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "raft: not the leader, and no leader is known"
+	}
+	return "raft: not the leader, the leader is " + e.Leader
+}
+
+func (e *NotLeaderError) Unwrap() error { return ErrNotLeader }
+
+// Entry is one command in the log. Entries with no command are appended by a
+// new leader to commit what earlier leaders left, and aren't applied.
+type Entry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Cmd   []byte `json:"cmd,omitempty"`
+}
+
+// Config configures a Node.
+type Config struct {
+	// ID is this node's address, as its peers know it. HTTPTransport expects
+	// base URLs such as "http://10.0.0.1:8080".
+	ID string
+	// Peers are the other nodes' IDs.
+	Peers []string
+	// Dir is where the term, vote, log and snapshot are kept. If it is empty
+	// they are kept in memory and lost on restart, which is only safe in tests.
+	Dir       string
+	Transport Transport
+	FSM       FSM
+
+	// HeartbeatInterval is how often the leader contacts idle followers.
+	// Defaults to 50ms.
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before starting an election, randomised up to twice as long. Defaults
+	// to 500ms.
+	ElectionTimeout time.Duration
+	// SnapshotThreshold is how many entries may be applied after the last
+	// snapshot before a new one is taken and the log before it dropped.
+	// Defaults to 8192.
+	SnapshotThreshold uint64
+}
+
+const (
+	maxAppendEntries = 512
+	maxApplyBatch    = 512
+)
+
+// Status is a node's view of the cluster.
+type Status struct {
+	ID            string
+	State         State
+	Term          uint64
+	Leader        string // empty if not known
+	LastIndex     uint64 // last entry in the log
+	CommitIndex   uint64 // last entry known to be on a majority
+	AppliedIndex  uint64 // last entry applied to the FSM
+	SnapshotIndex uint64 // last entry covered by the snapshot
+}
+
+type result struct {
+	value any
+	err   error
+}
+
+type waiter struct {
+	term uint64
+	done chan result
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	cfg    Config
+	quorum int
+
+	mu          sync.Mutex
+	store       *storage
+	state       State
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+	deadline    time.Time // election timeout
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicate   map[string]chan struct{} // pokes the leader's replicator for each peer
+	waiters     map[uint64]waiter        // Propose calls waiting for their entry
+
+	// applyMu serialises the FSM: applying entries, snapshots and restores
+	applyMu    sync.Mutex
+	applyCh    chan struct{}
+	snapshotCh chan chan error
+
+	stop    chan struct{}
+	stopped sync.Once
+	halted  bool // set under mu once Stop is waiting for the goroutines
+	wg      sync.WaitGroup
+}
+
+// NewNode opens the node's storage and restores its FSM from the latest
+// snapshot. The node takes part in the cluster once Start is called.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil || cfg.FSM == nil {
+		return nil, errors.New("raft: ID, Transport and FSM are required")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 500 * time.Millisecond
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 8192
+	}
+
+	store, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:        cfg,
+		quorum:     (len(cfg.Peers)+1)/2 + 1,
+		store:      store,
+		waiters:    make(map[uint64]waiter),
+		applyCh:    make(chan struct{}, 1),
+		snapshotCh: make(chan chan error),
+		stop:       make(chan struct{}),
+	}
+
+	snapshot, err := store.readSnapshot()
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	if snapshot != nil {
+		if err := n.restore(snapshot); err != nil {
+			store.close()
+			return nil, err
+		}
+		n.commitIndex, n.lastApplied = store.snapIndex, store.snapIndex
+	}
+	return n, nil
+}
+
+// restore loads a snapshot, header and all, into the FSM.
+func (n *Node) restore(snapshot []byte) error {
+	r := bufio.NewReader(bytes.NewReader(snapshot))
+	if _, _, err := readSnapshotHeader(r); err != nil {
+		return err
+	}
+	return n.cfg.FSM.Restore(r)
+}
+
+// Start starts the node's election timer and applier.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.runTimer()
+	go n.runApplier()
+}
+
+// Stop stops the node and closes its storage. Pending Propose calls return
+// ErrStopped.
+func (n *Node) Stop() error {
+	n.mu.Lock()
+	n.halted = true
+	n.mu.Unlock()
+	n.stopped.Do(func() { close(n.stop) })
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.state = Follower
+	return n.store.close()
+}
+
+// Status reports the node's state.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         n.state,
+		Term:          n.store.term,
+		Leader:        n.leader,
+		LastIndex:     n.store.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.store.snapIndex,
+	}
+}
+
+// Propose appends cmd to the log and waits until it has been committed and
+// applied on this node, returning what the FSM's Apply returned. It fails
+// with a *NotLeaderError anywhere but on the leader. If ctx ends first the
+// command may still be committed later.
+func (n *Node) Propose(ctx context.Context, cmd []byte) (any, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("raft: empty command")
+	}
+
+	n.mu.Lock()
+	if n.state != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	e := Entry{Term: n.store.term, Index: n.store.lastIndex() + 1, Cmd: cmd}
+	if err := n.store.append(e); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	done := make(chan result, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, done: done}
+	n.advanceCommit()
+	n.pokeReplicators()
+	n.mu.Unlock()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if w, ok := n.waiters[e.Index]; ok && w.done == done {
+			delete(n.waiters, e.Index)
+		}
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.stop:
+		return nil, ErrStopped
+	}
+}
+
+// Snapshot snapshots the FSM and drops the log entries the snapshot covers.
+// Nodes also do this on their own every SnapshotThreshold entries.
+func (n *Node) Snapshot() error {
+	reply := make(chan error, 1)
+	select {
+	case n.snapshotCh <- reply:
+		return <-reply
+	case <-n.stop:
+		return ErrStopped
+	}
+}
+
+// resetElectionTimer pushes the election timeout back, by a random amount so
+// that followers rarely time out together. Called with mu held.
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+func (n *Node) runTimer() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+		n.mu.Lock()
+		if n.state != Leader && time.Now().After(n.deadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// becomeFollower steps down, moving to term if it is newer. Called with mu held.
+func (n *Node) becomeFollower(term uint64, leader string) error {
+	if term > n.store.term {
+		if err := n.store.setState(term, ""); err != nil {
+			return err
+		}
+	}
+	n.state = Follower
+	n.leader = leader
+	n.replicate = nil
+	return nil
+}
+
+// startElection asks the peers to make this node leader of a new term.
+// Called with mu held.
+func (n *Node) startElection() {
+	term := n.store.term + 1
+	if err := n.store.setState(term, n.cfg.ID); err != nil {
+		n.resetElectionTimer()
+		return
+	}
+	n.state = Candidate
+	n.leader = ""
+	n.resetElectionTimer()
+
+	votes := 1
+	if votes >= n.quorum {
+		n.becomeLeader()
+		return
+	}
+	req := &VoteRequest{Term: term, Candidate: n.cfg.ID, LastLogIndex: n.store.lastIndex(), LastLogTerm: n.store.lastTerm()}
+	for _, peer := range n.cfg.Peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			resp, err := n.cfg.Transport.RequestVote(ctx, peer, req)
+			cancel()
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.store.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.state != Candidate || n.store.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over replication for the current term. Called with mu held.
+func (n *Node) becomeLeader() {
+	if n.halted {
+		return
+	}
+	n.state = Leader
+	n.leader = n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.replicate = make(map[string]chan struct{})
+
+	// An empty entry of its own term lets the leader commit what earlier
+	// leaders left behind
+	term := n.store.term
+	if err := n.store.append(Entry{Term: term, Index: n.store.lastIndex() + 1}); err != nil {
+		n.becomeFollower(term, "")
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.store.lastIndex()
+		poke := make(chan struct{}, 1)
+		n.replicate[peer] = poke
+		n.wg.Add(1)
+		go n.runReplicator(peer, term, poke)
+	}
+	n.advanceCommit()
+}
+
+func (n *Node) pokeReplicators() {
+	for _, poke := range n.replicate {
+		select {
+		case poke <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) pokeApplier() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// runReplicator keeps one peer's log in step with the leader's for as long as
+// this node leads term.
+func (n *Node) runReplicator(peer string, term uint64, poke chan struct{}) {
+	defer n.wg.Done()
+	heartbeat := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		more, ok := n.sendAppend(peer, term)
+		if !ok {
+			return
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-poke:
+		case <-heartbeat.C:
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// sendAppend sends the peer the entries it is missing, or a snapshot if the
+// leader has already dropped them. more reports whether there are entries
+// left to send; ok is false once this node no longer leads term.
+func (n *Node) sendAppend(peer string, term uint64) (more, ok bool) {
+	n.mu.Lock()
+	if n.state != Leader || n.store.term != term {
+		n.mu.Unlock()
+		return false, false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.store.snapIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	prev := next - 1
+	req := &AppendRequest{
+		Term:         term,
+		Leader:       n.cfg.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.store.termAt(prev),
+		Entries:      n.store.slice(next, n.store.lastIndex(), maxAppendEntries),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	resp, err := n.cfg.Transport.AppendEntries(ctx, peer, req)
+	cancel()
+	if err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.store.term {
+		n.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if n.state != Leader || n.store.term != term {
+		return false, false
+	}
+	if resp.Success {
+		match := prev + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		n.advanceCommit()
+	} else if resp.ConflictIndex > 0 {
+		n.nextIndex[peer] = max(1, min(resp.ConflictIndex, next-1))
+	} else {
+		return false, true // the follower couldn't write, try again later
+	}
+	return n.nextIndex[peer] <= n.store.lastIndex(), true
+}
+
+func (n *Node) sendSnapshot(peer string, term uint64) (more, ok bool) {
+	n.mu.Lock()
+	snapshot, err := n.store.readSnapshot()
+	if err != nil || snapshot == nil {
+		n.mu.Unlock()
+		return false, true
+	}
+	index, snapTerm, err := readSnapshotHeader(bufio.NewReader(bytes.NewReader(snapshot)))
+	n.mu.Unlock()
+	if err != nil {
+		return false, true
+	}
+
+	req := &SnapshotRequest{Term: term, Leader: n.cfg.ID, LastIndex: index, LastTerm: snapTerm, Data: snapshot}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.cfg.ElectionTimeout)
+	resp, err := n.cfg.Transport.InstallSnapshot(ctx, peer, req)
+	cancel()
+	if err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.store.term {
+		n.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if n.state != Leader || n.store.term != term {
+		return false, false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = max(n.nextIndex[peer], index+1)
+	return n.nextIndex[peer] <= n.store.lastIndex(), true
+}
+
+// advanceCommit commits the latest entry of the current term that a majority
+// holds. Entries of earlier terms are only committed along with one, as the
+// Raft paper requires. Called with mu held.
+func (n *Node) advanceCommit() {
+	for index := n.store.lastIndex(); index > n.commitIndex && index > n.store.snapIndex; index-- {
+		if n.store.termAt(index) != n.store.term {
+			return
+		}
+		count := 1
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum {
+			n.commitIndex = index
+			n.pokeApplier()
+			return
+		}
+	}
+}
+
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applyCh:
+			n.applyCommitted()
+		case reply := <-n.snapshotCh:
+			n.applyMu.Lock()
+			reply <- n.takeSnapshot()
+			n.applyMu.Unlock()
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// applyCommitted applies every committed entry not yet applied, in batches,
+// and takes a snapshot whenever SnapshotThreshold entries have built up.
+func (n *Node) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			return
+		}
+		entries := n.store.slice(n.lastApplied+1, n.commitIndex, maxApplyBatch)
+		n.mu.Unlock()
+		if len(entries) == 0 {
+			return
+		}
+
+		results := make([]any, len(entries))
+		for i, e := range entries {
+			if len(e.Cmd) > 0 {
+				results[i] = n.cfg.FSM.Apply(e.Cmd)
+			}
+		}
+
+		n.mu.Lock()
+		n.lastApplied = entries[len(entries)-1].Index
+		for i, e := range entries {
+			w, ok := n.waiters[e.Index]
+			if !ok {
+				continue
+			}
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.done <- result{value: results[i]}
+			} else {
+				w.done <- result{err: ErrLeadershipLost}
+			}
+		}
+		due := n.lastApplied-n.store.snapIndex >= n.cfg.SnapshotThreshold
+		n.mu.Unlock()
+
+		if due {
+			n.takeSnapshot()
+		}
+	}
+}
+
+// takeSnapshot snapshots everything applied so far. Called with applyMu held,
+// so nothing is applied while the FSM is written out.
+func (n *Node) takeSnapshot() error {
+	n.mu.Lock()
+	index := n.lastApplied
+	if index <= n.store.snapIndex {
+		n.mu.Unlock()
+		return nil
+	}
+	term := n.store.termAt(index)
+	n.mu.Unlock()
+
+	if err := n.store.writeSnapshot(index, term, n.cfg.FSM.Snapshot); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.store.compact(index, term)
+}
+
+// HandleRequestVote answers a candidate's request for this node's vote.
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.halted {
+		return nil, ErrStopped
+	}
+
+	if req.Term > n.store.term {
+		if err := n.becomeFollower(req.Term, ""); err != nil {
+			return nil, err
+		}
+	}
+	resp := &VoteResponse{Term: n.store.term}
+	if req.Term < n.store.term {
+		return resp, nil
+	}
+
+	// Only vote for a candidate whose log holds everything this one does,
+	// so a leader always has every committed entry
+	upToDate := req.LastLogTerm > n.store.lastTerm() ||
+		req.LastLogTerm == n.store.lastTerm() && req.LastLogIndex >= n.store.lastIndex()
+	if (n.store.votedFor == "" || n.store.votedFor == req.Candidate) && upToDate {
+		if err := n.store.setState(n.store.term, req.Candidate); err != nil {
+			return nil, err
+		}
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// HandleAppendEntries adds a leader's entries to this node's log.
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.halted {
+		return nil, ErrStopped
+	}
+
+	if req.Term < n.store.term {
+		return &AppendResponse{Term: n.store.term}, nil
+	}
+	if err := n.becomeFollower(req.Term, req.Leader); err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+	resp := &AppendResponse{Term: n.store.term}
+
+	// Entries the snapshot covers are committed, so they match already
+	prev, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prev < n.store.snapIndex {
+		skip := n.store.snapIndex - prev
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev, prevTerm = n.store.snapIndex, n.store.snapTerm
+	}
+
+	if prev > n.store.lastIndex() {
+		resp.ConflictIndex = n.store.lastIndex() + 1
+		return resp, nil
+	}
+	if term := n.store.termAt(prev); term != prevTerm {
+		// Skip back over the whole conflicting term rather than one entry a time
+		conflict := prev
+		for conflict > n.store.snapIndex+1 && n.store.termAt(conflict-1) == term {
+			conflict--
+		}
+		resp.ConflictIndex = conflict
+		return resp, nil
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.store.lastIndex() {
+			if n.store.termAt(e.Index) == e.Term {
+				continue
+			}
+			if err := n.store.truncateFrom(e.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.store.append(entries[i:]...); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	if commit := min(req.LeaderCommit, match); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.pokeApplier()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// HandleInstallSnapshot replaces this node's state with the leader's
+// snapshot, when the leader no longer has the entries the node is missing.
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.halted {
+		return nil, ErrStopped
+	}
+
+	if req.Term < n.store.term {
+		return &SnapshotResponse{Term: n.store.term}, nil
+	}
+	if err := n.becomeFollower(req.Term, req.Leader); err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+	resp := &SnapshotResponse{Term: n.store.term}
+	if req.LastIndex <= n.lastApplied {
+		return resp, nil
+	}
+
+	err := n.store.writeSnapshot(req.LastIndex, req.LastTerm, func(w io.Writer) error {
+		r := bufio.NewReader(bytes.NewReader(req.Data))
+		if _, _, err := readSnapshotHeader(r); err != nil {
+			return err
+		}
+		_, err := r.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := n.restore(req.Data); err != nil {
+		return nil, err
+	}
+	if err := n.store.compact(req.LastIndex, req.LastTerm); err != nil {
+		return nil, err
+	}
+	n.lastApplied = req.LastIndex
+	n.commitIndex = max(n.commitIndex, req.LastIndex)
+	n.resetElectionTimer()
+	return resp, nil
+}
@@ -0,0 +1,348 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kv is a map FSM. Commands are "key=value".
+type kv struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (f *kv) Apply(cmd []byte) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, value, _ := strings.Cut(string(cmd), "=")
+	if f.data == nil {
+		f.data = make(map[string]string)
+	}
+	f.data[key] = value
+	return len(f.data)
+}
+
+func (f *kv) Snapshot(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.NewEncoder(w).Encode(f.data)
+}
+
+func (f *kv) Restore(r io.Reader) error {
+	var data map[string]string
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = data
+	return nil
+}
+
+func (f *kv) get(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data[key]
+}
+
+// memTransport connects nodes in the same process, and can cut them off.
+type memTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+var errUnreachable = errors.New("unreachable")
+
+func (t *memTransport) peer(from, to string) (*Node, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.down[from] || t.down[to] || t.nodes[to] == nil {
+		return nil, errUnreachable
+	}
+	return t.nodes[to], nil
+}
+
+func (t *memTransport) setDown(id string, down bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down[id] = down
+}
+
+// from binds the transport to the sending node, so cut-off nodes can't send.
+func (t *memTransport) from(id string) Transport { return &memSender{t, id} }
+
+type memSender struct {
+	t  *memTransport
+	id string
+}
+
+func (s *memSender) RequestVote(_ context.Context, peer string, req *VoteRequest) (*VoteResponse, error) {
+	n, err := s.t.peer(s.id, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleRequestVote(req)
+}
+
+func (s *memSender) AppendEntries(_ context.Context, peer string, req *AppendRequest) (*AppendResponse, error) {
+	n, err := s.t.peer(s.id, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleAppendEntries(req)
+}
+
+func (s *memSender) InstallSnapshot(_ context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	n, err := s.t.peer(s.id, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleInstallSnapshot(req)
+}
+
+type cluster struct {
+	t         *testing.T
+	transport *memTransport
+	ids       []string
+	nodes     map[string]*Node
+	fsms      map[string]*kv
+}
+
+func newCluster(t *testing.T, size int, threshold uint64) *cluster {
+	t.Helper()
+	c := &cluster{
+		t:         t,
+		transport: &memTransport{nodes: make(map[string]*Node), down: make(map[string]bool)},
+		nodes:     make(map[string]*Node),
+		fsms:      make(map[string]*kv),
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node-%d", i))
+	}
+	for _, id := range c.ids {
+		var peers []string
+		for _, other := range c.ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+		fsm := &kv{}
+		n, err := NewNode(Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         c.transport.from(id),
+			FSM:               fsm,
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   50 * time.Millisecond,
+			SnapshotThreshold: threshold,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes[id], c.fsms[id] = n, fsm
+		c.transport.nodes[id] = n
+	}
+	for _, n := range c.nodes {
+		n.Start()
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// leader waits for exactly one reachable node to lead and returns its ID.
+func (c *cluster) leader() string {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []string
+		for id, n := range c.nodes {
+			if n.Status().State == Leader && !c.transport.down[id] {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("Timed out waiting for a leader")
+	return ""
+}
+
+func (c *cluster) propose(id, cmd string) any {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := c.nodes[id].Propose(ctx, []byte(cmd))
+	if err != nil {
+		c.t.Fatalf("Propose(%q) on %s: %v", cmd, id, err)
+	}
+	return result
+}
+
+// waitApplied waits until node id has applied every entry the leader has.
+func (c *cluster) waitApplied(id, leader string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if c.nodes[id].Status().AppliedIndex >= c.nodes[leader].Status().CommitIndex {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.t.Fatalf("Timed out waiting for %s to catch up: %+v", id, c.nodes[id].Status())
+}
+
+func TestCluster_ReplicatesToEveryNode(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+
+	for i := 0; i < 100; i++ {
+		if got := c.propose(leader, fmt.Sprintf("k%d=%d", i, i)); got != i+1 {
+			t.Fatalf("Propose returned %v, want what Apply returned", got)
+		}
+	}
+	for _, id := range c.ids {
+		c.waitApplied(id, leader)
+		if got := c.fsms[id].get("k99"); got != "99" {
+			t.Errorf("%s: k99 = %q", id, got)
+		}
+	}
+}
+
+func TestCluster_FollowersRedirect(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	c.propose(leader, "a=1") // followers learn the leader from its appends
+
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		_, err := c.nodes[id].Propose(context.Background(), []byte("b=2"))
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != leader || !errors.Is(err, ErrNotLeader) {
+			t.Errorf("Propose on follower %s = %v, want a redirect to %s", id, err, leader)
+		}
+	}
+}
+
+func TestCluster_LeaderFailover(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	old := c.leader()
+	c.propose(old, "a=1")
+
+	c.transport.setDown(old, true)
+	leader := c.leader()
+	if leader == old {
+		t.Fatal("Expected a new leader")
+	}
+	c.propose(leader, "b=2")
+	if got := c.fsms[leader].get("a"); got != "1" {
+		t.Errorf("Expected the new leader to have committed entries, a = %q", got)
+	}
+
+	// Proposals to the cut-off leader can't reach a majority
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.nodes[old].Propose(ctx, []byte("lost=1")); err == nil {
+		t.Error("Expected a proposal without a majority to fail")
+	}
+
+	// Back in the cluster, it steps down, drops its uncommitted entry and catches up
+	c.transport.setDown(old, false)
+	c.propose(leader, "c=3")
+	c.waitApplied(old, leader)
+	if got := c.fsms[old].get("b"); got != "2" || c.fsms[old].get("lost") != "" {
+		t.Errorf("Old leader did not converge: %v", c.fsms[old].data)
+	}
+}
+
+func TestCluster_SnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, 3, 10)
+	leader := c.leader()
+
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader {
+			lagging = id
+			break
+		}
+	}
+	c.transport.setDown(lagging, true)
+	for i := 0; i < 50; i++ {
+		c.propose(leader, fmt.Sprintf("k%d=%d", i, i))
+	}
+	if c.nodes[leader].Status().SnapshotIndex == 0 {
+		t.Fatal("Expected the leader to have snapshotted")
+	}
+
+	c.transport.setDown(lagging, false)
+	c.waitApplied(lagging, leader)
+	if got := c.fsms[lagging].get("k49"); got != "49" {
+		t.Errorf("k49 = %q after catching up", got)
+	}
+	if c.nodes[lagging].Status().SnapshotIndex == 0 {
+		t.Error("Expected the lagging node to have been sent a snapshot")
+	}
+}
+
+func TestNode_RestartFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	open := func(fsm *kv) *Node {
+		n, err := NewNode(Config{ID: "solo", Dir: dir, Transport: &memSender{t: &memTransport{}}, FSM: fsm, ElectionTimeout: 20 * time.Millisecond, SnapshotThreshold: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Start()
+		return n
+	}
+	propose := func(n *Node, cmd string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			_, err := n.Propose(ctx, []byte(cmd))
+			if errors.Is(err, ErrNotLeader) {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+
+	n := open(&kv{})
+	propose(n, "a=1")
+	if err := n.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	propose(n, "a=2")
+	propose(n, "b=3")
+	n.Stop()
+
+	fsm := &kv{}
+	n = open(fsm)
+	defer n.Stop()
+	if fsm.get("a") != "1" {
+		t.Errorf("Expected the snapshot to be restored before starting, a = %q", fsm.get("a"))
+	}
+	propose(n, "c=4") // committing it commits the entries from before the restart
+	if fsm.get("a") != "2" || fsm.get("b") != "3" || fsm.get("c") != "4" {
+		t.Errorf("Unexpected state after restart %v", fsm.data)
+	}
+}
@@ -0,0 +1,391 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	stateFile    = "state"
+	logFile      = "log"
+	snapshotFile = "snapshot"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// storage holds what a node must not forget across restarts: its term and
+// vote, its log and its latest snapshot. With no directory it is all kept in
+// memory, which is only useful in tests.
+//
+// The log file is a sequence of records
+//
+//	crc32c (4 bytes, LE) | uvarint n | uvarint term | uvarint index | cmd
+//
+// where n counts the bytes after it and the checksum covers them. A torn last
+// record, from a crash during an append, is cut off when the file is opened.
+// Snapshots start with a line "index term".
+type storage struct {
+	dir string
+	log *os.File
+	w   *bufio.Writer
+
+	term     uint64
+	votedFor string
+
+	snapIndex uint64
+	snapTerm  uint64
+	snapshot  []byte // the snapshot itself when there is no directory
+
+	// entries[i] has index snapIndex+1+i
+	entries []Entry
+}
+
+func openStorage(dir string) (*storage, error) {
+	s := &storage{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, stateFile)); err == nil {
+		fields := strings.SplitN(strings.TrimSpace(string(data)), " ", 2)
+		if s.term, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("raft: reading %s: %w", stateFile, err)
+		}
+		if len(fields) == 2 {
+			s.votedFor = fields[1]
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if f, err := os.Open(filepath.Join(dir, snapshotFile)); err == nil {
+		s.snapIndex, s.snapTerm, err = readSnapshotHeader(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := s.readLog(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.log, s.w = f, bufio.NewWriter(f)
+	return s, nil
+}
+
+// readLog loads the entries after the snapshot and returns how many bytes of
+// the file hold whole records.
+func (s *storage) readLog(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return valid, nil
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > 1<<30 {
+			return valid, nil
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return valid, nil
+		}
+		if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(head[:]) {
+			return valid, nil
+		}
+		e, err := decodeEntry(body)
+		if err != nil {
+			return valid, nil
+		}
+		valid += int64(4+uvarintLen(n)) + int64(n)
+
+		if e.Index <= s.snapIndex {
+			continue
+		}
+		if e.Index != s.lastIndex()+1 {
+			return 0, fmt.Errorf("raft: log entry %d follows %d", e.Index, s.lastIndex())
+		}
+		s.entries = append(s.entries, e)
+	}
+}
+
+func uvarintLen(n uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], n)
+}
+
+func encodeEntry(dst []byte, e Entry) []byte {
+	body := binary.AppendUvarint(nil, e.Term)
+	body = binary.AppendUvarint(body, e.Index)
+	body = append(body, e.Cmd...)
+
+	dst = binary.LittleEndian.AppendUint32(dst, crc32.Checksum(body, castagnoli))
+	dst = binary.AppendUvarint(dst, uint64(len(body)))
+	return append(dst, body...)
+}
+
+func decodeEntry(body []byte) (Entry, error) {
+	var e Entry
+	term, n := binary.Uvarint(body)
+	if n <= 0 {
+		return e, errors.New("raft: bad log entry")
+	}
+	index, m := binary.Uvarint(body[n:])
+	if m <= 0 {
+		return e, errors.New("raft: bad log entry")
+	}
+	e.Term, e.Index = term, index
+	if cmd := body[n+m:]; len(cmd) > 0 {
+		e.Cmd = cmd
+	}
+	return e, nil
+}
+
+func readSnapshotHeader(r *bufio.Reader) (index, term uint64, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, 0, fmt.Errorf("raft: reading snapshot: %w", err)
+	}
+	if _, err := fmt.Sscanf(line, "%d %d\n", &index, &term); err != nil {
+		return 0, 0, fmt.Errorf("raft: reading snapshot: %w", err)
+	}
+	return index, term, nil
+}
+
+func (s *storage) lastIndex() uint64 {
+	return s.snapIndex + uint64(len(s.entries))
+}
+
+func (s *storage) lastTerm() uint64 {
+	if len(s.entries) == 0 {
+		return s.snapTerm
+	}
+	return s.entries[len(s.entries)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must be at or after
+// the snapshot and no later than the last entry.
+func (s *storage) termAt(index uint64) uint64 {
+	if index == s.snapIndex {
+		return s.snapTerm
+	}
+	return s.entries[index-s.snapIndex-1].Term
+}
+
+// slice returns up to max entries from index from up to and including to.
+func (s *storage) slice(from, to uint64, max int) []Entry {
+	if to > s.lastIndex() {
+		to = s.lastIndex()
+	}
+	if from > to {
+		return nil
+	}
+	entries := s.entries[from-s.snapIndex-1 : to-s.snapIndex]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// setState durably records the current term and vote.
+func (s *storage) setState(term uint64, votedFor string) error {
+	if term == s.term && votedFor == s.votedFor {
+		return nil
+	}
+	if s.dir != "" {
+		data := strconv.FormatUint(term, 10)
+		if votedFor != "" {
+			data += " " + votedFor
+		}
+		if err := writeFileSync(filepath.Join(s.dir, stateFile), func(w io.Writer) error {
+			_, err := io.WriteString(w, data+"\n")
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	s.term, s.votedFor = term, votedFor
+	return nil
+}
+
+// append durably adds entries to the end of the log.
+func (s *storage) append(entries ...Entry) error {
+	if s.dir != "" {
+		var buf []byte
+		for _, e := range entries {
+			buf = encodeEntry(buf[:0], e)
+			if _, err := s.w.Write(buf); err != nil {
+				return err
+			}
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		if err := s.log.Sync(); err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// truncateFrom removes the entry at index and every one after it.
+func (s *storage) truncateFrom(index uint64) error {
+	return s.rewriteLog(s.entries[:index-s.snapIndex-1])
+}
+
+// rewriteLog replaces the log with entries, which follow the snapshot.
+func (s *storage) rewriteLog(entries []Entry) error {
+	entries = append([]Entry(nil), entries...)
+	if s.dir != "" {
+		path := filepath.Join(s.dir, logFile)
+		if err := writeFileSync(path, func(w io.Writer) error {
+			var buf []byte
+			for _, e := range entries {
+				buf = encodeEntry(buf[:0], e)
+				if _, err := w.Write(buf); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.log.Close()
+		s.log, s.w = f, bufio.NewWriter(f)
+	}
+	s.entries = entries
+	return nil
+}
+
+// writeSnapshot durably stores a snapshot of everything up to and including
+// index. It doesn't touch the log; compact does that once the snapshot is in
+// place.
+func (s *storage) writeSnapshot(index, term uint64, write func(io.Writer) error) error {
+	header := fmt.Sprintf("%d %d\n", index, term)
+	if s.dir == "" {
+		var buf bytes.Buffer
+		buf.WriteString(header)
+		if err := write(&buf); err != nil {
+			return err
+		}
+		s.snapshot = buf.Bytes()
+		return nil
+	}
+	return writeFileSync(filepath.Join(s.dir, snapshotFile), func(w io.Writer) error {
+		if _, err := io.WriteString(w, header); err != nil {
+			return err
+		}
+		return write(w)
+	})
+}
+
+// compact drops the entries a new snapshot up to index covers. If the log
+// doesn't hold the entry at index with the snapshot's term, as when a
+// follower is sent a snapshot from further ahead, the whole log is dropped.
+func (s *storage) compact(index, term uint64) error {
+	if index <= s.snapIndex {
+		return nil
+	}
+	var rest []Entry
+	if index < s.lastIndex() && s.termAt(index) == term {
+		rest = s.entries[index-s.snapIndex:]
+	}
+	s.snapIndex, s.snapTerm = index, term
+	return s.rewriteLog(rest)
+}
+
+// readSnapshot returns the latest snapshot, including its header, or nil if
+// there is none.
+func (s *storage) readSnapshot() ([]byte, error) {
+	if s.dir == "" {
+		return s.snapshot, nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		s.log.Close()
+		return err
+	}
+	return s.log.Close()
+}
+
+// writeFileSync replaces path atomically with what write produces.
+func writeFileSync(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
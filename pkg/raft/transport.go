@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// VoteRequest asks for a node's vote in an election.
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest carries log entries from the leader, or none as a heartbeat.
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should resume from when the follower's
+	// log doesn't match at PrevLogIndex.
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// SnapshotRequest carries the leader's latest snapshot to a follower that is
+// missing entries the leader has already dropped.
+type SnapshotRequest struct {
+	Term      uint64 `json:"term"`
+	Leader    string `json:"leader"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+	Data      []byte `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport carries RPCs between nodes. The receiving end hands them to the
+// peer's Handle methods.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// HTTPTransport sends RPCs as JSON to the Handler of each peer, whose ID is
+// its base URL.
+type HTTPTransport struct {
+	Client *http.Client
+}
+
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{Client: &http.Client{}}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, req *VoteRequest) (*VoteResponse, error) {
+	resp := new(VoteResponse)
+	return resp, t.call(ctx, peer, "/raft/vote", req, resp)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, req *AppendRequest) (*AppendResponse, error) {
+	resp := new(AppendResponse)
+	return resp, t.call(ctx, peer, "/raft/append", req, resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	resp := new(SnapshotResponse)
+	return resp, t.call(ctx, peer, "/raft/snapshot", req, resp)
+}
+
+func (t *HTTPTransport) call(ctx context.Context, peer, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := t.Client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return fmt.Errorf("raft: %s%s: status %d: %s", peer, path, httpResp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Handler serves the node's side of HTTPTransport under /raft/.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", serveRPC(n.HandleRequestVote))
+	mux.HandleFunc("POST /raft/append", serveRPC(n.HandleAppendEntries))
+	mux.HandleFunc("POST /raft/snapshot", serveRPC(n.HandleInstallSnapshot))
+	return mux
+}
+
+func serveRPC[Req, Resp any](handle func(*Req) (*Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := new(Req)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		resp, err := handle(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,145 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxBulkLen = 512 * 1024 * 1024 // Same limit as Redis' proto-max-bulk-len
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads one command, either as a RESP array of bulk strings (what
+// client libraries send) or as an inline, space separated line (what people type
+// into telnet).
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = []byte(f)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > 1024*1024 {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errProtocol)
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", errProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// writer renders replies in either RESP2 or RESP3, depending on what the client
+// negotiated with HELLO. The two only differ in how nulls and maps are encoded.
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(msg)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(b []byte) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) bulkString(s string) {
+	w.bulk([]byte(s))
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+// mapHeader starts a map of n pairs; RESP2 has no maps, so it gets a flat array.
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.WriteByte('%')
+		w.WriteString(strconv.Itoa(n))
+		w.WriteString("\r\n")
+		return
+	}
+	w.array(2 * n)
+}
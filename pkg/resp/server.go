@@ -0,0 +1,464 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/tcpserver"
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = tcpserver.ErrServerClosed
+
+// Store is the part of shard.CacheManager[string, []byte] the RESP server needs.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string) bool
+	Exists(key string) bool
+	TTL(key string) (time.Duration, bool)
+	Expire(key string, ttl time.Duration) bool
+	Compute(key string, fn func(value []byte, ttl time.Duration, found bool) ([]byte, time.Duration, bool)) ([]byte, bool)
+	Len() int
+	GetStats() lru.Stats
+}
+
+// Server speaks the Redis serialization protocol (RESP2, and RESP3 after HELLO 3)
+// on top of a Store, so that stock Redis clients, redis-cli and redis-benchmark
+// can use the cache.
+type Server struct {
+	store   Store
+	started time.Time
+
+	listener tcpserver.Listener
+}
+
+func NewServer(store Store) *Server {
+	return &Server{
+		store:   store,
+		started: time.Now(),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	return s.listener.Serve(l, s.serveConn)
+}
+
+// Close stops the listener and drops every open connection.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, 64*1024)
+	w := &writer{Writer: bufio.NewWriterSize(conn, 64*1024), proto: 2}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.error("ERR " + err.Error())
+				w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("resp: connection %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.dispatch(w, args)
+
+		// Only flush once the client has no more pipelined commands waiting
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// dispatch runs one command and reports whether the connection should be closed.
+func (s *Server) dispatch(w *writer, args [][]byte) bool {
+	raw := string(args[0])
+	name := strings.ToUpper(raw)
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		s.ping(w, args)
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return false
+		}
+		w.bulk(args[0])
+	case "GET":
+		s.get(w, args)
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		s.del(w, args)
+	case "EXISTS":
+		s.exists(w, args)
+	case "TTL":
+		s.ttl(w, args)
+	case "EXPIRE":
+		s.expire(w, args)
+	case "MGET":
+		s.mget(w, args)
+	case "MSET":
+		s.mset(w, args)
+	case "DBSIZE":
+		w.integer(int64(s.store.Len()))
+	case "INFO":
+		s.info(w, args)
+	case "HELLO":
+		s.hello(w, args)
+	case "SELECT":
+		// There is a single keyspace, which clients know as database 0
+		if len(args) != 1 {
+			wrongArgs(w, name)
+		} else if string(args[0]) != "0" {
+			w.error("ERR DB index is out of range")
+		} else {
+			w.simple("OK")
+		}
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; an empty list is a valid answer
+		w.array(0)
+	case "CLIENT":
+		w.simple("OK")
+	case "QUIT":
+		w.simple("OK")
+		return true
+	default:
+		w.error(fmt.Sprintf("ERR unknown command '%s'", raw))
+	}
+	return false
+}
+
+func (s *Server) ping(w *writer, args [][]byte) {
+	switch len(args) {
+	case 0:
+		w.simple("PONG")
+	case 1:
+		w.bulk(args[0])
+	default:
+		wrongArgs(w, "PING")
+	}
+}
+
+func (s *Server) get(w *writer, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(w, "GET")
+		return
+	}
+
+	value, found := s.store.Get(string(args[0]))
+	if !found {
+		w.null()
+		return
+	}
+	w.bulk(value)
+}
+
+// set implements SET key value [EX seconds | PX milliseconds | KEEPTTL] [NX | XX].
+func (s *Server) set(w *writer, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(w, "SET")
+		return
+	}
+
+	key, value := string(args[0]), args[1]
+	ttl := lru.NoExpiration
+	var nx, xx, keepTTL, hasTTL bool
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if hasTTL || i+1 >= len(args) {
+				w.error("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			var ok bool
+			if ttl, ok = expireTTL(n, unit); !ok || n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			hasTTL = true
+			i++
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && hasTTL) {
+		w.error("ERR syntax error")
+		return
+	}
+
+	if !nx && !xx && !keepTTL {
+		s.store.Set(key, value, ttl)
+		w.simple("OK")
+		return
+	}
+
+	_, stored := s.store.Compute(key, func(_ []byte, oldTTL time.Duration, found bool) ([]byte, time.Duration, bool) {
+		if (nx && found) || (xx && !found) {
+			return nil, 0, false
+		}
+		if keepTTL && found {
+			return value, oldTTL, true
+		}
+		return value, ttl, true
+	})
+	if !stored {
+		w.null()
+		return
+	}
+	w.simple("OK")
+}
+
+func (s *Server) del(w *writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "DEL")
+		return
+	}
+
+	var deleted int64
+	for _, key := range args {
+		if s.store.Delete(string(key)) {
+			deleted++
+		}
+	}
+	w.integer(deleted)
+}
+
+func (s *Server) exists(w *writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "EXISTS")
+		return
+	}
+
+	// Like Redis, a key named twice is counted twice
+	var count int64
+	for _, key := range args {
+		if s.store.Exists(string(key)) {
+			count++
+		}
+	}
+	w.integer(count)
+}
+
+func (s *Server) ttl(w *writer, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(w, "TTL")
+		return
+	}
+
+	ttl, found := s.store.TTL(string(args[0]))
+	switch {
+	case !found:
+		w.integer(-2)
+	case ttl == lru.NoExpiration:
+		w.integer(-1)
+	default:
+		w.integer(int64((ttl + 500*time.Millisecond) / time.Second))
+	}
+}
+
+func (s *Server) expire(w *writer, args [][]byte) {
+	if len(args) != 2 {
+		wrongArgs(w, "EXPIRE")
+		return
+	}
+
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		w.error("ERR value is not an integer or out of range")
+		return
+	}
+
+	ttl, ok := expireTTL(seconds, time.Second)
+	if !ok {
+		w.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+
+	key := string(args[0])
+	if seconds <= 0 {
+		// A deadline in the past removes the key straight away
+		ok = s.store.Delete(key)
+	} else {
+		ok = s.store.Expire(key, ttl)
+	}
+
+	if ok {
+		w.integer(1)
+	} else {
+		w.integer(0)
+	}
+}
+
+// expireTTL converts n units into a Duration, reporting false if that
+// overflows, as Redis refuses expire times it can't represent.
+func expireTTL(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (s *Server) mget(w *writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "MGET")
+		return
+	}
+
+	w.array(len(args))
+	for _, key := range args {
+		if value, found := s.store.Get(string(key)); found {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	}
+}
+
+// mset stores every pair. Unlike Redis it is not atomic across keys, since the
+// keys usually live in different shards.
+func (s *Server) mset(w *writer, args [][]byte) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		wrongArgs(w, "MSET")
+		return
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		s.store.Set(string(args[i]), args[i+1], lru.NoExpiration)
+	}
+	w.simple("OK")
+}
+
+func (s *Server) info(w *writer, args [][]byte) {
+	section := "default"
+	if len(args) > 0 {
+		section = strings.ToLower(string(args[0]))
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	stats := s.store.GetStats()
+	var b strings.Builder
+
+	write := func(name string, lines ...string) {
+		if !all && section != strings.ToLower(name) {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", name)
+		for _, line := range lines {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+		}
+	}
+
+	write("Server",
+		// Client libraries gate features on the reported version
+		"redis_version:7.2.0",
+		"redis_mode:standalone",
+		"server_name:sharded-lru-cache",
+		fmt.Sprintf("uptime_in_seconds:%d", int64(time.Since(s.started).Seconds())),
+	)
+	write("Clients",
+		fmt.Sprintf("connected_clients:%d", s.listener.ClientCount()),
+	)
+	write("Memory",
+		fmt.Sprintf("used_memory:%d", stats.Bytes),
+	)
+	write("Stats",
+		fmt.Sprintf("keyspace_hits:%d", stats.Hits),
+		fmt.Sprintf("keyspace_misses:%d", stats.Misses),
+		fmt.Sprintf("evicted_keys:%d", stats.Evictions),
+	)
+	write("Keyspace",
+		fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0", stats.Items),
+	)
+
+	w.bulkString(b.String())
+}
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME clientname]],
+// which is how RESP3 clients switch protocols.
+func (s *Server) hello(w *writer, args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		w.proto = proto
+	}
+
+	w.mapHeader(7)
+	w.bulkString("server")
+	w.bulkString("redis")
+	w.bulkString("version")
+	w.bulkString("7.2.0")
+	w.bulkString("proto")
+	w.integer(int64(w.proto))
+	w.bulkString("id")
+	w.integer(0)
+	w.bulkString("mode")
+	w.bulkString("standalone")
+	w.bulkString("role")
+	w.bulkString("master")
+	w.bulkString("modules")
+	w.array(0)
+}
+
+func wrongArgs(w *writer, name string) {
+	w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
@@ -0,0 +1,227 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/shard"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startServer(t *testing.T) *testClient {
+	t.Helper()
+
+	mgr, err := shard.NewCacheManager[string, []byte](4, 1000, 3, "", 0)
+	if err != nil {
+		t.Fatalf("NewCacheManager: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := NewServer(mgr)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(args ...string) {
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// do sends one command and renders the reply compactly, e.g. "+OK", ":1",
+// "$hello", "nil" or "[$a nil]".
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func (c *testClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '_':
+		return "nil"
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("read bulk: %v", err)
+		}
+		return "$" + string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.reply()
+		}
+		return string(line[0]) + "[" + strings.Join(items, " ") + "]"
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+func expect(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestServer_Basics(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.do("PING"), "+PONG")
+	expect(t, c.do("SET", "hero", "Batman"), "+OK")
+	expect(t, c.do("GET", "hero"), "$Batman")
+	expect(t, c.do("GET", "nobody"), "nil")
+	expect(t, c.do("EXISTS", "hero", "hero", "nobody"), ":2")
+	expect(t, c.do("DBSIZE"), ":1")
+	expect(t, c.do("DEL", "hero", "nobody"), ":1")
+	expect(t, c.do("GET", "hero"), "nil")
+	expect(t, c.do("FLY"), "-ERR unknown command 'FLY'")
+	expect(t, c.do("GET"), "-ERR wrong number of arguments for 'get' command")
+}
+
+func TestServer_BinarySafeValues(t *testing.T) {
+	c := startServer(t)
+
+	value := "line1\r\nline2\x00\xff"
+	expect(t, c.do("SET", "bin", value), "+OK")
+	expect(t, c.do("GET", "bin"), "$"+value)
+}
+
+func TestServer_SetOptions(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.do("SET", "k", "v1", "NX"), "+OK")
+	expect(t, c.do("SET", "k", "v2", "NX"), "nil")
+	expect(t, c.do("GET", "k"), "$v1")
+
+	expect(t, c.do("SET", "k", "v3", "XX", "EX", "100"), "+OK")
+	expect(t, c.do("GET", "k"), "$v3")
+	expect(t, c.do("TTL", "k"), ":100")
+
+	expect(t, c.do("SET", "k", "v4", "XX", "KEEPTTL"), "+OK")
+	expect(t, c.do("TTL", "k"), ":100")
+
+	expect(t, c.do("SET", "missing", "v", "XX"), "nil")
+	expect(t, c.do("EXISTS", "missing"), ":0")
+
+	expect(t, c.do("SET", "k", "v", "NX", "XX"), "-ERR syntax error")
+	expect(t, c.do("SET", "k", "v", "EX", "soon"), "-ERR value is not an integer or out of range")
+	expect(t, c.do("SET", "k", "v", "EX", "0"), "-ERR invalid expire time in 'set' command")
+	// Too far out for a Duration, which would wrap around to the past
+	expect(t, c.do("SET", "k", "v", "EX", "9223372036854775"), "-ERR invalid expire time in 'set' command")
+	expect(t, c.do("SET", "k", "v", "PX", "9223372036855"), "-ERR invalid expire time in 'set' command")
+	expect(t, c.do("TTL", "k"), ":100")
+
+	expect(t, c.do("SET", "short", "v", "PX", "20"), "+OK")
+	time.Sleep(40 * time.Millisecond)
+	expect(t, c.do("GET", "short"), "nil")
+}
+
+func TestServer_TTLAndExpire(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.do("TTL", "nobody"), ":-2")
+	expect(t, c.do("SET", "k", "v"), "+OK")
+	expect(t, c.do("TTL", "k"), ":-1")
+	expect(t, c.do("EXPIRE", "k", "50"), ":1")
+	expect(t, c.do("TTL", "k"), ":50")
+	expect(t, c.do("EXPIRE", "nobody", "50"), ":0")
+	expect(t, c.do("EXPIRE", "k", "9223372036854775"), "-ERR invalid expire time in 'expire' command")
+	expect(t, c.do("TTL", "k"), ":50")
+	expect(t, c.do("EXPIRE", "k", "0"), ":1")
+	expect(t, c.do("EXISTS", "k"), ":0")
+}
+
+func TestServer_MultiKey(t *testing.T) {
+	c := startServer(t)
+
+	expect(t, c.do("MSET", "a", "1", "b", "2"), "+OK")
+	expect(t, c.do("MGET", "a", "nobody", "b"), "*[$1 nil $2]")
+	expect(t, c.do("MSET", "a"), "-ERR wrong number of arguments for 'mset' command")
+}
+
+func TestServer_InfoAndHello(t *testing.T) {
+	c := startServer(t)
+
+	c.do("SET", "a", "1")
+	info := c.do("INFO")
+	for _, want := range []string{"# Server", "redis_version:", "keyspace_hits:", "db0:keys=1"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO is missing %q:\n%s", want, info)
+		}
+	}
+	if stats := c.do("INFO", "stats"); strings.Contains(stats, "# Server") {
+		t.Errorf("INFO stats should only contain the Stats section:\n%s", stats)
+	}
+
+	hello := c.do("HELLO", "3")
+	if !strings.HasPrefix(hello, "%[") || !strings.Contains(hello, "$proto :3") {
+		t.Errorf("Unexpected HELLO reply %q", hello)
+	}
+
+	// RESP3 has a dedicated null type
+	c.send("GET", "nobody")
+	line, _ := c.r.ReadString('\n')
+	expect(t, line, "_\r\n")
+
+	expect(t, c.do("HELLO", "4"), "-NOPROTO unsupported protocol version")
+}
+
+func TestServer_PipelineAndInline(t *testing.T) {
+	c := startServer(t)
+
+	// Several commands in one write must all be answered, in order
+	c.send("SET", "a", "1")
+	c.send("SET", "b", "2")
+	c.send("MGET", "a", "b")
+	expect(t, c.reply(), "+OK")
+	expect(t, c.reply(), "+OK")
+	expect(t, c.reply(), "*[$1 $2]")
+
+	fmt.Fprint(c.conn, "PING\r\n")
+	expect(t, c.reply(), "+PONG")
+
+	expect(t, c.do("QUIT"), "+OK")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed after QUIT, got %v", err)
+	}
+}
@@ -0,0 +1,553 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// RecoveryMode decides what LoadAOF does when it meets a torn or corrupt record.
+type RecoveryMode string
+
+const (
+	// RecoveryTruncate stops replay at the first bad record and truncates the
+	// file there, like Redis' aof-load-truncated.
+	RecoveryTruncate RecoveryMode = "truncate"
+	// RecoverySkip passes over corrupt records, counting them in the report,
+	// and replays everything else. A torn record at the end is still truncated.
+	RecoverySkip RecoveryMode = "skip"
+	// RecoveryFail makes LoadAOF return an error at the first bad record,
+	// leaving the file untouched.
+	RecoveryFail RecoveryMode = "fail"
+)
+
+// RecoveryReport summarises what LoadAOF did with the file.
+type RecoveryReport struct {
+	Applied   int   // records replayed into the cache
+	Skipped   int   // records passed over because they were corrupt or wouldn't decode
+	Truncated int64 // bytes cut from the end of the file
+	Segments  int   // segments replayed, for a segmented AOF
+	Stale     int   // records not encrypted with the current key; Compact rewrites them
+}
+
+// ErrRewriteInProgress is returned by Compact while another rewrite is running.
+var ErrRewriteInProgress = errors.New("shard: AOF rewrite already in progress")
+
+// ErrSegmentDamaged is returned by LoadAOF when a segment other than the last
+// would need truncating. The segments after it would then replay on top of
+// the records cut, so it has to be repaired by hand.
+var ErrSegmentDamaged = errors.New("shard: damaged AOF segment before the last")
+
+const (
+	// maxRewriteDrains caps how many times Compact drains the rewrite buffer
+	// before taking the lock for the final copy, so a steady stream of writes
+	// can't keep it going forever.
+	maxRewriteDrains = 8
+	// rewriteDrainThreshold is small enough to copy while writers are blocked.
+	rewriteDrainThreshold = 64 * 1024
+)
+
+// FsyncPolicy controls when AOF writes are forced to stable storage, mirroring
+// Redis' appendfsync setting.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways makes every write return only once it has been fsynced.
+	// Concurrent writers share a single fsync (group commit).
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverySec flushes and fsyncs once a second from StartAofSyncer, so a
+	// crash loses at most about a second of writes.
+	FsyncEverySec FsyncPolicy = "everysec"
+	// FsyncNo hands writes to the OS once a second and never fsyncs, leaving it
+	// to the kernel to decide when data reaches the disk.
+	FsyncNo FsyncPolicy = "no"
+)
+
+// ParseFsyncPolicy converts a name such as "everysec" into an FsyncPolicy.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch p := FsyncPolicy(strings.ToLower(name)); p {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %q", name)
+	}
+}
+
+// groupCommit tracks which appended records are known to be on disk, so that
+// writers under FsyncAlways can wait for a sync that covers their record rather
+// than each issuing their own.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64 // sequence number of the last record known to be durable
+	syncing bool   // a writer is currently flushing and fsyncing on behalf of all
+}
+
+func (m *CacheManager[K, V]) StartAofSyncer() {
+	// Under FsyncAlways every write is already durable when it returns
+	if m.fsync == FsyncAlways {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if m.writer == nil {
+					continue
+				}
+				if m.fsync == FsyncNo {
+					m.mu.Lock()
+					m.writer.Flush()
+					m.mu.Unlock()
+					continue
+				}
+				if _, err := m.syncAOF(); err != nil {
+					fmt.Printf("AOF fsync failed: %v\n", err)
+				}
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (m *CacheManager[K, V]) StartAofMonitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if m.writer == nil || m.aofMaxSize <= 0 {
+					continue
+				}
+
+				size, err := m.aofSize()
+				if err != nil {
+					continue
+				}
+
+				if size > m.aofMaxSize {
+					fmt.Printf("AOF size (%d) exceeds limit (%d). Starting compaction...\n", size, m.aofMaxSize)
+					if err := m.Compact(); err != nil {
+						fmt.Printf("Automatic compaction failed: %v\n", err)
+					}
+				}
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// LoadAOF replays the AOF into the shards and reports what it found. Every
+// record carries a CRC32C checksum; what happens at a torn or corrupt record
+// depends on the RecoveryMode the manager was built with. Records are applied
+// by one worker per shard, so replay scales with the number of shards.
+// The manager is Ready once LoadAOF returns, whether or not recovery succeeded.
+func (m *CacheManager[K, V]) LoadAOF() (RecoveryReport, error) {
+	defer m.markReady()
+
+	var report RecoveryReport
+	if m.aof == nil {
+		return report, nil
+	}
+	if m.seg != nil {
+		return report, m.loadSegments(&report)
+	}
+	return report, m.replayFile(m.aof, true, &report)
+}
+
+// replayFile replays one AOF file from the start, adding to report. Records
+// are read and their keys decoded here, then applied by per-shard workers.
+// tail says whether the file is the last one, the only one that may be
+// truncated.
+func (m *CacheManager[K, V]) replayFile(f *os.File, tail bool, report *RecoveryReport) error {
+	// Seek to the beginning of the file
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := aof.NewReader(f)
+	r.SetSealer(m.sealer)
+	p := m.startReplay()
+	err := m.readRecords(r, f, tail, p, report)
+	report.Stale += int(r.Stale())
+	// A worker can only have failed on a record before the one the reader stopped at
+	if werr := p.wait(report); werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (m *CacheManager[K, V]) readRecords(r *aof.Reader, f *os.File, tail bool, p *replayer[K, V], report *RecoveryReport) error {
+	for !p.failed.Load() {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		var recErr *aof.RecordError
+		if errors.As(err, &recErr) {
+			// A missing key is a configuration problem, not damage: dropping
+			// the record would destroy data that is fine
+			if m.recovery == RecoveryFail || errors.Is(err, aof.ErrKey) {
+				return err
+			}
+			// A torn tail always goes, otherwise the next append would be glued onto it
+			if m.recovery == RecoveryTruncate || errors.Is(err, aof.ErrTorn) {
+				if !tail {
+					return fmt.Errorf("%w: %w", ErrSegmentDamaged, err)
+				}
+				return truncateAOF(f, recErr.Offset, report)
+			}
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		item := replayItem[K]{rec: rec, format: r.Format(), offset: r.Offset()}
+		if err := unmarshal(item.format, rec.Key, &item.key); err != nil {
+			// The record is intact but its key doesn't decode into K
+			if m.recovery == RecoveryFail {
+				return fmt.Errorf("decoding key: %w at offset %d", err, r.Offset())
+			}
+			report.Skipped++
+			continue
+		}
+		p.add(item)
+	}
+	return nil
+}
+
+// truncateAOF cuts f off at offset, dropping the bad record and everything
+// after it.
+func truncateAOF(f *os.File, offset int64, report *RecoveryReport) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	report.Truncated += info.Size() - offset
+	return nil
+}
+
+// Compact rewrites the AOF as one SET per live entry, Redis BGREWRITEAOF style.
+// The new file is written in the configured format, so compacting a text AOF
+// upgrades it to the binary format in place.
+// The shards are snapshotted one at a time and written to a temporary file
+// without holding the AOF lock, so writers carry on as normal; anything they
+// append meanwhile is also kept in a rewrite buffer, which is copied to the end
+// of the new file just before it atomically replaces the old one.
+// A segmented AOF is compacted into a new base segment instead; see
+// WithSegmentSize.
+func (m *CacheManager[K, V]) Compact() error {
+	if m.writer == nil {
+		return nil
+	}
+	if m.seg != nil {
+		return m.compactSegments()
+	}
+
+	// 1. Start capturing writes. Anything appended from here on is replayed on
+	// top of the snapshot, so a write that races with its shard's snapshot is
+	// covered either way.
+	m.mu.Lock()
+	if m.rewriteBuf != nil {
+		m.mu.Unlock()
+		return ErrRewriteInProgress
+	}
+	m.rewriteBuf = new(bytes.Buffer)
+	aofPath := m.aof.Name()
+	m.mu.Unlock()
+
+	tempPath := aofPath + ".tmp"
+	abort := func(err error) error {
+		m.mu.Lock()
+		m.rewriteBuf = nil
+		m.mu.Unlock()
+		os.Remove(tempPath)
+		return err
+	}
+
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return abort(err)
+	}
+	defer tempFile.Close()
+	tempWriter := bufio.NewWriter(tempFile)
+
+	// 2. Snapshot each shard under its own read lock and write it out
+	if err := m.writeRewrite(tempWriter); err != nil {
+		return abort(err)
+	}
+
+	// 3. Drain the rewrite buffer while writers keep going, so the final copy
+	// under the lock is small
+	for i := 0; i < maxRewriteDrains; i++ {
+		m.mu.Lock()
+		pending := m.rewriteBuf
+		m.rewriteBuf = new(bytes.Buffer)
+		m.mu.Unlock()
+
+		n, _ := pending.WriteTo(tempWriter)
+		if n < rewriteDrainThreshold {
+			break
+		}
+	}
+	if err := tempWriter.Flush(); err != nil {
+		return abort(err)
+	}
+
+	// 4. Keep group-commit syncs away from the file while it is being swapped out
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := m.rewriteBuf
+	m.rewriteBuf = nil
+	if _, err := pending.WriteTo(tempFile); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if m.fsync != FsyncNo {
+		tempFile.Sync()
+	}
+
+	// 5. Prepare the old AOF for replacement
+	m.writer.Flush()
+	m.aof.Sync()
+	m.aof.Close()
+
+	// 6. Atomic Swap: Replace the old bloat with the new snapshot
+	if err := os.Rename(tempPath, aofPath); err != nil {
+		return err
+	}
+
+	// 7. Re-open the AOF and reset the buffered writer
+	newF, err := os.OpenFile(aofPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	m.aof = newF
+	// Reset rather than replace the writer, appenders check it for nil without the lock
+	m.writer.Reset(newF)
+	m.format.Store(uint32(m.aofFormat))
+
+	return nil
+}
+
+// writeRewrite writes a rewrite of the whole cache to w in the configured
+// format, snapshotting each shard under its own read lock.
+func (m *CacheManager[K, V]) writeRewrite(w *bufio.Writer) error {
+	switch m.aofFormat {
+	case aof.FormatHybrid:
+		return m.Snapshot(w)
+	case aof.FormatBinary:
+		w.Write(aof.Header)
+		fallthrough
+	default:
+		var err error
+		m.forEachEntry(func(key K, entry lru.Entry[V]) {
+			if err != nil {
+				return
+			}
+			var rec []byte
+			rec, err = m.sealer.AppendRecord(nil, m.aofFormat, setRecord(m.aofFormat, key, entry.Value, entry.ExpiryAt))
+			w.Write(rec)
+		})
+		return err
+	}
+}
+
+// bufferSet publishes a SET to replicas and buffers it in the AOF, returning
+// its sequence number for syncAppended, or 0 without an AOF. Writers call it
+// with the key's shard locked, so the stream and the AOF get a key's writes in
+// the order they reached the shard.
+func (m *CacheManager[K, V]) bufferSet(key K, value V, expiresAt time.Time) uint64 {
+	m.publish(func() aof.Record { return setRecord(aof.FormatBinary, key, value, expiresAt) })
+	if m.writer == nil {
+		return 0
+	}
+
+	return m.bufferRecord(func(format aof.Format) ([]byte, error) {
+		return m.sealer.AppendRecord(nil, format, setRecord(format, key, value, expiresAt))
+	})
+}
+
+// bufferDel is bufferSet for a DEL.
+func (m *CacheManager[K, V]) bufferDel(key K) uint64 {
+	m.publish(func() aof.Record { return delRecord(aof.FormatBinary, key) })
+	if m.writer == nil {
+		return 0
+	}
+
+	return m.bufferRecord(func(format aof.Format) ([]byte, error) {
+		return m.sealer.AppendRecord(nil, format, delRecord(format, key))
+	})
+}
+
+// syncAppended waits, under FsyncAlways, until the record with sequence number
+// seq and every one before it is on disk. A seq of 0 means nothing was buffered.
+func (m *CacheManager[K, V]) syncAppended(seq uint64) {
+	if seq > 0 && m.fsync == FsyncAlways {
+		m.waitDurable(seq)
+	}
+}
+
+// bufferRecord buffers one record and returns its sequence number. The record
+// is encoded before taking the lock, in the live file's format; it is only
+// encoded again if Compact switched formats in the meantime, or if a rewrite in
+// progress is producing a different format. A record that can't be encoded is
+// left out and fails every sync from then on, like a failed write.
+func (m *CacheManager[K, V]) bufferRecord(encode func(aof.Format) ([]byte, error)) uint64 {
+	format := m.liveFormat()
+	rec, err := encode(format)
+
+	m.mu.Lock()
+	if live := m.liveFormat(); live != format {
+		format = live
+		rec, err = encode(live)
+	}
+	if err == nil {
+		m.writer.Write(rec)
+		if m.rewriteBuf != nil && m.aofFormat != format {
+			rec, err = encode(m.aofFormat)
+		}
+		if m.rewriteBuf != nil {
+			m.rewriteBuf.Write(rec)
+		}
+	}
+	if err != nil && m.encodeErr == nil {
+		m.encodeErr = err
+	}
+	m.appended++
+	seq := m.appended
+	rotate := false
+	if m.seg != nil {
+		m.seg.written += int64(len(rec))
+		rotate = m.seg.written >= m.seg.size
+	}
+	m.mu.Unlock()
+
+	if rotate {
+		m.maybeRotate()
+	}
+	return seq
+}
+
+// liveFormat returns the format of the AOF currently being appended to.
+func (m *CacheManager[K, V]) liveFormat() aof.Format {
+	return aof.Format(m.format.Load())
+}
+
+// openFormat works out the format of an AOF that has just been opened. An empty
+// file is started in the configured format; anything else keeps the format it
+// was written in until Compact rewrites it.
+func openFormat(f *os.File, target aof.Format) (aof.Format, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() == 0 {
+		switch target {
+		case aof.FormatBinary:
+			_, err = f.Write(aof.Header)
+		case aof.FormatHybrid:
+			// Start with an empty preamble so the file is a valid hybrid AOF
+			err = aof.NewSnapshotWriter(f).Close()
+		}
+		return target, err
+	}
+
+	prefix := make([]byte, len(aof.Header))
+	n, err := f.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return aof.Detect(prefix[:n]), nil
+}
+
+// waitDurable blocks until the record with sequence number seq has been fsynced.
+// Whichever waiter finds no sync in flight becomes the leader and syncs everything
+// appended so far; the others wait for it, then check whether they were covered.
+// A failed sync ends the process, through failSync, unless Stop's final sync
+// already covered seq.
+func (m *CacheManager[K, V]) waitDurable(seq uint64) {
+	gc := &m.commit
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	for gc.synced < seq {
+		if gc.syncing {
+			gc.cond.Wait()
+			continue
+		}
+
+		gc.syncing = true
+		gc.mu.Unlock()
+		synced, err := m.syncAOF()
+		gc.mu.Lock()
+		gc.syncing = false
+
+		if err == nil {
+			gc.synced = max(gc.synced, synced)
+		} else if gc.synced < seq {
+			failSync(err)
+		}
+		gc.cond.Broadcast()
+	}
+}
+
+// failSync ends the process after a failed flush or fsync under FsyncAlways,
+// as Redis does under appendfsync always. Retrying is not safe: once fsync has
+// reported an error the kernel may have dropped the dirty pages, so a later
+// fsync can succeed without the records ever reaching the disk, and the
+// buffered writer keeps returning its first error anyway. Exiting keeps every
+// acknowledged write durable.
+func failSync(err error) {
+	fmt.Printf("AOF fsync failed, exiting: %v\n", err)
+	os.Exit(1)
+}
+
+// syncAOF flushes the buffered writer and fsyncs the AOF, returning the sequence
+// number of the last record the sync covers. The fsync runs outside m.mu so
+// writers can keep appending to the buffer while the disk catches up.
+func (m *CacheManager[K, V]) syncAOF() (uint64, error) {
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+
+	m.mu.Lock()
+	seq := m.appended
+	err := m.encodeErr
+	if err == nil {
+		err = m.writer.Flush()
+	}
+	f := m.aof
+	m.mu.Unlock()
+	if err != nil {
+		return seq, err
+	}
+
+	m.syncs.Add(1)
+	return seq, f.Sync()
+}
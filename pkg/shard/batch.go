@@ -0,0 +1,95 @@
+package shard
+
+import "time"
+
+// GetMany looks up every key and returns the values of the ones found. Keys
+// are grouped by shard, so each shard is locked once however many of the keys
+// it holds.
+func (m *CacheManager[K, V]) GetMany(keys []K) map[K]V {
+	values := make(map[K]V, len(keys))
+	m.lockMany(keys, func(shard *Shard[K, V], owned []int) {
+		for _, i := range owned {
+			if value, found := shard.cache.Get(keys[i]); found {
+				values[keys[i]] = value
+			}
+		}
+	})
+	return values
+}
+
+// SetMany stores every entry with the same TTL, locking each shard once.
+// The entries are appended to the AOF together, so under FsyncAlways the
+// call waits for one fsync rather than one per key.
+func (m *CacheManager[K, V]) SetMany(entries map[K]V, ttl time.Duration) {
+	keys := make([]K, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	expiresAt := expiryFor(ttl)
+	var seq uint64
+	m.lockMany(keys, func(shard *Shard[K, V], owned []int) {
+		for _, i := range owned {
+			shard.cache.Set(keys[i], entries[keys[i]], ttl)
+			seq = m.bufferSet(keys[i], entries[keys[i]], expiresAt)
+		}
+	})
+	m.syncAppended(seq)
+}
+
+// DeleteMany removes every key, locking each shard once, and reports for
+// each one, in order, whether it was present. A key listed twice is only
+// reported present the first time. Like Delete, it logs every key.
+func (m *CacheManager[K, V]) DeleteMany(keys []K) []bool {
+	deleted := make([]bool, len(keys))
+	var seq uint64
+	m.lockMany(keys, func(shard *Shard[K, V], owned []int) {
+		for _, i := range owned {
+			deleted[i] = shard.cache.Delete(keys[i])
+			seq = m.bufferDel(keys[i])
+		}
+	})
+	m.syncAppended(seq)
+	return deleted
+}
+
+// lockMany calls fn once for each shard that owns some of keys, with that
+// shard write-locked and the indexes of the keys it owns, in order. While
+// Resize is moving keys, or once one starts part way through, the remaining
+// keys go one at a time through lockKey, which carries them over first.
+func (m *CacheManager[K, V]) lockMany(keys []K, fn func(shard *Shard[K, V], owned []int)) {
+	single := func(i int) {
+		shard, from := m.lockKey(keys[i], false)
+		fn(shard, []int{i})
+		unlockKey(shard, from, false)
+	}
+
+	l := m.layout.Load()
+	if l.prev != nil {
+		for i := range keys {
+			single(i)
+		}
+		return
+	}
+
+	byShard := make([][]int, len(l.shards))
+	for i, key := range keys {
+		s := l.place.Locate(m.keyHash(key))
+		byShard[s] = append(byShard[s], i)
+	}
+	for s, owned := range byShard {
+		if len(owned) == 0 {
+			continue
+		}
+		shard := l.shards[s]
+		shard.mu.Lock()
+		if m.layout.Load() != l {
+			shard.mu.Unlock()
+			for _, i := range owned {
+				single(i)
+			}
+			continue
+		}
+		fn(shard, owned)
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,113 @@
+package shard
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheManager_GetSetDeleteMany(t *testing.T) {
+	m, _ := NewCacheManager[string, int](8, 100, 3, "", maxAofSize)
+	defer m.Stop()
+
+	entries := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		entries[fmt.Sprintf("key-%d", i)] = i
+	}
+	m.SetMany(entries, ttl)
+	if got := m.Len(); got != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), got)
+	}
+
+	got := m.GetMany([]string{"key-1", "missing", "key-49", "key-1"})
+	if want := map[string]int{"key-1": 1, "key-49": 49}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMany = %v, want %v", got, want)
+	}
+	if len(m.GetMany(nil)) != 0 {
+		t.Error("Expected nothing for no keys")
+	}
+
+	deleted := m.DeleteMany([]string{"key-2", "missing", "key-3", "key-2"})
+	if want := []bool{true, false, true, false}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("DeleteMany = %v, want %v", deleted, want)
+	}
+	if m.Exists("key-2") || m.Exists("key-3") || !m.Exists("key-4") {
+		t.Error("Expected exactly key-2 and key-3 to be deleted")
+	}
+}
+
+func TestCacheManager_BatchesDuringResize(t *testing.T) {
+	m, _ := NewCacheManager[string, int](4, 100000, 20, "", 0)
+	defer m.Stop()
+	const keys = 2000
+	batch := make(map[string]int, keys)
+	names := make([]string, 0, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		batch[key] = 0
+		names = append(names, key)
+	}
+	m.SetMany(batch, ttl)
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; !stop.Load(); round++ {
+			for key := range batch {
+				batch[key] = round
+			}
+			m.SetMany(batch, ttl)
+			got := m.GetMany(names)
+			if len(got) != keys {
+				t.Errorf("Round %d: GetMany found %d of %d keys", round, len(got), keys)
+				return
+			}
+			for key, value := range got {
+				if value != round {
+					t.Errorf("Round %d: %s = %d", round, key, value)
+					return
+				}
+			}
+		}
+	}()
+
+	for _, n := range []int{7, 16, 3, 9, 4} {
+		if _, err := m.Resize(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	if got := m.Len(); got != keys {
+		t.Errorf("Expected %d entries after resizing, got %d", keys, got)
+	}
+}
+
+func TestAOF_SetManySharesOneFsync(t *testing.T) {
+	aofPath := "test_set_many.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, int](4, 1000, 3, aofPath, maxAofSize, WithFsyncPolicy(FsyncAlways))
+	mgr.SetMany(map[string]int{"a": 1, "b": 2, "c": 3, "d": 4}, time.Hour)
+	if syncs := mgr.syncs.Load(); syncs != 1 {
+		t.Errorf("Expected one fsync for the batch, got %d", syncs)
+	}
+	mgr.DeleteMany([]string{"a", "missing"})
+	if syncs := mgr.syncs.Load(); syncs != 2 {
+		t.Errorf("Expected one more fsync for the deletes, got %d", syncs-1)
+	}
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, int](4, 1000, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	newMgr.LoadAOF()
+	if got := newMgr.GetMany([]string{"a", "b", "c", "d"}); !reflect.DeepEqual(got, map[string]int{"b": 2, "c": 3, "d": 4}) {
+		t.Errorf("After restart GetMany = %v", got)
+	}
+}
@@ -0,0 +1,73 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+// marshal encodes a key or value for an AOF record. The binary and hybrid
+// formats store strings and byte slices as they are; everything else, and every
+// field of the text format, is JSON.
+func marshal[T any](format aof.Format, v T) []byte {
+	if format != aof.FormatText {
+		switch x := any(v).(type) {
+		case []byte:
+			return x
+		case string:
+			return []byte(x)
+		}
+	}
+	buf, _ := json.Marshal(v)
+	return buf
+}
+
+// unmarshal is the inverse of marshal.
+func unmarshal[T any](format aof.Format, data []byte, v *T) error {
+	if format != aof.FormatText {
+		switch p := any(v).(type) {
+		case *[]byte:
+			*p = bytes.Clone(data)
+			return nil
+		case *string:
+			*p = string(data)
+			return nil
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// formatSet renders a SET record. The expiry is stored as a Unix timestamp, or 0
+// for entries that never expire.
+func formatSet[K comparable, V any](format aof.Format, key K, value V, expiresAt time.Time) []byte {
+	return aof.AppendRecord(nil, format, setRecord(format, key, value, expiresAt))
+}
+
+// formatDel renders a DEL record.
+func formatDel[K comparable](format aof.Format, key K) []byte {
+	return aof.AppendRecord(nil, format, delRecord(format, key))
+}
+
+func setRecord[K comparable, V any](format aof.Format, key K, value V, expiresAt time.Time) aof.Record {
+	return aof.Record{
+		Op:        aof.OpSet,
+		Key:       marshal(format, key),
+		Value:     marshal(format, value),
+		ExpiresAt: unixExpiry(expiresAt),
+	}
+}
+
+func delRecord[K comparable](format aof.Format, key K) aof.Record {
+	return aof.Record{Op: aof.OpDel, Key: marshal(format, key)}
+}
+
+// unixExpiry converts an entry's expiry to the Unix milliseconds stored on
+// disk, 0 for entries that never expire.
+func unixExpiry(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	return expiresAt.UnixMilli()
+}
@@ -0,0 +1,98 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// Proposer appends commands to a log replicated across nodes, such as a
+// *raft.Node, and returns once they have been committed and applied to this
+// manager through Apply, with what Apply returned.
+//
+// A manager can be the state machine behind such a log: Apply, Snapshot and
+// Restore make it a raft.FSM. Writes then go through ProposeSet and
+// ProposeDelete instead of Set and Delete, so every node applies them in the
+// same order.
+type Proposer interface {
+	Propose(ctx context.Context, cmd []byte) (any, error)
+}
+
+// ProposeSet stores key on every node through p. The expiry is fixed when the
+// write is proposed, so all nodes expire the key at the same moment.
+func (m *CacheManager[K, V]) ProposeSet(ctx context.Context, p Proposer, key K, value V, ttl time.Duration) error {
+	result, err := p.Propose(ctx, aof.AppendRecord(nil, aof.FormatBinary, setRecord(aof.FormatBinary, key, value, expiryFor(ttl))))
+	if err != nil {
+		return err
+	}
+	err, _ = result.(error)
+	return err
+}
+
+// ProposeDelete removes key on every node through p and reports whether it
+// was present.
+func (m *CacheManager[K, V]) ProposeDelete(ctx context.Context, p Proposer, key K) (bool, error) {
+	result, err := p.Propose(ctx, aof.AppendRecord(nil, aof.FormatBinary, delRecord(aof.FormatBinary, key)))
+	if err != nil {
+		return false, err
+	}
+	if err, ok := result.(error); ok {
+		return false, err
+	}
+	deleted, _ := result.(bool)
+	return deleted, nil
+}
+
+// Apply applies a command written by ProposeSet or ProposeDelete, through Set
+// and Delete, so it reaches the AOF and any replicas like a local write. It
+// returns whether a delete removed anything, or an error for a command it
+// can't decode; every node fails the same way on the same command.
+func (m *CacheManager[K, V]) Apply(cmd []byte) any {
+	rec, err := aof.DecodeRecord(cmd)
+	if err != nil {
+		return err
+	}
+	deleted, err := m.applyWrite(rec)
+	if err != nil {
+		return err
+	}
+	if rec.Op == aof.OpDel {
+		return deleted
+	}
+	return nil
+}
+
+// applyWrite applies a SET or DEL record written on another node through Set
+// and Delete. A SET that has expired in the meantime becomes a DEL.
+func (m *CacheManager[K, V]) applyWrite(rec aof.Record) (deleted bool, err error) {
+	var key K
+	if err := unmarshal(aof.FormatBinary, rec.Key, &key); err != nil {
+		return false, fmt.Errorf("decoding key: %w", err)
+	}
+	if rec.Op == aof.OpDel {
+		return m.Delete(key), nil
+	}
+
+	var value V
+	if err := unmarshal(aof.FormatBinary, rec.Value, &value); err != nil {
+		return false, fmt.Errorf("decoding value: %w", err)
+	}
+	if rec.ExpiresAt == 0 {
+		m.Set(key, value, lru.NoExpiration)
+	} else if remaining := time.Until(time.UnixMilli(rec.ExpiresAt)); remaining > 0 {
+		m.Set(key, value, remaining)
+	} else {
+		m.Delete(key)
+	}
+	return false, nil
+}
+
+// Restore replaces the contents with a snapshot written by Snapshot. Like
+// RestoreSnapshot, it leaves the cache untouched if the snapshot is bad.
+func (m *CacheManager[K, V]) Restore(r io.Reader) error {
+	return m.restoreSnapshot(r, true)
+}
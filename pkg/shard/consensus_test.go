@@ -0,0 +1,84 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// logProposer applies every command to each manager in turn, like a
+// replicated log that commits immediately, and returns the first one's result.
+type logProposer []*CacheManager[string, string]
+
+func (p logProposer) Propose(_ context.Context, cmd []byte) (any, error) {
+	var result any
+	for i, m := range p {
+		if r := m.Apply(cmd); i == 0 {
+			result = r
+		}
+	}
+	return result, nil
+}
+
+func TestConsensus_ProposeAppliesEverywhere(t *testing.T) {
+	var nodes logProposer
+	for i := 0; i < 3; i++ {
+		m, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+		defer m.Stop()
+		nodes = append(nodes, m)
+	}
+	ctx := context.Background()
+
+	if err := nodes[0].ProposeSet(ctx, nodes, "a", "1", 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].ProposeSet(ctx, nodes, "b", "2", lru.NoExpiration)
+	if deleted, err := nodes[0].ProposeDelete(ctx, nodes, "b"); err != nil || !deleted {
+		t.Errorf("ProposeDelete = %v, %v; want true", deleted, err)
+	}
+	if deleted, _ := nodes[0].ProposeDelete(ctx, nodes, "b"); deleted {
+		t.Error("Expected deleting a missing key to report false")
+	}
+
+	for i, m := range nodes {
+		if got, _ := m.Get("a"); got != "1" || m.Exists("b") {
+			t.Errorf("node %d diverged", i)
+		}
+		if ttl, _ := m.TTL("a"); ttl <= 0 || ttl > time.Hour {
+			t.Errorf("node %d: TTL(a) = %v", i, ttl)
+		}
+	}
+
+	if result := nodes[0].Apply([]byte("garbage")); result == nil {
+		t.Error("Expected an undecodable command to return an error")
+	}
+}
+
+func TestConsensus_RestoreReplacesContents(t *testing.T) {
+	src, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	defer src.Stop()
+	src.Set("a", "1", lru.NoExpiration)
+	var snapshot bytes.Buffer
+	if err := src.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	defer dst.Stop()
+	dst.Set("stale", "x", lru.NoExpiration)
+	if err := dst.Restore(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1])); err == nil {
+		t.Fatal("Expected a truncated snapshot to fail")
+	}
+	if !dst.Exists("stale") {
+		t.Error("Expected a failed Restore to leave the cache untouched")
+	}
+	if err := dst.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := dst.Get("a"); got != "1" || dst.Exists("stale") {
+		t.Error("Expected Restore to replace the contents")
+	}
+}
@@ -0,0 +1,74 @@
+package shard
+
+import (
+	"strconv"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// ShardDistribution describes how evenly keys are spread over the shards,
+// for tuning the replica count or choosing a placement strategy.
+type ShardDistribution struct {
+	Strategy placement.Strategy
+	// Replicas is the number of points per shard on the ring, 0 for the
+	// other strategies.
+	Replicas int
+	// Ownership is each shard's share of the hash space, in percent.
+	Ownership []float64
+	// Items counts the entries each shard holds, expired ones included until
+	// they are cleaned up. It is empty for a placement that isn't in use.
+	Items placement.Distribution
+	// Simulated counts where sample keys would go, the spread the placement
+	// gives whatever keys the cache happens to hold.
+	Simulated placement.Distribution
+}
+
+// ShardItemCounts returns the number of entries each shard holds, indexed
+// like the placement.
+func (m *CacheManager[K, V]) ShardItemCounts() []int {
+	stats := m.GetShardStats()
+	counts := make([]int, len(stats))
+	for i, s := range stats {
+		counts[i] = s.Items
+	}
+	return counts
+}
+
+// Distribution reports how the current placement spreads keys, both the ones
+// held and sample sample keys hashed like string keys.
+func (m *CacheManager[K, V]) Distribution(sample int) ShardDistribution {
+	l := m.layout.Load()
+	d := ShardDistribution{
+		Strategy:  m.strategy,
+		Ownership: l.place.Ownership(),
+		Items:     placement.Summarize(m.ShardItemCounts()),
+		Simulated: simulate(l.place, len(l.shards), m.hasher, sample),
+	}
+	if m.strategy == placement.StrategyRing {
+		d.Replicas = m.replicas
+	}
+	return d
+}
+
+// SimulateReplicas reports how a ring with replicas points per shard would
+// spread sample keys over the current shards, to compare with Distribution
+// before choosing a replica count.
+func (m *CacheManager[K, V]) SimulateReplicas(replicas, sample int) ShardDistribution {
+	ring := NewHashRingWithHasher(len(m.layout.Load().shards), replicas, m.hasher)
+	return ShardDistribution{
+		Strategy:  placement.StrategyRing,
+		Replicas:  replicas,
+		Ownership: ring.Ownership(),
+		Simulated: ring.Simulate(sample),
+	}
+}
+
+// simulate counts where n sample keys land on shards under p. Each key is
+// hashed and counted as it is made, so memory doesn't grow with n.
+func simulate(p placement.Placement, shards int, hasher Hasher, n int) placement.Distribution {
+	counts := make([]int, shards)
+	for i := 0; i < n; i++ {
+		counts[p.Locate(hasher.HashString("sample:"+strconv.Itoa(i)))]++
+	}
+	return placement.Summarize(counts)
+}
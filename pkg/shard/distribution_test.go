@@ -0,0 +1,61 @@
+package shard
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+func TestHashRing_OwnershipMatchesSimulation(t *testing.T) {
+	ring := NewHashRing(8, 3)
+	owned := ring.Ownership()
+	var total float64
+	for _, pct := range owned {
+		total += pct
+	}
+	if math.Abs(total-100) > 1e-6 {
+		t.Fatalf("Ownership adds up to %v%%", total)
+	}
+
+	sim := ring.Simulate(200000)
+	if sim.Total != 200000 || len(sim.Counts) != 8 {
+		t.Fatalf("Simulate placed %d keys on %d shards", sim.Total, len(sim.Counts))
+	}
+	for i, n := range sim.Counts {
+		if share := 100 * float64(n) / 200000; math.Abs(share-owned[i]) > 1 {
+			t.Errorf("shard %d owns %.2f%% of the ring but got %.2f%% of sample keys", i, owned[i], share)
+		}
+	}
+}
+
+func TestCacheManager_Distribution(t *testing.T) {
+	m, _ := NewCacheManager[string, int](16, 1000, 3, "", 0)
+	defer m.Stop()
+	for i := 0; i < 5000; i++ {
+		m.Set(fmt.Sprintf("key-%d", i), i, ttl)
+	}
+
+	d := m.Distribution(50000)
+	if d.Strategy != placement.StrategyRing || d.Replicas != 3 || len(d.Ownership) != 16 {
+		t.Errorf("Unexpected report %+v", d)
+	}
+	if d.Items.Total != 5000 || len(d.Items.Counts) != 16 {
+		t.Errorf("Expected the item counts of 16 shards adding up to 5000, got %+v", d.Items)
+	}
+	if d.Simulated.Total != 50000 {
+		t.Errorf("Expected 50000 simulated keys, got %d", d.Simulated.Total)
+	}
+
+	// More points per shard is what evens out a ring
+	if more := m.SimulateReplicas(200, 50000); more.Simulated.RelStdDev >= d.Simulated.RelStdDev {
+		t.Errorf("200 replicas spread keys no better than 3: %.3f vs %.3f", more.Simulated.RelStdDev, d.Simulated.RelStdDev)
+	}
+
+	jump, _ := NewCacheManager[string, int](16, 1000, 3, "", 0, WithPlacement(placement.StrategyJump))
+	defer jump.Stop()
+	if d := jump.Distribution(1000); d.Replicas != 0 || d.Ownership[0] != 100.0/16 {
+		t.Errorf("Unexpected jump report %+v", d)
+	}
+}
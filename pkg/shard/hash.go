@@ -0,0 +1,86 @@
+package shard
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"reflect"
+	"unsafe"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// Hasher turns keys into the 64-bit hashes that place them on the ring. The
+// hashers are defined in package placement, which places a ClusterClient's
+// keys with the same code.
+type Hasher = placement.Hasher
+
+type (
+	XXHash64 = placement.XXHash64
+	MapHash  = placement.MapHash
+	FNV1a    = placement.FNV1a
+)
+
+// NewMapHash returns a MapHash with a new random seed.
+func NewMapHash() MapHash {
+	return placement.NewMapHash()
+}
+
+// ShardKeyer is implemented by key types that choose what they are placed by,
+// such as a struct placed by its tenant ID so one tenant's keys share a shard.
+type ShardKeyer interface {
+	ShardKey() string
+}
+
+// fallbackSeed hashes keys of types the Hasher has no method for.
+var fallbackSeed = maphash.MakeSeed()
+
+// keyHasher returns the function that hashes keys of type K with h, without
+// going through their text form: ShardKeyers by their ShardKey, strings as
+// text, integers of every size by value, and 16-byte arrays such as UUIDs by
+// their two halves. The choice goes by the key's kind, so named types like
+// `type UserID int64` hash the same way as their underlying type. Any other
+// type is hashed by maphash.Comparable, which is consistent with == within
+// one process. The function is picked once per type, so a lookup neither
+// switches on the key's type nor boxes it.
+func keyHasher[K comparable](h Hasher) func(K) uint64 {
+	var zero K
+	if _, ok := any(zero).(ShardKeyer); ok {
+		return func(k K) uint64 { return h.HashString(any(k).(ShardKeyer).ShardKey()) }
+	}
+	t := reflect.TypeFor[K]()
+	switch t.Kind() {
+	case reflect.String:
+		return func(k K) uint64 { return h.HashString(*(*string)(unsafe.Pointer(&k))) }
+	case reflect.Int:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*int)(unsafe.Pointer(&k)))) }
+	case reflect.Int8:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*int8)(unsafe.Pointer(&k)))) }
+	case reflect.Int16:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*int16)(unsafe.Pointer(&k)))) }
+	case reflect.Int32:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*int32)(unsafe.Pointer(&k)))) }
+	case reflect.Int64:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*int64)(unsafe.Pointer(&k)))) }
+	case reflect.Uint:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*uint)(unsafe.Pointer(&k)))) }
+	case reflect.Uint8:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*uint8)(unsafe.Pointer(&k)))) }
+	case reflect.Uint16:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*uint16)(unsafe.Pointer(&k)))) }
+	case reflect.Uint32:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*uint32)(unsafe.Pointer(&k)))) }
+	case reflect.Uint64:
+		return func(k K) uint64 { return h.HashUint64(*(*uint64)(unsafe.Pointer(&k))) }
+	case reflect.Uintptr:
+		return func(k K) uint64 { return h.HashUint64(uint64(*(*uintptr)(unsafe.Pointer(&k)))) }
+	case reflect.Array:
+		if t.Len() == 16 && t.Elem().Kind() == reflect.Uint8 {
+			return func(k K) uint64 {
+				v := (*[16]byte)(unsafe.Pointer(&k))
+				hi := h.HashUint64(binary.LittleEndian.Uint64(v[:8]))
+				return h.HashUint64(hi ^ binary.LittleEndian.Uint64(v[8:]))
+			}
+		}
+	}
+	return func(k K) uint64 { return maphash.Comparable(fallbackSeed, k) }
+}
@@ -0,0 +1,106 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+type tenantKey struct {
+	tenant string
+	id     int
+}
+
+func (k tenantKey) ShardKey() string { return k.tenant }
+
+func TestKeyHasher_TypedKeys(t *testing.T) {
+	for _, h := range []Hasher{XXHash64{}, NewMapHash(), FNV1a{}} {
+		if keyHasher[int64](h)(42) != keyHasher[uint8](h)(42) || keyHasher[int](h)(42) != h.HashUint64(42) {
+			t.Errorf("%T: Expected integers of every size to hash by value", h)
+		}
+		uuid := keyHasher[[16]byte](h)
+		if uuid([16]byte{1}) != uuid([16]byte{1}) || uuid([16]byte{1}) == uuid([16]byte{15: 1}) {
+			t.Errorf("%T: Expected UUIDs to hash by both halves", h)
+		}
+		if tenant := keyHasher[tenantKey](h); tenant(tenantKey{"acme", 1}) != tenant(tenantKey{"acme", 2}) {
+			t.Errorf("%T: Expected ShardKey to decide placement", h)
+		}
+		type point struct{ x, y int }
+		if p := keyHasher[point](h); p(point{1, 2}) != p(point{1, 2}) {
+			t.Errorf("%T: Expected equal keys of other types to hash alike", h)
+		}
+	}
+}
+
+type (
+	userID    int64
+	sessionID string
+	requestID [16]byte
+)
+
+func TestKeyHasher_NamedTypes(t *testing.T) {
+	for _, h := range []Hasher{XXHash64{}, NewMapHash(), FNV1a{}} {
+		if keyHasher[userID](h)(42) != keyHasher[int64](h)(42) {
+			t.Errorf("%T: Expected a named integer to hash like its underlying type", h)
+		}
+		if keyHasher[sessionID](h)("abc") != h.HashString("abc") {
+			t.Errorf("%T: Expected a named string to hash as text", h)
+		}
+		if keyHasher[requestID](h)(requestID{1, 2}) != keyHasher[[16]byte](h)([16]byte{1, 2}) {
+			t.Errorf("%T: Expected a named UUID type to hash by both halves", h)
+		}
+	}
+	// XXHash64 places a named integer the same way in every process.
+	if got, want := keyHasher[userID](XXHash64{})(42), (XXHash64{}).HashUint64(42); got != want {
+		t.Errorf("Expected userID 42 to hash to %d, got %d", want, got)
+	}
+}
+
+func TestKeyHasher_NoAllocations(t *testing.T) {
+	for _, h := range []Hasher{XXHash64{}, NewMapHash(), FNV1a{}} {
+		m, _ := NewCacheManager[string, int](16, 100, 100, "", 0, WithHasher(h))
+		ints, _ := NewCacheManager[int64, int](16, 100, 100, "", 0, WithHasher(h))
+		uuids, _ := NewCacheManager[[16]byte, int](16, 100, 100, "", 0, WithHasher(h))
+		users, _ := NewCacheManager[userID, int](16, 100, 100, "", 0, WithHasher(h))
+		m.Set("user:1", 1, ttl)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			m.Get("user:1")
+			ints.shardIndex(1234567)
+			uuids.shardIndex([16]byte{1, 2, 3})
+			users.shardIndex(1234567)
+		})
+		if allocs != 0 {
+			t.Errorf("%T: %v allocations per lookup", h, allocs)
+		}
+	}
+}
+
+func TestHashRing_SpreadsKeys(t *testing.T) {
+	// FNV1a is left out: it bunches keys like these, as its doc says
+	for _, h := range []Hasher{XXHash64{}, NewMapHash()} {
+		ring := NewHashRingWithHasher(8, 100, h)
+		counts := make([]int, 8)
+		for i := 0; i < 80000; i++ {
+			counts[ring.GetShardIndex(fmt.Sprintf("user:%d", i))]++
+		}
+		for shard, n := range counts {
+			// 10000 each on a perfect spread
+			if n < 6000 || n > 14000 {
+				t.Errorf("%T: shard %d got %d of 80000 keys: %v", h, shard, n, counts)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkHashRing_Lookup(b *testing.B) {
+	for _, h := range []Hasher{XXHash64{}, NewMapHash(), FNV1a{}} {
+		m, _ := NewCacheManager[string, int](32, 100, 100, "", 0, WithHasher(h))
+		b.Run(fmt.Sprintf("%T", h), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.shardIndex("session:8f14e45fceea167a5a36dedd4bea2543")
+			}
+		})
+	}
+}
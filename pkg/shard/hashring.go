@@ -1,57 +1,41 @@
 package shard
 
 import (
-	"hash/fnv"
-	"sort"
 	"strconv"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
 )
 
+var _ placement.Placement = (*HashRing)(nil)
+
+// HashRing is the placement.Ring a CacheManager places keys on by default, with
+// its points named after the shards and hashed, like keys, with a Hasher.
 type HashRing struct {
-	hashes              []uint32
-	mapHashToShardIndex map[uint32]int
+	*placement.Ring
+	hasher Hasher
 }
 
+// NewHashRing builds a ring with replicas points per shard, hashed with
+// XXHash64.
 func NewHashRing(shardCount int, replicas int) *HashRing {
-	hr := &HashRing{
-		hashes:              make([]uint32, 0),
-		mapHashToShardIndex: make(map[uint32]int),
-	}
-	for i := 0; i < shardCount; i++ {
-		for r := 0; r < replicas; r++ {
-			nodeName := "shard-" + strconv.Itoa(i) + "-v" + strconv.Itoa(r)
-			h := hr.hash(nodeName)
-
-			hr.hashes = append(hr.hashes, h)
-			hr.mapHashToShardIndex[h] = i
-		}
-	}
-	sort.Slice(hr.hashes, func(i, j int) bool {
-		return hr.hashes[i] < hr.hashes[j]
-	})
-	return hr
+	return NewHashRingWithHasher(shardCount, replicas, XXHash64{})
 }
 
-func (hr *HashRing) GetShardIndex(key string) int {
-	if len(hr.hashes) == 0 {
-		return 0
-	}
-
-	hash := hr.hash(key)
-	// Find the first shard hash >= key hash (binary search)
-	nearestHasheIndex := sort.Search(len(hr.hashes), func(i int) bool {
-		return hr.hashes[i] >= hash
+// NewHashRingWithHasher builds a ring that hashes its points and keys with
+// hasher.
+func NewHashRingWithHasher(shardCount int, replicas int, hasher Hasher) *HashRing {
+	ring := placement.NewRingFunc(shardCount, replicas, func(shard, replica int) uint64 {
+		return hasher.HashString("shard-" + strconv.Itoa(shard) + "-v" + strconv.Itoa(replica))
 	})
+	return &HashRing{Ring: ring, hasher: hasher}
+}
 
-	if nearestHasheIndex == len(hr.hashes) {
-		nearestHasheIndex = 0
-	}
-
-	hashInRing := hr.hashes[nearestHasheIndex]
-	return hr.mapHashToShardIndex[hashInRing]
+func (hr *HashRing) GetShardIndex(key string) int {
+	return hr.Locate(hr.hasher.HashString(key))
 }
 
-func (hr *HashRing) hash(key string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return h.Sum32()
+// Simulate places n sample keys, "sample:0" and so on, and reports how many
+// each shard would get.
+func (hr *HashRing) Simulate(n int) placement.Distribution {
+	return simulate(hr, hr.Nodes(), hr.hasher, n)
 }
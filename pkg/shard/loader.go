@@ -0,0 +1,108 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Loader fetches the value for a key that is missing from the cache, along with
+// how long the result should be cached for.
+type Loader[K comparable, V any] func(ctx context.Context, key K) (V, time.Duration, error)
+
+// LoaderPanic is the error GetOrLoad returns, to every caller waiting on the
+// load, when the loader panics. The panic is recovered, since the loader runs
+// on a goroutine of its own where it would otherwise end the process.
+type LoaderPanic struct {
+	Value any    // what the loader panicked with
+	Stack []byte // the loader's stack at the time
+}
+
+func (p *LoaderPanic) Error() string {
+	return fmt.Sprintf("shard: loader panicked: %v", p.Value)
+}
+
+// loadCall is one in-flight Loader invocation that concurrent misses wait on.
+type loadCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// loadGroup collapses concurrent loads of the same key into one call (singleflight).
+type loadGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*loadCall[V]
+}
+
+// do returns the in-flight call for key, starting fn in a new one if there is none.
+func (g *loadGroup[K, V]) do(key K, fn func() (V, error)) *loadCall[V] {
+	g.mu.Lock()
+	if c, found := g.calls[key]; found {
+		g.mu.Unlock()
+		return c
+	}
+
+	if g.calls == nil {
+		g.calls = make(map[K]*loadCall[V])
+	}
+	c := &loadCall[V]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.err = &LoaderPanic{Value: r, Stack: debug.Stack()}
+			}
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+		c.value, c.err = fn()
+	}()
+
+	return c
+}
+
+// GetOrLoad returns the cached value for key. On a miss it calls loader, caches the
+// result for the TTL the loader chose and returns it. Concurrent misses for the same
+// key share a single loader call, so a hot key expiring does not stampede the backend.
+// Loader errors are returned to every waiter and nothing is cached, and so is a
+// panic in the loader, as a *LoaderPanic.
+//
+// ctx only bounds how long this caller waits. The loader itself runs with ctx's
+// values but without its cancellation, so one impatient caller cannot fail the
+// others waiting on the same load; loaders should apply their own timeouts.
+func (m *CacheManager[K, V]) GetOrLoad(ctx context.Context, key K, loader Loader[K, V]) (V, error) {
+	if value, found := m.Get(key); found {
+		return value, nil
+	}
+
+	loadCtx := context.WithoutCancel(ctx)
+	c := m.loads.do(key, func() (V, error) {
+		// A load that finished between our miss and now has already filled the
+		// key. Peek, so the miss isn't counted twice.
+		if entry, found := m.peek(key); found {
+			return entry.Value, nil
+		}
+
+		value, ttl, err := loader(loadCtx, key)
+		if err != nil {
+			return value, err
+		}
+		m.Set(key, value, ttl)
+		return value, nil
+	})
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+		var emptyValue V
+		return emptyValue, ctx.Err()
+	}
+}
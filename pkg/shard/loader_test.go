@@ -0,0 +1,141 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoad_CollapsesConcurrentMisses(t *testing.T) {
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, "", maxAofSize)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) (string, time.Duration, error) {
+		calls.Add(1)
+		<-release
+		return "value-of-" + key, ttl, nil
+	}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := mgr.GetOrLoad(context.Background(), "user:1", loader)
+			if err != nil {
+				t.Errorf("GetOrLoad: %v", err)
+			}
+			results <- v
+		}()
+	}
+
+	// Give every caller time to miss before the load completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 loader call, got %d", n)
+	}
+	for v := range results {
+		if v != "value-of-user:1" {
+			t.Errorf("Unexpected value %q", v)
+		}
+	}
+
+	if v, found := mgr.Get("user:1"); !found || v != "value-of-user:1" {
+		t.Errorf("Expected loaded value to be cached, got %q (found=%v)", v, found)
+	}
+}
+
+func TestGetOrLoad_HitSkipsLoader(t *testing.T) {
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, "", maxAofSize)
+	mgr.Set("a", 1, ttl)
+
+	v, err := mgr.GetOrLoad(context.Background(), "a", func(ctx context.Context, key string) (int, time.Duration, error) {
+		t.Error("Loader must not run on a hit")
+		return 0, ttl, nil
+	})
+	if err != nil || v != 1 {
+		t.Errorf("Expected 1, got %v (err=%v)", v, err)
+	}
+}
+
+func TestGetOrLoad_ErrorIsNotCached(t *testing.T) {
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, "", maxAofSize)
+	errBackend := errors.New("backend down")
+
+	_, err := mgr.GetOrLoad(context.Background(), "a", func(ctx context.Context, key string) (int, time.Duration, error) {
+		return 0, ttl, errBackend
+	})
+	if !errors.Is(err, errBackend) {
+		t.Fatalf("Expected backend error, got %v", err)
+	}
+
+	v, err := mgr.GetOrLoad(context.Background(), "a", func(ctx context.Context, key string) (int, time.Duration, error) {
+		return 42, ttl, nil
+	})
+	if err != nil || v != 42 {
+		t.Errorf("Expected the retry to load 42, got %v (err=%v)", v, err)
+	}
+}
+
+func TestGetOrLoad_LoaderPanic(t *testing.T) {
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, "", maxAofSize)
+
+	_, err := mgr.GetOrLoad(context.Background(), "a", func(ctx context.Context, key string) (int, time.Duration, error) {
+		panic("boom")
+	})
+	var panicErr *LoaderPanic
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Fatalf("Expected a LoaderPanic, got %v", err)
+	}
+	if mgr.Exists("a") {
+		t.Error("Expected nothing to be cached after a panic")
+	}
+}
+
+func TestGetOrLoad_CountsOneMiss(t *testing.T) {
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, "", maxAofSize)
+
+	mgr.GetOrLoad(context.Background(), "a", func(ctx context.Context, key string) (int, time.Duration, error) {
+		return 1, ttl, nil
+	})
+	if stats := mgr.GetStats(); stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("Expected one miss for one load, got %+v", stats)
+	}
+}
+
+func TestGetOrLoad_CallerCancellation(t *testing.T) {
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, "", maxAofSize)
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) (int, time.Duration, error) {
+		<-release
+		return 7, ttl, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := mgr.GetOrLoad(ctx, "a", loader); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	// The load carries on for the callers that are still waiting
+	done := make(chan int)
+	go func() {
+		v, _ := mgr.GetOrLoad(context.Background(), "a", loader)
+		done <- v
+	}()
+	close(release)
+
+	if v := <-done; v != 7 {
+		t.Errorf("Expected 7, got %d", v)
+	}
+}
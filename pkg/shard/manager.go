@@ -2,38 +2,123 @@ package shard
 
 import (
 	"bufio"
-	"encoding/base64"
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
 	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
 )
 
 type Shard[K comparable, V any] struct {
 	mu    sync.RWMutex
-	cache *lru.LRU[K, V]
+	cache lru.Policy[K, V]
+	seq   uint64 // creation order, which is the order shards are locked in
 }
 
 type CacheManager[K comparable, V any] struct {
-	shards     []*Shard[K, V]
+	layout     atomic.Pointer[layout[K, V]]
 	stopChan   chan struct{}
-	hashRing   *HashRing
 	aof        *os.File
 	aofMaxSize int64 // Threshold in bytes (e.g., 50 * 1024 * 1024 for 50MB)
 	writer     *bufio.Writer
 	mu         sync.RWMutex
+	loads      loadGroup[K, V]
+
+	fsync     FsyncPolicy
+	recovery  RecoveryMode
+	aofFormat aof.Format    // format for new files and rewrites
+	sealer    *aof.Sealer   // compresses and encrypts records, nil for plain ones
+	format    atomic.Uint32 // aof.Format of the live file, changed under mu
+	syncMu    sync.Mutex    // serialises fsyncs with swapping the AOF file out
+	appended  uint64        // records written to the AOF buffer, guarded by mu
+	encodeErr error         // the first record that couldn't be encoded, guarded by mu
+	// rewriteBuf collects records appended while Compact rewrites the AOF, guarded by mu
+	rewriteBuf *bytes.Buffer
+	seg        *segments     // nil unless the AOF is segmented, guarded by mu
+	rewriting  bool          // a segmented Compact is running, guarded by mu
+	ready      chan struct{} // closed once LoadAOF has finished
+	readyOnce  sync.Once
+	feed       replFeed      // numbers writes and streams them to replicas
+	replica    replicaState  // progress replicating from a primary
+	commit     groupCommit   // durability watermark for FsyncAlways
+	syncs      atomic.Uint64 // fsyncs issued by syncAOF
+
+	hasher   Hasher                           // hashes keys for the placement
+	strategy placement.Strategy               // places key hashes on shards
+	keyHash  func(K) uint64                   // hashes a key with hasher
+	replicas int                              // ring points per shard
+	newCache func() (lru.Policy[K, V], error) // builds the policy of a new shard
+	shardSeq uint64                           // shards created, guarded by resizeMu
+	resizeMu sync.RWMutex                     // held by Resize, and read by passes over every entry
 }
 
-func NewCacheManager[K comparable, V any](shardCount int, shardCapacity int, shardReplica int, aofPath string, aofMaxSize int64) (*CacheManager[K, V], error) {
+func NewCacheManager[K comparable, V any](shardCount int, shardCapacity int, shardReplica int, aofPath string, aofMaxSize int64, opts ...Option) (*CacheManager[K, V], error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var shardMaxBytes int64
+	if o.maxBytes > 0 && shardCount > 0 {
+		shardMaxBytes = (o.maxBytes + int64(shardCount) - 1) / int64(shardCount)
+	}
+
+	var costFunc lru.CostFunc[K, V]
+	if o.costFunc != nil {
+		costFunc = func(key K, value V) int64 {
+			return o.costFunc(key, value)
+		}
+	}
+
+	newCache := func() (lru.Policy[K, V], error) {
+		return lru.NewWeightedPolicy[K, V](o.policy, shardCapacity, shardMaxBytes, costFunc)
+	}
+	shards := make([]*Shard[K, V], shardCount)
+	for i := 0; i < shardCount; i++ {
+		cache, err := newCache()
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = &Shard[K, V]{cache: cache, seq: uint64(i)}
+	}
+
+	switch o.fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", o.fsync)
+	}
+	switch o.aofFormat {
+	case aof.FormatText, aof.FormatBinary, aof.FormatHybrid:
+	default:
+		return nil, fmt.Errorf("unknown AOF format %v", o.aofFormat)
+	}
+	if o.sealer != nil && o.aofFormat == aof.FormatText {
+		return nil, fmt.Errorf("AOF compression and encryption need the binary or hybrid format")
+	}
+	switch o.recovery {
+	case RecoveryTruncate, RecoverySkip, RecoveryFail:
+	default:
+		return nil, fmt.Errorf("unknown recovery mode %q", o.recovery)
+	}
+
 	var f *os.File
 	var w *bufio.Writer
+	var seg *segments
+	format := o.aofFormat
 
-	if aofPath != "" {
+	if aofPath != "" && o.segment > 0 {
+		var err error
+		seg, f, format, err = openSegments(aofPath, o.segment, o.aofFormat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open segmented AOF %s: %w", aofPath, err)
+		}
+		w = bufio.NewWriter(f)
+	} else if aofPath != "" {
 		var err error
 		f, err = os.OpenFile(aofPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
@@ -41,265 +126,299 @@ func NewCacheManager[K comparable, V any](shardCount int, shardCapacity int, sha
 		}
 		w = bufio.NewWriter(f)
 	}
+	if f != nil && seg == nil {
+		var err error
+		if format, err = openFormat(f, o.aofFormat); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read AOF file %s: %w", aofPath, err)
+		}
+	}
 
 	m := &CacheManager[K, V]{
-		shards:     make([]*Shard[K, V], shardCount),
 		stopChan:   make(chan struct{}),
-		hashRing:   NewHashRing(shardCount, shardReplica),
 		aof:        f,
 		aofMaxSize: aofMaxSize,
 		writer:     w,
+		fsync:      o.fsync,
+		recovery:   o.recovery,
+		aofFormat:  o.aofFormat,
+		sealer:     o.sealer,
+		seg:        seg,
+		ready:      make(chan struct{}),
+		hasher:     o.hasher,
+		strategy:   o.strategy,
+		keyHash:    keyHasher[K](o.hasher),
+		replicas:   shardReplica,
+		newCache:   newCache,
+		shardSeq:   uint64(shardCount),
 	}
-
-	for i := 0; i < shardCount; i++ {
-		m.shards[i] = &Shard[K, V]{
-			cache: lru.NewLRUCache[K, V](shardCapacity),
-		}
+	place, err := m.newPlacement(shardCount)
+	if err != nil {
+		return nil, err
 	}
+	m.layout.Store(&layout[K, V]{shards: shards, place: place})
+	if f == nil {
+		m.markReady() // nothing to recover
+	}
+	m.format.Store(uint32(format))
+	m.commit.cond = sync.NewCond(&m.commit.mu)
 	return m, nil
 }
 
-func (m *CacheManager[K, V]) Get(key K) (V, bool) {
-	shard := m.getShard(key)
+// Ready returns a channel that is closed once the manager has recovered its
+// contents, when LoadAOF returns. A manager without an AOF is ready from the
+// start. Servers can accept connections before then and turn requests away
+// until it is.
+func (m *CacheManager[K, V]) Ready() <-chan struct{} {
+	return m.ready
+}
+
+func (m *CacheManager[K, V]) markReady() {
+	m.readyOnce.Do(func() { close(m.ready) })
+}
 
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+func (m *CacheManager[K, V]) Get(key K) (V, bool) {
+	shard, from := m.lockKey(key, false)
+	defer unlockKey(shard, from, false)
 	return shard.cache.Get(key)
 }
 
-func (m *CacheManager[K, V]) Set(key K, value V, ttl time.Duration) {
-	shard := m.getShard(key)
+// GetEntry is Get that also returns the entry's expiry and version, read under
+// the same lock as the value.
+func (m *CacheManager[K, V]) GetEntry(key K) (lru.Entry[V], bool) {
+	shard, from := m.lockKey(key, false)
+	defer unlockKey(shard, from, false)
+	if _, found := shard.cache.Get(key); !found {
+		return lru.Entry[V]{}, false
+	}
+	return shard.cache.Peek(key)
+}
 
-	shard.mu.Lock()
+// Set stores value under key. The write is numbered for replicas and buffered
+// in the AOF before the shard is unlocked, so both see writes to a key in the
+// order they were made; only the wait for an fsync happens afterwards.
+func (m *CacheManager[K, V]) Set(key K, value V, ttl time.Duration) {
+	shard, from := m.lockKey(key, false)
 	shard.cache.Set(key, value, ttl)
-	shard.mu.Unlock()
+	seq := m.bufferSet(key, value, expiryFor(ttl))
+	unlockKey(shard, from, false)
 
-	if m.writer != nil {
-		kBuf, _ := json.Marshal(key)
-		vBuf, _ := json.Marshal(value)
+	m.syncAppended(seq)
+}
 
-		// Encode to Base64 to keep the AOF line clean
-		kEnc := base64.StdEncoding.EncodeToString(kBuf)
-		vEnc := base64.StdEncoding.EncodeToString(vBuf)
+// Delete removes the key and reports whether it was present. The delete is
+// logged either way: a key that was evicted from memory may still have a SET
+// in the AOF, or on a replica, that would otherwise bring it back.
+func (m *CacheManager[K, V]) Delete(key K) bool {
+	shard, from := m.lockKey(key, false)
+	deleted := shard.cache.Delete(key)
+	seq := m.bufferDel(key)
+	unlockKey(shard, from, false)
+
+	m.syncAppended(seq)
+	return deleted
+}
 
-		expiry := time.Now().Add(ttl).Unix()
-		line := fmt.Sprintf("SET|%s|%s|%d\n", kEnc, vEnc, expiry)
+// CompareAndDelete removes key only if it still holds the write numbered
+// version, checking and deleting under one lock. found is false if the key was
+// missing or expired.
+func (m *CacheManager[K, V]) CompareAndDelete(key K, version uint64) (deleted, found bool) {
+	shard, from := m.lockKey(key, false)
+	entry, found := shard.cache.Peek(key)
+	if !found || entry.Version != version {
+		unlockKey(shard, from, false)
+		return false, found
+	}
+	shard.cache.Delete(key)
+	seq := m.bufferDel(key)
+	unlockKey(shard, from, false)
 
-		m.mu.Lock()
-		m.writer.WriteString(line)
-		m.mu.Unlock()
+	m.syncAppended(seq)
+	return true, true
+}
+
+// Exists reports whether key holds a live entry, without counting a hit or miss
+// or refreshing the entry's position in the eviction order.
+func (m *CacheManager[K, V]) Exists(key K) bool {
+	_, found := m.peek(key)
+	return found
+}
+
+// TTL returns how long key has left to live, or lru.NoExpiration if it never expires.
+// found is false for missing and expired keys.
+func (m *CacheManager[K, V]) TTL(key K) (ttl time.Duration, found bool) {
+	entry, found := m.peek(key)
+	if !found || entry.ExpiryAt.IsZero() {
+		return lru.NoExpiration, found
 	}
+	// Never report 0 for a live entry, since that would read as "no expiry"
+	return max(time.Until(entry.ExpiryAt), time.Nanosecond), true
 }
 
-func (m *CacheManager[K, V]) StartJanitor(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				m.cleanup()
-			case <-m.stopChan:
-				ticker.Stop()
-				return
-			}
+// Expire gives an existing key a new TTL and reports whether the key existed.
+func (m *CacheManager[K, V]) Expire(key K, ttl time.Duration) bool {
+	_, stored := m.Compute(key, func(value V, _ time.Duration, found bool) (V, time.Duration, bool) {
+		return value, ttl, found
+	})
+	return stored
+}
+
+// Compute atomically replaces the entry for key with the result of fn. fn receives
+// the current value and remaining TTL (found is false for missing or expired keys)
+// and returns the new value and TTL, or store=false to leave the key as it is.
+// Compute returns the value the key holds afterwards and whether fn stored it.
+// fn runs under the shard lock and must not call back into the manager.
+func (m *CacheManager[K, V]) Compute(key K, fn func(value V, ttl time.Duration, found bool) (newValue V, newTTL time.Duration, store bool)) (V, bool) {
+	entry, stored := m.ComputeEntry(key, func(entry lru.Entry[V], found bool) (V, time.Duration, bool) {
+		ttl := lru.NoExpiration
+		if found && !entry.ExpiryAt.IsZero() {
+			ttl = max(time.Until(entry.ExpiryAt), time.Nanosecond)
 		}
-	}()
+		return fn(entry.Value, ttl, found)
+	})
+	return entry.Value, stored
 }
 
-func (m *CacheManager[K, V]) StartAofSyncer() {
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
+// ComputeEntry is Compute for callers that need the entry's version, such as a
+// compare-and-swap. It returns the entry the key holds afterwards, with the
+// version of the new write if fn stored one.
+func (m *CacheManager[K, V]) ComputeEntry(key K, fn func(entry lru.Entry[V], found bool) (newValue V, newTTL time.Duration, store bool)) (lru.Entry[V], bool) {
+	shard, from := m.lockKey(key, false)
+	entry, found := shard.cache.Peek(key)
+
+	newValue, newTTL, store := fn(entry, found)
+	if !store {
+		unlockKey(shard, from, false)
+		return entry, false
+	}
+	expiresAt := expiryFor(newTTL)
+	shard.cache.Set(key, newValue, newTTL)
+	seq := m.bufferSet(key, newValue, expiresAt)
+	stored, _ := shard.cache.Peek(key)
+	unlockKey(shard, from, false)
+
+	m.syncAppended(seq)
+	return lru.Entry[V]{Value: newValue, ExpiryAt: expiresAt, Version: stored.Version}, true
+}
 
-		for {
-			select {
-			case <-ticker.C:
-				if m.writer != nil {
-					m.mu.Lock()
-					m.writer.Flush()
-					m.aof.Sync()
-					m.mu.Unlock()
-				}
-			case <-m.stopChan:
-				return
-			}
-		}
-	}()
+// Len returns the number of entries held across all shards. Expired entries count
+// until they are accessed or cleaned up by the janitor.
+func (m *CacheManager[K, V]) Len() int {
+	return m.GetStats().Items
 }
 
-func (m *CacheManager[K, V]) StartAofMonitor(interval time.Duration) {
+func (m *CacheManager[K, V]) StartJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-
 		for {
 			select {
 			case <-ticker.C:
-				if m.aof == nil || m.aofMaxSize <= 0 {
-					continue
-				}
-
-				info, err := os.Stat(m.aof.Name())
-				if err != nil {
-					continue
-				}
-
-				if info.Size() > m.aofMaxSize {
-					fmt.Printf("AOF size (%d) exceeds limit (%d). Starting compaction...\n", info.Size(), m.aofMaxSize)
-					if err := m.Compact(); err != nil {
-						fmt.Printf("Automatic compaction failed: %v\n", err)
-					}
-				}
+				m.cleanup()
 			case <-m.stopChan:
+				ticker.Stop()
 				return
 			}
 		}
 	}()
 }
 
+// GetStats sums the stats of every shard, including any a Resize is
+// emptying.
 func (m *CacheManager[K, V]) GetStats() lru.Stats {
 	var total lru.Stats
-	for _, shard := range m.shards {
-		shard.mu.RLock()
-		total.Hits += shard.cache.Stats().Hits
-		total.Misses += shard.cache.Stats().Misses
-		total.Evictions += shard.cache.Stats().Evictions
-		shard.mu.RUnlock()
+	for _, stats := range shardStats(m.layout.Load().all()) {
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+		total.Evictions += stats.Evictions
+		total.Items += stats.Items
+		total.Bytes += stats.Bytes
 	}
 	return total
 }
 
-func (m *CacheManager[K, V]) Stop() {
-	close(m.stopChan)
-
-	if m.aof != nil {
-		m.aof.Sync()
-		m.aof.Close()
-	}
+// GetShardStats returns the stats of every shard, indexed like the placement.
+func (m *CacheManager[K, V]) GetShardStats() []lru.Stats {
+	return shardStats(m.layout.Load().shards)
 }
 
-func (m *CacheManager[K, V]) LoadAOF() error {
-	if m.aof == nil {
-		return nil
-	}
-	// Seek to the beginning of the file
-	m.aof.Seek(0, 0)
-	scanner := bufio.NewScanner(m.aof)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), "|")
-		if len(parts) != 4 {
-			continue
-		}
-
-		kBuf, _ := base64.StdEncoding.DecodeString(parts[1])
-		vBuf, _ := base64.StdEncoding.DecodeString(parts[2])
-
-		var k K
-		var v V
-		json.Unmarshal(kBuf, &k)
-		json.Unmarshal(vBuf, &v)
-
-		expiry, _ := strconv.ParseInt(parts[3], 10, 64)
-		remaining := time.Unix(expiry, 0).Sub(time.Now())
-
-		if remaining > 0 {
-			m.setInternal(k, v, remaining)
-		}
-	}
-	return nil
-}
-
-func (m *CacheManager[K, V]) Compact() error {
-	if m.aof == nil {
-		return nil
-	}
-
-	// --- ENTRANCE TO CRITICAL SECTION ---
-	// We lock the entire manager. No 'Set' operations can write to AOF
-	// or modify shards until we are finished.
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	tempPath := m.aof.Name() + ".tmp"
-	tempFile, err := os.Create(tempPath)
-	if err != nil {
-		return err
-	}
-	tempWriter := bufio.NewWriter(tempFile)
-
-	// 1. Iterate through all shards and write CURRENT state to the TEMP file
-	for _, shard := range m.shards {
-		// We use a Lock here because we are already inside the Manager's Lock.
-		// This ensures the shard doesn't change while we read it.
+func shardStats[K comparable, V any](shards []*Shard[K, V]) []lru.Stats {
+	res := make([]lru.Stats, len(shards))
+	for i, shard := range shards {
 		shard.mu.RLock()
-		items := shard.cache.Items() // this returns a map copy, which is safe to iterate through
+		res[i] = shard.cache.Stats()
 		shard.mu.RUnlock()
-		for key, entry := range items {
-			if time.Now().Before(entry.ExpiryAt) {
-				kBuf, _ := json.Marshal(key)
-				vBuf, _ := json.Marshal(entry.Value)
-				kEnc := base64.StdEncoding.EncodeToString(kBuf)
-				vEnc := base64.StdEncoding.EncodeToString(vBuf)
-
-				fmt.Fprintf(tempWriter, "SET|%s|%s|%d\n", kEnc, vEnc, entry.ExpiryAt.Unix())
-			}
-		}
 	}
+	return res
+}
 
-	// 2. Flush and close the temporary "snapshot" file
-	tempWriter.Flush()
-	tempFile.Close()
+func (m *CacheManager[K, V]) Stop() {
+	close(m.stopChan)
 
-	// 3. Prepare the old AOF for replacement
 	if m.writer != nil {
-		m.writer.Flush()
-	}
-	if m.aof != nil {
-		m.aof.Sync()
+		m.syncMu.Lock()
+		defer m.syncMu.Unlock()
+		m.mu.Lock()
+		seq := m.appended
+		err := m.encodeErr
+		if err == nil {
+			err = m.writer.Flush()
+		}
+		if err == nil {
+			err = m.aof.Sync()
+		}
 		m.aof.Close()
-	}
+		m.mu.Unlock()
 
-	// 4. Atomic Swap: Replace the old bloat with the new snapshot
-	if err := os.Rename(tempPath, m.aof.Name()); err != nil {
-		return err
+		// Writers whose records this sync covered are done; any others find
+		// the file closed and fail in waitDurable
+		if err == nil && m.fsync == FsyncAlways {
+			gc := &m.commit
+			gc.mu.Lock()
+			gc.synced = max(gc.synced, seq)
+			gc.cond.Broadcast()
+			gc.mu.Unlock()
+		}
 	}
+}
 
-	// 5. Re-open the AOF and reset the buffered writer
-	newF, err := os.OpenFile(m.aof.Name(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return err
+func expiryFor(ttl time.Duration) time.Time {
+	if ttl == lru.NoExpiration {
+		return time.Time{}
 	}
-	m.aof = newF
-	m.writer = bufio.NewWriter(newF)
+	return time.Now().Add(ttl)
+}
 
-	return nil
+func (m *CacheManager[K, V]) peek(key K) (lru.Entry[V], bool) {
+	shard, from := m.lockKey(key, true)
+	defer unlockKey(shard, from, true)
+	return shard.cache.Peek(key)
 }
 
 func (m *CacheManager[K, V]) setInternal(key K, value V, ttl time.Duration) {
-	shard := m.getShard(key)
-
-	shard.mu.Lock()
+	shard, from := m.lockKey(key, false)
 	shard.cache.Set(key, value, ttl)
-	shard.mu.Unlock()
+	unlockKey(shard, from, false)
 }
 
-func (m *CacheManager[K, V]) getShard(key K) *Shard[K, V] {
-	var shardIndex int
+func (m *CacheManager[K, V]) deleteInternal(key K) {
+	shard, from := m.lockKey(key, false)
+	shard.cache.Delete(key)
+	unlockKey(shard, from, false)
+}
 
-	switch v := any(key).(type) {
-	case string:
-		shardIndex = m.hashRing.GetShardIndex(v)
-	case int:
-		shardIndex = m.hashRing.GetShardIndex(strconv.Itoa(v))
-	default:
-		shardIndex = m.hashRing.GetShardIndex(fmt.Sprintf("%v", v))
-	}
+// getShard returns the shard that owns key. Operations that need the key to
+// stay there go through lockKey instead.
+func (m *CacheManager[K, V]) getShard(key K) *Shard[K, V] {
+	l := m.layout.Load()
+	return l.shards[l.place.Locate(m.keyHash(key))]
+}
 
-	return m.shards[shardIndex]
+func (m *CacheManager[K, V]) shardIndex(key K) int {
+	return m.layout.Load().place.Locate(m.keyHash(key))
 }
 
 func (m *CacheManager[K, V]) cleanup() {
-	for _, shard := range m.shards {
+	for _, shard := range m.layout.Load().all() {
 		shard.mu.Lock()
 		shard.cache.DeleteExpired()
 		shard.mu.Unlock()
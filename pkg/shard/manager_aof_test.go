@@ -1,9 +1,17 @@
 package shard
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
 )
 
 type ComplexUser struct {
@@ -32,7 +40,7 @@ func TestAOF_GenericTypes(t *testing.T) {
 
 	// 2. Create a NEW manager to simulate restart
 	newMgr, _ := NewCacheManager[string, ComplexUser](4, 100, 3, aofPath, maxAofSize)
-	err := newMgr.LoadAOF()
+	_, err := newMgr.LoadAOF()
 	if err != nil {
 		t.Fatalf("Failed to load AOF: %v", err)
 	}
@@ -47,3 +55,511 @@ func TestAOF_GenericTypes(t *testing.T) {
 		t.Errorf("Recovered data mismatch. Got %+v, want %+v", recovered, user)
 	}
 }
+
+func TestAOF_DeleteSurvivesRestart(t *testing.T) {
+	aofPath := "test_delete.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	mgr.Set("session:1", "alice", 1*time.Hour)
+	mgr.Set("session:2", "bob", 1*time.Hour)
+	if !mgr.Delete("session:1") {
+		t.Fatal("Expected session:1 to be deleted")
+	}
+
+	mgr.writer.Flush()
+	mgr.aof.Sync()
+	mgr.aof.Close()
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	if _, err := newMgr.LoadAOF(); err != nil {
+		t.Fatalf("Failed to load AOF: %v", err)
+	}
+
+	if _, found := newMgr.Get("session:1"); found {
+		t.Error("Deleted key came back after recovery")
+	}
+	if v, found := newMgr.Get("session:2"); !found || v != "bob" {
+		t.Errorf("Expected bob, got %q (found=%v)", v, found)
+	}
+
+	// Compaction must not resurrect the deleted key either
+	if err := newMgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	newMgr.aof.Close()
+
+	compacted, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	compacted.LoadAOF()
+	if _, found := compacted.Get("session:1"); found {
+		t.Error("Deleted key came back after compaction")
+	}
+}
+
+func TestAOF_ExpiryKeepsMilliseconds(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	mgr.Set("short", "v", 1500*time.Millisecond)
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	if _, err := newMgr.LoadAOF(); err != nil {
+		t.Fatalf("Failed to load AOF: %v", err)
+	}
+	// Whole seconds would round the deadline to 1 or 2 seconds out
+	if ttl, found := newMgr.TTL("short"); !found || ttl > 1500*time.Millisecond || ttl < 1200*time.Millisecond {
+		t.Errorf("Expected about 1.5s left after replay, got %v (found=%v)", ttl, found)
+	}
+}
+
+func TestAOF_DeleteOfEvictedKeySurvivesRestart(t *testing.T) {
+	aofPath := "test_delete_evicted.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](1, 1, 1, aofPath, maxAofSize)
+	mgr.Set("session:1", "alice", 1*time.Hour)
+	mgr.Set("session:2", "bob", 1*time.Hour) // evicts session:1
+	if mgr.Delete("session:1") {
+		t.Fatal("Expected session:1 to have been evicted already")
+	}
+	mgr.Stop()
+
+	// With room for both, replay would bring session:1 back without the DEL
+	newMgr, _ := NewCacheManager[string, string](1, 100, 1, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	newMgr.LoadAOF()
+	if newMgr.Exists("session:1") {
+		t.Error("Deleted key came back after recovery")
+	}
+}
+
+func TestAOF_FsyncAlwaysIsDurableOnReturn(t *testing.T) {
+	aofPath := "test_fsync_always.aof"
+	defer os.Remove(aofPath)
+
+	mgr, err := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithFsyncPolicy(FsyncAlways))
+	if err != nil {
+		t.Fatalf("NewCacheManager failed: %v", err)
+	}
+	defer mgr.Stop()
+
+	mgr.Set("token", "tok_123", 1*time.Hour)
+
+	// Nothing has flushed the writer, so the record must already be on disk
+	data, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatalf("Failed to read AOF: %v", err)
+	}
+	if len(data) <= len(aof.Header) {
+		t.Fatalf("Expected the SET record on disk when Set returned, got %q", data)
+	}
+}
+
+func TestAOF_FsyncAlwaysGroupCommit(t *testing.T) {
+	aofPath := "test_group_commit.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, int](4, 1000, 3, aofPath, maxAofSize, WithFsyncPolicy(FsyncAlways))
+
+	// Hold off the first fsync until every writer has appended its record
+	const writers = 16
+	mgr.syncMu.Lock()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			mgr.Set(fmt.Sprintf("writer:%d", w), w, 1*time.Hour)
+		}(w)
+	}
+	for {
+		mgr.mu.RLock()
+		appended := mgr.appended
+		mgr.mu.RUnlock()
+		if appended == writers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mgr.syncMu.Unlock()
+	wg.Wait()
+
+	if syncs := mgr.syncs.Load(); syncs != 1 {
+		t.Errorf("Expected %d concurrent writers to share one fsync, got %d", writers, syncs)
+	}
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, int](4, 1000, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	newMgr.LoadAOF()
+	if got := newMgr.Len(); got != writers {
+		t.Errorf("Expected %d keys after restart, got %d", writers, got)
+	}
+}
+
+func TestAOF_FsyncAlwaysExitsOnFailedSync(t *testing.T) {
+	// The failing write runs in a child process, since it ends the process
+	if os.Getenv("AOF_FAILED_SYNC_CHILD") == "1" {
+		mgr, _ := NewCacheManager[string, int](4, 100, 3, filepath.Join(t.TempDir(), "cache.aof"), maxAofSize, WithFsyncPolicy(FsyncAlways))
+		mgr.aof.Close() // every flush and fsync fails from now on
+		mgr.Set("k", 1, time.Hour)
+		fmt.Println("Set returned")
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAOF_FsyncAlwaysExitsOnFailedSync$")
+	cmd.Env = append(os.Environ(), "AOF_FAILED_SYNC_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("Expected the process to exit with status 1, got %v:\n%s", err, out)
+	}
+	if bytes.Contains(out, []byte("Set returned")) || !bytes.Contains(out, []byte("AOF fsync failed, exiting")) {
+		t.Errorf("Expected Set never to return after a failed fsync, got:\n%s", out)
+	}
+}
+
+func TestAOF_StopCoversPendingWrites(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize, WithFsyncPolicy(FsyncAlways))
+
+	// With another sync seemingly in flight, the writer waits for it rather
+	// than syncing itself. Stop's own sync is what covers its record, so the
+	// writer returns instead of failing on the closed file.
+	mgr.commit.mu.Lock()
+	mgr.commit.syncing = true
+	mgr.commit.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		mgr.Set("k", 1, time.Hour)
+		close(done)
+	}()
+	waitFor(t, "the record to be buffered", func() bool {
+		mgr.mu.RLock()
+		defer mgr.mu.RUnlock()
+		return mgr.appended == 1
+	})
+	mgr.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop's sync to release the waiting writer")
+	}
+
+	reloaded, _ := NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize)
+	defer reloaded.Stop()
+	reloaded.LoadAOF()
+	if v, found := reloaded.Get("k"); !found || v != 1 {
+		t.Errorf("Expected k to survive the restart, got %v, %v", v, found)
+	}
+}
+
+func TestAOF_FsyncNoLeavesSyncingToOS(t *testing.T) {
+	aofPath := "test_fsync_no.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithFsyncPolicy(FsyncNo))
+	mgr.StartAofSyncer()
+
+	mgr.Set("feed:1", "post", 1*time.Hour)
+	time.Sleep(1500 * time.Millisecond)
+
+	data, _ := os.ReadFile(aofPath)
+	if len(data) <= len(aof.Header) {
+		t.Errorf("Expected the syncer to hand the record to the OS, got %q", data)
+	}
+	if syncs := mgr.syncs.Load(); syncs != 0 {
+		t.Errorf("Expected no fsyncs under FsyncNo, got %d", syncs)
+	}
+	mgr.Stop()
+}
+
+func TestAOF_UnknownFsyncPolicy(t *testing.T) {
+	if _, err := NewCacheManager[string, string](4, 100, 3, "", maxAofSize, WithFsyncPolicy("sometimes")); err == nil {
+		t.Error("Expected an error for an unknown fsync policy")
+	}
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Expected ParseFsyncPolicy to reject an unknown policy")
+	}
+	if p, err := ParseFsyncPolicy("EverySec"); err != nil || p != FsyncEverySec {
+		t.Errorf("ParseFsyncPolicy(EverySec) = %q, %v", p, err)
+	}
+}
+
+func TestAOF_CompactDoesNotBlockWriters(t *testing.T) {
+	aofPath := "test_bg_rewrite.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	mgr.Set("old", "value", 1*time.Hour)
+
+	// Stall the rewrite on its first shard snapshot
+	stalled := mgr.layout.Load().shards[0]
+	stalled.mu.Lock()
+
+	done := make(chan error, 1)
+	go func() { done <- mgr.Compact() }()
+	for {
+		mgr.mu.RLock()
+		started := mgr.rewriteBuf != nil
+		mgr.mu.RUnlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("during:%d", i); mgr.getShard(k) != stalled {
+			key = k
+		}
+	}
+	written := make(chan struct{})
+	go func() {
+		mgr.Set(key, "new", 1*time.Hour)
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Set blocked while the AOF was being rewritten")
+	}
+
+	if err := mgr.Compact(); err != ErrRewriteInProgress {
+		t.Errorf("Expected ErrRewriteInProgress from a concurrent Compact, got %v", err)
+	}
+
+	stalled.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	newMgr.LoadAOF()
+	for k, want := range map[string]string{"old": "value", key: "new"} {
+		if got, ok := newMgr.Get(k); !ok || got != want {
+			t.Errorf("Get(%q) after restart = %q, %v; want %q", k, got, ok, want)
+		}
+	}
+}
+
+func TestAOF_CompactKeepsConcurrentWrites(t *testing.T) {
+	aofPath := "test_bg_rewrite_concurrent.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, int](8, 10000, 3, aofPath, maxAofSize)
+	for i := 0; i < 20000; i++ {
+		mgr.Set(fmt.Sprintf("seed:%d", i), i, 1*time.Hour)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- mgr.Compact() }()
+
+	// Keep writing and deleting until the rewrite has finished
+	written := 0
+	for running := true; running; written++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+			running = false
+		default:
+		}
+		mgr.Set(fmt.Sprintf("live:%d", written), written, 1*time.Hour)
+		mgr.Delete(fmt.Sprintf("seed:%d", written))
+	}
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, int](8, 10000, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	newMgr.LoadAOF()
+	for i := 0; i < written; i++ {
+		if got, ok := newMgr.Get(fmt.Sprintf("live:%d", i)); !ok || got != i {
+			t.Fatalf("live:%d after restart = %d, %v", i, got, ok)
+		}
+		if newMgr.Exists(fmt.Sprintf("seed:%d", i)) {
+			t.Fatalf("seed:%d was deleted during the rewrite but came back", i)
+		}
+	}
+}
+
+// writeAOF persists a few keys as text records and then appends junk, as a crash
+// or bad disk would.
+func writeAOF(t *testing.T, aofPath string, tail string) {
+	t.Helper()
+	os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithAOFFormat(aof.FormatText))
+	mgr.Set("a", "1", 1*time.Hour)
+	mgr.Set("b", "2", 1*time.Hour)
+	mgr.Stop()
+
+	f, err := os.OpenFile(aofPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(tail)
+	f.Close()
+}
+
+func TestAOF_TornTailIsTruncated(t *testing.T) {
+	aofPath := "test_torn.aof"
+	defer os.Remove(aofPath)
+
+	torn := "SET|ImMi|IjMi|0|deadbe"
+	writeAOF(t, aofPath, torn)
+	before, _ := os.Stat(aofPath)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	report, err := mgr.LoadAOF()
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if report.Applied != 2 || report.Skipped != 0 || report.Truncated != int64(len(torn)) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	after, _ := os.Stat(aofPath)
+	if after.Size() != before.Size()-int64(len(torn)) {
+		t.Errorf("Expected the torn record to be cut, size %d -> %d", before.Size(), after.Size())
+	}
+
+	// New records must start on a clean line
+	mgr.Set("c", "3", 1*time.Hour)
+	mgr.Stop()
+	reopened, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	defer reopened.Stop()
+	if report, _ := reopened.LoadAOF(); report.Applied != 3 || report.Truncated != 0 {
+		t.Errorf("Unexpected report after appending to the repaired file %+v", report)
+	}
+}
+
+func TestAOF_RecoveryModes(t *testing.T) {
+	aofPath := "test_corrupt.aof"
+	defer os.Remove(aofPath)
+
+	// A record with a bad checksum followed by a good one
+	corrupt := "SET|ImMi|IjMi|0|00000000\n"
+	good := string(formatSet(aof.FormatText, "d", "4", time.Time{}))
+
+	t.Run("truncate", func(t *testing.T) {
+		writeAOF(t, aofPath, corrupt+good)
+		mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+		defer mgr.Stop()
+
+		report, err := mgr.LoadAOF()
+		if err != nil {
+			t.Fatalf("LoadAOF failed: %v", err)
+		}
+		if report.Applied != 2 || report.Truncated != int64(len(corrupt+good)) || mgr.Exists("d") {
+			t.Errorf("Expected replay to stop at the corrupt record, got %+v", report)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		writeAOF(t, aofPath, corrupt+good)
+		mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithRecoveryMode(RecoverySkip))
+		defer mgr.Stop()
+
+		report, err := mgr.LoadAOF()
+		if err != nil {
+			t.Fatalf("LoadAOF failed: %v", err)
+		}
+		if report.Applied != 3 || report.Skipped != 1 || report.Truncated != 0 || !mgr.Exists("d") {
+			t.Errorf("Expected the corrupt record to be skipped, got %+v", report)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		writeAOF(t, aofPath, corrupt+good)
+		before, _ := os.Stat(aofPath)
+		mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithRecoveryMode(RecoveryFail))
+		defer mgr.Stop()
+
+		if _, err := mgr.LoadAOF(); !errors.Is(err, aof.ErrChecksum) {
+			t.Errorf("Expected aof.ErrChecksum, got %v", err)
+		}
+		if after, _ := os.Stat(aofPath); after.Size() != before.Size() {
+			t.Error("RecoveryFail must leave the file untouched")
+		}
+	})
+}
+
+func TestAOF_CompactUpgradesTextToBinary(t *testing.T) {
+	aofPath := "test_upgrade.aof"
+	defer os.Remove(aofPath)
+
+	writeAOF(t, aofPath, "")
+
+	// A manager configured for binary keeps appending text to the old file...
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	if _, err := mgr.LoadAOF(); err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	mgr.Set("c", "3", 1*time.Hour)
+	mgr.writer.Flush()
+	if data, _ := os.ReadFile(aofPath); aof.Detect(data) != aof.FormatText {
+		t.Fatal("Expected an existing text AOF to stay text until it is compacted")
+	}
+
+	// ...until Compact rewrites it
+	if err := mgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Set("d", "4", 1*time.Hour)
+	mgr.Delete("a")
+	mgr.Stop()
+
+	data, _ := os.ReadFile(aofPath)
+	if aof.Detect(data) != aof.FormatBinary {
+		t.Fatalf("Expected Compact to upgrade the file to binary, got %q", data)
+	}
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil || report.Skipped != 0 || report.Truncated != 0 {
+		t.Fatalf("LoadAOF = %+v, %v", report, err)
+	}
+	for k, want := range map[string]string{"b": "2", "c": "3", "d": "4"} {
+		if got, ok := newMgr.Get(k); !ok || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, got, ok, want)
+		}
+	}
+	if newMgr.Exists("a") {
+		t.Error("Expected the delete made after the upgrade to survive")
+	}
+}
+
+func TestAOF_BinaryTornTailIsTruncated(t *testing.T) {
+	aofPath := "test_binary_torn.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, []byte](4, 100, 3, aofPath, maxAofSize)
+	mgr.Set("blob", []byte{0, 1, 2, '\n', '|'}, 1*time.Hour)
+	mgr.Stop()
+
+	torn := formatSet(aof.FormatBinary, "half", []byte("written"), time.Time{})
+	torn = torn[:len(torn)-2]
+	f, _ := os.OpenFile(aofPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(torn)
+	f.Close()
+
+	newMgr, _ := NewCacheManager[string, []byte](4, 100, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if report.Applied != 1 || report.Truncated != int64(len(torn)) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if got, _ := newMgr.Get("blob"); string(got) != "\x00\x01\x02\n|" {
+		t.Errorf("Expected raw bytes to round-trip, got %q", got)
+	}
+}
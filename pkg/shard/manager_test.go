@@ -6,6 +6,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
 )
 
 const ttl = 10 * time.Minute
@@ -86,3 +88,78 @@ func TestCacheManager_Set(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheManager_CompareAndDelete(t *testing.T) {
+	m, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	defer m.Stop()
+
+	m.Set("k", "a", ttl)
+	first, _ := m.GetEntry("k")
+	m.Set("k", "b", ttl)
+	m.Set("k", "a", ttl)
+	// Writing the same value back is still a new write
+	if deleted, found := m.CompareAndDelete("k", first.Version); deleted || !found {
+		t.Errorf("CompareAndDelete with a stale version = %v, %v; want false, true", deleted, found)
+	}
+
+	current, _ := m.ComputeEntry("k", func(entry lru.Entry[string], found bool) (string, time.Duration, bool) {
+		return entry.Value + "!", ttl, found
+	})
+	if got, _ := m.GetEntry("k"); got.Value != "a!" || got.Version != current.Version || current.Version == first.Version {
+		t.Errorf("Expected ComputeEntry to return the new write, got %+v after %+v", current, got)
+	}
+	if deleted, found := m.CompareAndDelete("k", current.Version); !deleted || !found || m.Exists("k") {
+		t.Errorf("CompareAndDelete with the current version = %v, %v; want true, true", deleted, found)
+	}
+	if deleted, found := m.CompareAndDelete("k", current.Version); deleted || found {
+		t.Errorf("CompareAndDelete of a missing key = %v, %v; want false, false", deleted, found)
+	}
+}
+
+func TestCacheManager_EvictionPolicy(t *testing.T) {
+	for _, policy := range []lru.PolicyType{lru.PolicyLRU, lru.PolicyLFU, lru.PolicyTinyLFU, lru.PolicySIEVE, lru.PolicyARC} {
+		t.Run(string(policy), func(t *testing.T) {
+			mgr, err := NewCacheManager[string, int](4, 100, 3, "", maxAofSize, WithEvictionPolicy(policy))
+			if err != nil {
+				t.Fatalf("NewCacheManager: %v", err)
+			}
+
+			mgr.Set("a", 1, ttl)
+			if v, found := mgr.Get("a"); !found || v != 1 {
+				t.Errorf("Expected 1, got %v", v)
+			}
+		})
+	}
+
+	if _, err := NewCacheManager[string, int](4, 100, 3, "", maxAofSize, WithEvictionPolicy("random")); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestCacheManager_MaxBytes(t *testing.T) {
+	const maxBytes = 64 * 1024
+	mgr, _ := NewCacheManager[string, []byte](8, 1_000_000, 3, "", maxAofSize, WithMaxBytes(maxBytes))
+
+	for i := 0; i < 1000; i++ {
+		mgr.Set(fmt.Sprintf("key-%d", i), make([]byte, 1024), ttl)
+	}
+
+	stats := mgr.GetStats()
+	if stats.Bytes > maxBytes {
+		t.Errorf("Manager uses %d bytes, budget is %d", stats.Bytes, maxBytes)
+	}
+	if stats.Evictions == 0 {
+		t.Error("Expected evictions once the byte budget was reached")
+	}
+
+	var sum int64
+	for _, shardStats := range mgr.GetShardStats() {
+		if shardStats.Bytes > maxBytes/8 {
+			t.Errorf("Shard uses %d bytes, its budget is %d", shardStats.Bytes, maxBytes/8)
+		}
+		sum += shardStats.Bytes
+	}
+	if sum != stats.Bytes {
+		t.Errorf("Shard bytes add up to %d, total says %d", sum, stats.Bytes)
+	}
+}
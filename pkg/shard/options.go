@@ -0,0 +1,124 @@
+package shard
+
+import (
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// Option customises a CacheManager at construction time.
+type Option func(*options)
+
+type options struct {
+	policy    lru.PolicyType
+	maxBytes  int64
+	costFunc  func(key, value any) int64
+	fsync     FsyncPolicy
+	recovery  RecoveryMode
+	aofFormat aof.Format
+	segment   int64
+	sealer    *aof.Sealer
+	hasher    Hasher
+	strategy  placement.Strategy
+}
+
+func defaultOptions() options {
+	return options{
+		policy:    lru.PolicyLRU,
+		fsync:     FsyncEverySec,
+		recovery:  RecoveryTruncate,
+		aofFormat: aof.FormatBinary,
+		hasher:    XXHash64{},
+		strategy:  placement.StrategyRing,
+	}
+}
+
+// WithEvictionPolicy selects the eviction policy every shard is built with.
+func WithEvictionPolicy(policy lru.PolicyType) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// WithMaxBytes bounds the whole manager by the total cost of its entries, split
+// evenly across the shards. Entries are measured with lru.ByteCost unless
+// WithCostFunc is also given.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(o *options) {
+		o.maxBytes = maxBytes
+	}
+}
+
+// WithCostFunc replaces lru.ByteCost as the measure used for WithMaxBytes and
+// for the Bytes figure in the stats.
+func WithCostFunc(costFunc func(key, value any) int64) Option {
+	return func(o *options) {
+		o.costFunc = costFunc
+	}
+}
+
+// WithFsyncPolicy chooses when AOF writes are fsynced. The default is FsyncEverySec.
+func WithFsyncPolicy(policy FsyncPolicy) Option {
+	return func(o *options) {
+		o.fsync = policy
+	}
+}
+
+// WithRecoveryMode chooses how LoadAOF handles torn or corrupt records. The
+// default is RecoveryTruncate.
+func WithRecoveryMode(mode RecoveryMode) Option {
+	return func(o *options) {
+		o.recovery = mode
+	}
+}
+
+// WithAOFFormat chooses the record format for new AOF files and for the file
+// Compact writes. The default is aof.FormatBinary. With aof.FormatHybrid,
+// Compact writes a snapshot preamble followed by binary records. An existing
+// file keeps its format until it is compacted.
+func WithAOFFormat(format aof.Format) Option {
+	return func(o *options) {
+		o.aofFormat = format
+	}
+}
+
+// WithSegmentSize splits the AOF into segments of about size bytes each, tracked
+// by a manifest, in a directory next to the AOF path named after it with a ".d"
+// suffix. Compact writes a new base segment and drops the increments it covers,
+// and LoadAOF recovers each segment on its own, so a damaged file only costs
+// its own records. An existing single-file AOF becomes the first base segment.
+// The default, 0, keeps the whole AOF in one file.
+func WithSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.segment = size
+	}
+}
+
+// WithSealer compresses and/or encrypts every AOF record, snapshot included,
+// with sealer, and lets LoadAOF and RestoreSnapshot open them. It needs the
+// binary or hybrid format. Records already on disk keep the way they were
+// written until Compact rewrites them, which is also how a key rotation takes
+// effect: give the new key first and the old one after it, and compact once
+// LoadAOF reports stale records.
+func WithSealer(sealer *aof.Sealer) Option {
+	return func(o *options) {
+		o.sealer = sealer
+	}
+}
+
+// WithHasher chooses how keys are hashed onto the shards. The default is
+// XXHash64; NewMapHash resists keys crafted to collide.
+func WithHasher(hasher Hasher) Option {
+	return func(o *options) {
+		o.hasher = hasher
+	}
+}
+
+// WithPlacement chooses how key hashes are mapped onto shards. The default,
+// placement.StrategyRing, is a HashRing with the replica count given to
+// NewCacheManager; the other strategies ignore that count.
+func WithPlacement(strategy placement.Strategy) Option {
+	return func(o *options) {
+		o.strategy = strategy
+	}
+}
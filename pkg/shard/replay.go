@@ -0,0 +1,146 @@
+package shard
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+const (
+	// replayBatchSize is how many records the reader hands a shard worker at a
+	// time, so the channel isn't touched once per record.
+	replayBatchSize = 256
+	// replayQueueDepth is how many batches a shard worker can fall behind by
+	// before the reader waits for it.
+	replayQueueDepth = 4
+)
+
+// replayItem is one record on its way to the worker of the shard its key maps to.
+type replayItem[K comparable] struct {
+	key    K
+	rec    aof.Record
+	format aof.Format
+	offset int64 // where the record ends, for error messages
+}
+
+// replayer applies records read from the AOF with one worker per shard. The
+// reader decodes each key to find its shard; the worker decodes the value and
+// applies it. Every record for a key goes through the same worker in file
+// order, so the result is the same as a sequential replay, and the workers
+// never contend for a shard lock.
+type replayer[K comparable, V any] struct {
+	m       *CacheManager[K, V]
+	queues  []chan []replayItem[K]
+	batches [][]replayItem[K]
+	wg      sync.WaitGroup
+
+	applied atomic.Int64
+	skipped atomic.Int64
+	failed  atomic.Bool
+	errOnce sync.Once
+	err     error // the first record a worker couldn't apply, under RecoveryFail
+}
+
+// startReplay starts a worker per shard. Resize waits for LoadAOF, so the
+// shards stay the same until the replay is over.
+func (m *CacheManager[K, V]) startReplay() *replayer[K, V] {
+	shards := m.layout.Load().shards
+	p := &replayer[K, V]{
+		m:       m,
+		queues:  make([]chan []replayItem[K], len(shards)),
+		batches: make([][]replayItem[K], len(shards)),
+	}
+	for i := range shards {
+		p.queues[i] = make(chan []replayItem[K], replayQueueDepth)
+		p.wg.Add(1)
+		go p.work(shards[i], p.queues[i])
+	}
+	return p
+}
+
+// add queues a record for the shard that owns key.
+func (p *replayer[K, V]) add(item replayItem[K]) {
+	i := p.m.shardIndex(item.key)
+	p.batches[i] = append(p.batches[i], item)
+	if len(p.batches[i]) == replayBatchSize {
+		p.queues[i] <- p.batches[i]
+		p.batches[i] = make([]replayItem[K], 0, replayBatchSize)
+	}
+}
+
+// wait hands over what is left, waits for the workers to apply it and adds
+// their counts to report.
+func (p *replayer[K, V]) wait(report *RecoveryReport) error {
+	for i, batch := range p.batches {
+		if len(batch) > 0 {
+			p.queues[i] <- batch
+		}
+		close(p.queues[i])
+	}
+	p.wg.Wait()
+
+	report.Applied += int(p.applied.Load())
+	report.Skipped += int(p.skipped.Load())
+	return p.err
+}
+
+func (p *replayer[K, V]) work(shard *Shard[K, V], queue <-chan []replayItem[K]) {
+	defer p.wg.Done()
+
+	for batch := range queue {
+		for _, item := range batch {
+			// Keep draining after a failure so the reader never blocks on us
+			if p.failed.Load() {
+				continue
+			}
+			if err := p.m.applyRecord(shard, item); err != nil {
+				// The record is intact but its value doesn't decode into V
+				if p.m.recovery == RecoveryFail {
+					p.errOnce.Do(func() {
+						p.err = fmt.Errorf("%w at offset %d", err, item.offset)
+						p.failed.Store(true)
+					})
+					continue
+				}
+				p.skipped.Add(1)
+				continue
+			}
+			p.applied.Add(1)
+		}
+	}
+}
+
+// applyRecord replays one record into shard, the shard its key maps to.
+func (m *CacheManager[K, V]) applyRecord(shard *Shard[K, V], item replayItem[K]) error {
+	switch item.rec.Op {
+	case aof.OpSet:
+		var v V
+		if err := unmarshal(item.format, item.rec.Value, &v); err != nil {
+			return fmt.Errorf("decoding value: %w", err)
+		}
+
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		if item.rec.ExpiresAt == 0 {
+			shard.cache.Set(item.key, v, lru.NoExpiration)
+			return nil
+		}
+		remaining := time.UnixMilli(item.rec.ExpiresAt).Sub(time.Now())
+
+		if remaining > 0 {
+			shard.cache.Set(item.key, v, remaining)
+		} else {
+			// An expired SET still overrides whatever an earlier record stored
+			shard.cache.Delete(item.key)
+		}
+	case aof.OpDel:
+		shard.mu.Lock()
+		shard.cache.Delete(item.key)
+		shard.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package shard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+func TestReplay_MatchesWriteOrder(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	// Enough records per shard to fill several batches, with every key
+	// overwritten and some deleted, so out-of-order application would show
+	mgr, _ := NewCacheManager[string, int](8, 10000, 3, aofPath, maxAofSize)
+	want := make(map[string]int)
+	records := 0
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if (i+round)%7 == 0 {
+				mgr.Delete(key) // logged whether or not the key exists
+				records++
+				delete(want, key)
+				continue
+			}
+			mgr.Set(key, round*1000+i, 1*time.Hour)
+			want[key] = round*1000 + i
+			records++
+		}
+	}
+	mgr.Stop()
+
+	newMgr, _ := NewCacheManager[string, int](8, 10000, 3, aofPath, maxAofSize)
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if report.Applied != records {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if newMgr.Len() != len(want) {
+		t.Errorf("Len() = %d, want %d", newMgr.Len(), len(want))
+	}
+	for key, value := range want {
+		if got, ok := newMgr.Get(key); !ok || got != value {
+			t.Fatalf("Get(%q) = %d, %v; want %d", key, got, ok, value)
+		}
+	}
+}
+
+func TestReplay_UndecodableValue(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	// A string value where an int is expected, between two good records
+	f, _ := os.Create(aofPath)
+	f.Write(aof.Header)
+	f.Write(formatSet(aof.FormatBinary, "a", 1, time.Time{}))
+	f.Write(formatSet(aof.FormatBinary, "b", "two", time.Time{}))
+	f.Write(formatSet(aof.FormatBinary, "c", 3, time.Time{}))
+	f.Close()
+
+	mgr, _ := NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize)
+	report, err := mgr.LoadAOF()
+	mgr.Stop()
+	if err != nil || report.Applied != 2 || report.Skipped != 1 {
+		t.Errorf("LoadAOF = %+v, %v; want the bad value skipped", report, err)
+	}
+
+	mgr, _ = NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize, WithRecoveryMode(RecoveryFail))
+	defer mgr.Stop()
+	if _, err := mgr.LoadAOF(); err == nil {
+		t.Error("Expected RecoveryFail to report the undecodable value")
+	}
+}
+
+func TestReady(t *testing.T) {
+	isReady := func(m *CacheManager[string, string]) bool {
+		select {
+		case <-m.Ready():
+			return true
+		default:
+			return false
+		}
+	}
+
+	mem, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	if !isReady(mem) {
+		t.Error("Expected a manager without an AOF to be ready straight away")
+	}
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, filepath.Join(t.TempDir(), "cache.aof"), maxAofSize)
+	defer mgr.Stop()
+	if isReady(mgr) {
+		t.Error("Expected a manager with an AOF to wait for LoadAOF")
+	}
+	mgr.LoadAOF()
+	if !isReady(mgr) {
+		t.Error("Expected the manager to be ready after LoadAOF")
+	}
+}
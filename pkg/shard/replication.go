@@ -0,0 +1,381 @@
+package shard
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// A primary streams its contents and then its writes to a replica over any
+// byte stream; the server uses a long-lived HTTP response. The stream is a
+// sequence of frames:
+//
+//	kind | uvarint offset | uvarint n | record (n bytes)
+//
+// where record is an aof binary record, or empty. It starts with a snapshot,
+// frameSnapshot for every entry and frameSnapshotEnd with the offset the
+// snapshot was taken at. Then comes a frameWrite for every write, numbered
+// one after another, and a framePing with the primary's offset every second
+// so the replica can tell how far behind it is.
+const (
+	frameSnapshot    = 's'
+	frameSnapshotEnd = 'e'
+	frameWrite       = 'w'
+	framePing        = 'p'
+)
+
+const (
+	replPingInterval = time.Second
+	// replBacklog is how many writes a replica may fall behind by before the
+	// primary drops it. It then reconnects and starts again from a snapshot.
+	replBacklog = 1 << 16
+)
+
+var (
+	// ErrReplicaTooSlow is returned by ServeReplica when the replica fell more
+	// than the backlog behind.
+	ErrReplicaTooSlow = errors.New("shard: replica fell too far behind")
+	// ErrReplicationGap is returned by Replicate when the stream skips writes.
+	ErrReplicationGap = errors.New("shard: replication stream skipped writes")
+)
+
+// ReplicationStatus describes a manager's part in replication.
+type ReplicationStatus struct {
+	// Role is "primary", or "replica" once Replicate has been called.
+	Role string
+	// Offset counts the writes made, on a primary, or applied from the
+	// primary, on a replica.
+	Offset uint64
+	// Replicas is the number of replicas being streamed to.
+	Replicas int
+
+	// The rest only apply to a replica.
+	PrimaryOffset uint64 // the primary's offset as last heard
+	Connected     bool   // a stream is being read
+	Synced        bool   // a full snapshot has been loaded
+	// Lag is how many of the primary's writes, as of PrimaryOffset, are yet
+	// to be applied. It only counts writes the replica has heard of, so check
+	// LastHeard too: a primary that has gone quiet can't report new ones.
+	Lag uint64
+	// LastHeard is the time since anything, a ping at the least, arrived
+	// from the primary.
+	LastHeard time.Duration
+}
+
+type replFrame struct {
+	kind   byte
+	offset uint64
+	rec    []byte
+}
+
+// replFeed numbers every write and hands it to the replicas being streamed to.
+type replFeed struct {
+	mu     sync.Mutex
+	offset uint64
+	subs   map[chan replFrame]struct{}
+}
+
+// replicaState is the replica side of replication, guarded by mu.
+type replicaState struct {
+	mu            sync.Mutex
+	active        bool
+	connected     bool
+	synced        bool
+	offset        uint64
+	primaryOffset uint64
+	lastHeard     time.Time
+}
+
+// publish hands a write to the replicas. The record is only built if there
+// are any.
+func (m *CacheManager[K, V]) publish(record func() aof.Record) {
+	f := &m.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.offset++
+	if len(f.subs) == 0 {
+		return
+	}
+	frame := replFrame{kind: frameWrite, offset: f.offset, rec: aof.AppendRecord(nil, aof.FormatBinary, record())}
+	for sub := range f.subs {
+		select {
+		case sub <- frame:
+		default:
+			// Cut it loose rather than hold up writers; it will resync
+			delete(f.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// ServeReplica streams a copy of the cache to w, followed by every write from
+// then on, until ctx is done, w fails, the replica falls too far behind or the
+// manager is stopped. If w has a Flush method, as an http.ResponseWriter does, it is
+// called whenever a batch of frames has been written. The other end of the
+// stream is Replicate.
+func (m *CacheManager[K, V]) ServeReplica(ctx context.Context, w io.Writer) error {
+	sub := make(chan replFrame, replBacklog)
+	f := &m.feed
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[chan replFrame]struct{})
+	}
+	f.subs[sub] = struct{}{}
+	start := f.offset
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.subs, sub)
+		f.mu.Unlock()
+	}()
+
+	bw := bufio.NewWriter(w)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(interface{ Flush() }); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// Writes from start on queue up in sub meanwhile. One that races with its
+	// shard's copy ends up in both, and the replica applying it twice is harmless.
+	var err error
+	m.forEachEntry(func(key K, entry lru.Entry[V]) {
+		if err == nil {
+			err = writeFrame(bw, replFrame{kind: frameSnapshot, rec: aof.AppendRecord(nil, aof.FormatBinary, setRecord(aof.FormatBinary, key, entry.Value, entry.ExpiryAt))})
+		}
+	})
+	if err == nil {
+		err = writeFrame(bw, replFrame{kind: frameSnapshotEnd, offset: start})
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(replPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case frame, ok := <-sub:
+			if !ok {
+				return ErrReplicaTooSlow
+			}
+			// Send whatever else is already queued along with it
+			for more := true; more && ok; {
+				if err := writeFrame(bw, frame); err != nil {
+					return err
+				}
+				select {
+				case frame, ok = <-sub:
+				default:
+					more = false
+				}
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if !ok {
+				return ErrReplicaTooSlow
+			}
+		case <-ping.C:
+			f.mu.Lock()
+			offset := f.offset
+			f.mu.Unlock()
+			if err := writeFrame(bw, replFrame{kind: framePing, offset: offset}); err != nil {
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.stopChan:
+			return nil
+		}
+	}
+}
+
+func writeFrame(w *bufio.Writer, frame replFrame) error {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(frame.rec))
+	buf = append(buf, frame.kind)
+	buf = binary.AppendUvarint(buf, frame.offset)
+	buf = binary.AppendUvarint(buf, uint64(len(frame.rec)))
+	buf = append(buf, frame.rec...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (replFrame, error) {
+	var frame replFrame
+	kind, err := r.ReadByte()
+	if err != nil {
+		return frame, err
+	}
+	frame.kind = kind
+	if frame.offset, err = binary.ReadUvarint(r); err != nil {
+		return frame, io.ErrUnexpectedEOF
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return frame, io.ErrUnexpectedEOF
+	}
+	if n > aof.MaxRecordSize {
+		return frame, aof.ErrMalformed
+	}
+	frame.rec = make([]byte, n)
+	if _, err := io.ReadFull(r, frame.rec); err != nil {
+		return frame, io.ErrUnexpectedEOF
+	}
+	return frame, nil
+}
+
+// Replicate makes the manager a replica of the primary streaming to r from
+// ServeReplica. Once the primary's snapshot has arrived in full, it replaces
+// the cache's contents; the writes that follow are applied like any other,
+// so they reach the AOF and any replicas of this manager. Replicate returns
+// when the stream ends or breaks, and can be called again to resync.
+func (m *CacheManager[K, V]) Replicate(r io.Reader) error {
+	st := &m.replica
+	st.mu.Lock()
+	// A restarted primary counts from zero again
+	st.active, st.connected, st.lastHeard, st.primaryOffset = true, true, time.Now(), 0
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		st.connected = false
+		st.mu.Unlock()
+	}()
+
+	type staged struct {
+		key       K
+		value     V
+		expiresAt int64
+	}
+	var snapshot []staged
+	br := bufio.NewReader(r)
+
+	for {
+		frame, err := readFrame(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		st.mu.Lock()
+		st.lastHeard = time.Now()
+		st.mu.Unlock()
+
+		switch frame.kind {
+		case frameSnapshot:
+			rec, err := aof.DecodeRecord(frame.rec)
+			if err != nil {
+				return err
+			}
+			var e staged
+			if err := unmarshal(aof.FormatBinary, rec.Key, &e.key); err != nil {
+				return fmt.Errorf("decoding key: %w", err)
+			}
+			if err := unmarshal(aof.FormatBinary, rec.Value, &e.value); err != nil {
+				return fmt.Errorf("decoding value: %w", err)
+			}
+			e.expiresAt = rec.ExpiresAt
+			snapshot = append(snapshot, e)
+
+		case frameSnapshotEnd:
+			m.clear()
+			for _, e := range snapshot {
+				if e.expiresAt == 0 {
+					m.setInternal(e.key, e.value, lru.NoExpiration)
+				} else if remaining := time.Until(time.UnixMilli(e.expiresAt)); remaining > 0 {
+					m.setInternal(e.key, e.value, remaining)
+				}
+			}
+			snapshot = nil
+			if m.writer != nil {
+				if err := m.Compact(); err != nil {
+					return err
+				}
+			}
+			st.mu.Lock()
+			st.synced, st.offset, st.primaryOffset = true, frame.offset, frame.offset
+			st.mu.Unlock()
+
+		case frameWrite:
+			st.mu.Lock()
+			expected := st.offset + 1
+			st.mu.Unlock()
+			if frame.offset != expected {
+				return fmt.Errorf("%w: expected offset %d, got %d", ErrReplicationGap, expected, frame.offset)
+			}
+			rec, err := aof.DecodeRecord(frame.rec)
+			if err != nil {
+				return err
+			}
+			if _, err := m.applyWrite(rec); err != nil {
+				return err
+			}
+			st.mu.Lock()
+			st.offset, st.primaryOffset = frame.offset, max(st.primaryOffset, frame.offset)
+			st.mu.Unlock()
+
+		case framePing:
+			st.mu.Lock()
+			st.primaryOffset = max(st.primaryOffset, frame.offset)
+			st.mu.Unlock()
+
+		default:
+			return fmt.Errorf("shard: unknown replication frame %q", frame.kind)
+		}
+	}
+}
+
+// clear removes every entry, without logging anything.
+func (m *CacheManager[K, V]) clear() {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	for _, shard := range m.layout.Load().all() {
+		shard.mu.Lock()
+		for _, item := range shard.cache.Ordered() {
+			shard.cache.Delete(item.Key)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// ReplicationStatus reports the manager's replication role and progress.
+func (m *CacheManager[K, V]) ReplicationStatus() ReplicationStatus {
+	m.feed.mu.Lock()
+	status := ReplicationStatus{Role: "primary", Offset: m.feed.offset, Replicas: len(m.feed.subs)}
+	m.feed.mu.Unlock()
+
+	st := &m.replica
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.active {
+		status.Role = "replica"
+		status.Offset = st.offset
+		status.PrimaryOffset = st.primaryOffset
+		status.Connected = st.connected
+		status.Synced = st.synced
+		status.Lag = st.primaryOffset - min(st.offset, st.primaryOffset)
+		status.LastHeard = time.Since(st.lastHeard)
+	}
+	return status
+}
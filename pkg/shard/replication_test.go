@@ -0,0 +1,201 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication_SnapshotThenWrites(t *testing.T) {
+	primary, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	primary.Set("a", "1", 1*time.Hour)
+	primary.Set("b", "2", lru.NoExpiration)
+
+	aofPath := filepath.Join(t.TempDir(), "replica.aof")
+	replica, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	replica.Set("stale", "x", lru.NoExpiration) // gone once the snapshot is loaded
+
+	pr, pw := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- primary.ServeReplica(context.Background(), pw)
+		pw.Close()
+	}()
+	replicated := make(chan error, 1)
+	go func() { replicated <- replica.Replicate(pr) }()
+
+	waitFor(t, "the snapshot", func() bool { return replica.ReplicationStatus().Synced })
+	primary.Set("c", "3", 1*time.Hour)
+	primary.Set("a", "one", 1*time.Hour)
+	primary.Delete("b")
+	waitFor(t, "the writes", func() bool {
+		return replica.ReplicationStatus().Offset == primary.ReplicationStatus().Offset
+	})
+
+	if got, _ := replica.Get("a"); got != "one" || replica.Exists("b") || replica.Exists("stale") {
+		t.Error("Expected the replica to match the primary")
+	}
+	if ttl, _ := replica.TTL("c"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL(c) = %v, want the primary's", ttl)
+	}
+	if status := primary.ReplicationStatus(); status.Role != "primary" || status.Replicas != 1 || status.Offset != 5 {
+		t.Errorf("Unexpected primary status %+v", status)
+	}
+	if status := replica.ReplicationStatus(); status.Role != "replica" || !status.Connected || status.PrimaryOffset != 5 || status.Lag != 0 {
+		t.Errorf("Unexpected replica status %+v", status)
+	}
+
+	primary.Stop()
+	if err := <-served; err != nil {
+		t.Errorf("ServeReplica = %v", err)
+	}
+	if err := <-replicated; err != nil {
+		t.Errorf("Replicate = %v", err)
+	}
+	if replica.ReplicationStatus().Connected {
+		t.Error("Expected the replica to be disconnected")
+	}
+	replica.Stop()
+
+	// What the replica applied went to its own AOF
+	reloaded, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	defer reloaded.Stop()
+	reloaded.LoadAOF()
+	if got, _ := reloaded.Get("a"); got != "one" || reloaded.Exists("stale") || !reloaded.Exists("c") {
+		t.Error("Expected the replica's AOF to hold the replicated data")
+	}
+}
+
+// Concurrent writes to one key must reach the stream and the AOF in the order
+// they reached memory, or the replica and a restart end up with another value.
+func TestReplication_ConcurrentWritesKeepOrder(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "primary.aof")
+	primary, _ := NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize)
+	replica, _ := NewCacheManager[string, int](4, 100, 3, "", 0)
+	defer replica.Stop()
+
+	pr, pw := io.Pipe()
+	go func() {
+		primary.ServeReplica(context.Background(), pw)
+		pw.Close()
+	}()
+	go replica.Replicate(pr)
+	waitFor(t, "the snapshot", func() bool { return replica.ReplicationStatus().Synced })
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if i%7 == 0 {
+					primary.Delete("k")
+				} else {
+					primary.Set("k", w*1000+i, time.Hour)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the writes", func() bool {
+		return replica.ReplicationStatus().Offset == primary.ReplicationStatus().Offset
+	})
+
+	want, wantFound := primary.Get("k")
+	if got, found := replica.Get("k"); got != want || found != wantFound {
+		t.Errorf("Replica has %d, %v, primary %d, %v", got, found, want, wantFound)
+	}
+	primary.Stop()
+
+	reloaded, _ := NewCacheManager[string, int](4, 100, 3, aofPath, maxAofSize)
+	defer reloaded.Stop()
+	reloaded.LoadAOF()
+	if got, found := reloaded.Get("k"); got != want || found != wantFound {
+		t.Errorf("Replay gives %d, %v, memory had %d, %v", got, found, want, wantFound)
+	}
+}
+
+// A write holds its shard until it has been numbered for the stream, so no
+// later write to the key can get ahead of it.
+func TestReplication_PublishesUnderShardLock(t *testing.T) {
+	m, _ := NewCacheManager[string, int](1, 100, 3, "", 0)
+	defer m.Stop()
+
+	m.feed.mu.Lock() // stall the next write while it publishes
+	go m.Set("k", 1, time.Hour)
+	waitFor(t, "the write to start publishing", func() bool {
+		shard := m.layout.Load().shards[0]
+		if shard.mu.TryLock() {
+			shard.mu.Unlock()
+			return false
+		}
+		return true
+	})
+
+	read := make(chan struct{})
+	go func() {
+		m.Get("k")
+		close(read)
+	}()
+	select {
+	case <-read:
+		t.Error("Expected the shard to stay locked until the write is published")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.feed.mu.Unlock()
+	<-read
+}
+
+func TestReplication_LagCountsWrites(t *testing.T) {
+	replica, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	defer replica.Stop()
+
+	// A ping tells the replica about writes it hasn't received yet
+	var stream bytes.Buffer
+	w := bufio.NewWriter(&stream)
+	writeFrame(w, replFrame{kind: frameSnapshotEnd, offset: 7})
+	writeFrame(w, replFrame{kind: framePing, offset: 10})
+	w.Flush()
+
+	if err := replica.Replicate(&stream); err != nil {
+		t.Fatal(err)
+	}
+	if status := replica.ReplicationStatus(); status.Lag != 3 || status.LastHeard > time.Second {
+		t.Errorf("Expected a lag of 3 writes, heard from just now, got %+v", status)
+	}
+}
+
+func TestReplication_Gap(t *testing.T) {
+	replica, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	defer replica.Stop()
+
+	var stream bytes.Buffer
+	w := bufio.NewWriter(&stream)
+	writeFrame(w, replFrame{kind: frameSnapshotEnd, offset: 7})
+	writeFrame(w, replFrame{kind: frameWrite, offset: 9})
+	w.Flush()
+
+	if err := replica.Replicate(&stream); !errors.Is(err, ErrReplicationGap) {
+		t.Errorf("Expected ErrReplicationGap, got %v", err)
+	}
+}
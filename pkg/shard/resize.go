@@ -0,0 +1,221 @@
+package shard
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+// migrateBatchSize is how many keys Resize moves per lock of a pair of shards,
+// so operations on those shards never wait long behind it.
+const migrateBatchSize = 256
+
+// layout is a set of shards and the placement that maps keys onto them.
+// While Resize is moving keys, prev is the layout they are moving away from.
+type layout[K comparable, V any] struct {
+	shards []*Shard[K, V]
+	place  placement.Placement
+	prev   *layout[K, V]
+}
+
+// owners returns the shard that owns the key that hashed to h and, while keys
+// are moving, the shard it is moving away from, or nil if it stays put.
+func (l *layout[K, V]) owners(h uint64) (shard, from *Shard[K, V]) {
+	shard = l.shards[l.place.Locate(h)]
+	if l.prev != nil {
+		if s := l.prev.shards[l.prev.place.Locate(h)]; s != shard {
+			from = s
+		}
+	}
+	return shard, from
+}
+
+// all returns every shard that may hold entries, including the ones a shrink
+// is emptying. A pass over them that must see every entry once, such as
+// forEachEntry, holds resizeMu so that no keys move in the meantime.
+func (l *layout[K, V]) all() []*Shard[K, V] {
+	if l.prev == nil || len(l.prev.shards) <= len(l.shards) {
+		return l.shards
+	}
+	dropped := l.prev.shards[len(l.shards):]
+	return append(dropped[:len(dropped):len(dropped)], l.shards...)
+}
+
+// lockKey locks the shard that owns key, for reading if read is set, and
+// returns it. While Resize is moving key, it locks the shard key is moving
+// from as well, returned as from, and carries the key over first, so the
+// caller only ever works on shard. Release the locks with unlockKey.
+func (m *CacheManager[K, V]) lockKey(key K, read bool) (shard, from *Shard[K, V]) {
+	h := m.keyHash(key)
+	for {
+		l := m.layout.Load()
+		shard, from = l.owners(h)
+		switch {
+		case from != nil:
+			lockPair(shard, from)
+		case read:
+			shard.mu.RLock()
+		default:
+			shard.mu.Lock()
+		}
+		// A Resize may have started or finished while we waited for the lock
+		if m.layout.Load() == l {
+			if from != nil {
+				moveEntry(from, shard, key)
+			}
+			return shard, from
+		}
+		unlockKey(shard, from, read)
+	}
+}
+
+func unlockKey[K comparable, V any](shard, from *Shard[K, V], read bool) {
+	switch {
+	case from != nil:
+		shard.mu.Unlock()
+		from.mu.Unlock()
+	case read:
+		shard.mu.RUnlock()
+	default:
+		shard.mu.Unlock()
+	}
+}
+
+// lockPair locks two shards in the order they were created in, which is the
+// order every caller uses, so two goroutines never wait on each other.
+func lockPair[K comparable, V any](a, b *Shard[K, V]) {
+	if a.seq > b.seq {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+}
+
+// moveEntry moves key from one shard to another, both locked, and reports
+// whether there was a live entry to move. An entry already on to is newer
+// and wins.
+func moveEntry[K comparable, V any](from, to *Shard[K, V], key K) bool {
+	entry, found := from.cache.Peek(key)
+	from.cache.Delete(key)
+	if !found {
+		return false
+	}
+	if _, ok := to.cache.Peek(key); ok {
+		return false
+	}
+	ttl := lru.NoExpiration
+	if !entry.ExpiryAt.IsZero() {
+		ttl = max(time.Until(entry.ExpiryAt), time.Nanosecond)
+	}
+	to.cache.Set(key, entry.Value, ttl)
+	return true
+}
+
+// Resize changes the number of shards while the cache stays in use, and
+// returns how many keys it moved. Only keys whose owner changes move. With the
+// ring, jump and rendezvous placements that means growing moves keys onto the
+// new shards only, and shrinking moves only the keys of the removed shards;
+// Maglev also moves a few keys between shards that stay.
+//
+// Until the move is done, an operation on a key that is moving locks both its
+// old and new shard and carries the key over first, so nothing is missed or
+// written to the wrong place. Shards keep the capacity and byte budget they
+// were built with and new ones get the same, so the total grows and shrinks
+// with the shard count.
+//
+// Resize waits for the manager to be Ready, and runs one at a time. Snapshots
+// and AOF rewrites wait for it to finish.
+func (m *CacheManager[K, V]) Resize(shardCount int) (moved int, err error) {
+	if shardCount <= 0 {
+		return 0, fmt.Errorf("shard count must be positive, got %d", shardCount)
+	}
+	<-m.ready
+
+	m.resizeMu.Lock()
+	defer m.resizeMu.Unlock()
+
+	cur := m.layout.Load()
+	if shardCount == len(cur.shards) {
+		return 0, nil
+	}
+	shards := make([]*Shard[K, V], shardCount)
+	for i := copy(shards, cur.shards); i < shardCount; i++ {
+		if shards[i], err = m.newShard(); err != nil {
+			return 0, err
+		}
+	}
+	place, err := m.newPlacement(shardCount)
+	if err != nil {
+		return 0, err
+	}
+	next := &layout[K, V]{shards: shards, place: place, prev: cur}
+
+	m.layout.Store(next)
+	for _, src := range cur.shards {
+		moved += m.migrate(src, next)
+	}
+	m.layout.Store(&layout[K, V]{shards: next.shards, place: next.place})
+	return moved, nil
+}
+
+// migrate moves the keys on src that next puts on another shard. Nothing
+// writes a moving key to src once next is in place, so the keys to move can be
+// listed up front; each is moved unless an operation has carried it over
+// already. Keys go coldest first, keeping their order on the new shard.
+func (m *CacheManager[K, V]) migrate(src *Shard[K, V], next *layout[K, V]) int {
+	src.mu.RLock()
+	items := src.cache.Ordered()
+	src.mu.RUnlock()
+
+	moving := make(map[*Shard[K, V]][]K)
+	for _, item := range items {
+		if dst := next.shards[next.place.Locate(m.keyHash(item.Key))]; dst != src {
+			moving[dst] = append(moving[dst], item.Key)
+		}
+	}
+
+	moved := 0
+	for dst, keys := range moving {
+		for len(keys) > 0 {
+			batch := keys[:min(len(keys), migrateBatchSize)]
+			keys = keys[len(batch):]
+
+			lockPair(dst, src)
+			for _, key := range batch {
+				if moveEntry(src, dst, key) {
+					moved++
+				}
+			}
+			dst.mu.Unlock()
+			src.mu.Unlock()
+		}
+	}
+	return moved
+}
+
+// newShard builds an empty shard for Resize, under resizeMu.
+func (m *CacheManager[K, V]) newShard() (*Shard[K, V], error) {
+	cache, err := m.newCache()
+	if err != nil {
+		return nil, err
+	}
+	m.shardSeq++
+	return &Shard[K, V]{cache: cache, seq: m.shardSeq - 1}, nil
+}
+
+// newPlacement places keys on shardCount shards with the manager's strategy.
+// The ring is a HashRing, with the manager's replicas and Hasher; the other
+// strategies place shards by their names, "shard-0" and so on.
+func (m *CacheManager[K, V]) newPlacement(shardCount int) (placement.Placement, error) {
+	if m.strategy == placement.StrategyRing {
+		return NewHashRingWithHasher(shardCount, m.replicas, m.hasher), nil
+	}
+	nodes := make([]placement.Node, shardCount)
+	for i := range nodes {
+		nodes[i] = placement.Node{Name: "shard-" + strconv.Itoa(i)}
+	}
+	return placement.New(m.strategy, nodes)
+}
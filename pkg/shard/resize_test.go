@@ -0,0 +1,149 @@
+package shard
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/placement"
+)
+
+func TestResize_MovesOnlyReownedKeys(t *testing.T) {
+	m, _ := NewCacheManager[string, int](8, 10000, 50, "", 0)
+	defer m.Stop()
+	const keys = 5000
+	before := make([]int, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		m.Set(key, i, ttl)
+		before[i] = m.shardIndex(key)
+	}
+
+	moved, err := m.Resize(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		after := m.shardIndex(key)
+		if after != before[i] {
+			changed++
+			if after < 8 {
+				t.Fatalf("%s moved from shard %d to %d, an old shard", key, before[i], after)
+			}
+		}
+		if got, ok := m.Get(key); !ok || got != i {
+			t.Fatalf("Get(%s) = %d, %v after growing", key, got, ok)
+		}
+	}
+	if moved != changed {
+		t.Errorf("Resize moved %d keys, want the %d whose owner changed", moved, changed)
+	}
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("Resize moved %d of %d keys", moved, keys)
+	}
+	if got := len(m.GetShardStats()); got != 12 {
+		t.Errorf("Expected 12 shards, got %d", got)
+	}
+
+	if _, err := m.Resize(5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		if got, ok := m.Get(fmt.Sprintf("key-%d", i)); !ok || got != i {
+			t.Fatalf("Get(key-%d) = %d, %v after shrinking", i, got, ok)
+		}
+	}
+	if m.Len() != keys {
+		t.Errorf("Expected %d entries, got %d", keys, m.Len())
+	}
+
+	if _, err := m.Resize(0); err == nil {
+		t.Error("Expected a shard count of 0 to fail")
+	}
+}
+
+func TestResize_StaysLiveDuringMigration(t *testing.T) {
+	for _, s := range []placement.Strategy{placement.StrategyRing, placement.StrategyJump, placement.StrategyRendezvous, placement.StrategyMaglev} {
+		t.Run(string(s), func(t *testing.T) { testResizeStaysLive(t, s) })
+	}
+}
+
+func testResizeStaysLive(t *testing.T, strategy placement.Strategy) {
+	m, err := NewCacheManager[string, int](4, 100000, 20, "", 0, WithPlacement(strategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	const writers, keys = 4, 2000
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			m.Set(fmt.Sprintf("w%d-%d", w, i), 0, ttl)
+		}
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := make([]int, keys)
+			for round := 1; !stop.Load(); round++ {
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("w%d-%d", w, i)
+					// Every key this writer set must still read back its latest value
+					if got, ok := m.Get(key); !ok || got != last[i] {
+						errs <- fmt.Errorf("Get(%s) = %d, %v, want %d", key, got, ok, last[i])
+						return
+					}
+					if i%3 == 0 {
+						m.Set(key, round, ttl)
+						last[i] = round
+					}
+				}
+			}
+		}()
+	}
+
+	for _, n := range []int{7, 16, 3, 9, 4} {
+		if _, err := m.Resize(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := m.Len(); got != writers*keys {
+		t.Errorf("Expected %d entries after resizing, got %d", writers*keys, got)
+	}
+}
+
+func BenchmarkResize(b *testing.B) {
+	const keys = 20000
+	for _, s := range []placement.Strategy{placement.StrategyRing, placement.StrategyJump, placement.StrategyRendezvous, placement.StrategyMaglev} {
+		for _, c := range []struct{ from, to int }{{8, 9}, {8, 16}, {16, 8}, {8, 4}} {
+			b.Run(fmt.Sprintf("%s/%dto%d", s, c.from, c.to), func(b *testing.B) {
+				var moved int
+				for n := 0; n < b.N; n++ {
+					b.StopTimer()
+					m, _ := NewCacheManager[string, int](c.from, keys, 100, "", 0, WithPlacement(s))
+					for i := 0; i < keys; i++ {
+						m.Set(fmt.Sprintf("key-%d", i), i, ttl)
+					}
+					b.StartTimer()
+
+					moved, _ = m.Resize(c.to)
+				}
+				// Consistent placement should move about |to-from|/max(from,to) of the keys
+				b.ReportMetric(float64(moved)/keys, "moved/key")
+			})
+		}
+	}
+}
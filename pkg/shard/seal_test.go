@@ -0,0 +1,119 @@
+package shard
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+func newSealer(t *testing.T, compression aof.Compression, keys ...[]byte) *aof.Sealer {
+	t.Helper()
+	s, err := aof.NewSealer(compression, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAOF_SealedRecords(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	secret := strings.Repeat("session-payload ", 32)
+
+	for _, format := range []aof.Format{aof.FormatBinary, aof.FormatHybrid} {
+		t.Run(format.String(), func(t *testing.T) {
+			aofPath := filepath.Join(t.TempDir(), "cache.aof")
+			sealer := newSealer(t, aof.CompressZstd, key)
+
+			mgr, err := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithAOFFormat(format), WithSealer(sealer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mgr.Set("session:1", secret, 1*time.Hour)
+			mgr.Set("session:2", secret, 1*time.Hour)
+			if err := mgr.Compact(); err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+			mgr.Set("session:3", secret, 1*time.Hour)
+			mgr.Delete("session:2")
+			mgr.Stop()
+
+			data, _ := os.ReadFile(aofPath)
+			if bytes.Contains(data, []byte("session")) {
+				t.Fatal("Expected neither keys nor values to be readable on disk")
+			}
+
+			newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithAOFFormat(format), WithSealer(sealer))
+			defer newMgr.Stop()
+			report, err := newMgr.LoadAOF()
+			if err != nil || report.Stale != 0 {
+				t.Fatalf("LoadAOF = %+v, %v", report, err)
+			}
+			if got, _ := newMgr.Get("session:3"); got != secret || newMgr.Exists("session:2") {
+				t.Error("Expected the sealed AOF to replay like a plain one")
+			}
+		})
+	}
+}
+
+func TestAOF_KeyRotationDuringCompaction(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	writeAOF(t, aofPath, "") // plaintext from before encryption was turned on
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSealer(newSealer(t, aof.CompressNone, oldKey)))
+	mgr.LoadAOF()
+	mgr.Compact()
+	mgr.Set("c", "3", 1*time.Hour)
+	mgr.Stop()
+
+	// Rotate: the new key first, the old one kept to read what is on disk
+	mgr, _ = NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSealer(newSealer(t, aof.CompressNone, newKey, oldKey)))
+	report, err := mgr.LoadAOF()
+	if err != nil || report.Stale != 3 {
+		t.Fatalf("LoadAOF = %+v, %v; want 3 stale records", report, err)
+	}
+	if err := mgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Stop()
+
+	// The old key can now be dropped
+	mgr, _ = NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSealer(newSealer(t, aof.CompressNone, newKey)))
+	defer mgr.Stop()
+	report, err = mgr.LoadAOF()
+	if err != nil || report.Applied != 3 || report.Stale != 0 {
+		t.Fatalf("LoadAOF after rotation = %+v, %v", report, err)
+	}
+}
+
+func TestAOF_UnknownKeyIsNeverTruncated(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSealer(newSealer(t, aof.CompressNone, bytes.Repeat([]byte{1}, 32))))
+	mgr.Set("a", "1", 1*time.Hour)
+	mgr.Stop()
+	before, _ := os.Stat(aofPath)
+
+	mgr, _ = NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSealer(newSealer(t, aof.CompressNone, bytes.Repeat([]byte{2}, 32))))
+	defer mgr.Stop()
+	if _, err := mgr.LoadAOF(); !errors.Is(err, aof.ErrKey) {
+		t.Errorf("Expected aof.ErrKey, got %v", err)
+	}
+	if after, _ := os.Stat(aofPath); after.Size() != before.Size() {
+		t.Error("Expected a record under an unknown key to be left alone")
+	}
+}
+
+func TestAOF_SealerNeedsBinaryFormat(t *testing.T) {
+	_, err := NewCacheManager[string, string](4, 100, 3, "", 0, WithAOFFormat(aof.FormatText), WithSealer(newSealer(t, aof.CompressZstd)))
+	if err == nil {
+		t.Error("Expected an error for a sealed text AOF")
+	}
+}
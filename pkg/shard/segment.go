@@ -0,0 +1,294 @@
+package shard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+// segments is the state of a segmented AOF (see WithSegmentSize). The manager's
+// aof and writer point at the newest increment.
+type segments struct {
+	dir      string
+	prefix   string // file name prefix, the base name of the AOF path
+	size     int64  // rotate once the current increment reaches this many bytes
+	manifest aof.Manifest
+	written  int64 // bytes appended to the current increment
+}
+
+func (s *segments) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *segments) manifestPath() string {
+	return s.path(aof.ManifestName(s.prefix))
+}
+
+// incrFormat is the format increments are written in. Hybrid only makes sense
+// for a base, so its increments are plain binary.
+func incrFormat(target aof.Format) aof.Format {
+	if target == aof.FormatHybrid {
+		return aof.FormatBinary
+	}
+	return target
+}
+
+// openSegments opens the segmented AOF for aofPath, which lives in the
+// directory aofPath+".d". The first time, an existing single-file AOF at
+// aofPath is moved in as the base segment.
+func openSegments(aofPath string, size int64, target aof.Format) (*segments, *os.File, aof.Format, error) {
+	s := &segments{
+		dir:    aofPath + ".d",
+		prefix: filepath.Base(aofPath),
+		size:   size,
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, nil, 0, err
+	}
+
+	manifest, err := aof.ReadManifest(s.manifestPath())
+	switch {
+	case err == nil:
+		s.manifest = *manifest
+	case errors.Is(err, fs.ErrNotExist):
+		if info, err := os.Stat(aofPath); err == nil && info.Mode().IsRegular() {
+			base := aof.Segment{Name: aof.SegmentName(s.prefix, aof.SegmentBase, 1), Type: aof.SegmentBase, Seq: 1}
+			if err := os.Rename(aofPath, s.path(base.Name)); err != nil {
+				return nil, nil, 0, err
+			}
+			s.manifest.Segments = append(s.manifest.Segments, base)
+		}
+	default:
+		return nil, nil, 0, err
+	}
+
+	incr, ok := s.manifest.LastIncr()
+	if !ok {
+		incr = aof.Segment{Name: aof.SegmentName(s.prefix, aof.SegmentIncr, 1), Type: aof.SegmentIncr, Seq: 1}
+		s.manifest.Segments = append(s.manifest.Segments, incr)
+		if err := aof.WriteManifest(s.manifestPath(), &s.manifest); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	f, format, err := openSegment(s.path(incr.Name), incrFormat(target))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	s.written = info.Size()
+	return s, f, format, nil
+}
+
+func openSegment(path string, target aof.Format) (*os.File, aof.Format, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	format, err := openFormat(f, target)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, format, nil
+}
+
+// maybeRotate starts a new increment once the current one has reached the
+// segment size.
+func (m *CacheManager[K, V]) maybeRotate() {
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.seg.written < m.seg.size {
+		return // someone else got there first
+	}
+	if err := m.rotateLocked(); err != nil {
+		fmt.Printf("AOF segment rotation failed: %v\n", err)
+	}
+}
+
+// rotateLocked closes the current increment and starts appending to a new one.
+// The caller holds syncMu and mu. If anything fails before the manifest lists
+// the new segment, appends carry on into the old one.
+func (m *CacheManager[K, V]) rotateLocked() error {
+	s := m.seg
+	last, _ := s.manifest.LastIncr()
+	next := aof.Segment{Name: aof.SegmentName(s.prefix, aof.SegmentIncr, last.Seq+1), Type: aof.SegmentIncr, Seq: last.Seq + 1}
+
+	f, format, err := openSegment(s.path(next.Name), incrFormat(m.aofFormat))
+	if err != nil {
+		return err
+	}
+	manifest := aof.Manifest{Segments: append(s.manifest.Segments[:len(s.manifest.Segments):len(s.manifest.Segments)], next)}
+	if err := aof.WriteManifest(s.manifestPath(), &manifest); err != nil {
+		f.Close()
+		os.Remove(s.path(next.Name))
+		return err
+	}
+
+	m.writer.Flush()
+	if m.fsync != FsyncNo {
+		m.aof.Sync()
+	}
+	m.aof.Close()
+
+	info, _ := f.Stat()
+	m.aof = f
+	m.writer.Reset(f)
+	m.format.Store(uint32(format))
+	s.manifest = manifest
+	s.written = info.Size()
+	return nil
+}
+
+// compactSegments rewrites a segmented AOF. It rotates to a fresh increment,
+// writes a new base from a snapshot of the shards while appends carry on into
+// that increment, then switches the manifest to the new base plus every
+// increment from the rotation on and deletes the files it no longer lists.
+// Writes that race with the snapshot end up in both, which replay tolerates.
+func (m *CacheManager[K, V]) compactSegments() error {
+	m.syncMu.Lock()
+	m.mu.Lock()
+	if m.rewriting {
+		m.mu.Unlock()
+		m.syncMu.Unlock()
+		return ErrRewriteInProgress
+	}
+	err := m.rotateLocked()
+	s := m.seg
+	firstKept, _ := s.manifest.LastIncr()
+	oldBase, _ := s.manifest.Base()
+	if err == nil {
+		m.rewriting = true
+	}
+	m.mu.Unlock()
+	m.syncMu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		m.mu.Lock()
+		m.rewriting = false
+		m.mu.Unlock()
+	}()
+
+	base := aof.Segment{Name: aof.SegmentName(s.prefix, aof.SegmentBase, oldBase.Seq+1), Type: aof.SegmentBase, Seq: oldBase.Seq + 1}
+	if err := m.writeBase(s.path(base.Name)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	manifest := aof.Manifest{Segments: []aof.Segment{base}}
+	for _, seg := range s.manifest.Segments {
+		if seg.Type == aof.SegmentIncr && seg.Seq >= firstKept.Seq {
+			manifest.Segments = append(manifest.Segments, seg)
+		}
+	}
+	if err := aof.WriteManifest(s.manifestPath(), &manifest); err != nil {
+		m.mu.Unlock()
+		os.Remove(s.path(base.Name))
+		return err
+	}
+	old := s.manifest
+	s.manifest = manifest
+	m.mu.Unlock()
+
+	for _, seg := range old.Segments {
+		if seg.Type == aof.SegmentBase || seg.Seq < firstKept.Seq {
+			os.Remove(s.path(seg.Name))
+		}
+	}
+	return nil
+}
+
+// writeBase writes a rewrite of the whole cache to path, via a temporary file
+// so the base only appears once it is complete.
+func (m *CacheManager[K, V]) writeBase(path string) error {
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = m.writeRewrite(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && m.fsync != FsyncNo {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// loadSegments replays every segment the manifest lists, in order. Only the
+// last one may be truncated, as in a single-file AOF: cutting an earlier one
+// would replay the later ones over a gap, so that fails with ErrSegmentDamaged
+// instead.
+func (m *CacheManager[K, V]) loadSegments(report *RecoveryReport) error {
+	segments := m.seg.manifest.Segments
+	for i, seg := range segments {
+		f, err := os.OpenFile(m.seg.path(seg.Name), os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("opening AOF segment %s: %w", seg.Name, err)
+		}
+		err = m.replayFile(f, i == len(segments)-1, report)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("AOF segment %s: %w", seg.Name, err)
+		}
+		report.Segments++
+	}
+
+	// The current increment may have been truncated under the writer
+	info, err := m.aof.Stat()
+	if err != nil {
+		return err
+	}
+	m.seg.written = info.Size()
+	return nil
+}
+
+// aofSize returns the total size of the AOF on disk, across every segment.
+func (m *CacheManager[K, V]) aofSize() (int64, error) {
+	m.mu.RLock()
+	var paths []string
+	if m.seg == nil {
+		paths = []string{m.aof.Name()}
+	} else {
+		for _, seg := range m.seg.manifest.Segments {
+			paths = append(paths, m.seg.path(seg.Name))
+		}
+	}
+	m.mu.RUnlock()
+
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
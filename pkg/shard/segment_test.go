@@ -0,0 +1,180 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+)
+
+func readManifest(t *testing.T, aofPath string) *aof.Manifest {
+	t.Helper()
+	m, err := aof.ReadManifest(filepath.Join(aofPath+".d", aof.ManifestName(filepath.Base(aofPath))))
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	return m
+}
+
+func TestSegments_RotateAndReplay(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, err := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		mgr.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i), 1*time.Hour)
+	}
+	mgr.Delete("key-0")
+	mgr.Stop()
+
+	manifest := readManifest(t, aofPath)
+	if len(manifest.Segments) < 3 {
+		t.Fatalf("Expected writes to rotate through several segments, got %+v", manifest.Segments)
+	}
+	for _, seg := range manifest.Segments {
+		info, err := os.Stat(filepath.Join(aofPath+".d", seg.Name))
+		if err != nil {
+			t.Fatalf("Segment %s: %v", seg.Name, err)
+		}
+		// A segment can overshoot by at most one record
+		if info.Size() > 256+64 {
+			t.Errorf("Segment %s is %d bytes", seg.Name, info.Size())
+		}
+	}
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if report.Segments != len(manifest.Segments) || report.Applied != 51 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if newMgr.Exists("key-0") {
+		t.Error("Expected the delete to survive replay")
+	}
+	if got, ok := newMgr.Get("key-49"); !ok || got != "value-49" {
+		t.Errorf("Get(key-49) = %q, %v", got, ok)
+	}
+}
+
+func TestSegments_CompactDropsOldIncrements(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	for i := 0; i < 50; i++ {
+		mgr.Set("key", fmt.Sprintf("value-%d", i), 1*time.Hour)
+	}
+	before := readManifest(t, aofPath)
+
+	if err := mgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Set("after", "1", 1*time.Hour)
+	mgr.Stop()
+
+	after := readManifest(t, aofPath)
+	if len(after.Segments) != 2 || after.Segments[0].Type != aof.SegmentBase {
+		t.Fatalf("Expected a base and one increment, got %+v", after.Segments)
+	}
+	for _, seg := range before.Segments {
+		if _, err := os.Stat(filepath.Join(aofPath+".d", seg.Name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted, got %v", seg.Name, err)
+		}
+	}
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	defer newMgr.Stop()
+	if _, err := newMgr.LoadAOF(); err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	for k, want := range map[string]string{"key": "value-49", "after": "1"} {
+		if got, ok := newMgr.Get(k); !ok || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, got, ok, want)
+		}
+	}
+}
+
+func TestSegments_MigratesSingleFile(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+	writeAOF(t, aofPath, "")
+
+	mgr, err := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Stop()
+	if _, err := os.Stat(aofPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the single-file AOF to be moved, got %v", err)
+	}
+	if base, ok := readManifest(t, aofPath).Base(); !ok || base.Name != "cache.aof.1.base" {
+		t.Fatalf("Expected the old file as base segment, got %+v", base)
+	}
+
+	if _, err := mgr.LoadAOF(); err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if got, ok := mgr.Get("b"); !ok || got != "2" {
+		t.Errorf("Get(b) = %q, %v", got, ok)
+	}
+}
+
+// tearSegment appends half a record to the i'th segment of the manifest.
+func tearSegment(t *testing.T, aofPath string, i int) string {
+	t.Helper()
+	path := filepath.Join(aofPath+".d", readManifest(t, aofPath).Segments[i].Name)
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{byte(aof.OpSet), 0x7f})
+	f.Close()
+	return path
+}
+
+func TestSegments_TruncatesTheLastSegment(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	for i := 0; i < 50; i++ {
+		mgr.Set(fmt.Sprintf("key-%d", i), "v", 1*time.Hour)
+	}
+	mgr.Stop()
+	tearSegment(t, aofPath, len(readManifest(t, aofPath).Segments)-1)
+
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil {
+		t.Fatalf("LoadAOF failed: %v", err)
+	}
+	if report.Truncated != 2 || report.Applied != 50 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestSegments_DamageBeforeTheLastFails(t *testing.T) {
+	aofPath := filepath.Join(t.TempDir(), "cache.aof")
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	for i := 0; i < 50; i++ {
+		mgr.Set(fmt.Sprintf("key-%d", i), "v", 1*time.Hour)
+	}
+	mgr.Stop()
+	first := tearSegment(t, aofPath, 0)
+	before, _ := os.Stat(first)
+
+	// Cutting the first increment would replay the rest over a gap
+	newMgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize, WithSegmentSize(256))
+	defer newMgr.Stop()
+	if _, err := newMgr.LoadAOF(); !errors.Is(err, ErrSegmentDamaged) {
+		t.Fatalf("Expected ErrSegmentDamaged, got %v", err)
+	}
+	if after, _ := os.Stat(first); after.Size() != before.Size() {
+		t.Error("Expected the damaged segment to be left as it was")
+	}
+}
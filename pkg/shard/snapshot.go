@@ -0,0 +1,146 @@
+package shard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+// Snapshot writes every live entry to w in the aof snapshot format. Each shard
+// is copied under its own read lock, so the snapshot is consistent per shard
+// and writers are never held up for longer than one shard's copy.
+func (m *CacheManager[K, V]) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	s := aof.NewSnapshotWriter(bw)
+	s.SetSealer(m.sealer)
+	m.forEachEntry(func(key K, entry lru.Entry[V]) {
+		s.Add(marshal(aof.FormatHybrid, key), marshal(aof.FormatHybrid, entry.Value), unixExpiry(entry.ExpiryAt))
+	})
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// RestoreSnapshot loads a snapshot written by Snapshot on top of the current
+// contents. The snapshot is read and decoded in full before any of it is
+// applied, so a truncated or corrupt snapshot leaves the cache untouched.
+// Entries that have expired since the snapshot was taken are skipped. When the
+// manager has an AOF it is compacted afterwards, so the restored entries
+// survive a restart.
+func (m *CacheManager[K, V]) RestoreSnapshot(r io.Reader) error {
+	return m.restoreSnapshot(r, false)
+}
+
+// restoreSnapshot is RestoreSnapshot, clearing the current contents first if
+// replace is set.
+func (m *CacheManager[K, V]) restoreSnapshot(r io.Reader, replace bool) error {
+	type staged struct {
+		key       K
+		value     V
+		expiresAt int64
+	}
+
+	var entries []staged
+	err := aof.ReadSealedSnapshot(r, m.sealer, func(rec aof.Record) error {
+		var e staged
+		if err := unmarshal(aof.FormatHybrid, rec.Key, &e.key); err != nil {
+			return fmt.Errorf("decoding key: %w", err)
+		}
+		if err := unmarshal(aof.FormatHybrid, rec.Value, &e.value); err != nil {
+			return fmt.Errorf("decoding value: %w", err)
+		}
+		e.expiresAt = rec.ExpiresAt
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		m.clear()
+	}
+	for _, e := range entries {
+		if e.expiresAt == 0 {
+			m.setInternal(e.key, e.value, lru.NoExpiration)
+		} else if remaining := time.Until(time.UnixMilli(e.expiresAt)); remaining > 0 {
+			m.setInternal(e.key, e.value, remaining)
+		}
+	}
+
+	if m.writer == nil {
+		return nil
+	}
+	return m.Compact()
+}
+
+// SaveSnapshot writes a snapshot to path, replacing any previous one atomically
+// so a reader never sees a partial file.
+func (m *CacheManager[K, V]) SaveSnapshot(path string) error {
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = m.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// StartSnapshotter saves a snapshot to path every interval, for backups to be
+// picked up by another process.
+func (m *CacheManager[K, V]) StartSnapshotter(path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.SaveSnapshot(path); err != nil {
+					fmt.Printf("Scheduled snapshot failed: %v\n", err)
+				}
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// forEachEntry calls fn for every live entry, copying one shard at a time
+// under its read lock. Within a shard entries come coldest first, so replaying
+// them in order leaves the shard evicting the same keys it would have before.
+// A Resize waits until it is done, so no entry is skipped or seen twice on its
+// way between shards.
+func (m *CacheManager[K, V]) forEachEntry(fn func(key K, entry lru.Entry[V])) {
+	m.resizeMu.RLock()
+	defer m.resizeMu.RUnlock()
+	for _, shard := range m.layout.Load().all() {
+		shard.mu.RLock()
+		items := shard.cache.Ordered() // a copy, which is safe to iterate through
+		shard.mu.RUnlock()
+
+		now := time.Now()
+		for _, item := range items {
+			if !item.Expired(now) {
+				fn(item.Key, item.Entry)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package shard
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Hiroki111/sharded-lru-cache/pkg/aof"
+	"github.com/Hiroki111/sharded-lru-cache/pkg/lru"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	src, _ := NewCacheManager[string, ComplexUser](4, 100, 3, "", 0)
+	src.Set("bruce", ComplexUser{ID: 1, Name: "Bruce Wayne", Active: true}, 1*time.Hour)
+	src.Set("alfred", ComplexUser{ID: 2, Name: "Alfred"}, lru.NoExpiration)
+	src.Set("gone", ComplexUser{ID: 3}, -1*time.Second)
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	dst, _ := NewCacheManager[string, ComplexUser](4, 100, 3, "", 0)
+	if err := dst.RestoreSnapshot(&buf); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+
+	if got, ok := dst.Get("bruce"); !ok || got.Name != "Bruce Wayne" {
+		t.Errorf("Get(bruce) = %+v, %v", got, ok)
+	}
+	if ttl, ok := dst.TTL("bruce"); !ok || ttl <= 59*time.Minute {
+		t.Errorf("Expected bruce to keep its TTL, got %v, %v", ttl, ok)
+	}
+	if ttl, ok := dst.TTL("alfred"); !ok || ttl != lru.NoExpiration {
+		t.Errorf("Expected alfred to never expire, got %v, %v", ttl, ok)
+	}
+	if dst.Exists("gone") {
+		t.Error("Expected expired entries to be left out of the snapshot")
+	}
+}
+
+func TestSnapshot_RestoreRejectsTruncatedSnapshot(t *testing.T) {
+	src, _ := NewCacheManager[string, []byte](4, 100, 3, "", 0)
+	src.Set("a", []byte("1"), 1*time.Hour)
+	src.Set("b", []byte("2"), 1*time.Hour)
+
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+	truncated := buf.Bytes()[:buf.Len()-3]
+
+	dst, _ := NewCacheManager[string, []byte](4, 100, 3, "", 0)
+	if err := dst.RestoreSnapshot(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("Expected an error restoring a truncated snapshot")
+	}
+	if dst.Len() != 0 {
+		t.Errorf("Expected nothing to be restored from a truncated snapshot, got %d entries", dst.Len())
+	}
+}
+
+func TestSnapshot_RestorePersistsToAOF(t *testing.T) {
+	aofPath := "test_restore.aof"
+	defer os.Remove(aofPath)
+
+	src, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	src.Set("k", "v", 1*time.Hour)
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	if err := mgr.RestoreSnapshot(&buf); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	mgr.Stop()
+
+	restarted, _ := NewCacheManager[string, string](4, 100, 3, aofPath, maxAofSize)
+	defer restarted.Stop()
+	restarted.LoadAOF()
+	if got, ok := restarted.Get("k"); !ok || got != "v" {
+		t.Errorf("Expected the restored entry to survive a restart, got %q, %v", got, ok)
+	}
+}
+
+func TestAOF_HybridPreamble(t *testing.T) {
+	aofPath := "test_hybrid.aof"
+	defer os.Remove(aofPath)
+
+	mgr, _ := NewCacheManager[string, []byte](4, 100, 3, aofPath, maxAofSize, WithAOFFormat(aof.FormatHybrid))
+	mgr.Set("a", []byte("1"), 1*time.Hour)
+	mgr.Set("b", []byte("2"), 1*time.Hour)
+	if err := mgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Set("c", []byte("3"), 1*time.Hour)
+	mgr.Delete("a")
+	mgr.Stop()
+
+	data, _ := os.ReadFile(aofPath)
+	if aof.Detect(data) != aof.FormatHybrid {
+		t.Fatalf("Expected the compacted file to start with a snapshot, got %q", data)
+	}
+
+	// The preamble on its own is a complete snapshot
+	preamble, _ := NewCacheManager[string, []byte](4, 100, 3, "", 0)
+	if err := preamble.RestoreSnapshot(bytes.NewReader(data)); err != nil || preamble.Len() != 2 {
+		t.Errorf("Expected the preamble to restore as a 2-entry snapshot, got %d entries, %v", preamble.Len(), err)
+	}
+
+	newMgr, _ := NewCacheManager[string, []byte](4, 100, 3, aofPath, maxAofSize, WithAOFFormat(aof.FormatHybrid))
+	defer newMgr.Stop()
+	report, err := newMgr.LoadAOF()
+	if err != nil || report.Applied != 4 {
+		t.Fatalf("LoadAOF = %+v, %v", report, err)
+	}
+	if newMgr.Exists("a") || !newMgr.Exists("b") || !newMgr.Exists("c") {
+		t.Error("Expected the records after the preamble to be replayed on top of it")
+	}
+}
+
+func TestSnapshot_Scheduled(t *testing.T) {
+	path := "test_scheduled.snap"
+	defer os.Remove(path)
+
+	mgr, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+	mgr.Set("k", "v", 1*time.Hour)
+	mgr.StartSnapshotter(path, 50*time.Millisecond)
+	defer mgr.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if f, err := os.Open(path); err == nil {
+			restored, _ := NewCacheManager[string, string](4, 100, 3, "", 0)
+			err := restored.RestoreSnapshot(f)
+			f.Close()
+			if err != nil || !restored.Exists("k") {
+				t.Fatalf("Scheduled snapshot didn't restore: %v", err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No snapshot was written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAOF_CompactPreservesRecency(t *testing.T) {
+	aofPath := "test_recency.aof"
+	defer os.Remove(aofPath)
+
+	// One shard, so eviction order is the whole cache's order
+	const n = 50
+	mgr, _ := NewCacheManager[string, int](1, n, 3, aofPath, maxAofSize)
+	for i := 0; i < n; i++ {
+		mgr.Set(fmt.Sprintf("k%d", i), i, 1*time.Hour)
+	}
+	// Touch the even keys, leaving the odd ones as the coldest half
+	for i := 0; i < n; i += 2 {
+		mgr.Get(fmt.Sprintf("k%d", i))
+	}
+	if err := mgr.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	mgr.Stop()
+
+	restarted, _ := NewCacheManager[string, int](1, n, 3, aofPath, maxAofSize)
+	defer restarted.Stop()
+	restarted.LoadAOF()
+
+	// Making room for n/2 new keys must push out exactly the odd ones
+	for i := 0; i < n/2; i++ {
+		restarted.Set(fmt.Sprintf("new%d", i), i, 1*time.Hour)
+	}
+	for i := 0; i < n; i++ {
+		if want := i%2 == 0; restarted.Exists(fmt.Sprintf("k%d", i)) != want {
+			t.Errorf("k%d survived=%v after a restart, want %v", i, !want, want)
+		}
+	}
+}
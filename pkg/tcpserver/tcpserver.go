@@ -0,0 +1,99 @@
+// Package tcpserver accepts and tracks the connections of the cache's plain
+// TCP protocol listeners, such as RESP and memcached.
+package tcpserver
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// Listener serves connections accepted from a net.Listener and keeps track of
+// them so that Close can drop them all. The zero value is ready to use.
+type Listener struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// Serve accepts connections on l until Close is called, running handle on each
+// one in its own goroutine and closing the connection once handle returns.
+func (s *Listener) Serve(l net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// Close stops the listener and drops every open connection.
+func (s *Listener) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// ClientCount returns the number of open connections.
+func (s *Listener) ClientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Listener) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Listener) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
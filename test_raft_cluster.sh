@@ -0,0 +1,81 @@
+#!/bin/bash
+
+# Starts a three-node Raft cluster on ports 9001-9003, writes through a
+# follower, kills the leader and checks that the data survives on the others.
+
+SERVER_BIN="./cache-server"
+DATA_DIR="./data/raft-cluster"
+PORTS=(9001 9002 9003)
+
+# 1. Clean up old state
+rm -rf $DATA_DIR
+go build -o $SERVER_BIN cmd/cache-server/main.go
+
+# 2. Start the nodes in the background
+declare -A PIDS
+start_node() {
+    local port=$1 peers=""
+    for other in "${PORTS[@]}"; do
+        if [[ $other != "$port" ]]; then
+            peers="$peers,http://localhost:$other"
+        fi
+    done
+    $SERVER_BIN -addr :$port -raft-id http://localhost:$port -raft-peers "${peers#,}" \
+        -raft-dir $DATA_DIR/$port -snapshot-path $DATA_DIR/$port.snap > $DATA_DIR/$port.log 2>&1 &
+    PIDS[$port]=$!
+}
+mkdir -p $DATA_DIR
+for port in "${PORTS[@]}"; do
+    start_node $port
+done
+
+# Wait for an election
+sleep 3
+
+leader_port() {
+    for port in "${PORTS[@]}"; do
+        if curl -s "http://localhost:$port/stats" | grep -q '"state":"leader"'; then
+            echo $port
+            return
+        fi
+    done
+}
+LEADER=$(leader_port)
+echo "Leader is on port $LEADER"
+
+# 3. Write through a follower; -L follows the redirect to the leader
+for port in "${PORTS[@]}"; do
+    if [[ $port != "$LEADER" ]]; then
+        FOLLOWER=$port
+        break
+    fi
+done
+echo "Writing through the follower on port $FOLLOWER..."
+curl -s -L -X PUT --data-binary Batman "http://localhost:$FOLLOWER/keys/hero"
+
+# 4. Kill the leader
+echo "CRASHING the leader (SIGKILL)..."
+kill -9 ${PIDS[$LEADER]}
+sleep 3
+
+# 5. Verify the data on the survivors, and that they elected a new leader
+RESULT="✅ SUCCESS"
+for port in "${PORTS[@]}"; do
+    if [[ $port == "$LEADER" ]]; then
+        continue
+    fi
+    RESPONSE=$(curl -s "http://localhost:$port/keys/hero")
+    if [[ $RESPONSE != "Batman" ]]; then
+        RESULT="❌ FAILURE: node $port returned $RESPONSE"
+    fi
+done
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -L -X PUT --data-binary Joker "http://localhost:$FOLLOWER/keys/villain")
+if [[ $STATUS != "204" ]]; then
+    RESULT="❌ FAILURE: write after failover returned $STATUS"
+fi
+echo "$RESULT"
+
+# Cleanup
+for port in "${PORTS[@]}"; do
+    kill ${PIDS[$port]} 2>/dev/null
+done